@@ -0,0 +1,9 @@
+package apimodel
+
+// Announcement is played over the current sound: an audio url, or a text spoken by the text-to-speech engine
+type Announcement struct {
+	Url  string `json:"url,omitempty"`
+	Text string `json:"text,omitempty"`
+	// Shown on the display during the announcement, the spoken text by default
+	Message string `json:"message,omitempty"`
+}
@@ -1,3 +1,45 @@
 package apimodel
 
-type PlaylistId int64
+// PlaylistId identifies a playlist whatever the other playlists, prefixed by its player: "local:" followed by the
+// folder or M3U file name for local playlists, "mifasol:", "subsonic:" or "upnp:" followed by the id given by the server
+// for remote playlists, "podcast:" followed by the podcast name for podcasts
+type PlaylistId string
+
+type Playlist struct {
+	PlaylistId PlaylistId `json:"playlist_id"`
+	Name       string     `json:"name"`
+	// Position of the playlist in the order followed by the playlist button, starting at 1
+	Index int64 `json:"index"`
+}
+
+// PlayMode defines the order in which the songs of a playlist are played
+type PlayMode string
+
+const (
+	ShufflePlayMode    PlayMode = "shuffle"
+	SequentialPlayMode PlayMode = "sequential"
+	RepeatAllPlayMode  PlayMode = "repeat_all"
+	RepeatOnePlayMode  PlayMode = "repeat_one"
+)
+
+// PlayModes lists the play modes in the order they are switched
+var PlayModes = []PlayMode{ShufflePlayMode, SequentialPlayMode, RepeatAllPlayMode, RepeatOnePlayMode}
+
+func (m PlayMode) IsValid() bool {
+	for _, playMode := range PlayModes {
+		if m == playMode {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the play mode following this one
+func (m PlayMode) Next() PlayMode {
+	for i, playMode := range PlayModes {
+		if m == playMode {
+			return PlayModes[(i+1)%len(PlayModes)]
+		}
+	}
+	return PlayModes[0]
+}
@@ -0,0 +1,38 @@
+package apimodel
+
+// State describes what the server is currently doing
+type State struct {
+	Volume         int64               `json:"volume"`
+	Alarm          AlarmState          `json:"alarm"`
+	Webradio       *WebradioState      `json:"webradio,omitempty"`
+	Playlist       *PlaylistState      `json:"playlist,omitempty"`
+	PlaylistPlayer PlaylistPlayerState `json:"playlist_player"`
+}
+
+type AlarmState struct {
+	Enabled bool  `json:"enabled"`
+	Running bool  `json:"running"`
+	Hour    int64 `json:"hour"`
+	Minute  int64 `json:"minute"`
+}
+
+type WebradioState struct {
+	WebradioId WebradioId `json:"webradio_id"`
+	Name       string     `json:"name"`
+}
+
+// PlaylistState describes the playlist being played, position and duration of the current song being in seconds
+type PlaylistState struct {
+	PlaylistId PlaylistId `json:"playlist_id"`
+	Name       string     `json:"name"`
+	PlayMode   PlayMode   `json:"play_mode"`
+	Song       string     `json:"song"`
+	Position   float64    `json:"position"`
+	Duration   float64    `json:"duration,omitempty"`
+}
+
+// PlaylistPlayerState tells whether the playlists are reachable, and why they aren't
+type PlaylistPlayerState struct {
+	Connected bool   `json:"connected"`
+	Error     string `json:"error,omitempty"`
+}
@@ -0,0 +1,19 @@
+package apimodel
+
+// Station is a webradio of the station directory
+type Station struct {
+	StationUuid string   `json:"station_uuid"`
+	Name        string   `json:"name"`
+	Urls        []string `json:"urls"`
+	Homepage    string   `json:"homepage,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	CountryCode string   `json:"country_code,omitempty"`
+	Codec       string   `json:"codec,omitempty"`
+	Bitrate     int64    `json:"bitrate,omitempty"`
+}
+
+// StationImport adds stations of the station directory to a webradio group
+type StationImport struct {
+	GroupId      int64    `json:"group_id"`
+	StationUuids []string `json:"station_uuids"`
+}
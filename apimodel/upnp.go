@@ -0,0 +1,14 @@
+package apimodel
+
+// UpnpServer is a media server found on the network
+type UpnpServer struct {
+	Name string `json:"name"`
+	Udn  string `json:"udn"`
+}
+
+// UpnpObject is a container or an audio item of a media server
+type UpnpObject struct {
+	Id        string `json:"id"`
+	Title     string `json:"title"`
+	Container bool   `json:"container"`
+}
@@ -4,11 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"github.com/jypelle/vekigi/internal/srv"
+	"github.com/jypelle/vekigi/internal/srv/device"
 	"github.com/jypelle/vekigi/internal/version"
 	"github.com/sirupsen/logrus"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -47,6 +49,8 @@ func main() {
 		flag.PrintDefaults()
 		fmt.Printf("\nCommands:\n")
 		fmt.Printf("  run       Run server\n")
+		fmt.Printf("  search    Search webradios in the station directory\n")
+		fmt.Printf("  import    Import stations of the station directory into a webradio group\n")
 		fmt.Printf("  version   Show the version number\n")
 		fmt.Printf("\nRun '%s COMMAND --help' for more information on a command.\n", mainCommand)
 	}
@@ -59,6 +63,32 @@ func main() {
 		fmt.Printf("\nRun the server\n")
 	}
 
+	// search command
+	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
+	searchCountry := searchCmd.String("country", "", "Country code of the stations, like FR")
+	searchTag := searchCmd.String("tag", "", "Tag of the stations, like jazz")
+	searchLimit := searchCmd.Int64("limit", 20, "Maximum number of stations")
+
+	searchCmd.Usage = func() {
+		fmt.Printf("\nUsage: %s search [OPTIONS] [NAME]\n", mainCommand)
+		fmt.Printf("\nSearch webradios in the station directory, most popular first\n")
+		fmt.Printf("\nOptions:\n")
+		searchCmd.PrintDefaults()
+	}
+
+	// import command
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	importGroup := importCmd.Int64("group", 0, "Webradio group receiving the stations")
+
+	importCmd.Usage = func() {
+		fmt.Printf("\nUsage: %s import -group GROUP STATION_UUID...\n", mainCommand)
+		fmt.Printf("\nImport stations of the station directory into a webradio group\n")
+		fmt.Printf("\nA running server imports the stations itself when its API is enabled. Otherwise stop the server\n")
+		fmt.Printf("before importing: it would overwrite the imported stations when saving its param file.\n")
+		fmt.Printf("\nOptions:\n")
+		importCmd.PrintDefaults()
+	}
+
 	// version command
 	versionCmd := flag.NewFlagSet("version", flag.ExitOnError)
 
@@ -85,6 +115,15 @@ func main() {
 			runCmd.Usage()
 			os.Exit(1)
 		}
+	case "search":
+		searchCmd.Parse(flag.Args()[1:])
+	case "import":
+		importCmd.Parse(flag.Args()[1:])
+		if importCmd.NArg() == 0 || *importGroup < 1 {
+			fmt.Printf("\n\"%s %s\" requires a webradio group and at least one station uuid\n", mainCommand, flag.Arg(0))
+			importCmd.Usage()
+			os.Exit(1)
+		}
 	case "version":
 		versionCmd.Parse(flag.Args()[1:])
 		if versionCmd.NArg() > 0 {
@@ -110,6 +149,30 @@ func main() {
 
 	if versionCmd.Parsed() {
 		fmt.Printf("Version %s\n", version.AppVersion.String())
+	} else if searchCmd.Parsed() {
+		stations, err := serverApp.SearchStations(device.StationQuery{
+			Name:        strings.Join(searchCmd.Args(), " "),
+			CountryCode: *searchCountry,
+			Tag:         *searchTag,
+			Limit:       *searchLimit,
+		})
+		if err != nil {
+			logrus.Fatalf("Unable to search stations: %v", err)
+		}
+		for _, station := range stations {
+			fmt.Printf("%s  %s [%s %s %dkbps] %s\n", station.StationUuid, station.Name, station.CountryCode, station.Codec, station.Bitrate, strings.Join(station.Tags, ","))
+		}
+	} else if importCmd.Parsed() {
+		webradioIds, importedByServer, err := serverApp.ImportStations(*importGroup, importCmd.Args())
+		if err != nil {
+			logrus.Fatalf("Unable to import stations: %v", err)
+		}
+		for i, webradioId := range webradioIds {
+			fmt.Printf("%s: webradio %d of group %d\n", importCmd.Arg(i), webradioId.IndexId, webradioId.GroupId)
+		}
+		if !importedByServer {
+			fmt.Printf("Start the server to listen to the imported stations\n")
+		}
 	} else {
 		if runCmd.Parsed() {
 			// Listen stop signal
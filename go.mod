@@ -7,6 +7,8 @@ require (
 	github.com/gorilla/handlers v1.5.1
 	github.com/gorilla/mux v1.8.0
 	github.com/hajimehoshi/bitmapfont/v2 v2.1.3
+	github.com/hajimehoshi/go-mp3 v0.3.4
+	github.com/jfreymuth/oggvorbis v1.0.5
 	github.com/jypelle/mifasol v0.4.3
 	github.com/sirupsen/logrus v1.8.1
 	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
@@ -28,6 +28,26 @@ var NumbersImgFile []byte
 
 var NumbersImage image.Image
 
+//go:embed shuffle.png
+var ShuffleImgFile []byte
+
+var ShuffleImage image.Image
+
+//go:embed sequential.png
+var SequentialImgFile []byte
+
+var SequentialImage image.Image
+
+//go:embed repeat_all.png
+var RepeatAllImgFile []byte
+
+var RepeatAllImage image.Image
+
+//go:embed repeat_one.png
+var RepeatOneImgFile []byte
+
+var RepeatOneImage image.Image
+
 func init() {
 	// Load images
 	var err error
@@ -52,4 +72,24 @@ func init() {
 		logrus.Fatalf("Can't load numbers image: %v", err)
 	}
 
+	ShuffleImage, _, err = image.Decode(bytes.NewReader(ShuffleImgFile))
+	if err != nil {
+		logrus.Fatalf("Can't load shuffle image: %v", err)
+	}
+
+	SequentialImage, _, err = image.Decode(bytes.NewReader(SequentialImgFile))
+	if err != nil {
+		logrus.Fatalf("Can't load sequential image: %v", err)
+	}
+
+	RepeatAllImage, _, err = image.Decode(bytes.NewReader(RepeatAllImgFile))
+	if err != nil {
+		logrus.Fatalf("Can't load repeat all image: %v", err)
+	}
+
+	RepeatOneImage, _, err = image.Decode(bytes.NewReader(RepeatOneImgFile))
+	if err != nil {
+		logrus.Fatalf("Can't load repeat one image: %v", err)
+	}
+
 }
@@ -0,0 +1,11 @@
+package sounds
+
+import (
+	_ "embed"
+)
+
+//go:embed hour_chime.wav
+var HourChimeFile []byte
+
+//go:embed quarter_chime.wav
+var QuarterChimeFile []byte
@@ -0,0 +1,34 @@
+package config
+
+// AnnouncementParam sets the text-to-speech engine speaking the texts announced through the api and the talking clock,
+// and the announcement spoken when the alarm fires, before playing the alarm webradio or playlist.
+type AnnouncementParam struct {
+	// Speak Template when the alarm fires
+	AlarmAnnouncement bool `yaml:"alarm_announcement,omitempty"`
+	// Spoken text, as a Go template (text/template) using {{.Time}}, {{.Hour}}, {{.Minute}}, {{.Weekday}},
+	// {{.Date}}, {{.Day}}, {{.Month}}, {{.Year}} and the data of the sources, like {{.Sources.weather.temperature}}
+	Template string `yaml:"template,omitempty"`
+	// Text of the talking clock, as a Go template using the same data as Template, sources aside. "It's {{.Time}}."
+	// by default.
+	TimeTemplate string `yaml:"time_template,omitempty"`
+	// Local text-to-speech engine: espeak (default), pico, or command
+	Engine string `yaml:"engine,omitempty"`
+	// Voice language, like "en" for espeak or "en-US" for pico
+	Language string `yaml:"language,omitempty"`
+	// Text-to-speech command of the command engine, writing a wav file. "{text}", "{output}" and "{language}" are
+	// replaced by the text to speak, the wav filename and the language.
+	Command []string `yaml:"command,omitempty"`
+	// Names of the weekdays (sunday first) and of the months (january first), english by default
+	Weekdays []string `yaml:"weekdays,omitempty"`
+	Months   []string `yaml:"months,omitempty"`
+	// Data read when the alarm fires
+	Sources []*AnnouncementSource `yaml:"sources,omitempty"`
+}
+
+// AnnouncementSource is a local file or an http resource, made available to the template under its name: JSON
+// content as structured data, any other content as text
+type AnnouncementSource struct {
+	Name string `yaml:"name"`
+	// Filename or http(s) url
+	Location string `yaml:"location"`
+}
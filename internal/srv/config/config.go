@@ -12,6 +12,10 @@ import (
 const paramFilename = "param.yaml"
 const stateFilename = "state.yaml"
 const playlistFolder = "playlist"
+const recordingFolder = "recordings"
+const loudnessCacheFilename = "loudness.yaml"
+const mifasolCacheFolder = "mifasol_cache"
+const podcastFolder = "podcasts"
 
 type ServerConfig struct {
 	ConfigDir      string
@@ -69,12 +73,20 @@ func NewServerConfig(configDir string, debugMode bool, simulationMode bool) *Ser
 		serverConfig.ServerParam.MifasolParam.ConfigDir = serverConfig.ConfigDir
 	}
 
+	// Imported stations may create new groups
+	if serverConfig.WebradioGroups == nil {
+		serverConfig.WebradioGroups = make(map[int64][]*Webradio)
+	}
 	for groupId, webradioList := range serverConfig.WebradioGroups {
 		for pseudoIndexId, webradio := range webradioList {
 			webradio.WebradioId = apimodel.WebradioId{
 				GroupId: groupId,
 				IndexId: int64(pseudoIndexId) + 1,
 			}
+			if webradio.Url != "" {
+				webradio.Urls = append([]string{webradio.Url}, webradio.Urls...)
+				webradio.Url = ""
+			}
 		}
 	}
 
@@ -96,6 +108,22 @@ func (sc *ServerConfig) GetCompletePlaylistFolder() string {
 	return filepath.Join(sc.ConfigDir, playlistFolder)
 }
 
+func (sc *ServerConfig) GetCompleteRecordingFolder() string {
+	return filepath.Join(sc.ConfigDir, recordingFolder)
+}
+
+func (sc *ServerConfig) GetCompleteLoudnessCacheFilename() string {
+	return filepath.Join(sc.ConfigDir, loudnessCacheFilename)
+}
+
+func (sc *ServerConfig) GetCompleteMifasolCacheFolder() string {
+	return filepath.Join(sc.ConfigDir, mifasolCacheFolder)
+}
+
+func (sc *ServerConfig) GetCompletePodcastFolder() string {
+	return filepath.Join(sc.ConfigDir, podcastFolder)
+}
+
 func (sc *ServerConfig) SaveParam() {
 	logrus.Debugf("Save param file: %s", sc.GetCompleteParamFilename())
 	rawConfig, err := yaml.Marshal(*sc.ServerParam)
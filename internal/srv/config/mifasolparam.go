@@ -16,6 +16,8 @@ type MifasolParam struct {
 	Username         string `yaml:"username"`
 	Password         string `yaml:"password"`
 	Timeout          int64  `yaml:"timeout"`
+	RefreshPeriod    int64  `yaml:"refresh_period,omitempty"`
+	CacheSize        int64  `yaml:"cache_size,omitempty"`
 }
 
 func (c *MifasolParam) GetCert() []byte {
@@ -3,22 +3,106 @@ package config
 import (
 	_ "embed"
 	"github.com/jypelle/vekigi/apimodel"
+	"time"
 )
 
 //go:embed param_default.yaml
 var ParamDefaultFile []byte
 
 type ServerParam struct {
-	SnoozeDuration int64                 `yaml:"snooze_duration"`
-	WebradioGroups map[int64][]*Webradio `yaml:"webradio_groups"`
-	MifasolParam   *MifasolParam         `yaml:"mifasol,omitempty"`
-	ApiParam       ApiParam              `yaml:"api"`
+	SnoozeDuration        int64                         `yaml:"snooze_duration"`
+	WebradioStartTimeout  int64                         `yaml:"webradio_start_timeout,omitempty"`
+	ResumeOnStartup       bool                          `yaml:"resume_on_startup,omitempty"`
+	WebradioGroups        map[int64][]*Webradio         `yaml:"webradio_groups"`
+	StationDirectoryUrl   string                        `yaml:"station_directory_url,omitempty"`   // radio-browser compatible, https://all.api.radio-browser.info by default
+	PlaylistVolumeOffsets map[apimodel.PlaylistId]int64 `yaml:"playlist_volume_offsets,omitempty"` // by playlist id, as listed by the api
+	Recordings            []*Recording                  `yaml:"recordings,omitempty"`
+	MifasolParam          *MifasolParam                 `yaml:"mifasol,omitempty"`
+	SubsonicParam         *SubsonicParam                `yaml:"subsonic,omitempty"`
+	UpnpParam             *UpnpParam                    `yaml:"upnp,omitempty"`
+	Podcasts              []*Podcast                    `yaml:"podcasts,omitempty"`
+	AnnouncementParam     *AnnouncementParam            `yaml:"announcement,omitempty"`
+	ChimeParam            *ChimeParam                   `yaml:"chime,omitempty"`
+	ApiParam              ApiParam                      `yaml:"api"`
+	MpdParam              *MpdParam                     `yaml:"mpd,omitempty"`
+	RendererParam         *RendererParam                `yaml:"renderer,omitempty"`
+	AudioParam            AudioParam                    `yaml:"audio"`
 }
 
 type Webradio struct {
+	Name string `yaml:"name"`
+	// Ordered list of stream urls: mirrors are tried one after the other until one of them plays
+	Urls []string `yaml:"urls"`
+	// Deprecated: single stream url of older param files, moved into Urls when loading
+	Url string `yaml:"url,omitempty"`
+	// Added to the volume while playing this webradio
+	VolumeOffset int64               `yaml:"volume_offset,omitempty"`
+	WebradioId   apimodel.WebradioId `yaml:"-"`
+}
+
+type Recording struct {
 	Name       string              `yaml:"name"`
-	Url        string              `yaml:"url"`
-	WebradioId apimodel.WebradioId `yaml:"-"`
+	WebradioId apimodel.WebradioId `yaml:"webradio_id"`
+	Hour       int64               `yaml:"hour"`
+	Minute     int64               `yaml:"minute"`
+	// Duration in seconds
+	Duration int64 `yaml:"duration"`
+	// Bit mask of recording days (1: sunday, 2: monday, 4: tuesday ... 64: saturday), 0 means every day
+	Weekdays int64 `yaml:"weekdays"`
+}
+
+func (r *Recording) IsScheduledOn(weekday time.Weekday) bool {
+	return r.Weekdays == 0 || r.Weekdays&(1<<uint(weekday)) != 0
+}
+
+// Podcast is a RSS or Atom feed played as a playlist, newest episodes first
+type Podcast struct {
+	Name string `yaml:"name"`
+	Url  string `yaml:"url"`
+	// Number of unplayed episodes downloaded ahead of time, 3 by default
+	DownloadCount int64 `yaml:"download_count,omitempty"`
+}
+
+// ChimeParam makes the radio chime at the beginning of every hour, and optionally of every quarter of an hour
+type ChimeParam struct {
+	// Chime also at quarter past, half past and quarter to
+	Quarters bool `yaml:"quarters,omitempty"`
+	// Hours without chime, from QuietFrom (included) to QuietTo (excluded), like 22 to 7. None when equal.
+	QuietFrom int64 `yaml:"quiet_from,omitempty"`
+	QuietTo   int64 `yaml:"quiet_to,omitempty"`
+	// Speak the time after the hourly chime, with the text-to-speech engine of the announcements
+	SpeakTime bool `yaml:"speak_time,omitempty"`
+}
+
+func (c *ChimeParam) IsQuiet(hour int64) bool {
+	if c.QuietFrom <= c.QuietTo {
+		return hour >= c.QuietFrom && hour < c.QuietTo
+	}
+	return hour >= c.QuietFrom || hour < c.QuietTo
+}
+
+type AudioParam struct {
+	// Decode, mix and output sound in process instead of running cvlc for each stream
+	Pipeline bool `yaml:"pipeline"`
+	// Pipeline output: alsa (default), file or null
+	Sink string `yaml:"sink,omitempty"`
+	// Alsa device used by the alsa sink: default (first card), hw:<card>,<device> or hw:CARD=<name>,DEV=<device>
+	SinkDevice string `yaml:"sink_device,omitempty"`
+	// Raw PCM file written by the file sink
+	SinkFile string `yaml:"sink_file,omitempty"`
+	// Command decoding to PCM the formats other than wav, mp3 and ogg vorbis, "{input}" being replaced by the file, the
+	// url or "-" for stdin
+	DecoderCommand []string `yaml:"decoder_command,omitempty"`
+	// Alsa mixer control driven by the volume (PCM by default), "software" to always use a software gain. While the
+	// mixer control fails, a software gain is used instead: without pipeline, it only applies to the next played stream.
+	MixerControl string `yaml:"mixer_control,omitempty"`
+	// Play local playlist songs at the same loudness, using ReplayGain tags or cached measurements
+	LoudnessNormalization bool `yaml:"loudness_normalization,omitempty"`
+	// Crossfade duration in seconds between playlist songs, 0 for gapless transitions (pipeline only)
+	Crossfade float64 `yaml:"crossfade,omitempty"`
+	// Volume in percent of the sound playing under an announcement, 40 by default (pipeline only). Without pipeline,
+	// the sound is paused during the announcement.
+	DuckingLevel int64 `yaml:"ducking_level,omitempty"`
 }
 
 type ApiParam struct {
@@ -26,3 +110,18 @@ type ApiParam struct {
 	SslPort int64  `yaml:"ssl_port"`
 	ApiKey  string `yaml:"api_key"`
 }
+
+// MpdParam enables the Music Player Daemon protocol, to control the radio from MPD clients
+type MpdParam struct {
+	Port int64 `yaml:"port"`
+	// Asked by the password command before any other command, none when empty
+	Password string `yaml:"password,omitempty"`
+}
+
+// RendererParam makes the radio a UPnP media renderer, to play the music cast from phones and computers
+type RendererParam struct {
+	// Name shown by the control points, vekigi by default
+	Name string `yaml:"name,omitempty"`
+	// Port of the http server serving the descriptions and the control urls
+	Port int64 `yaml:"port"`
+}
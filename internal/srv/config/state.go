@@ -9,6 +9,9 @@ import (
 	"time"
 )
 
+// Number of played episodes remembered for each podcast
+const maxPlayedEpisodes = 500
+
 type ServerState struct {
 	serverStateConfig     ServerStateConfig
 	lock                  sync.RWMutex
@@ -68,6 +71,146 @@ func (ss *ServerState) SetAlarm(alarm Alarm) {
 	ss.scheduleSave()
 }
 
+// PlayMode returns the play mode of a playlist, shuffle by default
+func (ss *ServerState) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+
+	playMode, ok := ss.serverStateConfig.PlayModes[playlistId]
+	if !ok || !playMode.IsValid() {
+		return apimodel.ShufflePlayMode
+	}
+	return playMode
+}
+
+func (ss *ServerState) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.serverStateConfig.PlayModes == nil {
+		ss.serverStateConfig.PlayModes = make(map[apimodel.PlaylistId]apimodel.PlayMode)
+	}
+	ss.serverStateConfig.PlayModes[playlistId] = playMode
+	ss.scheduleSave()
+}
+
+// PlaylistResume returns the point where a playlist has been left, if any
+func (ss *ServerState) PlaylistResume(playlistId apimodel.PlaylistId) (PlaylistResume, bool) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+
+	resume, ok := ss.serverStateConfig.PlaylistResumes[playlistId]
+	return resume, ok
+}
+
+func (ss *ServerState) SetPlaylistResume(playlistId apimodel.PlaylistId, resume PlaylistResume) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if ss.serverStateConfig.PlaylistResumes == nil {
+		ss.serverStateConfig.PlaylistResumes = make(map[apimodel.PlaylistId]PlaylistResume)
+	}
+	ss.serverStateConfig.PlaylistResumes[playlistId] = resume
+	ss.scheduleSave()
+}
+
+func (ss *ServerState) ClearPlaylistResume(playlistId apimodel.PlaylistId) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if _, ok := ss.serverStateConfig.PlaylistResumes[playlistId]; ok {
+		delete(ss.serverStateConfig.PlaylistResumes, playlistId)
+		ss.scheduleSave()
+	}
+}
+
+// PlaylistIds lists the playlists having a play mode or a resume point
+func (ss *ServerState) PlaylistIds() []apimodel.PlaylistId {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+
+	var playlistIds []apimodel.PlaylistId
+	for playlistId := range ss.serverStateConfig.PlayModes {
+		playlistIds = append(playlistIds, playlistId)
+	}
+	for playlistId := range ss.serverStateConfig.PlaylistResumes {
+		if _, ok := ss.serverStateConfig.PlayModes[playlistId]; !ok {
+			playlistIds = append(playlistIds, playlistId)
+		}
+	}
+	return playlistIds
+}
+
+// RenamePlaylistId moves the play mode and the resume point of a playlist to a new id, unless the new id has its own
+func (ss *ServerState) RenamePlaylistId(playlistId apimodel.PlaylistId, newPlaylistId apimodel.PlaylistId) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	if playMode, ok := ss.serverStateConfig.PlayModes[playlistId]; ok {
+		if _, ok := ss.serverStateConfig.PlayModes[newPlaylistId]; !ok {
+			ss.serverStateConfig.PlayModes[newPlaylistId] = playMode
+		}
+		delete(ss.serverStateConfig.PlayModes, playlistId)
+	}
+	if resume, ok := ss.serverStateConfig.PlaylistResumes[playlistId]; ok {
+		if _, ok := ss.serverStateConfig.PlaylistResumes[newPlaylistId]; !ok {
+			ss.serverStateConfig.PlaylistResumes[newPlaylistId] = resume
+		}
+		delete(ss.serverStateConfig.PlaylistResumes, playlistId)
+	}
+	ss.scheduleSave()
+}
+
+// IsEpisodePlayed tells whether an episode of a podcast has already been played
+func (ss *ServerState) IsEpisodePlayed(podcastName string, episodeGuid string) bool {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+
+	for _, playedGuid := range ss.serverStateConfig.PlayedEpisodes[podcastName] {
+		if playedGuid == episodeGuid {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEpisodePlayed records an episode of a podcast as played, only the last played episodes being remembered
+func (ss *ServerState) SetEpisodePlayed(podcastName string, episodeGuid string) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	playedGuids := ss.serverStateConfig.PlayedEpisodes[podcastName]
+	for _, playedGuid := range playedGuids {
+		if playedGuid == episodeGuid {
+			return
+		}
+	}
+	playedGuids = append(playedGuids, episodeGuid)
+	if len(playedGuids) > maxPlayedEpisodes {
+		playedGuids = playedGuids[len(playedGuids)-maxPlayedEpisodes:]
+	}
+	if ss.serverStateConfig.PlayedEpisodes == nil {
+		ss.serverStateConfig.PlayedEpisodes = make(map[string][]string)
+	}
+	ss.serverStateConfig.PlayedEpisodes[podcastName] = playedGuids
+	ss.scheduleSave()
+}
+
+func (ss *ServerState) LastPlayed() LastPlayed {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+
+	return ss.serverStateConfig.LastPlayed
+}
+
+func (ss *ServerState) SetLastPlayed(lastPlayed LastPlayed) {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+
+	ss.serverStateConfig.LastPlayed = lastPlayed
+	ss.scheduleSave()
+}
+
 func (ss *ServerState) scheduleSave() {
 	if ss.backupTimer == nil {
 		ss.backupTimer = time.AfterFunc(10*time.Second, func() {
@@ -105,6 +248,28 @@ func (ss *ServerState) FlushSave() {
 type ServerStateConfig struct {
 	Volume int64 `yaml:"volume"`
 	Alarm  Alarm `yaml:"alarm"`
+	// Play mode of each playlist, by playlist id
+	PlayModes map[apimodel.PlaylistId]apimodel.PlayMode `yaml:"play_modes,omitempty"`
+	// Point where each playlist has been left, by playlist id
+	PlaylistResumes map[apimodel.PlaylistId]PlaylistResume `yaml:"playlist_resumes,omitempty"`
+	// Guids of the played episodes of each podcast, by podcast name
+	PlayedEpisodes map[string][]string `yaml:"played_episodes,omitempty"`
+	// What was playing when the server stopped
+	LastPlayed LastPlayed `yaml:"last_played,omitempty"`
+}
+
+// PlaylistResume is the point where a playlist has been left: songs in play order (file names for local playlists,
+// song ids for mifasol and subsonic playlists), position of the current song and offset in seconds in this song
+type PlaylistResume struct {
+	Songs    []string          `yaml:"songs"`
+	Position int64             `yaml:"position"`
+	Offset   int64             `yaml:"offset"`
+	PlayMode apimodel.PlayMode `yaml:"play_mode"`
+}
+
+type LastPlayed struct {
+	WebradioId *apimodel.WebradioId `yaml:"webradio_id,omitempty"`
+	PlaylistId *apimodel.PlaylistId `yaml:"playlist_id,omitempty"`
 }
 
 type Alarm struct {
@@ -0,0 +1,11 @@
+package config
+
+// SubsonicParam gives access to a Subsonic compatible server (Navidrome, Airsonic, Gonic...)
+type SubsonicParam struct {
+	// Base url of the server, like https://music.example.com
+	Url      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Delay in seconds between two refreshes of the playlists, 900 by default
+	RefreshPeriod int64 `yaml:"refresh_period,omitempty"`
+}
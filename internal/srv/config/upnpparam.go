@@ -0,0 +1,19 @@
+package config
+
+// UpnpParam exposes containers of UPnP media servers (DLNA NAS, minidlna...) as playlists
+type UpnpParam struct {
+	Playlists []*UpnpPlaylist `yaml:"playlists"`
+	// Description urls of media servers unreachable by SSDP discovery, like http://nas:8200/rootDesc.xml
+	Locations []string `yaml:"locations,omitempty"`
+	// Delay in seconds between two refreshes of the playlists, 900 by default
+	RefreshPeriod int64 `yaml:"refresh_period,omitempty"`
+}
+
+// UpnpPlaylist is a container whose audio items, including those of its sub containers, are played as a playlist
+type UpnpPlaylist struct {
+	Name string `yaml:"name"`
+	// Friendly name or UDN of the media server
+	Server string `yaml:"server"`
+	// Id of the container, as listed by GET /api/upnp/browse
+	ContainerId string `yaml:"container_id"`
+}
@@ -0,0 +1,486 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/sounds"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultAnnouncementTemplate = "It's {{.Time}}, {{.Weekday}} {{.Date}}."
+	defaultTimeTemplate         = "It's {{.Time}}."
+	// Maximum delay to read the sources and to synthesize the speech, the alarm having to ring anyway
+	announcementPrepareTimeout = 60 * time.Second
+	announcementSourceTimeout  = 10 * time.Second
+	maxAnnouncementSourceSize  = 64 * 1024
+)
+
+var defaultWeekdays = []string{"Sunday", "Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday"}
+var defaultMonths = []string{"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"}
+
+// Announcer speaks announcements, the end of each one being notified to let the interrupted sound go on
+type Announcer struct {
+	lock              sync.Mutex
+	eventChannel      chan event.AnnouncerEvent
+	audio             *Audio
+	announcementParam *config.AnnouncementParam
+
+	tts          *ttsCommand
+	template     *template.Template
+	timeTemplate *template.Template
+	weekdays     []string
+	months       []string
+
+	// Cancels the announcement being prepared or played, whose end is notified with endData
+	cancel   context.CancelFunc
+	endData  interface{}
+	playback Playback
+
+	sendEvent bool
+}
+
+// announcementPreparer returns the sources of an announcement, played one after the other, and a cleanup function
+// called once they are played
+type announcementPreparer func(ctx context.Context) ([]pipeline.Source, func(), error)
+
+// announcementData is given to the templates of the alarm announcement and of the talking clock
+type announcementData struct {
+	Time    string
+	Hour    int
+	Minute  int
+	Weekday string
+	Date    string
+	Day     int
+	Month   string
+	Year    int
+	Sources map[string]interface{}
+}
+
+func NewAnnouncer(serverConfig *config.ServerConfig, audio *Audio) *Announcer {
+	announcer := Announcer{
+		eventChannel:      make(chan event.AnnouncerEvent),
+		audio:             audio,
+		announcementParam: serverConfig.AnnouncementParam,
+		weekdays:          defaultWeekdays,
+		months:            defaultMonths,
+		sendEvent:         true,
+	}
+
+	if announcer.announcementParam != nil {
+		var err error
+		announcer.tts, err = newTtsCommand(announcer.announcementParam)
+		if err != nil {
+			logrus.Errorf("Unable to speak announcements: %v", err)
+		}
+
+		templateText := announcer.announcementParam.Template
+		if templateText == "" {
+			templateText = defaultAnnouncementTemplate
+		}
+		announcer.template, err = template.New("announcement").Parse(templateText)
+		if err != nil {
+			logrus.Errorf("Invalid announcement template: %v", err)
+			announcer.template = template.Must(template.New("announcement").Parse(defaultAnnouncementTemplate))
+		}
+
+		templateText = announcer.announcementParam.TimeTemplate
+		if templateText == "" {
+			templateText = defaultTimeTemplate
+		}
+		announcer.timeTemplate, err = template.New("time").Parse(templateText)
+		if err != nil {
+			logrus.Errorf("Invalid time template: %v", err)
+			announcer.timeTemplate = template.Must(template.New("time").Parse(defaultTimeTemplate))
+		}
+
+		if len(announcer.announcementParam.Weekdays) == 7 {
+			announcer.weekdays = announcer.announcementParam.Weekdays
+		}
+		if len(announcer.announcementParam.Months) == 12 {
+			announcer.months = announcer.announcementParam.Months
+		}
+	}
+
+	return &announcer
+}
+
+func (d *Announcer) Start() {
+	logrus.Infof("Start announcer device")
+}
+
+func (d *Announcer) StopSendingEvent() {
+	logrus.Infof("Stop sending events for announcer device")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendEvent = false
+}
+
+func (d *Announcer) Stop() {
+	logrus.Infof("Stop announcer device")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *Announcer) EventChannel() chan event.AnnouncerEvent {
+	return d.eventChannel
+}
+
+// IsAlarmAnnouncementEnabled tells whether an announcement is spoken when the alarm fires
+func (d *Announcer) IsAlarmAnnouncementEnabled() bool {
+	return d.tts != nil && d.announcementParam.AlarmAnnouncement
+}
+
+// AnnounceAlarm speaks the alarm announcement in background. Its end is notified even when it fails, for the alarm
+// to ring anyway.
+func (d *Announcer) AnnounceAlarm() {
+	d.announce(
+		func(ctx context.Context) ([]pipeline.Source, func(), error) {
+			text := d.alarmText(ctx)
+			logrus.Infof("Announce \"%s\"", text)
+			return d.speech(ctx, text)
+		},
+		false,
+		event.AnnouncerEventAlarmEndData{},
+	)
+}
+
+// AnnounceMessage plays in background an audio file, an url, or speaks a text, over the current sound when over is
+// set. The audio file is removed once played. The alarm announcement is not interrupted by messages.
+func (d *Announcer) AnnounceMessage(text string, url string, path string, over bool) error {
+	if path == "" && url == "" {
+		if text == "" {
+			return fmt.Errorf("Nothing to announce")
+		}
+		if d.tts == nil {
+			return fmt.Errorf("No text-to-speech engine configured")
+		}
+	}
+	if d.isAnnouncingAlarm() {
+		return fmt.Errorf("The alarm announcement is being spoken")
+	}
+
+	d.announce(
+		func(ctx context.Context) ([]pipeline.Source, func(), error) {
+			switch {
+			case path != "":
+				return []pipeline.Source{{Path: path}}, func() { os.Remove(path) }, nil
+			case url != "":
+				return []pipeline.Source{{Url: url}}, func() {}, nil
+			default:
+				logrus.Infof("Announce \"%s\"", text)
+				return d.speech(ctx, text)
+			}
+		},
+		over,
+		event.AnnouncerEventMessageEndData{},
+	)
+	return nil
+}
+
+// AnnounceChime plays in background the hour or the quarter chime, followed by the spoken time when speakTime is set
+// and a text-to-speech engine is configured. It doesn't interrupt the current announcement.
+func (d *Announcer) AnnounceChime(hour bool, speakTime bool, over bool) error {
+	if d.IsAnnouncing() {
+		return fmt.Errorf("An announcement is being played")
+	}
+
+	chime := sounds.QuarterChimeFile
+	if hour {
+		chime = sounds.HourChimeFile
+	}
+	d.announce(
+		func(ctx context.Context) ([]pipeline.Source, func(), error) {
+			chimeSource := pipeline.Source{Reader: ioutil.NopCloser(bytes.NewReader(chime))}
+			if !speakTime || d.tts == nil {
+				return []pipeline.Source{chimeSource}, func() {}, nil
+			}
+			speechSources, cleanup, err := d.speech(ctx, d.timeText())
+			if err != nil {
+				// The chime rings anyway
+				logrus.Warnf("Unable to speak the time: %v", err)
+				return []pipeline.Source{chimeSource}, func() {}, nil
+			}
+			return append([]pipeline.Source{chimeSource}, speechSources...), cleanup, nil
+		},
+		over,
+		event.AnnouncerEventMessageEndData{},
+	)
+	return nil
+}
+
+// AnnounceTime speaks the time in background (talking clock), replacing the current announcement unless it is the
+// alarm one
+func (d *Announcer) AnnounceTime(over bool) error {
+	if d.tts == nil {
+		return fmt.Errorf("No text-to-speech engine configured")
+	}
+	if d.isAnnouncingAlarm() {
+		return fmt.Errorf("The alarm announcement is being spoken")
+	}
+
+	d.announce(
+		func(ctx context.Context) ([]pipeline.Source, func(), error) {
+			text := d.timeText()
+			logrus.Infof("Announce \"%s\"", text)
+			return d.speech(ctx, text)
+		},
+		over,
+		event.AnnouncerEventMessageEndData{},
+	)
+	return nil
+}
+
+// IsAnnouncing tells whether an announcement is being prepared or played
+func (d *Announcer) IsAnnouncing() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.endData != nil
+}
+
+// IsAnnouncingMessage tells whether a message, a chime or the time is being announced
+func (d *Announcer) IsAnnouncingMessage() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.endData.(event.AnnouncerEventMessageEndData)
+	return ok
+}
+
+func (d *Announcer) isAnnouncingAlarm() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, ok := d.endData.(event.AnnouncerEventAlarmEndData)
+	return ok
+}
+
+// Clear interrupts the announcement, its end not being notified
+func (d *Announcer) Clear() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *Announcer) clear() {
+	if d.cancel != nil {
+		d.cancel()
+		d.cancel = nil
+		d.endData = nil
+	}
+	if d.playback != nil {
+		d.playback.Stop()
+		d.playback = nil
+	}
+}
+
+// announce prepares and plays an announcement in background, replacing the current one, and sends endData once done.
+// When over is set, the announcement is played over the current sound instead of replacing it.
+func (d *Announcer) announce(prepare announcementPreparer, over bool, endData interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.endData = endData
+
+	go func() {
+		d.play(ctx, prepare, over)
+
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		if ctx.Err() == nil {
+			// Not interrupted
+			d.cancel = nil
+			d.endData = nil
+			if d.sendEvent {
+				go func() { d.eventChannel <- event.AnnouncerEvent{Data: endData} }()
+			}
+		}
+		cancel()
+	}()
+}
+
+func (d *Announcer) play(ctx context.Context, prepare announcementPreparer, over bool) {
+	prepareCtx, cancelPrepare := context.WithTimeout(ctx, announcementPrepareTimeout)
+	sources, cleanup, err := prepare(prepareCtx)
+	cancelPrepare()
+	if err != nil {
+		if ctx.Err() == nil {
+			logrus.Warnf("Unable to prepare announcement: %v", err)
+		}
+		return
+	}
+	defer cleanup()
+
+	for _, source := range sources {
+		if !d.playSource(ctx, source, over) {
+			return
+		}
+	}
+}
+
+// playSource plays a source of the announcement until its end. It returns false when the announcement has been
+// interrupted or when the source can't be played.
+func (d *Announcer) playSource(ctx context.Context, source pipeline.Source, over bool) bool {
+	d.lock.Lock()
+	if ctx.Err() != nil {
+		d.lock.Unlock()
+		if source.Reader != nil {
+			source.Reader.Close()
+		}
+		return false
+	}
+	var playback Playback
+	var err error
+	if over {
+		playback, err = d.audio.PlayOver(source)
+	} else {
+		d.audio.SetVolumeOffset(0)
+		playback, err = d.audio.Play(source)
+	}
+	if err != nil {
+		d.lock.Unlock()
+		logrus.Warnf("Unable to play announcement: %v", err)
+		return false
+	}
+	d.playback = playback
+	d.lock.Unlock()
+
+	_ = playback.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.playback == playback {
+		d.playback = nil
+	}
+	return ctx.Err() == nil
+}
+
+// speech synthesizes the spoken text into a temporary wav file, removed by the returned cleanup function
+func (d *Announcer) speech(ctx context.Context, text string) ([]pipeline.Source, func(), error) {
+	if d.tts == nil {
+		return nil, nil, fmt.Errorf("No text-to-speech engine")
+	}
+	wavFile, err := ioutil.TempFile("", "vekigi-announcement-*.wav")
+	if err != nil {
+		return nil, nil, err
+	}
+	wavFile.Close()
+	cleanup := func() { os.Remove(wavFile.Name()) }
+
+	err = d.tts.synthesize(ctx, text, wavFile.Name())
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return []pipeline.Source{{Path: wavFile.Name()}}, cleanup, nil
+}
+
+// alarmText fills the announcement template, the default template being used when it fails
+func (d *Announcer) alarmText(ctx context.Context) string {
+	data := d.newAnnouncementData(time.Now())
+	data.Sources = d.readSources(ctx)
+	return fillAnnouncementTemplate(d.template, defaultAnnouncementTemplate, data)
+}
+
+// timeText fills the time template of the talking clock, the default template being used when it fails
+func (d *Announcer) timeText() string {
+	data := d.newAnnouncementData(time.Now())
+	data.Sources = make(map[string]interface{})
+	return fillAnnouncementTemplate(d.timeTemplate, defaultTimeTemplate, data)
+}
+
+func (d *Announcer) newAnnouncementData(now time.Time) announcementData {
+	data := announcementData{
+		Time:    fmt.Sprintf("%d:%02d", now.Hour(), now.Minute()),
+		Hour:    now.Hour(),
+		Minute:  now.Minute(),
+		Weekday: d.weekdays[now.Weekday()],
+		Day:     now.Day(),
+		Month:   d.months[now.Month()-1],
+		Year:    now.Year(),
+	}
+	data.Date = data.Month + " " + strconv.Itoa(data.Day)
+	return data
+}
+
+func fillAnnouncementTemplate(textTemplate *template.Template, defaultTemplate string, data announcementData) string {
+	var text bytes.Buffer
+	err := textTemplate.Execute(&text, data)
+	if err != nil {
+		logrus.Warnf("Unable to fill template %s: %v", textTemplate.Name(), err)
+		text.Reset()
+		template.Must(template.New(textTemplate.Name()).Parse(defaultTemplate)).Execute(&text, data)
+	}
+	return strings.TrimSpace(text.String())
+}
+
+// readSources reads the data of the sources, empty when unavailable
+func (d *Announcer) readSources(ctx context.Context) map[string]interface{} {
+	sources := make(map[string]interface{})
+	for _, source := range d.announcementParam.Sources {
+		sources[source.Name] = ""
+		content, err := readAnnouncementSource(ctx, source.Location)
+		if err != nil {
+			logrus.Warnf("Unable to read announcement source %s: %v", source.Name, err)
+			continue
+		}
+		var value interface{}
+		if json.Unmarshal(content, &value) == nil {
+			sources[source.Name] = value
+		} else {
+			sources[source.Name] = strings.TrimSpace(string(content))
+		}
+	}
+	return sources
+}
+
+func readAnnouncementSource(ctx context.Context, location string) ([]byte, error) {
+	if !strings.HasPrefix(location, "http://") && !strings.HasPrefix(location, "https://") {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return ioutil.ReadAll(io.LimitReader(file, maxAnnouncementSourceSize))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, announcementSourceTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxAnnouncementSourceSize))
+}
@@ -11,14 +11,21 @@ import (
 	"github.com/jypelle/vekigi/internal/srv/event"
 	"github.com/jypelle/vekigi/internal/tool"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"path/filepath"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// Maximum size of the audio files uploaded to be announced
+const maxAnnouncementUploadSize = 32 << 20
+
 type Api struct {
 	lock         sync.RWMutex
 	eventChannel chan event.ApiEvent
@@ -40,6 +47,8 @@ func NewApi(config *config.ServerConfig) *Api {
 		done:         make(chan bool),
 	}
 
+	stationDirectory := NewStationDirectory(config)
+
 	api.router = mux.NewRouter().Schemes("https").Subrouter()
 	api.router = mux.NewRouter().StrictSlash(false)
 
@@ -117,18 +126,58 @@ func NewApi(config *config.ServerConfig) *Api {
 	api.apiRouter.HandleFunc("/playlist/play/{playlist_id}",
 		func(w http.ResponseWriter, r *http.Request) {
 			vars := mux.Vars(r)
-			playlistIdstr, ok := vars["playlist_id"]
+			playlistId, ok := vars["playlist_id"]
+			if !ok || playlistId == "" {
+				ErrorStatusAction(w, r, http.StatusBadRequest)
+				return
+			}
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventPlaylistPlayData{PlaylistId: apimodel.PlaylistId(playlistId)}}
+			err := <-result
+			if err == nil {
+				ErrorStatusAction(w, r, http.StatusOK)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusForbidden)
+			}
+		}).Methods("POST")
+	api.apiRouter.HandleFunc("/playlist/play_mode/{playlist_id}/{play_mode}",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			playlistId, ok := vars["playlist_id"]
+			if !ok || playlistId == "" {
+				ErrorStatusAction(w, r, http.StatusBadRequest)
+				return
+			}
+			playMode := apimodel.PlayMode(vars["play_mode"])
+			if !playMode.IsValid() {
+				ErrorStatusAction(w, r, http.StatusBadRequest)
+				return
+			}
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventPlaylistPlayModeData{PlaylistId: apimodel.PlaylistId(playlistId), PlayMode: playMode}}
+			err := <-result
+			if err == nil {
+				ErrorStatusAction(w, r, http.StatusOK)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusForbidden)
+			}
+		}).Methods("POST")
+	api.apiRouter.HandleFunc("/playlist/seek/{offset}",
+		func(w http.ResponseWriter, r *http.Request) {
+			vars := mux.Vars(r)
+			offsetStr, ok := vars["offset"]
 			if !ok {
 				ErrorStatusAction(w, r, http.StatusBadRequest)
 				return
 			}
-			playlistId, err := strconv.ParseInt(playlistIdstr, 10, 0)
+			// Offset in seconds, negative to move backward
+			offset, err := strconv.ParseInt(offsetStr, 10, 0)
 			if err != nil {
 				ErrorStatusAction(w, r, http.StatusBadRequest)
 				return
 			}
 			result := make(chan error)
-			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventPlaylistPlayData{PlaylistId: apimodel.PlaylistId(playlistId)}}
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventPlaylistSeekData{Offset: time.Duration(offset) * time.Second}}
 			err = <-result
 			if err == nil {
 				ErrorStatusAction(w, r, http.StatusOK)
@@ -158,6 +207,134 @@ func NewApi(config *config.ServerConfig) *Api {
 				GlobalErrorAction(w, err.Error(), http.StatusForbidden)
 			}
 		}).Methods("POST")
+	api.apiRouter.HandleFunc("/playlist/refresh",
+		func(w http.ResponseWriter, r *http.Request) {
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventPlaylistRefreshData{}}
+			err := <-result
+			if err == nil {
+				ErrorStatusAction(w, r, http.StatusOK)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusServiceUnavailable)
+			}
+		}).Methods("POST")
+	api.apiRouter.HandleFunc("/state",
+		func(w http.ResponseWriter, r *http.Request) {
+			var state apimodel.State
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventStateData{State: &state}}
+			err := <-result
+			if err == nil {
+				JsonAction(w, state)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusInternalServerError)
+			}
+		}).Methods("GET")
+	api.apiRouter.HandleFunc("/upnp/browse",
+		func(w http.ResponseWriter, r *http.Request) {
+			// Browsing doesn't change the server state, media servers being queried without the event loop
+			result, err := BrowseUpnp(config.ServerParam.UpnpParam, r.URL.Query().Get("server"), r.URL.Query().Get("container"))
+			if err == nil {
+				JsonAction(w, result)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusNotFound)
+			}
+		}).Methods("GET")
+
+	api.apiRouter.HandleFunc("/station/search",
+		func(w http.ResponseWriter, r *http.Request) {
+			query := StationQuery{
+				Name:        r.URL.Query().Get("name"),
+				CountryCode: r.URL.Query().Get("country"),
+				Tag:         r.URL.Query().Get("tag"),
+			}
+			if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+				limit, err := strconv.ParseInt(limitStr, 10, 0)
+				if err != nil {
+					ErrorStatusAction(w, r, http.StatusBadRequest)
+					return
+				}
+				query.Limit = limit
+			}
+			// Searching doesn't change the server state, the directory being queried without the event loop
+			stations, err := stationDirectory.Search(query)
+			if err == nil {
+				JsonAction(w, stations)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusServiceUnavailable)
+			}
+		}).Methods("GET")
+	api.apiRouter.HandleFunc("/station/import",
+		func(w http.ResponseWriter, r *http.Request) {
+			var stationImport apimodel.StationImport
+			err := json.NewDecoder(r.Body).Decode(&stationImport)
+			if err != nil || len(stationImport.StationUuids) == 0 {
+				ErrorStatusAction(w, r, http.StatusBadRequest)
+				return
+			}
+			stations, err := stationDirectory.Stations(stationImport.StationUuids)
+			if err != nil {
+				GlobalErrorAction(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			var webradioIds []apimodel.WebradioId
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventWebradioImportData{GroupId: stationImport.GroupId, Stations: stations, WebradioIds: &webradioIds}}
+			err = <-result
+			if err == nil {
+				JsonAction(w, webradioIds)
+			} else {
+				GlobalErrorAction(w, err.Error(), http.StatusForbidden)
+			}
+		}).Methods("POST")
+
+	api.apiRouter.HandleFunc("/announce",
+		func(w http.ResponseWriter, r *http.Request) {
+			// JSON announcement, or form with an optional uploaded audio file
+			var announcement apimodel.Announcement
+			var path string
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				err := json.NewDecoder(r.Body).Decode(&announcement)
+				if err != nil {
+					ErrorStatusAction(w, r, http.StatusBadRequest)
+					return
+				}
+			} else {
+				r.Body = http.MaxBytesReader(w, r.Body, maxAnnouncementUploadSize)
+				// Uploaded files larger than 1MB are kept on disk while parsing
+				err := r.ParseMultipartForm(1 << 20)
+				if err != nil && err != http.ErrNotMultipart {
+					ErrorStatusAction(w, r, http.StatusBadRequest)
+					return
+				}
+				if r.MultipartForm != nil {
+					defer r.MultipartForm.RemoveAll()
+				}
+				announcement.Url = r.FormValue("url")
+				announcement.Text = r.FormValue("text")
+				announcement.Message = r.FormValue("message")
+				path, err = saveAnnouncementUpload(r)
+				if err != nil {
+					GlobalErrorAction(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if announcement.Message == "" {
+				announcement.Message = announcement.Text
+			}
+
+			result := make(chan error)
+			api.eventChannel <- event.ApiEvent{Result: result, Data: event.ApiEventAnnounceData{Text: announcement.Text, Url: announcement.Url, Path: path, Message: announcement.Message}}
+			err := <-result
+			if err == nil {
+				ErrorStatusAction(w, r, http.StatusOK)
+			} else {
+				if path != "" {
+					os.Remove(path)
+				}
+				GlobalErrorAction(w, err.Error(), http.StatusForbidden)
+			}
+		}).Methods("POST")
 
 	// Tell the browser that it's OK for JS to communicate with the server
 	headersOk := handlers.AllowedHeaders([]string{"Authorization"})
@@ -221,6 +398,31 @@ func (d *Api) EventChannel() chan event.ApiEvent {
 	return d.eventChannel
 }
 
+// saveAnnouncementUpload copies the uploaded audio file, if any, to a temporary file removed once played
+func saveAnnouncementUpload(r *http.Request) (string, error) {
+	file, header, err := r.FormFile("file")
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// The extension helps the decoder to recognize the format
+	uploadFile, err := ioutil.TempFile("", "vekigi-announcement-*"+filepath.Ext(header.Filename))
+	if err != nil {
+		return "", err
+	}
+	defer uploadFile.Close()
+	_, err = io.Copy(uploadFile, file)
+	if err != nil {
+		os.Remove(uploadFile.Name())
+		return "", err
+	}
+	return uploadFile.Name(), nil
+}
+
 func (d *Api) selfSignedKeyFilename() string {
 	return filepath.Join(d.config.ConfigDir, "key.pem")
 }
@@ -274,3 +476,9 @@ func ErrorMessageAction(w http.ResponseWriter, title string, status int) {
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(errorMessage)
 }
+
+func JsonAction(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(value)
+}
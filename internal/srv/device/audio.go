@@ -1,21 +1,57 @@
 package device
 
 import (
+	"fmt"
 	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
 	"github.com/sirupsen/logrus"
+	"io"
+	"math"
 	"os/exec"
 	"strconv"
 	"sync"
+	"time"
 )
 
+const defaultMixerControl = "PCM"
+const softwareMixerControl = "software"
+const defaultDuckingLevel = 40
+
 type Audio struct {
 	lock         sync.RWMutex
 	serverState  *config.ServerState
+	audioParam   config.AudioParam
 	zeroSoundCmd *exec.Cmd
+	pipeline     *pipeline.Pipeline
+
+	mixerControl   string
+	softwareVolume bool
+	volumeOffset   int64
+	// Set when the last mixer control call failed, the software gain being used until the next successful call
+	mixerFailed bool
+	// Silences the output without changing the saved volume
+	muted bool
 }
 
-func NewAudio(serverState *config.ServerState) *Audio {
-	device := Audio{serverState: serverState}
+// Playback is a sound being played by the audio device
+type Playback interface {
+	// Wait blocks until the end of the playback
+	Wait() error
+	Stop()
+	// Position returns the duration already played
+	Position() time.Duration
+}
+
+func NewAudio(serverConfig *config.ServerConfig) *Audio {
+	device := Audio{
+		serverState:  serverConfig.ServerState,
+		audioParam:   serverConfig.AudioParam,
+		mixerControl: serverConfig.AudioParam.MixerControl,
+	}
+	if device.mixerControl == "" {
+		device.mixerControl = defaultMixerControl
+	}
+	device.softwareVolume = device.mixerControl == softwareMixerControl
 	return &device
 }
 
@@ -25,24 +61,161 @@ func (w *Audio) Start() {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	w.zeroSoundCmd = exec.Command("aplay", "-D", "default", "-t", "raw", "-r", "44100", "-c", "2", "-f", "S16_LE", "/dev/zero")
-	err := w.zeroSoundCmd.Start()
-	if err != nil {
-		logrus.Panic("Unable to activate popping/clicking cleaner: %v", err)
-		return
+	if w.audioParam.Pipeline {
+		sink, err := w.newSink()
+		if err != nil {
+			logrus.Panicf("Unable to open audio output: %v", err)
+			return
+		}
+		// The pipeline writes silence when nothing is playing: no popping/clicking cleaner needed
+		w.pipeline = pipeline.New(sink, w.audioParam.DecoderCommand)
+		w.pipeline.SetCrossfade(time.Duration(w.audioParam.Crossfade * float64(time.Second)))
+		duckingLevel := w.audioParam.DuckingLevel
+		if duckingLevel <= 0 {
+			duckingLevel = defaultDuckingLevel
+		} else if duckingLevel > 100 {
+			duckingLevel = 100
+		}
+		w.pipeline.SetDucking(volumeToGain(duckingLevel))
+		w.pipeline.Start()
+	} else {
+		w.zeroSoundCmd = exec.Command("aplay", "-D", "default", "-t", "raw", "-r", "44100", "-c", "2", "-f", "S16_LE", "/dev/zero")
+		err := w.zeroSoundCmd.Start()
+		if err != nil {
+			logrus.Panicf("Unable to activate popping/clicking cleaner: %v", err)
+			return
+		}
 	}
 
 	w.applyVolume()
 }
 
+func (w *Audio) newSink() (pipeline.Sink, error) {
+	switch w.audioParam.Sink {
+	case "", "alsa":
+		return pipeline.NewAlsaSink(w.audioParam.SinkDevice)
+	case "file":
+		return pipeline.NewFileSink(w.audioParam.SinkFile, true)
+	case "null":
+		return pipeline.NewNullSink(true), nil
+	default:
+		return nil, fmt.Errorf("unknown audio sink %s", w.audioParam.Sink)
+	}
+}
+
 func (w *Audio) Stop() {
 	logrus.Infof("Stop audio device")
 
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	if err := w.zeroSoundCmd.Process.Kill(); err != nil {
-		logrus.Errorf("Failed to stop popping/clicking cleaner: %v", err)
+	if w.pipeline != nil {
+		w.pipeline.Stop()
+	} else {
+		if err := w.zeroSoundCmd.Process.Kill(); err != nil {
+			logrus.Errorf("Failed to stop popping/clicking cleaner: %v", err)
+		}
+	}
+}
+
+// Play starts playing a file, an url or a stream, through the pipeline when enabled or with cvlc otherwise
+func (w *Audio) Play(source pipeline.Source) (Playback, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.pipeline != nil {
+		return w.pipeline.Play(source), nil
+	}
+
+	args := []string{"--aout=alsa", "--play-and-exit"}
+	gain := pipeline.DbToGain(source.Gain)
+	if w.softwareVolume || w.mixerFailed {
+		gain *= volumeToGain(w.effectiveVolume())
+	}
+	if gain != 1 {
+		args = append(args, "--gain="+strconv.FormatFloat(gain, 'f', 4, 64))
+	}
+	if source.Start > 0 {
+		args = append(args, "--start-time="+strconv.FormatFloat(source.Start.Seconds(), 'f', 1, 64))
+	}
+	var cmd *exec.Cmd
+	switch {
+	case source.Reader != nil:
+		cmd = exec.Command("cvlc", append(args, "-")...)
+		cmd.Stdin = source.Reader
+	case source.Path != "":
+		cmd = exec.Command("cvlc", append(args, source.Path)...)
+	default:
+		cmd = exec.Command("cvlc", append(args, source.Url)...)
+	}
+	err := cmd.Start()
+	if err != nil {
+		if source.Reader != nil {
+			source.Reader.Close()
+		}
+		return nil, err
+	}
+
+	return &cvlcPlayback{cmd: cmd, reader: source.Reader, startTime: time.Now()}, nil
+}
+
+// CanPlayOver tells whether a source can be played over the current sound, which requires the pipeline
+func (w *Audio) CanPlayOver() bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	return w.pipeline != nil
+}
+
+// PlayOver plays a source over the current sound, lowered until the end of the source
+func (w *Audio) PlayOver(source pipeline.Source) (Playback, error) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	if w.pipeline == nil {
+		if source.Reader != nil {
+			source.Reader.Close()
+		}
+		return nil, fmt.Errorf("playing over the current sound requires the pipeline")
+	}
+	return w.pipeline.PlayOver(source), nil
+}
+
+// PlayNext chains a source to the current playback, to be played without gap or with a crossfade. It returns nil
+// when the pipeline is disabled, the source having then to be played once the current playback is over.
+func (w *Audio) PlayNext(current Playback, source pipeline.Source) *pipeline.Stream {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	currentStream, ok := current.(*pipeline.Stream)
+	if w.pipeline == nil || !ok {
+		return nil
+	}
+	return w.pipeline.PlayNext(currentStream, source)
+}
+
+type cvlcPlayback struct {
+	cmd       *exec.Cmd
+	reader    io.Closer
+	startTime time.Time
+}
+
+func (p *cvlcPlayback) Wait() error {
+	err := p.cmd.Wait()
+	if p.reader != nil {
+		p.reader.Close()
+	}
+	return err
+}
+
+// Position is estimated from the start time of the process
+func (p *cvlcPlayback) Position() time.Duration {
+	return time.Since(p.startTime)
+}
+
+func (p *cvlcPlayback) Stop() {
+	if err := p.cmd.Process.Kill(); err != nil {
+		logrus.Errorf("Failed to kill process: %v", err)
 	}
 }
 
@@ -54,16 +227,50 @@ func (w *Audio) setVolume(volume int64) {
 		volume = 0
 	}
 	w.serverState.SetVolume(volume)
+	w.muted = false
 	w.applyVolume()
 }
 
+// effectiveVolume is the volume corrected by the offset of the current source, 0 when muted
+func (w *Audio) effectiveVolume() int64 {
+	if w.muted {
+		return 0
+	}
+	volume := w.serverState.Volume() + w.volumeOffset
+	if volume > 100 {
+		volume = 100
+	}
+	if volume < 0 {
+		volume = 0
+	}
+	return volume
+}
+
 func (w *Audio) applyVolume() {
-	cmd := exec.Command("amixer", "set", "PCM", strconv.FormatInt(int64(w.serverState.Volume()), 10)+"%")
-	err := cmd.Run()
-	if err != nil {
-		logrus.Warnf("Unable to set volume")
+	if w.pipeline != nil {
+		w.pipeline.SetGain(volumeToGain(w.effectiveVolume()))
 		return
 	}
+
+	if !w.softwareVolume {
+		// The mixer control is tried again at each volume change, the software volume being only a fallback
+		cmd := exec.Command("amixer", "set", w.mixerControl, strconv.FormatInt(w.effectiveVolume(), 10)+"%")
+		err := cmd.Run()
+		if err == nil {
+			w.mixerFailed = false
+			return
+		}
+		logrus.Warnf("Unable to set volume with mixer control %s, fallback to software volume: %v", w.mixerControl, err)
+		w.mixerFailed = true
+	}
+
+	// Software volume is given to cvlc when starting the next stream
+	logrus.Debugf("Software volume set to %d", w.effectiveVolume())
+}
+
+// volumeToGain maps a 0-100 volume to a software gain with a cubic curve, closer to the perceived loudness
+func volumeToGain(volume int64) float64 {
+	return math.Pow(float64(volume)/100, 3)
 }
 
 func (w *Audio) IncreaseVolume() {
@@ -80,6 +287,39 @@ func (w *Audio) DecreaseVolume() {
 	w.setVolume(w.serverState.Volume() - 4)
 }
 
+// SetVolumeOffset sets the offset of the source about to be played, to balance quiet and loud sources
+func (w *Audio) SetVolumeOffset(volumeOffset int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.volumeOffset != volumeOffset {
+		logrus.Infof("Set volume offset to %d", volumeOffset)
+		w.volumeOffset = volumeOffset
+		w.applyVolume()
+	}
+}
+
+// SetMute silences the output, or restores it, the saved volume being kept. Setting the volume restores the output too.
+func (w *Audio) SetMute(muted bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.muted != muted {
+		logrus.Infof("Set mute to %v", muted)
+		w.muted = muted
+		w.applyVolume()
+	}
+}
+
+func (w *Audio) Muted() bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	return w.muted
+}
+
+// Volume returns the volume set by the user, without the offset of the current source
+func (w *Audio) Volume() int64 {
+	return w.serverState.Volume()
+}
+
 func (w *Audio) SetVolume(volume int64) error {
 	logrus.Infof("Set volume")
 	w.lock.Lock()
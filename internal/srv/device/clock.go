@@ -50,7 +50,7 @@ func (d *Clock) Start() {
 				// Check starting minute
 				displayedTime := now.Format("15:04")
 				if oldDisplayedTime != displayedTime {
-					d.eventChannel <- event.TickerEvent{Data: event.TickerEventTickData{}}
+					d.eventChannel <- event.TickerEvent{Data: event.TickerEventTickData{Time: now, Startup: oldDisplayedTime == ""}}
 				}
 				oldDisplayedTime = displayedTime
 
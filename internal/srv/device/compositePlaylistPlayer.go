@@ -0,0 +1,273 @@
+package device
+
+import (
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// CompositePlaylistPlayer gathers the playlists of several players in a single catalogue, numbered in the order of the
+// players. Only one player plays at a time.
+type CompositePlaylistPlayer struct {
+	lock            sync.Mutex
+	playlistPlayers []PlaylistPlayer
+	eventChannel    chan event.PlaylistEvent
+
+	// Catalogue built at the first need, and built again once a player has read its playlists again
+	catalogueBuilt     bool
+	cataloguePlaylists []Playlist
+	catalogueOwners    []PlaylistPlayer
+}
+
+func NewCompositePlaylistPlayer(playlistPlayers ...PlaylistPlayer) PlaylistPlayer {
+	playlistPlayer := CompositePlaylistPlayer{
+		playlistPlayers: playlistPlayers,
+		eventChannel:    make(chan event.PlaylistEvent),
+	}
+
+	// Forward the events of every player
+	for _, player := range playlistPlayers {
+		go func(player PlaylistPlayer) {
+			for ev := range player.EventChannel() {
+				switch ev.Data.(type) {
+				case event.PlaylistEventPlaylistsData, event.PlaylistEventConnectionData:
+					playlistPlayer.invalidateCatalogue()
+				}
+				playlistPlayer.eventChannel <- ev
+			}
+		}(player)
+	}
+
+	return &playlistPlayer
+}
+
+func (d *CompositePlaylistPlayer) Start() {
+	logrus.Infof("Start composite playlist player device")
+
+	for _, player := range d.playlistPlayers {
+		player.Start()
+	}
+}
+
+func (d *CompositePlaylistPlayer) StopSendingEvent() {
+	for _, player := range d.playlistPlayers {
+		player.StopSendingEvent()
+	}
+}
+
+func (d *CompositePlaylistPlayer) Stop() {
+	logrus.Infof("Stop composite playlist player device")
+
+	for _, player := range d.playlistPlayers {
+		player.Stop()
+	}
+}
+
+func (d *CompositePlaylistPlayer) EventChannel() chan event.PlaylistEvent {
+	return d.eventChannel
+}
+
+func (d *CompositePlaylistPlayer) PlaylistCount() int64 {
+	playlists, _ := d.catalogue()
+	return int64(len(playlists))
+}
+
+// catalogue lists the playlists of all the players, with the player owning each of them. The lists are shared and
+// must not be modified.
+func (d *CompositePlaylistPlayer) catalogue() ([]Playlist, []PlaylistPlayer) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.catalogueBuilt {
+		return d.cataloguePlaylists, d.catalogueOwners
+	}
+
+	var playlists []Playlist
+	var owners []PlaylistPlayer
+	for _, player := range d.playlistPlayers {
+		for index := int64(1); ; index++ {
+			playlist := player.GetPlaylistByIndex(index)
+			if playlist == nil {
+				break
+			}
+			playlist.Index = int64(len(playlists) + 1)
+			playlists = append(playlists, *playlist)
+			owners = append(owners, player)
+		}
+	}
+	d.cataloguePlaylists = playlists
+	d.catalogueOwners = owners
+	d.catalogueBuilt = true
+	return playlists, owners
+}
+
+// invalidateCatalogue makes the next call to catalogue build the catalogue again
+func (d *CompositePlaylistPlayer) invalidateCatalogue() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.catalogueBuilt = false
+}
+
+// find returns a copy of the playlist with its position in the catalogue, and the player owning it
+func (d *CompositePlaylistPlayer) find(playlistId apimodel.PlaylistId) (*Playlist, PlaylistPlayer) {
+	playlists, owners := d.catalogue()
+	for i := range playlists {
+		if playlists[i].PlaylistId == playlistId {
+			playlist := playlists[i]
+			return &playlist, owners[i]
+		}
+	}
+	return nil, nil
+}
+
+// current returns the player which is playing, nil when none of them plays
+func (d *CompositePlaylistPlayer) current() PlaylistPlayer {
+	for _, player := range d.playlistPlayers {
+		if player.CurrentPlaylist() != nil {
+			return player
+		}
+	}
+	return nil
+}
+
+func (d *CompositePlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	playlist, _ := d.find(playlistId)
+	return playlist
+}
+
+func (d *CompositePlaylistPlayer) GetPlaylistByIndex(index int64) *Playlist {
+	playlists, _ := d.catalogue()
+	if index < 1 || index > int64(len(playlists)) {
+		return nil
+	}
+	playlist := playlists[index-1]
+	return &playlist
+}
+
+func (d *CompositePlaylistPlayer) NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist {
+	playlists, _ := d.catalogue()
+	playlist := nextPlaylist(playlists, playlistId)
+	if playlist == nil {
+		return nil
+	}
+	next := *playlist
+	return &next
+}
+
+func (d *CompositePlaylistPlayer) Refresh() error {
+	defer d.invalidateCatalogue()
+
+	var err error
+	for _, player := range d.playlistPlayers {
+		if playerErr := player.Refresh(); playerErr != nil {
+			err = playerErr
+		}
+	}
+	return err
+}
+
+// ConnectionError returns the error of the first unreachable player
+func (d *CompositePlaylistPlayer) ConnectionError() error {
+	for _, player := range d.playlistPlayers {
+		if err := player.ConnectionError(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *CompositePlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
+	_, owner := d.find(playlistId)
+	if owner == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+
+	for _, player := range d.playlistPlayers {
+		if player != owner {
+			player.Clear()
+		}
+	}
+	return owner.Play(playlistId)
+}
+
+func (d *CompositePlaylistPlayer) CurrentPlaylist() *Playlist {
+	current := d.current()
+	if current == nil {
+		return nil
+	}
+	currentPlaylist := current.CurrentPlaylist()
+	if currentPlaylist == nil {
+		return nil
+	}
+	if playlist, _ := d.find(currentPlaylist.PlaylistId); playlist != nil {
+		return playlist
+	}
+	return currentPlaylist
+}
+
+func (d *CompositePlaylistPlayer) CurrentSongName() string {
+	if current := d.current(); current != nil {
+		return current.CurrentSongName()
+	}
+	return ""
+}
+
+func (d *CompositePlaylistPlayer) Clear() {
+	for _, player := range d.playlistPlayers {
+		player.Clear()
+	}
+}
+
+func (d *CompositePlaylistPlayer) NextSong() {
+	if current := d.current(); current != nil {
+		current.NextSong()
+	}
+}
+
+func (d *CompositePlaylistPlayer) PreviousSong() {
+	if current := d.current(); current != nil {
+		current.PreviousSong()
+	}
+}
+
+func (d *CompositePlaylistPlayer) Seek(offset time.Duration) error {
+	current := d.current()
+	if current == nil {
+		return fmt.Errorf("No song is playing")
+	}
+	return current.Seek(offset)
+}
+
+func (d *CompositePlaylistPlayer) Position() time.Duration {
+	if current := d.current(); current != nil {
+		return current.Position()
+	}
+	return 0
+}
+
+func (d *CompositePlaylistPlayer) Duration() time.Duration {
+	if current := d.current(); current != nil {
+		return current.Duration()
+	}
+	return 0
+}
+
+func (d *CompositePlaylistPlayer) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	_, owner := d.find(playlistId)
+	if owner == nil {
+		return apimodel.ShufflePlayMode
+	}
+	return owner.PlayMode(playlistId)
+}
+
+func (d *CompositePlaylistPlayer) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error {
+	_, owner := d.find(playlistId)
+	if owner == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	return owner.SetPlayMode(playlistId, playMode)
+}
@@ -3,33 +3,108 @@ package device
 import (
 	"fmt"
 	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/jypelle/vekigi/internal/srv/tag"
 	"github.com/sirupsen/logrus"
-	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Prefix of the local playlist ids, followed by the name of the folder or of the M3U file
+const localPlaylistIdPrefix = "local:"
+
+// Name and id of the playlist gathering the finished webradio recordings, the id being the one of a hidden folder to
+// never match a playlist folder
+const (
+	recordingPlaylistName = "Recordings"
+	recordingPlaylistId   = apimodel.PlaylistId(localPlaylistIdPrefix + ".recordings")
+)
+
+// Delay between two checks of the playlist and recording folders, an event being sent when they have been modified
+const localPlaylistCheckPeriod = 5 * time.Second
+
 type LocalPlaylistPlayer struct {
-	lock           sync.RWMutex
-	eventChannel   chan event.PlaylistEvent
-	playlistFolder string
+	lock            sync.RWMutex
+	eventChannel    chan event.PlaylistEvent
+	audio           *Audio
+	serverState     *config.ServerState
+	playlistFolder  string
+	recordingFolder string
+	volumeOffsets   map[apimodel.PlaylistId]int64
+
+	loudnessNormalizer *LoudnessNormalizer
+
+	// Playlists and songs found at the last scans, rescanned when the folders are modified
+	playlistsScanned  bool
+	playlistsModTimes [2]int64
+	playlists         []localPlaylist
+	songScans         map[string]*localSongScan
+	// Names of the songs of the current playlist, read from their tags
+	songNames map[string]string
 
 	currentPlaylist          *Playlist
+	currentPlaylistFolder    string
 	currentPlaylistSongFiles []string
+	currentPlaylistOrder     []int
+	currentPlayMode          apimodel.PlayMode
 	currentPlaylistPosition  int64
-	currentPlaylistCmd       *exec.Cmd
+	currentSongStart         time.Duration
+	currentSongDuration      time.Duration
+	currentPlaylistPlayback  Playback
+	// Song chained to the current one by the audio pipeline, and previous song still fading out
+	nextPlaylistPlayback     *pipeline.Stream
+	previousPlaylistPlayback Playback
 
 	sendEvent bool
+
+	quit chan struct{}
+	done chan bool
+}
+
+type localPlaylist struct {
+	Playlist
+	folder string
+	// M3U file listing the songs, instead of the content of the folder
+	m3uFile string
+}
+
+// scan lists the songs of the playlist
+func (p *localPlaylist) scan() (*localSongScan, error) {
+	if p.m3uFile != "" {
+		return scanM3uFile(p.m3uFile)
+	}
+	return scanSongFiles(p.folder)
+}
+
+// location identifies the folder or the M3U file of the playlist
+func (p *localPlaylist) location() string {
+	if p.m3uFile != "" {
+		return p.m3uFile
+	}
+	return p.folder
 }
 
-func NewLocalPlaylistPlayer(playlistFolder string) PlaylistPlayer {
+func NewLocalPlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio) PlaylistPlayer {
 	playlistPlayer := LocalPlaylistPlayer{
-		playlistFolder: playlistFolder,
-		eventChannel:   make(chan event.PlaylistEvent),
-		sendEvent:      true,
+		audio:           audio,
+		serverState:     serverConfig.ServerState,
+		playlistFolder:  serverConfig.GetCompletePlaylistFolder(),
+		recordingFolder: serverConfig.GetCompleteRecordingFolder(),
+		volumeOffsets:   serverConfig.PlaylistVolumeOffsets,
+		songScans:       make(map[string]*localSongScan),
+		songNames:       make(map[string]string),
+		eventChannel:    make(chan event.PlaylistEvent),
+		sendEvent:       true,
+		quit:            make(chan struct{}),
+		done:            make(chan bool),
+	}
+	if serverConfig.AudioParam.LoudnessNormalization {
+		playlistPlayer.loudnessNormalizer = NewLoudnessNormalizer(serverConfig)
 	}
 
 	return &playlistPlayer
@@ -37,6 +112,27 @@ func NewLocalPlaylistPlayer(playlistFolder string) PlaylistPlayer {
 
 func (d *LocalPlaylistPlayer) Start() {
 	logrus.Infof("Start local playlist player device")
+
+	if d.loudnessNormalizer != nil {
+		d.loudnessNormalizer.Start()
+	}
+
+	// Rescan the folders once modified, to tell the other devices about the new playlists
+	go func() {
+		ticker := time.NewTicker(localPlaylistCheckPeriod)
+		defer ticker.Stop()
+		for loop := true; loop; {
+			select {
+			case <-ticker.C:
+				d.lock.Lock()
+				d.localPlaylists()
+				d.lock.Unlock()
+			case <-d.quit:
+				loop = false
+			}
+		}
+		d.done <- true
+	}()
 }
 
 func (d *LocalPlaylistPlayer) StopSendingEvent() {
@@ -52,10 +148,17 @@ func (d *LocalPlaylistPlayer) StopSendingEvent() {
 func (d *LocalPlaylistPlayer) Stop() {
 	logrus.Infof("Stop local playlist player device")
 
+	close(d.quit)
+	<-d.done
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	d.clear()
+
+	if d.loudnessNormalizer != nil {
+		d.loudnessNormalizer.Stop()
+	}
 }
 
 func (d *LocalPlaylistPlayer) EventChannel() chan event.PlaylistEvent {
@@ -63,53 +166,164 @@ func (d *LocalPlaylistPlayer) EventChannel() chan event.PlaylistEvent {
 }
 
 func (d *LocalPlaylistPlayer) PlaylistCount() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return int64(len(d.localPlaylists()))
+}
+
+// localPlaylists lists the sub folders and the M3U files of the playlist folder, followed by the recording folder when
+// it contains finished recordings. The previous list is kept as long as both folders are unmodified.
+func (d *LocalPlaylistPlayer) localPlaylists() []localPlaylist {
+	modTimes := [2]int64{modTime(d.playlistFolder), modTime(d.recordingFolder)}
+	if d.playlistsScanned && modTimes == d.playlistsModTimes {
+		return d.playlists
+	}
+	if d.playlistsScanned && d.sendEvent {
+		go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlaylistsData{}} }()
+	}
+
+	var localPlaylists []localPlaylist
+
 	files, err := os.ReadDir(d.playlistFolder)
 	if err != nil {
 		logrus.Warningf("Unable to access local playlist folder: %v", err)
-		return 0
 	}
-	len := int64(0)
 	for _, file := range files {
-		if file.IsDir() {
-			len++
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			localPlaylists = append(localPlaylists, localPlaylist{
+				Playlist: Playlist{
+					PlaylistId: localPlaylistId(file.Name()),
+					Name:       file.Name(),
+					Index:      int64(len(localPlaylists) + 1),
+				},
+				folder: filepath.Join(d.playlistFolder, file.Name()),
+			})
+		} else if isM3uFile(file.Name()) {
+			localPlaylists = append(localPlaylists, localPlaylist{
+				Playlist: Playlist{
+					PlaylistId: localPlaylistId(file.Name()),
+					Name:       strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())),
+					Index:      int64(len(localPlaylists) + 1),
+				},
+				folder:  d.playlistFolder,
+				m3uFile: filepath.Join(d.playlistFolder, file.Name()),
+			})
 		}
 	}
-	return len
-}
 
-func (d *LocalPlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Playlist {
-	d.lock.Lock()
-	defer d.lock.Unlock()
+	if d.recordingFolder != "" {
+		files, err = os.ReadDir(d.recordingFolder)
+		if err == nil {
+			for _, file := range files {
+				if !file.IsDir() && pipeline.IsAudioFile(file.Name()) {
+					localPlaylists = append(localPlaylists, localPlaylist{
+						Playlist: Playlist{
+							PlaylistId: recordingPlaylistId,
+							Name:       recordingPlaylistName,
+							Index:      int64(len(localPlaylists) + 1),
+						},
+						folder: d.recordingFolder,
+					})
+					break
+				}
+			}
+		}
+	}
+
+	d.playlists = localPlaylists
+	d.playlistsModTimes = modTimes
+	d.playlistsScanned = true
 
-	return d.getPlaylist(playlistId)
+	return localPlaylists
 }
 
-func (d *LocalPlaylistPlayer) getPlaylist(playlistId apimodel.PlaylistId) *Playlist {
-	if playlistId < 1 {
-		logrus.Warnf("Playlist %d is undefined", playlistId)
-		return nil
-	}
+// LegacyPlaylistId numbers the sub folders of the playlist folder as previous versions did: hidden folders included,
+// M3U files and recordings excluded
+func (d *LocalPlaylistPlayer) LegacyPlaylistId(index int64) (*apimodel.PlaylistId, bool) {
 	files, err := os.ReadDir(d.playlistFolder)
 	if err != nil {
 		logrus.Warningf("Unable to access local playlist folder: %v", err)
-		return nil
+		return nil, true
 	}
-	currPlaylistId := apimodel.PlaylistId(0)
+	folderIndex := int64(0)
 	for _, file := range files {
 		if file.IsDir() {
-			currPlaylistId++
-			if currPlaylistId == playlistId {
-				return &Playlist{
-					PlaylistId: playlistId,
-					Name:       file.Name(),
-				}
+			folderIndex++
+			if folderIndex == index && !strings.HasPrefix(file.Name(), ".") {
+				playlistId := localPlaylistId(file.Name())
+				return &playlistId, true
 			}
 		}
 	}
+	return nil, true
+}
+
+func (d *LocalPlaylistPlayer) Refresh() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.playlistsScanned = false
+	d.songScans = make(map[string]*localSongScan)
+	return nil
+}
 
-	logrus.Warnf("Playlist %d is undefined", playlistId)
+// ConnectionError is always nil: local playlists are always reachable
+func (d *LocalPlaylistPlayer) ConnectionError() error {
 	return nil
+}
+
+func (d *LocalPlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	localPlaylist := d.getLocalPlaylist(playlistId)
+	if localPlaylist == nil {
+		return nil
+	}
+	playlist := localPlaylist.Playlist
+	return &playlist
+}
+
+func (d *LocalPlaylistPlayer) GetPlaylistByIndex(index int64) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	localPlaylists := d.localPlaylists()
+	if index < 1 || index > int64(len(localPlaylists)) {
+		return nil
+	}
+	playlist := localPlaylists[index-1].Playlist
+	return &playlist
+}
 
+func (d *LocalPlaylistPlayer) NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	localPlaylists := d.localPlaylists()
+	playlists := make([]Playlist, len(localPlaylists))
+	for i, localPlaylist := range localPlaylists {
+		playlists[i] = localPlaylist.Playlist
+	}
+	return nextPlaylist(playlists, playlistId)
+}
+
+// localPlaylistId identifies the playlist of a sub folder or of a M3U file of the playlist folder
+func localPlaylistId(filename string) apimodel.PlaylistId {
+	return apimodel.PlaylistId(localPlaylistIdPrefix + filename)
+}
+
+func (d *LocalPlaylistPlayer) getLocalPlaylist(playlistId apimodel.PlaylistId) *localPlaylist {
+	localPlaylists := d.localPlaylists()
+	for i := range localPlaylists {
+		if localPlaylists[i].PlaylistId == playlistId {
+			return &localPlaylists[i]
+		}
+	}
+
+	logrus.Warnf("Playlist %s is undefined", playlistId)
+	return nil
 }
 
 func (d *LocalPlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
@@ -117,74 +331,174 @@ func (d *LocalPlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
 	defer d.lock.Unlock()
 
 	if d.currentPlaylist != nil && playlistId == d.currentPlaylist.PlaylistId {
-		logrus.Infof("Already listening playlist %d", playlistId)
+		logrus.Infof("Already listening playlist %s", playlistId)
 		return nil
 	}
-	playlist := d.getPlaylist(playlistId)
+	playlist := d.getLocalPlaylist(playlistId)
 	if playlist == nil {
-		return fmt.Errorf("Playlist %d is undefined", playlistId)
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
 	}
 
 	// Retrieve playlist content
-	files, err := os.ReadDir(filepath.Join(d.playlistFolder, playlist.Name))
-	if err != nil {
-		return fmt.Errorf("Unable to parse playlist folder: %v", err)
+	scan, ok := d.songScans[playlist.location()]
+	if !ok || !scan.upToDate() {
+		var err error
+		scan, err = playlist.scan()
+		if err != nil {
+			return fmt.Errorf("Unable to parse playlist %s: %v", playlist.location(), err)
+		}
+		d.songScans[playlist.location()] = scan
 	}
-	var playlistSongFiles []string
-	for _, file := range files {
-		if !file.IsDir() {
-			playlistSongFiles = append(playlistSongFiles, file.Name())
+	playlistSongFiles := scan.songFiles
+	playMode := d.serverState.PlayMode(playlist.PlaylistId)
+	playlistOrder := playOrder(len(playlistSongFiles), playMode)
+	playlistPosition := int64(0)
+	var start time.Duration
+	if resume, ok := d.serverState.PlaylistResume(playlist.PlaylistId); ok {
+		if resumedOrder, resumedPosition, resumedStart, ok := resumeOrder(playlistSongFiles, resume, playMode); ok {
+			playlistOrder, playlistPosition, start = resumedOrder, resumedPosition, resumedStart
 		}
 	}
-	rand.Shuffle(len(playlistSongFiles), func(i, j int) {
-		playlistSongFiles[i], playlistSongFiles[j] = playlistSongFiles[j], playlistSongFiles[i]
-	})
 
 	// Clear actual playlist
 	d.clear()
 
-	d.currentPlaylist = playlist
+	d.currentPlaylist = &playlist.Playlist
+	d.currentPlaylistFolder = playlist.folder
+	d.songNames = make(map[string]string)
+	for songFile, songName := range scan.songNames {
+		d.songNames[songFile] = songName
+	}
 	d.currentPlaylistSongFiles = playlistSongFiles
-	logrus.Infof("Listening Playlist %d: \"%s\" ", playlistId, playlist.Name)
+	d.currentPlaylistOrder = playlistOrder
+	d.currentPlaylistPosition = playlistPosition
+	d.currentPlayMode = playMode
+	if playlistPosition > 0 || start > 0 {
+		logrus.Infof("Resuming Playlist %s: \"%s\" (%s) at song %d", playlistId, playlist.Name, playMode, playlistPosition+1)
+	} else {
+		logrus.Infof("Listening Playlist %s: \"%s\" (%s)", playlistId, playlist.Name, playMode)
+	}
+	d.audio.SetVolumeOffset(d.volumeOffsets[playlist.PlaylistId])
 
-	d.playSong()
+	if d.loudnessNormalizer != nil {
+		var songFilenames []string
+		for position := range playlistSongFiles {
+			if songFilename := d.songFilename(int64(position)); !isSongUrl(songFilename) {
+				songFilenames = append(songFilenames, songFilename)
+			}
+		}
+		d.loudnessNormalizer.Prepare(songFilenames)
+	}
+
+	d.playSongFrom(start)
 
 	return nil
 }
 
 func (d *LocalPlaylistPlayer) playSong() {
-	if d.currentPlaylistCmd != nil {
-		if err := d.currentPlaylistCmd.Process.Kill(); err != nil {
-			logrus.Errorf("Failed to kill process: %v", err)
-		}
-	}
-	d.currentPlaylistCmd = nil
+	d.playSongFrom(0)
+}
+
+// playSongFrom plays the song at the current position, starting at the given position in the song
+func (d *LocalPlaylistPlayer) playSongFrom(start time.Duration) {
+	d.stopPlayback()
 
 	if d.currentPlaylistPosition >= int64(len(d.currentPlaylistSongFiles)) {
-		d.currentPlaylistCmd = nil
+		// The playlist is over: next time it starts from the beginning
+		d.serverState.ClearPlaylistResume(d.currentPlaylist.PlaylistId)
 		d.currentPlaylist = nil
+		d.currentPlaylistFolder = ""
 		d.currentPlaylistPosition = 0
 		d.currentPlaylistSongFiles = nil
+		d.currentPlaylistOrder = nil
+		d.currentSongDuration = 0
 		return
 	}
 
-	d.currentPlaylistCmd = exec.Command("cvlc", "--aout=alsa", "--play-and-exit", filepath.Join(d.playlistFolder, d.currentPlaylist.Name, d.currentPlaylistSongFiles[d.currentPlaylistPosition]))
-	err := d.currentPlaylistCmd.Start()
+	source := d.songSource(d.currentPlaylistPosition)
+	source.Start = start
+	var err error
+	d.currentPlaylistPlayback, err = d.audio.Play(source)
 	if err != nil {
 		logrus.Warnf("Unable to listen song %d on playlist %s", d.currentPlaylistPosition, d.currentPlaylist.Name)
 		d.clear()
 		return
 	}
+	if start == 0 || d.currentSongDuration == 0 {
+		d.probeSongDuration()
+	}
+	d.currentSongStart = start
+	d.saveResume()
+
+	d.followSong()
+}
+
+// saveResume records the current song and the position in it, to resume the playlist later
+func (d *LocalPlaylistPlayer) saveResume() {
+	d.serverState.SetPlaylistResume(
+		d.currentPlaylist.PlaylistId,
+		newPlaylistResume(d.currentPlaylistSongFiles, d.currentPlaylistOrder, d.currentPlaylistPosition, d.position(), d.currentPlayMode),
+	)
+}
 
-	currentPlaylistCmd := d.currentPlaylistCmd
+// probeSongDuration retrieves the duration of the current song in background
+func (d *LocalPlaylistPlayer) probeSongDuration() {
+	d.currentSongDuration = 0
+	position := d.currentPlaylistPosition
+	filename := d.songFilename(position)
 	go func() {
-		currentPlaylistCmd.Wait()
+		duration, err := pipeline.Duration(filename)
+		if err != nil {
+			logrus.Debugf("Unable to get duration of %s: %v", filename, err)
+			return
+		}
 		d.lock.Lock()
 		defer d.lock.Unlock()
-		if d.currentPlaylistCmd == currentPlaylistCmd {
-			d.currentPlaylistCmd = nil
-			d.currentPlaylistPosition++
-			d.playSong()
+		if d.currentPlaylist != nil && d.currentPlaylistPosition == position && position < int64(len(d.currentPlaylistSongFiles)) && d.songFilename(position) == filename {
+			d.currentSongDuration = duration
+		}
+	}()
+}
+
+// followSong chains the next song to the current one when the audio pipeline allows it, and moves forward in the
+// playlist when the current song ends
+func (d *LocalPlaylistPlayer) followSong() {
+	if d.nextPlaylistPlayback != nil {
+		d.nextPlaylistPlayback.Stop()
+	}
+	d.nextPlaylistPlayback = nil
+	nextPlaylistPosition := nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistSongFiles), d.currentPlayMode, false)
+	if nextPlaylistPosition < int64(len(d.currentPlaylistSongFiles)) {
+		d.nextPlaylistPlayback = d.audio.PlayNext(d.currentPlaylistPlayback, d.songSource(nextPlaylistPosition))
+	}
+
+	currentPlaylistPlayback := d.currentPlaylistPlayback
+	nextPlaylistPlayback := d.nextPlaylistPlayback
+	go func() {
+		if nextPlaylistPlayback != nil {
+			// The pipeline starts the next song by itself, during the crossfade or right after the current one
+			<-nextPlaylistPlayback.Started()
+		} else {
+			currentPlaylistPlayback.Wait()
+		}
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		// The next song may have been chained again after a play mode change
+		if d.currentPlaylistPlayback == currentPlaylistPlayback && d.nextPlaylistPlayback == nextPlaylistPlayback {
+			d.currentPlaylistPosition = nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistSongFiles), d.currentPlayMode, false)
+			if nextPlaylistPlayback != nil {
+				// The previous song may still be fading out
+				d.previousPlaylistPlayback = currentPlaylistPlayback
+				d.currentPlaylistPlayback = nextPlaylistPlayback
+				d.nextPlaylistPlayback = nil
+				d.currentSongStart = 0
+				d.probeSongDuration()
+				d.saveResume()
+				d.followSong()
+			} else {
+				d.currentPlaylistPlayback = nil
+				d.playSong()
+			}
 			if d.sendEvent {
 				go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlayingSongData{}} }()
 			}
@@ -192,6 +506,42 @@ func (d *LocalPlaylistPlayer) playSong() {
 	}()
 }
 
+// songFilename returns the file, or the url for M3U playlists, of the song played at the given position
+func (d *LocalPlaylistPlayer) songFilename(position int64) string {
+	songFile := d.currentPlaylistSongFiles[d.currentPlaylistOrder[position]]
+	if isSongUrl(songFile) || filepath.IsAbs(songFile) {
+		return songFile
+	}
+	return filepath.Join(d.currentPlaylistFolder, songFile)
+}
+
+func (d *LocalPlaylistPlayer) songSource(position int64) pipeline.Source {
+	songFilename := d.songFilename(position)
+	if isSongUrl(songFilename) {
+		return pipeline.Source{Url: songFilename}
+	}
+	source := pipeline.Source{Path: songFilename}
+	if d.loudnessNormalizer != nil {
+		source.Gain = d.loudnessNormalizer.Gain(source.Path)
+	}
+	return source
+}
+
+func (d *LocalPlaylistPlayer) stopPlayback() {
+	if d.previousPlaylistPlayback != nil {
+		d.previousPlaylistPlayback.Stop()
+	}
+	if d.currentPlaylistPlayback != nil {
+		d.currentPlaylistPlayback.Stop()
+	}
+	if d.nextPlaylistPlayback != nil {
+		d.nextPlaylistPlayback.Stop()
+	}
+	d.previousPlaylistPlayback = nil
+	d.currentPlaylistPlayback = nil
+	d.nextPlaylistPlayback = nil
+}
+
 func (d *LocalPlaylistPlayer) CurrentPlaylist() *Playlist {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -204,12 +554,31 @@ func (d *LocalPlaylistPlayer) CurrentSongName() string {
 	defer d.lock.Unlock()
 
 	if d.currentPlaylistPosition < int64(len(d.currentPlaylistSongFiles)) {
-		return d.currentPlaylistSongFiles[d.currentPlaylistPosition]
+		return d.songName(d.songFilename(d.currentPlaylistPosition))
 	} else {
 		return ""
 	}
 }
 
+// songName returns "Artist - Title" read from the song tags, or the file name without extension for untagged songs
+func (d *LocalPlaylistPlayer) songName(filename string) string {
+	if name, ok := d.songNames[filename]; ok {
+		return name
+	}
+
+	name := ""
+	tags, err := tag.Read(filename)
+	if err == nil {
+		name = tags.Name()
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	d.songNames[filename] = name
+
+	return name
+}
+
 func (d *LocalPlaylistPlayer) Clear() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
@@ -219,23 +588,128 @@ func (d *LocalPlaylistPlayer) Clear() {
 
 func (d *LocalPlaylistPlayer) clear() {
 	if d.currentPlaylist != nil {
-		if d.currentPlaylistCmd != nil {
-			if err := d.currentPlaylistCmd.Process.Kill(); err != nil {
-				logrus.Errorf("Failed to kill process: %v", err)
-			}
+		if d.currentPlaylistPlayback != nil {
+			d.saveResume()
 		}
-		d.currentPlaylistCmd = nil
+		d.stopPlayback()
 		d.currentPlaylist = nil
+		d.currentPlaylistFolder = ""
 		d.currentPlaylistPosition = 0
 		d.currentPlaylistSongFiles = nil
+		d.currentPlaylistOrder = nil
+		d.currentSongDuration = 0
 	}
 }
 
 func (d *LocalPlaylistPlayer) NextSong() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+
+	d.nextSong()
+}
+
+func (d *LocalPlaylistPlayer) nextSong() {
 	if d.currentPlaylist != nil {
-		d.currentPlaylistPosition++
+		songCount := len(d.currentPlaylistSongFiles)
+		skipPosition := nextPosition(d.currentPlaylistPosition, songCount, d.currentPlayMode, true)
+		if d.nextPlaylistPlayback != nil && skipPosition == nextPosition(d.currentPlaylistPosition, songCount, d.currentPlayMode, false) {
+			// Only pipeline streams are chained: let the pipeline switch to the next song, with the crossfade
+			d.currentPlaylistPlayback.(*pipeline.Stream).Skip()
+			return
+		}
+		d.currentPlaylistPosition = skipPosition
 		d.playSong()
 	}
 }
+
+func (d *LocalPlaylistPlayer) PreviousSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlaylist != nil {
+		if d.position() < previousSongThreshold {
+			d.currentPlaylistPosition = previousPosition(d.currentPlaylistPosition, len(d.currentPlaylistSongFiles), d.currentPlayMode)
+		}
+		d.playSong()
+	}
+}
+
+func (d *LocalPlaylistPlayer) Seek(offset time.Duration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlaylistPlayback == nil {
+		return fmt.Errorf("No song is playing")
+	}
+	start := d.position() + offset
+	if start < 0 {
+		start = 0
+	}
+	if d.currentSongDuration > 0 && start >= d.currentSongDuration {
+		d.nextSong()
+		return nil
+	}
+	logrus.Infof("Seek to %v", start.Round(time.Second))
+	d.playSongFrom(start)
+
+	return nil
+}
+
+func (d *LocalPlaylistPlayer) Position() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.position()
+}
+
+func (d *LocalPlaylistPlayer) position() time.Duration {
+	if d.currentPlaylistPlayback == nil {
+		return 0
+	}
+	return d.currentSongStart + d.currentPlaylistPlayback.Position()
+}
+
+func (d *LocalPlaylistPlayer) Duration() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.currentSongDuration
+}
+
+func (d *LocalPlaylistPlayer) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	playlist := d.getLocalPlaylist(playlistId)
+	if playlist == nil {
+		return apimodel.ShufflePlayMode
+	}
+	return d.serverState.PlayMode(playlist.PlaylistId)
+}
+
+func (d *LocalPlaylistPlayer) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !playMode.IsValid() {
+		return fmt.Errorf("Play mode %s is undefined", playMode)
+	}
+	playlist := d.getLocalPlaylist(playlistId)
+	if playlist == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	logrus.Infof("Set play mode of playlist \"%s\" to %s", playlist.Name, playMode)
+	d.serverState.SetPlayMode(playlist.PlaylistId, playMode)
+
+	// Apply the new play mode to the songs still to be played
+	if d.currentPlaylist != nil && d.currentPlaylist.PlaylistId == playlistId && d.currentPlayMode != playMode {
+		d.currentPlaylistPosition = reorder(d.currentPlaylistOrder, d.currentPlaylistPosition, playMode)
+		d.currentPlayMode = playMode
+		d.saveResume()
+		if d.nextPlaylistPlayback != nil {
+			d.followSong()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,78 @@
+package device
+
+import (
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localSongScan is the list of the audio files found in a playlist folder and its sub folders, or listed by a M3U
+// file, valid as long as none of the scanned files has been modified
+type localSongScan struct {
+	songFiles []string
+	songNames map[string]string
+	modTimes  map[string]int64
+}
+
+// scanSongFiles walks through a playlist folder and keeps the audio files, as paths relative to the playlist folder.
+// Hidden files and folders are ignored.
+func scanSongFiles(folder string) (*localSongScan, error) {
+	scan := localSongScan{
+		modTimes: make(map[string]int64),
+	}
+
+	err := filepath.WalkDir(folder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == folder {
+				return err
+			}
+			logrus.Warnf("Unable to scan %s: %v", path, err)
+			return nil
+		}
+		if path != folder && strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			scan.modTimes[path] = modTime(path)
+			return nil
+		}
+		if pipeline.IsAudioFile(entry.Name()) {
+			songFile, err := filepath.Rel(folder, path)
+			if err == nil {
+				scan.songFiles = append(scan.songFiles, songFile)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &scan, nil
+}
+
+// upToDate checks that no file has been added, removed or renamed in the scanned folders, and that the scanned M3U
+// file is unchanged
+func (s *localSongScan) upToDate() bool {
+	for filename, fileModTime := range s.modTimes {
+		if modTime(filename) != fileModTime {
+			return false
+		}
+	}
+	return true
+}
+
+// modTime returns the modification time of a file in nanoseconds, 0 when the file can't be accessed
+func modTime(filename string) int64 {
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fileInfo.ModTime().UnixNano()
+}
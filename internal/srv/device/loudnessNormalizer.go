@@ -0,0 +1,227 @@
+package device
+
+import (
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/jypelle/vekigi/internal/srv/tag"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+type loudnessCacheEntry struct {
+	Size    int64   `yaml:"size"`
+	ModTime int64   `yaml:"mod_time"`
+	Gain    float64 `yaml:"gain"`
+}
+
+// LoudnessNormalizer provides the gain bringing each song to the reference loudness: from ReplayGain tags when
+// present, otherwise from a measurement done in background and cached in the config folder
+type LoudnessNormalizer struct {
+	lock           sync.Mutex
+	cacheFilename  string
+	decoderCommand []string
+	cache          map[string]loudnessCacheEntry
+
+	queue          []string
+	queued         map[string]bool
+	failed         map[string]bool
+	currentDecoder pipeline.Decoder
+
+	wakeUp  chan bool
+	askDone chan bool
+	done    chan bool
+}
+
+func NewLoudnessNormalizer(serverConfig *config.ServerConfig) *LoudnessNormalizer {
+	normalizer := LoudnessNormalizer{
+		cacheFilename:  serverConfig.GetCompleteLoudnessCacheFilename(),
+		decoderCommand: serverConfig.AudioParam.DecoderCommand,
+		cache:          make(map[string]loudnessCacheEntry),
+		queued:         make(map[string]bool),
+		failed:         make(map[string]bool),
+		wakeUp:         make(chan bool, 1),
+		askDone:        make(chan bool),
+		done:           make(chan bool),
+	}
+
+	rawCache, err := ioutil.ReadFile(normalizer.cacheFilename)
+	if err == nil {
+		err = yaml.Unmarshal(rawCache, &normalizer.cache)
+		if err != nil {
+			logrus.Warnf("Unable to interpret loudness cache file: %v", err)
+			normalizer.cache = make(map[string]loudnessCacheEntry)
+		}
+	}
+
+	return &normalizer
+}
+
+func (n *LoudnessNormalizer) Start() {
+	logrus.Infof("Start loudness normalizer")
+
+	go func() {
+		for loop := true; loop; {
+			select {
+			case <-n.wakeUp:
+				for {
+					filename, ok := n.nextQueuedFilename()
+					if !ok {
+						break
+					}
+					n.measure(filename)
+				}
+			case <-n.askDone:
+				loop = false
+			}
+		}
+		n.done <- true
+	}()
+}
+
+func (n *LoudnessNormalizer) Stop() {
+	logrus.Infof("Stop loudness normalizer")
+
+	n.lock.Lock()
+	n.queue = nil
+	if n.currentDecoder != nil {
+		// Interrupt the running measurement
+		n.currentDecoder.Close()
+	}
+	n.lock.Unlock()
+
+	n.askDone <- true
+	<-n.done
+}
+
+// Gain returns the gain in dB to apply to a song, 0 when its loudness is still unknown
+func (n *LoudnessNormalizer) Gain(filename string) float64 {
+	tags, err := tag.Read(filename)
+	if err == nil {
+		if gain, ok := tags.ReplayGain(); ok {
+			logrus.Debugf("ReplayGain of %s: %.2f dB", filename, gain)
+			return gain
+		}
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if entry, ok := n.cachedEntry(filename); ok {
+		logrus.Debugf("Measured gain of %s: %.2f dB", filename, entry.Gain)
+		return entry.Gain
+	}
+	n.enqueue(filename)
+	return 0
+}
+
+// Prepare schedules the measurement of the songs which will be played soon
+func (n *LoudnessNormalizer) Prepare(filenames []string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, filename := range filenames {
+		if _, ok := n.cachedEntry(filename); !ok {
+			n.enqueue(filename)
+		}
+	}
+}
+
+func (n *LoudnessNormalizer) cachedEntry(filename string) (loudnessCacheEntry, bool) {
+	entry, ok := n.cache[filename]
+	if !ok {
+		return entry, false
+	}
+	fileInfo, err := os.Stat(filename)
+	if err != nil || fileInfo.Size() != entry.Size || fileInfo.ModTime().Unix() != entry.ModTime {
+		return entry, false
+	}
+	return entry, true
+}
+
+func (n *LoudnessNormalizer) enqueue(filename string) {
+	if n.queued[filename] || n.failed[filename] {
+		return
+	}
+	n.queued[filename] = true
+	n.queue = append(n.queue, filename)
+	select {
+	case n.wakeUp <- true:
+	default:
+	}
+}
+
+func (n *LoudnessNormalizer) nextQueuedFilename() (string, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if len(n.queue) == 0 {
+		return "", false
+	}
+	filename := n.queue[0]
+	n.queue = n.queue[1:]
+	delete(n.queued, filename)
+	return filename, true
+}
+
+func (n *LoudnessNormalizer) measure(filename string) {
+	// Songs with ReplayGain tags don't need any measurement
+	tags, err := tag.Read(filename)
+	if err == nil {
+		if _, ok := tags.ReplayGain(); ok {
+			return
+		}
+	}
+
+	fileInfo, err := os.Stat(filename)
+	if err != nil {
+		return
+	}
+
+	decoder, err := pipeline.Open(pipeline.Source{Path: filename}, n.decoderCommand)
+	if err != nil {
+		logrus.Warnf("Unable to measure loudness of %s: %v", filename, err)
+		n.lock.Lock()
+		n.failed[filename] = true
+		n.lock.Unlock()
+		return
+	}
+	n.lock.Lock()
+	n.currentDecoder = decoder
+	n.lock.Unlock()
+
+	loudness, err := pipeline.MeasureLoudness(decoder)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.currentDecoder = nil
+	decoder.Close()
+
+	if err != nil {
+		logrus.Warnf("Unable to measure loudness of %s: %v", filename, err)
+		n.failed[filename] = true
+		return
+	}
+	logrus.Debugf("Loudness of %s: %.2f LUFS", filename, loudness.Integrated)
+
+	n.cache[filename] = loudnessCacheEntry{
+		Size:    fileInfo.Size(),
+		ModTime: fileInfo.ModTime().Unix(),
+		Gain:    loudness.Gain(),
+	}
+	n.save()
+}
+
+func (n *LoudnessNormalizer) save() {
+	rawCache, err := yaml.Marshal(n.cache)
+	if err != nil {
+		logrus.Warnf("Unable to serialize loudness cache: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(n.cacheFilename, rawCache, 0660)
+	if err != nil {
+		logrus.Warnf("Unable to save loudness cache: %v", err)
+	}
+}
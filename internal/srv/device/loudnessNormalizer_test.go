@@ -0,0 +1,111 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sineWav builds a 16 bits stereo wav file of a 1kHz sine at 44100Hz
+func sineWav(seconds float64, amplitudeDb float64) []byte {
+	amplitude := math.Pow(10, amplitudeDb/20)
+	frames := int(seconds * 44100)
+	data := make([]byte, frames*4)
+	for i := 0; i < frames; i++ {
+		value := uint16(int16(32767 * amplitude * math.Sin(2*math.Pi*1000*float64(i)/44100)))
+		binary.LittleEndian.PutUint16(data[4*i:], value)
+		binary.LittleEndian.PutUint16(data[4*i+2:], value)
+	}
+
+	var wav bytes.Buffer
+	wav.WriteString("RIFF")
+	binary.Write(&wav, binary.LittleEndian, uint32(36+len(data)))
+	wav.WriteString("WAVEfmt ")
+	for _, value := range []interface{}{uint32(16), uint16(1), uint16(2), uint32(44100), uint32(44100 * 4), uint16(4), uint16(16)} {
+		binary.Write(&wav, binary.LittleEndian, value)
+	}
+	wav.WriteString("data")
+	binary.Write(&wav, binary.LittleEndian, uint32(len(data)))
+	wav.Write(data)
+	return wav.Bytes()
+}
+
+// replayGainMp3 builds an ID3v2.3 tag holding a ReplayGain track gain, followed by a frame header
+func replayGainMp3(gain string) []byte {
+	payload := append([]byte("\x00REPLAYGAIN_TRACK_GAIN\x00"), gain...)
+	frame := append([]byte("TXXX"), 0, 0, 0, byte(len(payload)), 0, 0)
+	frame = append(frame, payload...)
+	tag := append([]byte{'I', 'D', '3', 3, 0, 0, 0, 0, 0, byte(len(frame))}, frame...)
+	return append(tag, 0xFF, 0xFB, 0x90, 0xC0)
+}
+
+func newTestLoudnessNormalizer(configDir string) *LoudnessNormalizer {
+	return NewLoudnessNormalizer(&config.ServerConfig{
+		ConfigDir:   configDir,
+		ServerParam: &config.ServerParam{AudioParam: config.AudioParam{LoudnessNormalization: true}},
+	})
+}
+
+func TestLoudnessNormalizerReplayGain(t *testing.T) {
+	directory := t.TempDir()
+	filename := filepath.Join(directory, "tagged.mp3")
+	err := ioutil.WriteFile(filename, replayGainMp3("-4.50 dB"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normalizer := newTestLoudnessNormalizer(directory)
+	if gain := normalizer.Gain(filename); gain != -4.5 {
+		t.Errorf("Gain %.2f dB, expected the ReplayGain of -4.50 dB", gain)
+	}
+	if len(normalizer.queue) != 0 {
+		t.Errorf("Tagged song queued for measurement")
+	}
+}
+
+func TestLoudnessNormalizerMeasurement(t *testing.T) {
+	directory := t.TempDir()
+	filename := filepath.Join(directory, "untagged.wav")
+	err := ioutil.WriteFile(filename, sineWav(3, -20), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	normalizer := newTestLoudnessNormalizer(directory)
+	if gain := normalizer.Gain(filename); gain != 0 {
+		t.Errorf("Gain %.2f dB before measurement, expected 0", gain)
+	}
+
+	// -20 LUFS brought to the -18 LUFS reference
+	normalizer.Start()
+	deadline := time.Now().Add(5 * time.Second)
+	gain := normalizer.Gain(filename)
+	for math.Abs(gain-2) > 0.1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		gain = normalizer.Gain(filename)
+	}
+	normalizer.Stop()
+	if math.Abs(gain-2) > 0.1 {
+		t.Fatalf("Measured gain %.2f dB, expected 2", gain)
+	}
+
+	// The measurement is cached in the config folder
+	normalizer = newTestLoudnessNormalizer(directory)
+	if gain := normalizer.Gain(filename); math.Abs(gain-2) > 0.1 {
+		t.Errorf("Cached gain %.2f dB, expected 2", gain)
+	}
+
+	// and discarded once the song changes
+	err = ioutil.WriteFile(filename, sineWav(4, -10), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gain := normalizer.Gain(filename); gain != 0 {
+		t.Errorf("Gain %.2f dB of a modified song, expected 0", gain)
+	}
+}
@@ -0,0 +1,119 @@
+package device
+
+import (
+	"bufio"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// isM3uFile reports whether the file is a M3U playlist
+func isM3uFile(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".m3u", ".m3u8":
+		return true
+	default:
+		return false
+	}
+}
+
+// isSongUrl reports whether a playlist entry is an http stream rather than a local file
+func isSongUrl(songFile string) bool {
+	return strings.HasPrefix(songFile, "http://") || strings.HasPrefix(songFile, "https://")
+}
+
+// scanM3uFile reads the entries of a M3U playlist: relative paths are resolved from the folder of the M3U file,
+// absolute paths, file:// and http urls are kept as is. Titles given by #EXTINF lines become the song names.
+func scanM3uFile(filename string) (*localSongScan, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scan := localSongScan{
+		songNames: make(map[string]string),
+		modTimes:  map[string]int64{filename: modTime(filename)},
+	}
+
+	folder := filepath.Dir(filename)
+	title := ""
+	scanner := bufio.NewScanner(file)
+	for firstLine := true; scanner.Scan(); firstLine = false {
+		line := scanner.Text()
+		if firstLine {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if !utf8.ValidString(line) {
+			// Legacy .m3u files are Latin-1 encoded
+			line = decodeLatin1(line)
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#EXTINF:"):
+			if comma := strings.Index(line, ","); comma >= 0 {
+				title = strings.TrimSpace(line[comma+1:])
+			}
+			continue
+		case strings.HasPrefix(line, "#"):
+			continue
+		}
+
+		songFile, ok := resolveM3uEntry(folder, line)
+		if ok {
+			scan.songFiles = append(scan.songFiles, songFile)
+			if title != "" {
+				scan.songNames[songFile] = title
+			}
+		} else {
+			logrus.Warnf("Ignoring entry %s of playlist %s", line, filename)
+		}
+		title = ""
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &scan, nil
+}
+
+// resolveM3uEntry returns the url or the absolute path of an existing audio file designated by a M3U entry
+func resolveM3uEntry(folder string, entry string) (string, bool) {
+	if isSongUrl(entry) {
+		return entry, true
+	}
+	if strings.HasPrefix(entry, "file://") {
+		entryUrl, err := url.Parse(entry)
+		if err != nil {
+			return "", false
+		}
+		entry = entryUrl.Path
+	} else if !filepath.IsAbs(entry) {
+		// Playlists exported on Windows use backslashes
+		entry = filepath.Join(folder, filepath.FromSlash(strings.ReplaceAll(entry, "\\", "/")))
+	}
+
+	if !pipeline.IsAudioFile(entry) {
+		return "", false
+	}
+	fileInfo, err := os.Stat(entry)
+	if err != nil || fileInfo.IsDir() {
+		return "", false
+	}
+	return entry, true
+}
+
+func decodeLatin1(text string) string {
+	runes := make([]rune, len(text))
+	for i := 0; i < len(text); i++ {
+		runes[i] = rune(text[i])
+	}
+	return string(runes)
+}
@@ -0,0 +1,223 @@
+package device
+
+import (
+	"encoding/json"
+	"github.com/jypelle/mifasol/restApiV1"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	mifasolCacheIndexFilename     = "index.yaml"
+	mifasolCachePlaylistsFilename = "playlists.json"
+)
+
+// Default maximum size of the mifasol cache, in MB
+const mifasolDefaultCacheSize = 1024
+
+type mifasolCacheEntry struct {
+	Name     string `yaml:"name"`
+	Size     int64  `yaml:"size"`
+	LastUsed int64  `yaml:"last_used"` // in nanoseconds, to tell apart the songs prefetched together
+}
+
+// MifasolCache keeps mifasol songs on disk to play them when the server is unreachable, the least recently used songs
+// being removed when the cache exceeds its maximum size. The last playlists read from the server are kept too.
+type MifasolCache struct {
+	lock    sync.Mutex
+	folder  string
+	maxSize int64
+	entries map[string]mifasolCacheEntry
+	// Songs being downloaded, to download each song only once
+	downloads map[string]bool
+}
+
+func NewMifasolCache(folder string, maxSize int64) *MifasolCache {
+	cache := MifasolCache{
+		folder:    folder,
+		maxSize:   maxSize,
+		entries:   make(map[string]mifasolCacheEntry),
+		downloads: make(map[string]bool),
+	}
+
+	err := os.MkdirAll(folder, 0770)
+	if err != nil {
+		logrus.Warnf("Unable to create mifasol cache folder: %v", err)
+	}
+
+	rawIndex, err := ioutil.ReadFile(filepath.Join(folder, mifasolCacheIndexFilename))
+	if err == nil {
+		err = yaml.Unmarshal(rawIndex, &cache.entries)
+		if err != nil {
+			logrus.Warnf("Unable to interpret mifasol cache index: %v", err)
+			cache.entries = make(map[string]mifasolCacheEntry)
+		}
+	}
+
+	// Forget the songs whose file is missing
+	for songId := range cache.entries {
+		if _, err := os.Stat(cache.songFilename(songId)); err != nil {
+			delete(cache.entries, songId)
+		}
+	}
+
+	return &cache
+}
+
+// Has tells whether the song is in the cache
+func (c *MifasolCache) Has(songId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.entries[songId]
+	return ok
+}
+
+// Song returns the file and the name of a cached song, which becomes the most recently used one
+func (c *MifasolCache) Song(songId string) (string, string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[songId]
+	if !ok {
+		return "", "", false
+	}
+	entry.LastUsed = time.Now().UnixNano()
+	c.entries[songId] = entry
+	c.save()
+
+	return c.songFilename(songId), entry.Name, true
+}
+
+// StartDownload reserves the download of a song, false when the song is already cached or being downloaded
+func (c *MifasolCache) StartDownload(songId string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.entries[songId]; ok || c.downloads[songId] {
+		return false
+	}
+	c.downloads[songId] = true
+	return true
+}
+
+// EndDownload releases the download of a song, stored or not
+func (c *MifasolCache) EndDownload(songId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	delete(c.downloads, songId)
+}
+
+// Store copies the song content into the cache, removing the least recently used songs if needed
+func (c *MifasolCache) Store(songId string, name string, content io.Reader) error {
+	file, err := ioutil.TempFile(c.folder, "incoming")
+	if err != nil {
+		return err
+	}
+	size, err := io.Copy(file, content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), c.songFilename(songId))
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[songId] = mifasolCacheEntry{
+		Name:     name,
+		Size:     size,
+		LastUsed: time.Now().UnixNano(),
+	}
+	c.evict(songId)
+	c.save()
+
+	return nil
+}
+
+// evict removes the least recently used songs, except the given one, until the cache fits in its maximum size
+func (c *MifasolCache) evict(keptSongId string) {
+	totalSize := int64(0)
+	songIds := make([]string, 0, len(c.entries))
+	for songId, entry := range c.entries {
+		totalSize += entry.Size
+		songIds = append(songIds, songId)
+	}
+	sort.Slice(songIds, func(i, j int) bool {
+		return c.entries[songIds[i]].LastUsed < c.entries[songIds[j]].LastUsed
+	})
+
+	for _, songId := range songIds {
+		if totalSize <= c.maxSize {
+			break
+		}
+		if songId == keptSongId {
+			continue
+		}
+		logrus.Debugf("Remove song %s from mifasol cache", songId)
+		err := os.Remove(c.songFilename(songId))
+		if err != nil && !os.IsNotExist(err) {
+			logrus.Warnf("Unable to remove song %s from mifasol cache: %v", songId, err)
+			continue
+		}
+		totalSize -= c.entries[songId].Size
+		delete(c.entries, songId)
+	}
+}
+
+// SavePlaylists keeps the playlists read from the server, stored as returned by the mifasol api
+func (c *MifasolCache) SavePlaylists(playlists []restApiV1.Playlist) {
+	rawPlaylists, err := json.Marshal(playlists)
+	if err != nil {
+		logrus.Warnf("Unable to serialize mifasol playlists: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(c.folder, mifasolCachePlaylistsFilename), rawPlaylists, 0660)
+	if err != nil {
+		logrus.Warnf("Unable to save mifasol playlists: %v", err)
+	}
+}
+
+// Playlists returns the last playlists read from the server
+func (c *MifasolCache) Playlists() []restApiV1.Playlist {
+	var playlists []restApiV1.Playlist
+	rawPlaylists, err := ioutil.ReadFile(filepath.Join(c.folder, mifasolCachePlaylistsFilename))
+	if err != nil {
+		return nil
+	}
+	err = json.Unmarshal(rawPlaylists, &playlists)
+	if err != nil {
+		logrus.Warnf("Unable to interpret cached mifasol playlists: %v", err)
+		return nil
+	}
+	return playlists
+}
+
+func (c *MifasolCache) songFilename(songId string) string {
+	return filepath.Join(c.folder, sanitizeFilename(songId))
+}
+
+func (c *MifasolCache) save() {
+	rawIndex, err := yaml.Marshal(c.entries)
+	if err != nil {
+		logrus.Warnf("Unable to serialize mifasol cache index: %v", err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(c.folder, mifasolCacheIndexFilename), rawIndex, 0660)
+	if err != nil {
+		logrus.Warnf("Unable to save mifasol cache index: %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package device
+
+import (
+	"encoding/json"
+	"github.com/jypelle/mifasol/restApiV1"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMifasolServer serves the playlists and the songs of a single user, as the mifasol rest api does
+type fakeMifasolServer struct {
+	*httptest.Server
+	lock            sync.Mutex
+	playlists       []restApiV1.Playlist
+	songs           map[restApiV1.SongId][]byte
+	contentRequests map[restApiV1.SongId]int
+	// When set, song contents are sent once the channel is closed
+	contentRelease chan struct{}
+}
+
+func newFakeMifasolServer(t *testing.T, playlists []restApiV1.Playlist, songs map[restApiV1.SongId][]byte) *fakeMifasolServer {
+	server := &fakeMifasolServer{
+		playlists:       playlists,
+		songs:           songs,
+		contentRequests: make(map[restApiV1.SongId]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakeMifasolServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/isalive":
+	case r.URL.Path == "/api/v1/token" && r.Method == "POST":
+		json.NewEncoder(w).Encode(restApiV1.Token{AccessToken: "token", TokenType: "Bearer", UserId: "user"})
+	case r.URL.Path == "/api/v1/playlists":
+		json.NewEncoder(w).Encode(s.playlists)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/songs/"):
+		songId := restApiV1.SongId(strings.TrimPrefix(r.URL.Path, "/api/v1/songs/"))
+		json.NewEncoder(w).Encode(restApiV1.Song{Id: songId, SongMeta: restApiV1.SongMeta{Name: "Song " + string(songId)}})
+	case strings.HasPrefix(r.URL.Path, "/api/v1/songContents/"):
+		songId := restApiV1.SongId(strings.TrimPrefix(r.URL.Path, "/api/v1/songContents/"))
+		s.lock.Lock()
+		s.contentRequests[songId]++
+		contentRelease := s.contentRelease
+		s.lock.Unlock()
+		if contentRelease != nil {
+			<-contentRelease
+		}
+		w.Write(s.songs[songId])
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(restApiV1.ApiError{ErrorCode: restApiV1.UnknownErrorCode})
+	}
+}
+
+func (s *fakeMifasolServer) contentRequestCount(songId restApiV1.SongId) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.contentRequests[songId]
+}
+
+// newTestServerConfig configures the audio device to play through a null sink
+func newTestServerConfig(t *testing.T, configDir string) *config.ServerConfig {
+	serverConfig := &config.ServerConfig{
+		ConfigDir: configDir,
+		ServerParam: &config.ServerParam{
+			AudioParam: config.AudioParam{Pipeline: true, Sink: "null", MixerControl: softwareMixerControl},
+		},
+		ServerState: config.NewsServerState(filepath.Join(configDir, "state.yaml")),
+	}
+	t.Cleanup(serverConfig.FlushSave)
+	return serverConfig
+}
+
+func newTestAudio(t *testing.T, serverConfig *config.ServerConfig) *Audio {
+	audio := NewAudio(serverConfig)
+	audio.Start()
+	t.Cleanup(audio.Stop)
+	return audio
+}
+
+// newTestMifasolPlaylistPlayer connects a mifasol player playing through a null sink to the fake server
+func newTestMifasolPlaylistPlayer(t *testing.T, configDir string, server *fakeMifasolServer) *MifasolPlaylistPlayer {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPort, _ := strconv.ParseInt(port, 10, 64)
+	serverConfig := newTestServerConfig(t, configDir)
+	serverConfig.MifasolParam = &config.MifasolParam{
+		ConfigDir:      configDir,
+		ServerHostname: host,
+		ServerPort:     serverPort,
+		Username:       "user",
+		Password:       "password",
+	}
+
+	playlistPlayer := NewMifasolPlaylistPlayer(serverConfig, newTestAudio(t, serverConfig)).(*MifasolPlaylistPlayer)
+	t.Cleanup(func() {
+		playlistPlayer.lock.Lock()
+		defer playlistPlayer.lock.Unlock()
+		playlistPlayer.clear()
+	})
+	return playlistPlayer
+}
+
+func testMifasolPlaylist() ([]restApiV1.Playlist, map[restApiV1.SongId][]byte) {
+	playlist := restApiV1.Playlist{
+		Id:           "playlist",
+		PlaylistMeta: restApiV1.PlaylistMeta{Name: "Morning", SongIds: []restApiV1.SongId{"a", "b", "c"}},
+	}
+	songs := map[restApiV1.SongId][]byte{
+		"a": sineWav(0.2, -20),
+		"b": sineWav(0.2, -20),
+		"c": sineWav(0.2, -20),
+	}
+	return []restApiV1.Playlist{playlist}, songs
+}
+
+// cacheTestSongs downloads the songs of the first playlist at the given indexes, one after the other
+func cacheTestSongs(t *testing.T, playlistPlayer *MifasolPlaylistPlayer, indexes ...int) {
+	for _, index := range indexes {
+		songRef := mifasolSongRef{playlist: &playlistPlayer.mifasolPlaylistList[0], index: index}
+		err := playlistPlayer.cacheSong(playlistPlayer.mifasolClient, songRef)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMifasolCacheLeastRecentlyUsed(t *testing.T) {
+	playlists, songs := testMifasolPlaylist()
+	server := newFakeMifasolServer(t, playlists, songs)
+	configDir := t.TempDir()
+	playlistPlayer := newTestMifasolPlaylistPlayer(t, configDir, server)
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Room for two songs, a being played after b was downloaded
+	songSize := int64(len(songs["a"]))
+	playlistPlayer.cache = NewMifasolCache(playlistPlayer.cache.folder, 2*songSize+songSize/2)
+	cacheTestSongs(t, playlistPlayer, 0, 1)
+	if _, _, ok := playlistPlayer.cache.Song("a"); !ok {
+		t.Fatalf("Song a not cached")
+	}
+	cacheTestSongs(t, playlistPlayer, 2)
+
+	for songId, cached := range map[string]bool{"a": true, "b": false, "c": true} {
+		if playlistPlayer.cache.Has(songId) != cached {
+			t.Errorf("Song %s cached: %v, expected %v", songId, !cached, cached)
+		}
+	}
+
+	// The index survives a restart
+	cache := NewMifasolCache(playlistPlayer.cache.folder, 2*songSize+songSize/2)
+	if !cache.Has("a") || cache.Has("b") || !cache.Has("c") {
+		t.Errorf("Cache index not saved")
+	}
+}
+
+func TestMifasolCacheSizeBound(t *testing.T) {
+	playlists, songs := testMifasolPlaylist()
+	server := newFakeMifasolServer(t, playlists, songs)
+	playlistPlayer := newTestMifasolPlaylistPlayer(t, t.TempDir(), server)
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	songSize := int64(len(songs["a"]))
+	maxSize := songSize + songSize/2
+	playlistPlayer.cache = NewMifasolCache(playlistPlayer.cache.folder, maxSize)
+	cacheTestSongs(t, playlistPlayer, 0, 1, 2)
+
+	totalSize := int64(0)
+	for _, entry := range playlistPlayer.cache.entries {
+		totalSize += entry.Size
+	}
+	if totalSize > maxSize {
+		t.Errorf("Cache of %d bytes exceeds its maximum size of %d bytes", totalSize, maxSize)
+	}
+	if !playlistPlayer.cache.Has("c") {
+		t.Errorf("Last downloaded song removed")
+	}
+
+	// A song bigger than the cache is kept until the next one is stored
+	playlistPlayer.cache = NewMifasolCache(playlistPlayer.cache.folder, songSize/2)
+	cacheTestSongs(t, playlistPlayer, 0)
+	if !playlistPlayer.cache.Has("a") || playlistPlayer.cache.Has("c") {
+		t.Errorf("Song bigger than the cache not kept alone")
+	}
+}
+
+func TestMifasolCacheSingleDownload(t *testing.T) {
+	playlists, songs := testMifasolPlaylist()
+	server := newFakeMifasolServer(t, playlists, songs)
+	playlistPlayer := newTestMifasolPlaylistPlayer(t, t.TempDir(), server)
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contentRelease := make(chan struct{})
+	server.lock.Lock()
+	server.contentRelease = contentRelease
+	server.lock.Unlock()
+
+	// The prefetch of the alarm playlist is downloading the song when the next song is prefetched
+	alarmPlaylistId := mifasolPlaylistId(&playlistPlayer.mifasolPlaylistList[0])
+	playlistPlayer.serverState.SetAlarm(config.Alarm{PlaylistId: &alarmPlaylistId})
+	prefetched := make(chan bool)
+	go func() {
+		playlistPlayer.prefetch()
+		prefetched <- true
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for server.contentRequestCount("a") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The next song prefetch leaves it to the running download
+	nextPrefetched := make(chan error, 1)
+	go func() {
+		songRef := mifasolSongRef{playlist: &playlistPlayer.mifasolPlaylistList[0], index: 0}
+		nextPrefetched <- playlistPlayer.cacheSong(playlistPlayer.mifasolClient, songRef)
+	}()
+	select {
+	case err := <-nextPrefetched:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Song downloaded twice")
+	}
+	close(contentRelease)
+	select {
+	case <-prefetched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Prefetch still running")
+	}
+
+	if count := server.contentRequestCount("a"); count != 1 {
+		t.Errorf("Song downloaded %d times, expected once", count)
+	}
+	if !playlistPlayer.cache.Has("a") {
+		t.Errorf("Song not cached")
+	}
+}
+
+func TestMifasolCacheOfflinePlayback(t *testing.T) {
+	playlists, songs := testMifasolPlaylist()
+	server := newFakeMifasolServer(t, playlists, songs)
+	configDir := t.TempDir()
+	playlistPlayer := newTestMifasolPlaylistPlayer(t, configDir, server)
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheTestSongs(t, playlistPlayer, 1)
+	server.Close()
+
+	// Restarted without the server: the playlists and the cached song are read from the cache
+	playlistPlayer = newTestMifasolPlaylistPlayer(t, configDir, server)
+	if err := playlistPlayer.Refresh(); err == nil {
+		t.Fatalf("Mifasol server still reachable")
+	}
+	err = playlistPlayer.Play(apimodel.PlaylistId("mifasol:playlist"))
+	if err != nil {
+		t.Fatalf("Cached playlist not played: %v", err)
+	}
+
+	playlistPlayer.lock.Lock()
+	defer playlistPlayer.lock.Unlock()
+	if playlistPlayer.currentSongName != "Song b" || playlistPlayer.currentPlaylistPlayback == nil {
+		t.Errorf("Playing \"%s\", expected the cached song b", playlistPlayer.currentSongName)
+	}
+	if len(playlistPlayer.currentPlaylistOrder) != 1 {
+		t.Errorf("%d songs to play, expected the single cached one", len(playlistPlayer.currentPlaylistOrder))
+	}
+}
@@ -7,51 +7,281 @@ import (
 	"github.com/jypelle/vekigi/apimodel"
 	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
 	"github.com/sirupsen/logrus"
-	"math/rand"
-	"os/exec"
+	"io"
 	"sync"
+	"time"
 )
 
+// Delays between two attempts to reach the mifasol server, doubled at each failure
+const (
+	mifasolMinRetryDelay = 5 * time.Second
+	mifasolMaxRetryDelay = 5 * time.Minute
+)
+
+// Default delay between two refreshes of the mifasol playlists
+const mifasolDefaultRefreshPeriod = 15 * time.Minute
+
+// Prefix of the mifasol playlist ids, followed by the id given by the mifasol server
+const mifasolPlaylistIdPrefix = "mifasol:"
+
+// Number of upcoming songs of the alarm playlist and of the playlist being played downloaded in the cache
+const mifasolPrefetchCount = 10
+
 type MifasolPlaylistPlayer struct {
 	lock          sync.RWMutex
 	eventChannel  chan event.PlaylistEvent
+	audio         *Audio
+	serverState   *config.ServerState
+	volumeOffsets map[apimodel.PlaylistId]int64
+	mifasolParam  *config.MifasolParam
+	refreshPeriod time.Duration
+
+	// Client connected to the mifasol server, nil until the first successful login or after a connection error
 	mifasolClient *restClientV1.RestClient
+	connectionErr error
+	cache         *MifasolCache
 
+	// Copy of the playlist being played, unaffected by the playlist refreshes
+	currentMifasolPlaylist  *restApiV1.Playlist
 	currentPlaylistId       apimodel.PlaylistId
+	currentPlaylistOrder    []int
+	currentPlayMode         apimodel.PlayMode
 	currentPlaylistPosition int64
 	currentSongName         string
-	currentPlaylistCmd      *exec.Cmd
+	currentSongStart        time.Duration
+	currentPlaylistPlayback Playback
+	// Incremented each time a song is asked, to drop the answers of the previous requests to the mifasol server
+	songRequest int64
 
 	sendEvent bool
 
 	mifasolPlaylistList []restApiV1.Playlist
+	// Set once the playlists have been read from the server, the list read from the cache possibly being outdated
+	playlistsLoaded bool
+
+	wakeUp chan bool
+	quit   chan struct{}
+	done   chan bool
 }
 
-func NewMifasolPlaylistPlayer(mifasolParam *config.MifasolParam) PlaylistPlayer {
+// mifasolSongRef designates a song of a mifasol playlist
+type mifasolSongRef struct {
+	playlist *restApiV1.Playlist
+	index    int
+}
+
+func NewMifasolPlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio) PlaylistPlayer {
 	playlistPlayer := MifasolPlaylistPlayer{
-		eventChannel: make(chan event.PlaylistEvent),
-		sendEvent:    true,
+		audio:         audio,
+		serverState:   serverConfig.ServerState,
+		volumeOffsets: serverConfig.PlaylistVolumeOffsets,
+		mifasolParam:  serverConfig.MifasolParam,
+		refreshPeriod: time.Duration(serverConfig.MifasolParam.RefreshPeriod) * time.Second,
+		connectionErr: fmt.Errorf("Not connected yet"),
+		eventChannel:  make(chan event.PlaylistEvent),
+		sendEvent:     true,
+		wakeUp:        make(chan bool, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan bool),
 	}
-
-	var err error
-	playlistPlayer.mifasolClient, err = restClientV1.NewRestClient(mifasolParam, false)
-	if err != nil {
-		logrus.Warningf("Failed to create mifasol client: %v", err)
+	if playlistPlayer.refreshPeriod <= 0 {
+		playlistPlayer.refreshPeriod = mifasolDefaultRefreshPeriod
 	}
 
-	userId := playlistPlayer.mifasolClient.UserId()
-	playlistFilterOrder := restApiV1.PlaylistFilterOrderByName
-	playlistPlayer.mifasolPlaylistList, err = playlistPlayer.mifasolClient.ReadPlaylists(&restApiV1.PlaylistFilter{
-		FavoriteUserId: &userId,
-		OrderBy:        &playlistFilterOrder,
-	})
+	cacheSize := serverConfig.MifasolParam.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = mifasolDefaultCacheSize
+	}
+	playlistPlayer.cache = NewMifasolCache(serverConfig.GetCompleteMifasolCacheFolder(), cacheSize*1024*1024)
+	// Playlists read at the last connection, playable from the cache until the server is reached
+	playlistPlayer.mifasolPlaylistList = playlistPlayer.cache.Playlists()
 
 	return &playlistPlayer
 }
 
+// Start connects to the mifasol server in background, retrying until it succeeds, then refreshes the playlists
+// periodically
 func (d *MifasolPlaylistPlayer) Start() {
 	logrus.Infof("Start mifasol playlist player device")
+
+	go func() {
+		retryDelay := mifasolMinRetryDelay
+		for loop := true; loop; {
+			delay := d.refreshPeriod
+			err := d.refreshPlaylists()
+			if err != nil {
+				logrus.Warnf("Unable to read mifasol playlists, next attempt in %v: %v", retryDelay, err)
+				delay = retryDelay
+				retryDelay *= 2
+				if retryDelay > mifasolMaxRetryDelay {
+					retryDelay = mifasolMaxRetryDelay
+				}
+			} else {
+				retryDelay = mifasolMinRetryDelay
+				d.prefetch()
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-d.wakeUp:
+				timer.Stop()
+			case <-d.quit:
+				timer.Stop()
+				loop = false
+			}
+		}
+		d.done <- true
+	}()
+}
+
+// refreshPlaylists logs in to the mifasol server when needed and reads the favorite playlists of the user
+func (d *MifasolPlaylistPlayer) refreshPlaylists() error {
+	d.lock.Lock()
+	mifasolClient := d.mifasolClient
+	d.lock.Unlock()
+
+	var err error
+	if mifasolClient == nil {
+		mifasolClient, err = restClientV1.NewRestClient(d.mifasolParam, false)
+	}
+	var mifasolPlaylistList []restApiV1.Playlist
+	if err == nil {
+		userId := mifasolClient.UserId()
+		playlistFilterOrder := restApiV1.PlaylistFilterOrderByName
+		var cliErr restClientV1.ClientError
+		mifasolPlaylistList, cliErr = mifasolClient.ReadPlaylists(&restApiV1.PlaylistFilter{
+			FavoriteUserId: &userId,
+			OrderBy:        &playlistFilterOrder,
+		})
+		if cliErr != nil {
+			err = cliErr
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err != nil {
+		d.setConnectionErr(err)
+		return err
+	}
+	d.mifasolClient = mifasolClient
+	d.mifasolPlaylistList = mifasolPlaylistList
+	d.playlistsLoaded = true
+	d.cache.SavePlaylists(mifasolPlaylistList)
+	d.setConnectionErr(nil)
+	if d.sendEvent {
+		go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlaylistsData{}} }()
+	}
+	logrus.Debugf("%d mifasol playlists read", len(mifasolPlaylistList))
+	return nil
+}
+
+// setConnectionErr records the connection status, a new login being done at the next attempt after an error
+func (d *MifasolPlaylistPlayer) setConnectionErr(err error) {
+	statusChanged := (err == nil) != (d.connectionErr == nil)
+	d.connectionErr = err
+	if err != nil {
+		d.mifasolClient = nil
+	}
+	if statusChanged {
+		if err == nil {
+			logrus.Infof("Connected to mifasol server")
+		}
+		if d.sendEvent {
+			go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventConnectionData{}} }()
+		}
+	}
+}
+
+// connectionLost records a connection error met while playing, and asks for an immediate reconnection
+func (d *MifasolPlaylistPlayer) connectionLost(err error) {
+	d.setConnectionErr(err)
+	d.wake()
+}
+
+// wake asks the background loop for an immediate refresh of the playlists, followed by a prefetch
+func (d *MifasolPlaylistPlayer) wake() {
+	select {
+	case d.wakeUp <- true:
+	default:
+	}
+}
+
+// prefetch downloads into the cache the upcoming songs of the alarm playlist and of the playlist being played
+func (d *MifasolPlaylistPlayer) prefetch() {
+	d.lock.Lock()
+	mifasolClient := d.mifasolClient
+	songRefs := d.upcomingSongs()
+	d.lock.Unlock()
+
+	if mifasolClient == nil {
+		return
+	}
+	for _, songRef := range songRefs {
+		songId := songRef.playlist.SongIds[songRef.index]
+		if d.cache.Has(string(songId)) {
+			continue
+		}
+		select {
+		case <-d.quit:
+			return
+		default:
+		}
+
+		err := d.cacheSong(mifasolClient, songRef)
+		if err != nil {
+			logrus.Warnf("Unable to prefetch song %s: %v", songId, err)
+			return
+		}
+	}
+}
+
+// upcomingSongs lists the next songs of the playlist being played, and those of the alarm playlist from the point
+// where it will be resumed
+func (d *MifasolPlaylistPlayer) upcomingSongs() []mifasolSongRef {
+	var songRefs []mifasolSongRef
+
+	if d.currentMifasolPlaylist != nil {
+		for position := d.currentPlaylistPosition; position < int64(len(d.currentPlaylistOrder)) && position < d.currentPlaylistPosition+mifasolPrefetchCount; position++ {
+			songRefs = append(songRefs, mifasolSongRef{playlist: d.currentMifasolPlaylist, index: d.currentPlaylistOrder[position]})
+		}
+	}
+
+	alarm := d.serverState.Alarm()
+	if alarm.PlaylistId != nil {
+		// The alarm playlist may belong to another player
+		if mifasolPlaylist := d.findMifasolPlaylist(*alarm.PlaylistId); mifasolPlaylist != nil {
+			alarmPlaylist := *mifasolPlaylist
+			order := playOrder(len(alarmPlaylist.SongIds), apimodel.SequentialPlayMode)
+			position := int64(0)
+			if resume, ok := d.serverState.PlaylistResume(mifasolPlaylistId(&alarmPlaylist)); ok {
+				playMode := d.serverState.PlayMode(mifasolPlaylistId(&alarmPlaylist))
+				if resumedOrder, resumedPosition, _, ok := resumeOrder(mifasolSongKeys(&alarmPlaylist), resume, playMode); ok {
+					order, position = resumedOrder, resumedPosition
+				}
+			}
+			for ; position < int64(len(order)) && len(songRefs) < 2*mifasolPrefetchCount; position++ {
+				songRefs = append(songRefs, mifasolSongRef{playlist: &alarmPlaylist, index: order[position]})
+			}
+		}
+	}
+
+	return songRefs
+}
+
+func (d *MifasolPlaylistPlayer) Refresh() error {
+	return d.refreshPlaylists()
+}
+
+func (d *MifasolPlaylistPlayer) ConnectionError() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.connectionErr
 }
 
 func (d *MifasolPlaylistPlayer) StopSendingEvent() {
@@ -67,6 +297,9 @@ func (d *MifasolPlaylistPlayer) StopSendingEvent() {
 func (d *MifasolPlaylistPlayer) Stop() {
 	logrus.Infof("Stop playlist mifasol player device")
 
+	close(d.quit)
+	<-d.done
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
@@ -88,30 +321,89 @@ func (d *MifasolPlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Pla
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	mifasolPlaylist := d.getMifasolPlaylist(playlistId)
+	return d.getPlaylist(playlistId)
+}
 
-	if mifasolPlaylist != nil {
-		return &Playlist{
-			PlaylistId: playlistId,
-			Name:       mifasolPlaylist.Name,
-		}
-	} else {
+func (d *MifasolPlaylistPlayer) GetPlaylistByIndex(index int64) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if index < 1 || index > int64(len(d.mifasolPlaylistList)) {
 		return nil
 	}
+	return d.playlist(int(index - 1))
+}
+
+// LegacyPlaylistId numbers the favorite playlists by name as previous versions did, once they have been read from the
+// server
+func (d *MifasolPlaylistPlayer) LegacyPlaylistId(index int64) (*apimodel.PlaylistId, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !d.playlistsLoaded {
+		return nil, false
+	}
+	if index < 1 || index > int64(len(d.mifasolPlaylistList)) {
+		return nil, true
+	}
+	playlistId := mifasolPlaylistId(&d.mifasolPlaylistList[index-1])
+	return &playlistId, true
+}
+
+func (d *MifasolPlaylistPlayer) NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	playlists := make([]Playlist, len(d.mifasolPlaylistList))
+	for i := range d.mifasolPlaylistList {
+		playlists[i] = *d.playlist(i)
+	}
+	return nextPlaylist(playlists, playlistId)
+}
+
+func (d *MifasolPlaylistPlayer) getPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	for i := range d.mifasolPlaylistList {
+		if mifasolPlaylistId(&d.mifasolPlaylistList[i]) == playlistId {
+			return d.playlist(i)
+		}
+	}
+	return nil
+}
+
+// playlist describes the mifasol playlist at the given position of the playlist list
+func (d *MifasolPlaylistPlayer) playlist(i int) *Playlist {
+	return &Playlist{
+		PlaylistId: mifasolPlaylistId(&d.mifasolPlaylistList[i]),
+		Name:       d.mifasolPlaylistList[i].Name,
+		Index:      int64(i + 1),
+	}
 }
 
 func (d *MifasolPlaylistPlayer) getMifasolPlaylist(playlistId apimodel.PlaylistId) *restApiV1.Playlist {
-	if playlistId < 1 {
+	if playlistId == "" {
 		return nil
 	}
 
-	if int(playlistId) <= len(d.mifasolPlaylistList) {
-		return &d.mifasolPlaylistList[playlistId-1]
+	if mifasolPlaylist := d.findMifasolPlaylist(playlistId); mifasolPlaylist != nil {
+		return mifasolPlaylist
 	}
 
-	logrus.Warnf("Mifasol playlist %d is undefined", playlistId)
+	logrus.Warnf("Mifasol playlist %s is undefined", playlistId)
 	return nil
+}
+
+// findMifasolPlaylist returns the playlist with the given id, nil when it isn't a mifasol playlist
+func (d *MifasolPlaylistPlayer) findMifasolPlaylist(playlistId apimodel.PlaylistId) *restApiV1.Playlist {
+	for i := range d.mifasolPlaylistList {
+		if mifasolPlaylistId(&d.mifasolPlaylistList[i]) == playlistId {
+			return &d.mifasolPlaylistList[i]
+		}
+	}
+	return nil
+}
 
+func mifasolPlaylistId(mifasolPlaylist *restApiV1.Playlist) apimodel.PlaylistId {
+	return apimodel.PlaylistId(mifasolPlaylistIdPrefix + string(mifasolPlaylist.Id))
 }
 
 func (d *MifasolPlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
@@ -120,80 +412,172 @@ func (d *MifasolPlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
 
 	mifasolPlaylist := d.getMifasolPlaylist(playlistId)
 	if mifasolPlaylist == nil {
-		return fmt.Errorf("Playlist %d is undefined", playlistId)
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
 	}
 
-	if d.currentPlaylistId > 0 && d.currentPlaylistId == playlistId {
-		logrus.Infof("Already listening playlist %d", playlistId)
+	if d.currentPlaylistId != "" && d.currentPlaylistId == playlistId {
+		logrus.Infof("Already listening playlist %s", playlistId)
 		return nil
 	}
 
-	// Shuffle playlist content
-	rand.Shuffle(len(mifasolPlaylist.SongIds), func(i, j int) {
-		mifasolPlaylist.SongIds[i], mifasolPlaylist.SongIds[j] = mifasolPlaylist.SongIds[j], mifasolPlaylist.SongIds[i]
-	})
+	playMode := d.serverState.PlayMode(playlistId)
+	playlistOrder := playOrder(len(mifasolPlaylist.SongIds), playMode)
+	playlistPosition := int64(0)
+	var start time.Duration
+	if resume, ok := d.serverState.PlaylistResume(playlistId); ok {
+		if resumedOrder, resumedPosition, resumedStart, ok := resumeOrder(mifasolSongKeys(mifasolPlaylist), resume, playMode); ok {
+			playlistOrder, playlistPosition, start = resumedOrder, resumedPosition, resumedStart
+		}
+	}
+	if d.mifasolClient == nil {
+		// Only the cached songs can be played without the mifasol server
+		cachedOrder, cachedPosition := d.cachedOrder(mifasolPlaylist, playlistOrder, playlistPosition)
+		if len(cachedOrder) == 0 {
+			return fmt.Errorf("Mifasol server unavailable and no song of playlist %s in cache: %v", mifasolPlaylist.Name, d.connectionErr)
+		}
+		if playlistPosition >= int64(len(playlistOrder)) || cachedOrder[cachedPosition] != playlistOrder[playlistPosition] {
+			start = 0
+		}
+		logrus.Infof("Mifasol server unavailable, %d cached songs of playlist %s will be played", len(cachedOrder), mifasolPlaylist.Name)
+		playlistOrder, playlistPosition = cachedOrder, cachedPosition
+	}
 
 	// Clear actual playlist
 	d.clear()
 
+	currentMifasolPlaylist := *mifasolPlaylist
+	d.currentMifasolPlaylist = &currentMifasolPlaylist
 	d.currentPlaylistId = playlistId
-	logrus.Infof("Listening Playlist %d: \"%s\" ", playlistId, mifasolPlaylist.Name)
+	d.currentPlaylistOrder = playlistOrder
+	d.currentPlaylistPosition = playlistPosition
+	d.currentPlayMode = playMode
+	if playlistPosition > 0 || start > 0 {
+		logrus.Infof("Resuming Playlist %s: \"%s\" (%s) at song %d", playlistId, mifasolPlaylist.Name, playMode, playlistPosition+1)
+	} else {
+		logrus.Infof("Listening Playlist %s: \"%s\" (%s)", playlistId, mifasolPlaylist.Name, playMode)
+	}
+	d.audio.SetVolumeOffset(d.volumeOffsets[playlistId])
 
-	d.playSong()
+	d.playSongFrom(start)
+	if d.mifasolClient != nil {
+		d.wake()
+	}
 
 	return nil
 }
 
-func (d *MifasolPlaylistPlayer) playSong() {
-	if d.currentPlaylistCmd != nil {
-		if err := d.currentPlaylistCmd.Process.Kill(); err != nil {
-			logrus.Errorf("Failed to kill process: %v", err)
+// cachedOrder keeps the cached songs of a play order, the position moving to the first cached song from there
+func (d *MifasolPlaylistPlayer) cachedOrder(mifasolPlaylist *restApiV1.Playlist, order []int, position int64) ([]int, int64) {
+	var cachedOrder []int
+	cachedPosition := int64(-1)
+	for i, songIndex := range order {
+		if !d.cache.Has(string(mifasolPlaylist.SongIds[songIndex])) {
+			continue
 		}
+		if cachedPosition < 0 && int64(i) >= position {
+			cachedPosition = int64(len(cachedOrder))
+		}
+		cachedOrder = append(cachedOrder, songIndex)
+	}
+	if cachedPosition < 0 {
+		cachedPosition = 0
 	}
-	d.currentPlaylistCmd = nil
+	return cachedOrder, cachedPosition
+}
+
+func (d *MifasolPlaylistPlayer) playSong() {
+	d.playSongFrom(0)
+}
 
-	currentMifasolPlaylist := d.getMifasolPlaylist(d.currentPlaylistId)
-	if currentMifasolPlaylist == nil || d.currentPlaylistPosition >= int64(len(currentMifasolPlaylist.SongIds)) {
-		d.currentPlaylistCmd = nil
-		d.currentPlaylistId = 0
+// playSongFrom plays the song at the current position, starting at the given position in the song
+func (d *MifasolPlaylistPlayer) playSongFrom(start time.Duration) {
+	if d.currentPlaylistPlayback != nil {
+		d.currentPlaylistPlayback.Stop()
+	}
+	d.currentPlaylistPlayback = nil
+
+	currentMifasolPlaylist := d.currentMifasolPlaylist
+	if currentMifasolPlaylist == nil || d.currentPlaylistPosition >= int64(len(d.currentPlaylistOrder)) {
+		if currentMifasolPlaylist != nil {
+			// The playlist is over: next time it starts from the beginning
+			d.serverState.ClearPlaylistResume(mifasolPlaylistId(currentMifasolPlaylist))
+		}
+		d.currentPlaylistPlayback = nil
+		d.currentMifasolPlaylist = nil
+		d.currentPlaylistId = ""
+		d.currentPlaylistOrder = nil
 		d.currentPlaylistPosition = 0
 		d.currentSongName = ""
 		return
 	}
 
-	song, cliErr := d.mifasolClient.ReadSong(currentMifasolPlaylist.SongIds[d.currentPlaylistPosition])
-	if cliErr != nil {
-		logrus.Warnf("Unknown song %d on playlist %s", d.currentPlaylistPosition, currentMifasolPlaylist.Name)
-		d.clear()
+	d.songRequest++
+	songRef := mifasolSongRef{playlist: currentMifasolPlaylist, index: d.currentPlaylistOrder[d.currentPlaylistPosition]}
+	songId := songRef.playlist.SongIds[songRef.index]
+	if filename, songName, ok := d.cache.Song(string(songId)); ok {
+		d.startSong(pipeline.Source{Path: filename, Start: start}, songName)
 		return
 	}
-	songContent, _, cliErr := d.mifasolClient.ReadSongContent(currentMifasolPlaylist.SongIds[d.currentPlaylistPosition])
-	if cliErr != nil {
-		logrus.Warnf("Unable to read %d on playlist %s", d.currentPlaylistPosition, currentMifasolPlaylist.Name)
+
+	mifasolClient := d.mifasolClient
+	if mifasolClient == nil {
+		logrus.Warnf("Unable to read song %d on playlist %s: mifasol server unavailable and song not in cache", d.currentPlaylistPosition, currentMifasolPlaylist.Name)
 		d.clear()
 		return
 	}
 
-	d.currentSongName = song.Name
-	d.currentPlaylistCmd = exec.Command("cvlc", "--aout=alsa", "--play-and-exit", "-")
-	d.currentPlaylistCmd.Stdin = songContent
-	err := d.currentPlaylistCmd.Start()
+	// The song is requested without holding the lock, the request being dropped if another song has been asked since
+	d.currentSongName = ""
+	songRequest := d.songRequest
+	go func() {
+		songName, songContent, err := readMifasolSong(mifasolClient, songRef)
+
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		if d.songRequest != songRequest {
+			if songContent != nil {
+				songContent.Close()
+			}
+			return
+		}
+		if err != nil {
+			logrus.Warnf("Unable to read song %d on playlist %s: %v", d.currentPlaylistPosition, currentMifasolPlaylist.Name, err)
+			d.connectionLost(err)
+			d.clear()
+		} else {
+			d.startSong(pipeline.Source{Reader: songContent, Start: start}, songName)
+		}
+		if d.sendEvent {
+			go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlayingSongData{}} }()
+		}
+	}()
+}
+
+// startSong plays the current song from the given source, downloads the next one in background and moves forward in
+// the playlist at the end of the song
+func (d *MifasolPlaylistPlayer) startSong(source pipeline.Source, songName string) {
+	var err error
+	d.currentSongName = songName
+	d.currentPlaylistPlayback, err = d.audio.Play(source)
 	if err != nil {
-		logrus.Warnf("Unable to listen song %d on playlist %s", d.currentPlaylistPosition, currentMifasolPlaylist.Name)
+		logrus.Warnf("Unable to listen song %d on playlist %s", d.currentPlaylistPosition, d.currentMifasolPlaylist.Name)
 		d.clear()
 		return
 	}
+	d.currentSongStart = source.Start
+	d.saveResume()
+	d.prefetchNextSong()
 
-	currentPlaylistCmd := d.currentPlaylistCmd
+	currentPlaylistPlayback := d.currentPlaylistPlayback
 	go func() {
-		currentPlaylistCmd.Wait()
-		songContent.Close()
+		currentPlaylistPlayback.Wait()
 		d.lock.Lock()
 		defer d.lock.Unlock()
 
-		if d.currentPlaylistCmd == currentPlaylistCmd {
-			d.currentPlaylistCmd = nil
-			d.currentPlaylistPosition++
+		if d.currentPlaylistPlayback == currentPlaylistPlayback {
+			d.currentPlaylistPlayback = nil
+			d.currentPlaylistPosition = nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode, false)
 			d.playSong()
 			if d.sendEvent {
 				go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlayingSongData{}} }()
@@ -202,29 +586,86 @@ func (d *MifasolPlaylistPlayer) playSong() {
 	}()
 }
 
+// prefetchNextSong downloads the next song into the cache while the current one plays, to start it without delay
+func (d *MifasolPlaylistPlayer) prefetchNextSong() {
+	nextPlaylistPosition := nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode, false)
+	if d.mifasolClient == nil || nextPlaylistPosition >= int64(len(d.currentPlaylistOrder)) {
+		return
+	}
+	songRef := mifasolSongRef{playlist: d.currentMifasolPlaylist, index: d.currentPlaylistOrder[nextPlaylistPosition]}
+	if d.cache.Has(string(songRef.playlist.SongIds[songRef.index])) {
+		return
+	}
+
+	mifasolClient := d.mifasolClient
+	go func() {
+		err := d.cacheSong(mifasolClient, songRef)
+		if err != nil {
+			logrus.Warnf("Unable to prefetch next song: %v", err)
+		}
+	}()
+}
+
+// cacheSong downloads a song into the cache, unless it is already being downloaded by another prefetch
+func (d *MifasolPlaylistPlayer) cacheSong(mifasolClient *restClientV1.RestClient, songRef mifasolSongRef) error {
+	songId := songRef.playlist.SongIds[songRef.index]
+	if !d.cache.StartDownload(string(songId)) {
+		return nil
+	}
+	defer d.cache.EndDownload(string(songId))
+
+	songName, songContent, err := readMifasolSong(mifasolClient, songRef)
+	if err != nil {
+		return err
+	}
+	defer songContent.Close()
+
+	err = d.cache.Store(string(songId), songName, songContent)
+	if err != nil {
+		return err
+	}
+	logrus.Debugf("Song \"%s\" prefetched", songName)
+	return nil
+}
+
+// readMifasolSong requests the name and the content of a song to the mifasol server
+func readMifasolSong(mifasolClient *restClientV1.RestClient, songRef mifasolSongRef) (string, io.ReadCloser, error) {
+	songId := songRef.playlist.SongIds[songRef.index]
+	song, cliErr := mifasolClient.ReadSong(songId)
+	if cliErr != nil {
+		return "", nil, cliErr
+	}
+	songContent, _, cliErr := mifasolClient.ReadSongContent(songId)
+	if cliErr != nil {
+		return "", nil, cliErr
+	}
+	return song.Name, songContent, nil
+}
+
 func (d *MifasolPlaylistPlayer) CurrentPlaylist() *Playlist {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	currentMifasolPlaylist := d.getMifasolPlaylist(d.currentPlaylistId)
-
-	if currentMifasolPlaylist != nil {
-		return &Playlist{
-			PlaylistId: d.currentPlaylistId,
-			Name:       currentMifasolPlaylist.Name,
-		}
-	} else {
+	if d.currentMifasolPlaylist == nil {
 		return nil
 	}
+	if playlist := d.getPlaylist(d.currentPlaylistId); playlist != nil {
+		return playlist
+	}
+	// The playlist has been removed from the favorites since it started
+	return &Playlist{
+		PlaylistId: d.currentPlaylistId,
+		Name:       d.currentMifasolPlaylist.Name,
+	}
 }
 
 func (d *MifasolPlaylistPlayer) CurrentSongName() string {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
-	currentMifasolPlaylist := d.getMifasolPlaylist(d.currentPlaylistId)
+	currentMifasolPlaylist := d.currentMifasolPlaylist
 
-	if currentMifasolPlaylist != nil && d.currentPlaylistPosition < int64(len(currentMifasolPlaylist.SongIds)) {
+	if currentMifasolPlaylist != nil && d.currentPlaylistPosition < int64(len(d.currentPlaylistOrder)) {
 		return d.currentSongName
 	} else {
 		return ""
@@ -238,15 +679,38 @@ func (d *MifasolPlaylistPlayer) Clear() {
 	d.clear()
 }
 
+// saveResume records the current song and the position in it, to resume the playlist later
+func (d *MifasolPlaylistPlayer) saveResume() {
+	currentMifasolPlaylist := d.currentMifasolPlaylist
+	if currentMifasolPlaylist == nil {
+		return
+	}
+	d.serverState.SetPlaylistResume(
+		mifasolPlaylistId(currentMifasolPlaylist),
+		newPlaylistResume(mifasolSongKeys(currentMifasolPlaylist), d.currentPlaylistOrder, d.currentPlaylistPosition, d.position(), d.currentPlayMode),
+	)
+}
+
+func mifasolSongKeys(mifasolPlaylist *restApiV1.Playlist) []string {
+	songKeys := make([]string, len(mifasolPlaylist.SongIds))
+	for i, songId := range mifasolPlaylist.SongIds {
+		songKeys[i] = string(songId)
+	}
+	return songKeys
+}
+
 func (d *MifasolPlaylistPlayer) clear() {
-	if d.currentPlaylistId > 0 {
-		if d.currentPlaylistCmd != nil {
-			if err := d.currentPlaylistCmd.Process.Kill(); err != nil {
-				logrus.Errorf("Failed to kill process: %v", err)
-			}
+	// Drop the song being requested
+	d.songRequest++
+	if d.currentPlaylistId != "" {
+		if d.currentPlaylistPlayback != nil {
+			d.saveResume()
+			d.currentPlaylistPlayback.Stop()
 		}
-		d.currentPlaylistCmd = nil
-		d.currentPlaylistId = 0
+		d.currentPlaylistPlayback = nil
+		d.currentMifasolPlaylist = nil
+		d.currentPlaylistId = ""
+		d.currentPlaylistOrder = nil
 		d.currentPlaylistPosition = 0
 		d.currentSongName = ""
 	}
@@ -255,8 +719,97 @@ func (d *MifasolPlaylistPlayer) clear() {
 func (d *MifasolPlaylistPlayer) NextSong() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	if d.currentPlaylistId > 0 {
-		d.currentPlaylistPosition++
+
+	d.nextSong()
+}
+
+func (d *MifasolPlaylistPlayer) nextSong() {
+	if d.currentPlaylistId != "" {
+		d.currentPlaylistPosition = nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode, true)
+		d.playSong()
+	}
+}
+
+func (d *MifasolPlaylistPlayer) PreviousSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlaylistId != "" {
+		if d.position() < previousSongThreshold {
+			d.currentPlaylistPosition = previousPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode)
+		}
 		d.playSong()
 	}
 }
+
+// Seek downloads the song again, the part before the new position being decoded and dropped
+func (d *MifasolPlaylistPlayer) Seek(offset time.Duration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlaylistPlayback == nil {
+		return fmt.Errorf("No song is playing")
+	}
+	start := d.position() + offset
+	if start < 0 {
+		start = 0
+	}
+	logrus.Infof("Seek to %v", start.Round(time.Second))
+	d.playSongFrom(start)
+
+	return nil
+}
+
+func (d *MifasolPlaylistPlayer) Position() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.position()
+}
+
+func (d *MifasolPlaylistPlayer) position() time.Duration {
+	if d.currentPlaylistPlayback == nil {
+		return 0
+	}
+	return d.currentSongStart + d.currentPlaylistPlayback.Position()
+}
+
+// Duration is unknown for mifasol songs, which are streamed
+func (d *MifasolPlaylistPlayer) Duration() time.Duration {
+	return 0
+}
+
+func (d *MifasolPlaylistPlayer) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	mifasolPlaylist := d.getMifasolPlaylist(playlistId)
+	if mifasolPlaylist == nil {
+		return apimodel.ShufflePlayMode
+	}
+	return d.serverState.PlayMode(playlistId)
+}
+
+func (d *MifasolPlaylistPlayer) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !playMode.IsValid() {
+		return fmt.Errorf("Play mode %s is undefined", playMode)
+	}
+	mifasolPlaylist := d.getMifasolPlaylist(playlistId)
+	if mifasolPlaylist == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	logrus.Infof("Set play mode of playlist \"%s\" to %s", mifasolPlaylist.Name, playMode)
+	d.serverState.SetPlayMode(playlistId, playMode)
+
+	// Apply the new play mode to the songs still to be played
+	if d.currentPlaylistId == playlistId && d.currentPlayMode != playMode {
+		d.currentPlaylistPosition = reorder(d.currentPlaylistOrder, d.currentPlaylistPosition, playMode)
+		d.currentPlayMode = playMode
+		d.saveResume()
+	}
+
+	return nil
+}
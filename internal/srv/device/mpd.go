@@ -0,0 +1,640 @@
+package device
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Protocol version announced to the clients
+const mpdProtocolVersion = "0.21.0"
+
+// Delay between two state checks of an idle client
+const mpdIdlePollPeriod = 500 * time.Millisecond
+
+// Error codes of the ACK responses
+const (
+	mpdAckErrorArg        = 2
+	mpdAckErrorPassword   = 3
+	mpdAckErrorPermission = 4
+	mpdAckErrorUnknown    = 5
+	mpdAckErrorNoExist    = 50
+	mpdAckErrorSystem     = 52
+)
+
+// Mpd serves a subset of the Music Player Daemon protocol: the queue is made of the song or the webradio being
+// played, and the stored playlists are the playlists of the playlist player
+type Mpd struct {
+	lock         sync.Mutex
+	eventChannel chan event.ApiEvent
+	mpdParam     *config.MpdParam
+
+	listener    net.Listener
+	connections map[net.Conn]bool
+	quit        chan struct{}
+}
+
+// mpdSession is the state of a client connection
+type mpdSession struct {
+	authenticated bool
+	// Playlist loaded into the queue, played by the next play command
+	loadedPlaylistId *apimodel.PlaylistId
+}
+
+type mpdError struct {
+	code    int
+	message string
+}
+
+func (e *mpdError) Error() string {
+	return e.message
+}
+
+type mpdCommand func(d *Mpd, session *mpdSession, args []string) (string, error)
+
+var mpdCommands map[string]mpdCommand
+
+func init() {
+	// Set in init to let the commands command list them
+	mpdCommands = map[string]mpdCommand{
+		"clear":         (*Mpd).stopCommand,
+		"close":         nil,
+		"commands":      (*Mpd).commandsCommand,
+		"currentsong":   (*Mpd).currentSongCommand,
+		"idle":          nil,
+		"listplaylists": (*Mpd).listPlaylistsCommand,
+		"load":          (*Mpd).loadCommand,
+		"next":          (*Mpd).nextCommand,
+		"noidle":        (*Mpd).pingCommand,
+		"notcommands":   (*Mpd).pingCommand,
+		"outputs":       (*Mpd).outputsCommand,
+		"password":      nil,
+		"pause":         (*Mpd).pauseCommand,
+		"ping":          (*Mpd).pingCommand,
+		"play":          (*Mpd).playCommand,
+		"playlistinfo":  (*Mpd).currentSongCommand,
+		"previous":      (*Mpd).previousCommand,
+		"setvol":        (*Mpd).setVolCommand,
+		"status":        (*Mpd).statusCommand,
+		"stop":          (*Mpd).stopCommand,
+		"tagtypes":      (*Mpd).pingCommand,
+	}
+}
+
+func NewMpd(config *config.ServerConfig) *Mpd {
+	return &Mpd{
+		eventChannel: make(chan event.ApiEvent),
+		mpdParam:     config.MpdParam,
+		connections:  make(map[net.Conn]bool),
+		quit:         make(chan struct{}),
+	}
+}
+
+// Start listens to the MPD clients, when the MPD protocol is enabled
+func (d *Mpd) Start() {
+	if d.mpdParam == nil {
+		return
+	}
+	logrus.Infof("Start MPD device")
+
+	listener, err := net.Listen("tcp", ":"+strconv.FormatInt(d.mpdParam.Port, 10))
+	if err != nil {
+		logrus.Errorf("Unable to listen to MPD clients: %v", err)
+		return
+	}
+	d.lock.Lock()
+	d.listener = listener
+	d.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-d.quit:
+				default:
+					logrus.Errorf("Unable to accept MPD client: %v", err)
+				}
+				return
+			}
+			d.lock.Lock()
+			d.connections[conn] = true
+			d.lock.Unlock()
+			go d.serve(conn)
+		}
+	}()
+}
+
+// StopSendingEvent closes the listener and the client connections
+func (d *Mpd) StopSendingEvent() {
+	if d.mpdParam == nil {
+		return
+	}
+	logrus.Infof("Stop MPD device")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	close(d.quit)
+	if d.listener != nil {
+		d.listener.Close()
+	}
+	for conn := range d.connections {
+		conn.Close()
+	}
+}
+
+func (d *Mpd) EventChannel() chan event.ApiEvent {
+	return d.eventChannel
+}
+
+// sendEvent asks the event loop to execute a request
+func (d *Mpd) sendEvent(data interface{}) error {
+	result := make(chan error, 1)
+	select {
+	case d.eventChannel <- event.ApiEvent{Result: result, Data: data}:
+	case <-d.quit:
+		return &mpdError{code: mpdAckErrorSystem, message: "Server stopping"}
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-d.quit:
+		return &mpdError{code: mpdAckErrorSystem, message: "Server stopping"}
+	}
+}
+
+func (d *Mpd) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		d.lock.Lock()
+		delete(d.connections, conn)
+		d.lock.Unlock()
+	}()
+	logrus.Debugf("MPD client connected from %s", conn.RemoteAddr())
+
+	// Lines are read in background, to detect the noidle command while idle
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-d.quit:
+				return
+			}
+		}
+	}()
+
+	session := mpdSession{authenticated: d.mpdParam.Password == ""}
+	writer := bufio.NewWriter(conn)
+	io.WriteString(writer, "OK MPD "+mpdProtocolVersion+"\n")
+	writer.Flush()
+
+	for line := range lines {
+		args, err := splitMpdArgs(line)
+		if err != nil {
+			writeMpdAck(writer, 0, "", &mpdError{code: mpdAckErrorArg, message: err.Error()})
+			writer.Flush()
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "close":
+			return
+		case "command_list_begin", "command_list_ok_begin":
+			listOk := args[0] == "command_list_ok_begin"
+			var commandList [][]string
+			// Index of the first line that can't be parsed, -1 when the whole list is valid
+			invalidIndex := -1
+			var invalidErr error
+			ended := false
+			for line := range lines {
+				args, err := splitMpdArgs(line)
+				if err == nil && len(args) > 0 && args[0] == "command_list_end" {
+					ended = true
+					break
+				}
+				if err != nil && invalidIndex < 0 {
+					invalidIndex = len(commandList)
+					invalidErr = err
+				}
+				if invalidIndex < 0 && len(args) > 0 {
+					commandList = append(commandList, args)
+				}
+			}
+			if !ended {
+				// Client gone before the end of the list: nothing is run
+				return
+			}
+			if invalidIndex >= 0 {
+				// Nothing is run when a line of the list is invalid
+				writeMpdAck(writer, invalidIndex, "", &mpdError{code: mpdAckErrorArg, message: invalidErr.Error()})
+			} else {
+				d.executeList(writer, &session, commandList, listOk)
+			}
+		case "idle":
+			if !session.authenticated {
+				writeMpdAck(writer, 0, args[0], &mpdError{code: mpdAckErrorPermission, message: "you don't have permission for \"idle\""})
+			} else if !d.idle(writer, lines, args[1:]) {
+				return
+			}
+		default:
+			d.executeList(writer, &session, [][]string{args}, false)
+		}
+		writer.Flush()
+	}
+	logrus.Debugf("MPD client %s disconnected", conn.RemoteAddr())
+}
+
+// executeList runs commands one after the other, stopping at the first error
+func (d *Mpd) executeList(writer *bufio.Writer, session *mpdSession, commandList [][]string, listOk bool) {
+	for i, args := range commandList {
+		output, err := d.execute(session, args)
+		if err != nil {
+			writeMpdAck(writer, i, args[0], err)
+			return
+		}
+		io.WriteString(writer, output)
+		if listOk {
+			io.WriteString(writer, "list_OK\n")
+		}
+	}
+	io.WriteString(writer, "OK\n")
+}
+
+func (d *Mpd) execute(session *mpdSession, args []string) (string, error) {
+	name := args[0]
+	if name == "password" {
+		if len(args) != 2 {
+			return "", &mpdError{code: mpdAckErrorArg, message: "wrong number of arguments for \"password\""}
+		}
+		if args[1] != d.mpdParam.Password {
+			return "", &mpdError{code: mpdAckErrorPassword, message: "incorrect password"}
+		}
+		session.authenticated = true
+		return "", nil
+	}
+
+	command, ok := mpdCommands[name]
+	if !ok || command == nil {
+		return "", &mpdError{code: mpdAckErrorUnknown, message: fmt.Sprintf("unknown command \"%s\"", name)}
+	}
+	if !session.authenticated && name != "ping" {
+		return "", &mpdError{code: mpdAckErrorPermission, message: fmt.Sprintf("you don't have permission for \"%s\"", name)}
+	}
+	logrus.Debugf("MPD command: %s", name)
+	return command(d, session, args[1:])
+}
+
+func writeMpdAck(writer *bufio.Writer, index int, command string, err error) {
+	code := mpdAckErrorSystem
+	if mpdErr, ok := err.(*mpdError); ok {
+		code = mpdErr.code
+	}
+	fmt.Fprintf(writer, "ACK [%d@%d] {%s} %s\n", code, index, command, err.Error())
+}
+
+// splitMpdArgs splits a command line into its arguments, double quoted arguments using backslash escapes
+func splitMpdArgs(line string) ([]string, error) {
+	var args []string
+	for i := 0; i < len(line); {
+		switch {
+		case line[i] == ' ' || line[i] == '\t':
+			i++
+		case line[i] == '"':
+			var arg strings.Builder
+			i++
+			for ; i < len(line) && line[i] != '"'; i++ {
+				if line[i] == '\\' && i+1 < len(line) {
+					i++
+				}
+				arg.WriteByte(line[i])
+			}
+			if i >= len(line) {
+				return nil, fmt.Errorf("missing closing '\"'")
+			}
+			i++
+			args = append(args, arg.String())
+		default:
+			start := i
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			args = append(args, line[start:i])
+		}
+	}
+	return args, nil
+}
+
+// idle waits for a change of one of the given subsystems, or for the noidle command. It returns false when the
+// client is gone.
+func (d *Mpd) idle(writer *bufio.Writer, lines chan string, subsystems []string) bool {
+	writer.Flush()
+
+	var initialState apimodel.State
+	if err := d.sendEvent(event.ApiEventStateData{State: &initialState}); err != nil {
+		return false
+	}
+
+	ticker := time.NewTicker(mpdIdlePollPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			if strings.TrimSpace(line) != "noidle" {
+				logrus.Debugf("Unexpected MPD command while idle: %s", line)
+				return false
+			}
+			io.WriteString(writer, "OK\n")
+			return true
+		case <-ticker.C:
+			var state apimodel.State
+			if err := d.sendEvent(event.ApiEventStateData{State: &state}); err != nil {
+				return false
+			}
+			changes := mpdChanges(&initialState, &state, subsystems)
+			if len(changes) > 0 {
+				for _, change := range changes {
+					io.WriteString(writer, "changed: "+change+"\n")
+				}
+				io.WriteString(writer, "OK\n")
+				return true
+			}
+		case <-d.quit:
+			return false
+		}
+	}
+}
+
+// mpdChanges lists the subsystems, among the wanted ones (all of them when empty), changed between two states
+func mpdChanges(previous *apimodel.State, current *apimodel.State, subsystems []string) []string {
+	var changes []string
+	if mpdQueueVersion(previous) != mpdQueueVersion(current) {
+		changes = append(changes, "playlist")
+	}
+	if mpdQueueVersion(previous) != mpdQueueVersion(current) || mpdSongName(previous) != mpdSongName(current) {
+		changes = append(changes, "player")
+	}
+	if previous.Volume != current.Volume {
+		changes = append(changes, "mixer")
+	}
+	if previous.Playlist != nil && current.Playlist != nil && previous.Playlist.PlayMode != current.Playlist.PlayMode {
+		changes = append(changes, "options")
+	}
+
+	if len(subsystems) == 0 {
+		return changes
+	}
+	var wantedChanges []string
+	for _, change := range changes {
+		for _, subsystem := range subsystems {
+			if change == subsystem {
+				wantedChanges = append(wantedChanges, change)
+			}
+		}
+	}
+	return wantedChanges
+}
+
+// mpdQueueVersion identifies the content of the queue: the webradio or the playlist being played
+func mpdQueueVersion(state *apimodel.State) uint32 {
+	switch {
+	case state.Webradio != nil:
+		return crc32.ChecksumIEEE([]byte(fmt.Sprintf("webradio:%d.%d", state.Webradio.WebradioId.GroupId, state.Webradio.WebradioId.IndexId)))
+	case state.Playlist != nil:
+		return crc32.ChecksumIEEE([]byte("playlist:" + string(state.Playlist.PlaylistId)))
+	default:
+		return 0
+	}
+}
+
+func mpdSongName(state *apimodel.State) string {
+	switch {
+	case state.Webradio != nil:
+		return state.Webradio.Name
+	case state.Playlist != nil:
+		return state.Playlist.Song
+	default:
+		return ""
+	}
+}
+
+// mpdLine formats a response line, new lines being removed from the value
+func mpdLine(key string, value string) string {
+	return key + ": " + strings.NewReplacer("\n", " ", "\r", " ").Replace(value) + "\n"
+}
+
+func (d *Mpd) state() (*apimodel.State, error) {
+	var state apimodel.State
+	err := d.sendEvent(event.ApiEventStateData{State: &state})
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (d *Mpd) pingCommand(session *mpdSession, args []string) (string, error) {
+	return "", nil
+}
+
+func (d *Mpd) commandsCommand(session *mpdSession, args []string) (string, error) {
+	var names []string
+	for name := range mpdCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var output strings.Builder
+	for _, name := range names {
+		output.WriteString(mpdLine("command", name))
+	}
+	return output.String(), nil
+}
+
+func (d *Mpd) outputsCommand(session *mpdSession, args []string) (string, error) {
+	return mpdLine("outputid", "0") + mpdLine("outputname", "Vekigi") + mpdLine("outputenabled", "1"), nil
+}
+
+func (d *Mpd) statusCommand(session *mpdSession, args []string) (string, error) {
+	state, err := d.state()
+	if err != nil {
+		return "", err
+	}
+
+	random, repeat, single := "0", "0", "0"
+	if state.Playlist != nil {
+		switch state.Playlist.PlayMode {
+		case apimodel.ShufflePlayMode:
+			random = "1"
+		case apimodel.RepeatAllPlayMode:
+			repeat = "1"
+		case apimodel.RepeatOnePlayMode:
+			repeat, single = "1", "1"
+		}
+	}
+
+	var output strings.Builder
+	output.WriteString(mpdLine("volume", strconv.FormatInt(state.Volume, 10)))
+	output.WriteString(mpdLine("repeat", repeat))
+	output.WriteString(mpdLine("random", random))
+	output.WriteString(mpdLine("single", single))
+	output.WriteString(mpdLine("consume", "0"))
+	output.WriteString(mpdLine("playlist", strconv.FormatUint(uint64(mpdQueueVersion(state)), 10)))
+	if state.Webradio == nil && state.Playlist == nil {
+		output.WriteString(mpdLine("playlistlength", "0"))
+		output.WriteString(mpdLine("state", "stop"))
+		return output.String(), nil
+	}
+
+	output.WriteString(mpdLine("playlistlength", "1"))
+	output.WriteString(mpdLine("state", "play"))
+	output.WriteString(mpdLine("song", "0"))
+	output.WriteString(mpdLine("songid", "1"))
+	if state.Playlist != nil {
+		output.WriteString(mpdLine("time", fmt.Sprintf("%d:%d", int64(state.Playlist.Position), int64(state.Playlist.Duration))))
+		output.WriteString(mpdLine("elapsed", strconv.FormatFloat(state.Playlist.Position, 'f', 3, 64)))
+		if state.Playlist.Duration > 0 {
+			output.WriteString(mpdLine("duration", strconv.FormatFloat(state.Playlist.Duration, 'f', 3, 64)))
+		}
+	}
+	return output.String(), nil
+}
+
+func (d *Mpd) currentSongCommand(session *mpdSession, args []string) (string, error) {
+	state, err := d.state()
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	switch {
+	case state.Webradio != nil:
+		output.WriteString(mpdLine("file", fmt.Sprintf("webradio/%d/%d", state.Webradio.WebradioId.GroupId, state.Webradio.WebradioId.IndexId)))
+		output.WriteString(mpdLine("Name", state.Webradio.Name))
+		output.WriteString(mpdLine("Title", state.Webradio.Name))
+	case state.Playlist != nil:
+		output.WriteString(mpdLine("file", "playlist/"+string(state.Playlist.PlaylistId)))
+		output.WriteString(mpdLine("Title", state.Playlist.Song))
+		output.WriteString(mpdLine("Album", state.Playlist.Name))
+		if state.Playlist.Duration > 0 {
+			output.WriteString(mpdLine("Time", strconv.FormatInt(int64(state.Playlist.Duration), 10)))
+			output.WriteString(mpdLine("duration", strconv.FormatFloat(state.Playlist.Duration, 'f', 3, 64)))
+		}
+	default:
+		return "", nil
+	}
+	output.WriteString(mpdLine("Pos", "0"))
+	output.WriteString(mpdLine("Id", "1"))
+	return output.String(), nil
+}
+
+func (d *Mpd) playlists() ([]apimodel.Playlist, error) {
+	var playlists []apimodel.Playlist
+	err := d.sendEvent(event.ApiEventPlaylistListData{Playlists: &playlists})
+	return playlists, err
+}
+
+func (d *Mpd) listPlaylistsCommand(session *mpdSession, args []string) (string, error) {
+	playlists, err := d.playlists()
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	for _, playlist := range playlists {
+		output.WriteString(mpdLine("playlist", playlist.Name))
+	}
+	return output.String(), nil
+}
+
+// loadCommand replaces the queue by a playlist, designated by its name or its id, which is played by the next play
+// command
+func (d *Mpd) loadCommand(session *mpdSession, args []string) (string, error) {
+	if len(args) < 1 {
+		return "", &mpdError{code: mpdAckErrorArg, message: "wrong number of arguments for \"load\""}
+	}
+	playlists, err := d.playlists()
+	if err != nil {
+		return "", err
+	}
+	for _, playlist := range playlists {
+		if playlist.Name == args[0] || string(playlist.PlaylistId) == args[0] {
+			playlistId := playlist.PlaylistId
+			session.loadedPlaylistId = &playlistId
+			return "", nil
+		}
+	}
+	return "", &mpdError{code: mpdAckErrorNoExist, message: "No such playlist"}
+}
+
+// playCommand plays the loaded playlist, or resumes what was played last when nothing is playing
+func (d *Mpd) playCommand(session *mpdSession, args []string) (string, error) {
+	var err error
+	if session.loadedPlaylistId != nil {
+		err = d.sendEvent(event.ApiEventPlaylistPlayData{PlaylistId: *session.loadedPlaylistId})
+		session.loadedPlaylistId = nil
+	} else {
+		err = d.sendEvent(event.ApiEventResumeData{})
+	}
+	return "", err
+}
+
+func (d *Mpd) stopCommand(session *mpdSession, args []string) (string, error) {
+	return "", d.sendEvent(event.ApiEventStopData{})
+}
+
+// pauseCommand stops the playback, played again from where it was left when resumed
+func (d *Mpd) pauseCommand(session *mpdSession, args []string) (string, error) {
+	var pause bool
+	if len(args) > 0 {
+		pause = args[0] == "1"
+	} else {
+		state, err := d.state()
+		if err != nil {
+			return "", err
+		}
+		pause = state.Webradio != nil || state.Playlist != nil
+	}
+	if pause {
+		return d.stopCommand(session, nil)
+	}
+	return d.playCommand(session, nil)
+}
+
+func (d *Mpd) nextCommand(session *mpdSession, args []string) (string, error) {
+	return "", d.sendEvent(event.ApiEventPlaylistNextData{})
+}
+
+func (d *Mpd) previousCommand(session *mpdSession, args []string) (string, error) {
+	return "", d.sendEvent(event.ApiEventPlaylistPreviousData{})
+}
+
+func (d *Mpd) setVolCommand(session *mpdSession, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", &mpdError{code: mpdAckErrorArg, message: "wrong number of arguments for \"setvol\""}
+	}
+	volume, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil || volume < 0 || volume > 100 {
+		return "", &mpdError{code: mpdAckErrorArg, message: "Invalid volume value"}
+	}
+	return "", d.sendEvent(event.ApiEventAudioVolumeData{Volume: volume})
+}
@@ -0,0 +1,236 @@
+package device
+
+import (
+	"bufio"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMpdEventLoop answers the events of the MPD device as the event loop does, from a state changed by the volume
+// events
+type fakeMpdEventLoop struct {
+	lock          sync.Mutex
+	state         apimodel.State
+	volumeEvents  int
+	stateRequests int
+}
+
+func (l *fakeMpdEventLoop) run(d *Mpd) {
+	for {
+		select {
+		case ev := <-d.EventChannel():
+			l.lock.Lock()
+			switch data := ev.Data.(type) {
+			case event.ApiEventStateData:
+				*data.State = l.state
+				l.stateRequests++
+			case event.ApiEventAudioVolumeData:
+				l.state.Volume = data.Volume
+				l.volumeEvents++
+			}
+			l.lock.Unlock()
+			ev.Result <- nil
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+func (l *fakeMpdEventLoop) setVolume(volume int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.state.Volume = volume
+}
+
+func (l *fakeMpdEventLoop) stateRequestCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.stateRequests
+}
+
+func (l *fakeMpdEventLoop) volume() (int64, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.state.Volume, l.volumeEvents
+}
+
+// mpdClient is the client side of a connection served by the MPD device
+type mpdClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestMpdClient(t *testing.T, password string) (*mpdClient, *fakeMpdEventLoop) {
+	d := NewMpd(&config.ServerConfig{ServerParam: &config.ServerParam{MpdParam: &config.MpdParam{Password: password}}})
+	eventLoop := &fakeMpdEventLoop{state: apimodel.State{Volume: 50}}
+	go eventLoop.run(d)
+
+	serverConn, clientConn := net.Pipe()
+	d.connections[serverConn] = true
+	go d.serve(serverConn)
+	t.Cleanup(func() {
+		clientConn.Close()
+		d.StopSendingEvent()
+	})
+
+	client := &mpdClient{t: t, conn: clientConn, reader: bufio.NewReader(clientConn)}
+	client.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if greeting := client.readLine(); greeting != "OK MPD "+mpdProtocolVersion {
+		t.Fatalf("Greeting \"%s\"", greeting)
+	}
+	return client, eventLoop
+}
+
+func (c *mpdClient) readLine() string {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimSuffix(line, "\n")
+}
+
+// send writes the request lines and returns the response lines, up to the final OK or ACK line
+func (c *mpdClient) send(lines ...string) []string {
+	for _, line := range lines {
+		_, err := c.conn.Write([]byte(line + "\n"))
+		if err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	var response []string
+	for {
+		line := c.readLine()
+		response = append(response, line)
+		if line == "OK" || strings.HasPrefix(line, "ACK ") {
+			return response
+		}
+	}
+}
+
+func TestSplitMpdArgs(t *testing.T) {
+	for _, test := range []struct {
+		line         string
+		expectedArgs []string
+		expectedErr  bool
+	}{
+		{line: "play", expectedArgs: []string{"play"}},
+		{line: "  setvol \t 50 ", expectedArgs: []string{"setvol", "50"}},
+		{line: `load "Morning songs"`, expectedArgs: []string{"load", "Morning songs"}},
+		{line: `load "say \"hi\" \\ bye"`, expectedArgs: []string{"load", `say "hi" \ bye`}},
+		{line: `load ""`, expectedArgs: []string{"load", ""}},
+		{line: ""},
+		{line: `load "Morning`, expectedErr: true},
+	} {
+		args, err := splitMpdArgs(test.line)
+		if (err != nil) != test.expectedErr {
+			t.Errorf("Line %s: error %v", test.line, err)
+			continue
+		}
+		if strings.Join(args, "|") != strings.Join(test.expectedArgs, "|") || len(args) != len(test.expectedArgs) {
+			t.Errorf("Line %s split as %q, expected %q", test.line, args, test.expectedArgs)
+		}
+	}
+}
+
+func TestMpdCommandList(t *testing.T) {
+	client, eventLoop := newTestMpdClient(t, "")
+
+	response := client.send("command_list_ok_begin", "setvol 30", "status", "command_list_end")
+	if strings.Count(strings.Join(response, "\n"), "list_OK") != 2 || response[len(response)-1] != "OK" {
+		t.Errorf("Response %q, expected a list_OK by command", response)
+	}
+	if !strings.Contains(strings.Join(response, "\n"), "volume: 30") {
+		t.Errorf("Response %q, expected the volume set by the first command", response)
+	}
+
+	// Stopped at the first failing command
+	response = client.send("command_list_begin", "setvol 40", "setvol 200", "setvol 60", "command_list_end")
+	if len(response) != 1 || response[0] != "ACK [2@1] {setvol} Invalid volume value" {
+		t.Errorf("Response %q, expected the error of the second command", response)
+	}
+	if volume, _ := eventLoop.volume(); volume != 40 {
+		t.Errorf("Volume %d, expected 40", volume)
+	}
+}
+
+func TestMpdCommandListParseError(t *testing.T) {
+	client, eventLoop := newTestMpdClient(t, "")
+
+	// Nothing is run, the lines following the invalid one being part of the list
+	response := client.send("command_list_begin", "setvol 20", `load "Morning`, "setvol 10", "command_list_end")
+	if len(response) != 1 || response[0] != `ACK [2@1] {} missing closing '"'` {
+		t.Errorf("Response %q, expected the parse error of the second line", response)
+	}
+	if volume, volumeEvents := eventLoop.volume(); volume != 50 || volumeEvents != 0 {
+		t.Errorf("Volume set to %d by %d commands, expected none run", volume, volumeEvents)
+	}
+
+	// Back to top level commands
+	response = client.send("ping")
+	if len(response) != 1 || response[0] != "OK" {
+		t.Errorf("Response %q to ping", response)
+	}
+}
+
+func TestMpdPassword(t *testing.T) {
+	client, _ := newTestMpdClient(t, "secret")
+
+	for _, exchange := range []struct {
+		request          string
+		expectedResponse string
+	}{
+		{request: "status", expectedResponse: `ACK [4@0] {status} you don't have permission for "status"`},
+		{request: "idle", expectedResponse: `ACK [4@0] {idle} you don't have permission for "idle"`},
+		{request: "ping", expectedResponse: "OK"},
+		{request: "password wrong", expectedResponse: "ACK [3@0] {password} incorrect password"},
+		{request: "password", expectedResponse: `ACK [2@0] {password} wrong number of arguments for "password"`},
+		{request: "password secret", expectedResponse: "OK"},
+		{request: "setvol 70", expectedResponse: "OK"},
+		{request: "unknown", expectedResponse: `ACK [5@0] {unknown} unknown command "unknown"`},
+	} {
+		response := client.send(exchange.request)
+		if response[len(response)-1] != exchange.expectedResponse {
+			t.Errorf("Response %q to %s, expected %s", response, exchange.request, exchange.expectedResponse)
+		}
+	}
+}
+
+func TestMpdIdle(t *testing.T) {
+	client, eventLoop := newTestMpdClient(t, "")
+
+	// Answered once the volume changes
+	_, err := client.conn.Write([]byte("idle mixer player\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for eventLoop.stateRequestCount() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	eventLoop.setVolume(80)
+	response := client.send()
+	if strings.Join(response, "|") != "changed: mixer|OK" {
+		t.Errorf("Response %q, expected a mixer change", response)
+	}
+
+	// Or when the client cancels it
+	_, err = client.conn.Write([]byte("idle\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response = client.send("noidle")
+	if len(response) != 1 || response[0] != "OK" {
+		t.Errorf("Response %q to noidle", response)
+	}
+	response = client.send("ping")
+	if len(response) != 1 || response[0] != "OK" {
+		t.Errorf("Response %q to ping after idle", response)
+	}
+}
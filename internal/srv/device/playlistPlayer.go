@@ -2,12 +2,22 @@ package device
 
 import (
 	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/event"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
 )
 
+// PreviousSong restarts the current song when it has been played longer than this threshold
+const previousSongThreshold = 3 * time.Second
+
 type Playlist struct {
 	PlaylistId apimodel.PlaylistId
 	Name       string
+	// Position of the playlist in the order followed by the playlist button, starting at 1
+	Index int64
 }
 
 type PlaylistPlayer interface {
@@ -17,9 +27,201 @@ type PlaylistPlayer interface {
 	EventChannel() chan event.PlaylistEvent
 	PlaylistCount() int64
 	GetPlaylist(playlistId apimodel.PlaylistId) *Playlist
+	// GetPlaylistByIndex returns the playlist at the given position in the playlist button order
+	GetPlaylistByIndex(index int64) *Playlist
+	// NextPlaylist returns the playlist following the given one in the playlist button order, the first playlist when
+	// the given one is nil, unknown or the last one
+	NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist
+	// Refresh reads the playlists again
+	Refresh() error
+	// ConnectionError returns the reason why the playlists are unreachable, nil when they are available
+	ConnectionError() error
 	Play(playlistId apimodel.PlaylistId) error
 	CurrentPlaylist() *Playlist
 	CurrentSongName() string
 	Clear()
 	NextSong()
+	PreviousSong()
+	// Seek moves forward in the current song, or backward with a negative offset
+	Seek(offset time.Duration) error
+	// Position returns the position in the current song
+	Position() time.Duration
+	// Duration returns the duration of the current song, 0 when unknown
+	Duration() time.Duration
+	PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode
+	SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error
+}
+
+// LegacyPlaylistIndexer is implemented by the players whose playlists were identified by their position in previous
+// versions
+type LegacyPlaylistIndexer interface {
+	// LegacyPlaylistId returns the id of the playlist at the given position in the numbering of previous versions, nil
+	// when there is none. ready is false as long as the playlists aren't loaded.
+	LegacyPlaylistId(index int64) (playlistId *apimodel.PlaylistId, ready bool)
+}
+
+// playlistIdPrefixes lists the prefixes of the playlist ids of every player, which tell the players apart
+var playlistIdPrefixes = []string{
+	localPlaylistIdPrefix,
+	mifasolPlaylistIdPrefix,
+	subsonicPlaylistIdPrefix,
+	upnpPlaylistIdPrefix,
+	podcastPlaylistIdPrefix,
+}
+
+// PrefixedPlaylistId returns the id of a local or mifasol playlist saved without prefix by previous versions: the
+// local playlist with that name when there is one, or the mifasol playlist with that id when mifasol is used. ok is
+// false when the id is already prefixed.
+func PrefixedPlaylistId(playlistId apimodel.PlaylistId, playlistPlayer PlaylistPlayer, mifasol bool) (apimodel.PlaylistId, bool) {
+	for _, prefix := range playlistIdPrefixes {
+		if strings.HasPrefix(string(playlistId), prefix) {
+			return playlistId, false
+		}
+	}
+	localPlaylistId := localPlaylistId(string(playlistId))
+	if !mifasol || playlistPlayer.GetPlaylist(localPlaylistId) != nil {
+		return localPlaylistId, true
+	}
+	return apimodel.PlaylistId(mifasolPlaylistIdPrefix + string(playlistId)), true
+}
+
+// nextPlaylist returns the playlist following the given one among playlists sorted by index
+func nextPlaylist(playlists []Playlist, playlistId *apimodel.PlaylistId) *Playlist {
+	if len(playlists) == 0 {
+		return nil
+	}
+	if playlistId != nil {
+		for i := range playlists {
+			if playlists[i].PlaylistId == *playlistId && i+1 < len(playlists) {
+				return &playlists[i+1]
+			}
+		}
+	}
+	return &playlists[0]
+}
+
+// playOrder returns the indexes of the playlist songs in the order they are played
+func playOrder(songCount int, playMode apimodel.PlayMode) []int {
+	order := make([]int, songCount)
+	for i := range order {
+		order[i] = i
+	}
+	if playMode == apimodel.ShufflePlayMode {
+		rand.Shuffle(len(order), func(i, j int) {
+			order[i], order[j] = order[j], order[i]
+		})
+	}
+	return order
+}
+
+// reorder applies a new play mode to a playlist being played: the songs following the current one are shuffled, or
+// the whole playlist is sorted back. It returns the new position of the current song.
+func reorder(order []int, position int64, playMode apimodel.PlayMode) int64 {
+	if position < 0 || position >= int64(len(order)) {
+		return position
+	}
+	if playMode == apimodel.ShufflePlayMode {
+		remaining := order[position+1:]
+		rand.Shuffle(len(remaining), func(i, j int) {
+			remaining[i], remaining[j] = remaining[j], remaining[i]
+		})
+		return position
+	}
+
+	currentSong := order[position]
+	sort.Ints(order)
+	return int64(currentSong)
+}
+
+// nextPosition returns the position of the song following the current one according to the play mode, songCount
+// when the playlist is over. skip is set when the user asked for the next song.
+func nextPosition(position int64, songCount int, playMode apimodel.PlayMode, skip bool) int64 {
+	switch {
+	case playMode == apimodel.RepeatOnePlayMode && !skip:
+		return position
+	case playMode == apimodel.RepeatAllPlayMode || playMode == apimodel.RepeatOnePlayMode:
+		if songCount == 0 {
+			return 0
+		}
+		return (position + 1) % int64(songCount)
+	default:
+		return position + 1
+	}
+}
+
+// previousPosition returns the position of the song preceding the current one according to the play mode
+func previousPosition(position int64, songCount int, playMode apimodel.PlayMode) int64 {
+	switch {
+	case position > 0:
+		return position - 1
+	case (playMode == apimodel.RepeatAllPlayMode || playMode == apimodel.RepeatOnePlayMode) && songCount > 0:
+		return int64(songCount) - 1
+	default:
+		return 0
+	}
+}
+
+// newPlaylistResume builds the resume point of a playlist from its song keys, the play order and the position
+func newPlaylistResume(songKeys []string, order []int, position int64, offset time.Duration, playMode apimodel.PlayMode) config.PlaylistResume {
+	songs := make([]string, len(order))
+	for i, songIndex := range order {
+		songs[i] = songKeys[songIndex]
+	}
+	return config.PlaylistResume{
+		Songs:    songs,
+		Position: position,
+		Offset:   int64(offset / time.Second),
+		PlayMode: playMode,
+	}
+}
+
+// resumeOrder rebuilds the play order, the position and the offset saved in a resume point. Songs removed since are
+// skipped, new songs are played last. It returns false when there is nothing left to resume.
+func resumeOrder(songKeys []string, resume config.PlaylistResume, playMode apimodel.PlayMode) ([]int, int64, time.Duration, bool) {
+	songIndexes := make(map[string]int, len(songKeys))
+	for i, songKey := range songKeys {
+		songIndexes[songKey] = i
+	}
+
+	var order []int
+	used := make(map[int]bool)
+	position := int64(-1)
+	offset := time.Duration(resume.Offset) * time.Second
+	for savedPosition, songKey := range resume.Songs {
+		songIndex, ok := songIndexes[songKey]
+		if !ok || used[songIndex] {
+			continue
+		}
+		if position < 0 && int64(savedPosition) >= resume.Position {
+			if int64(savedPosition) > resume.Position {
+				// The song being played has been removed
+				offset = 0
+			}
+			position = int64(len(order))
+		}
+		order = append(order, songIndex)
+		used[songIndex] = true
+	}
+	if position < 0 {
+		return nil, 0, 0, false
+	}
+
+	var newSongs []int
+	for songIndex := range songKeys {
+		if !used[songIndex] {
+			newSongs = append(newSongs, songIndex)
+		}
+	}
+	if playMode == apimodel.ShufflePlayMode {
+		rand.Shuffle(len(newSongs), func(i, j int) {
+			newSongs[i], newSongs[j] = newSongs[j], newSongs[i]
+		})
+	}
+	order = append(order, newSongs...)
+
+	if playMode != apimodel.ShufflePlayMode || resume.PlayMode != playMode {
+		position = reorder(order, position, playMode)
+	}
+
+	return order, position, offset, true
 }
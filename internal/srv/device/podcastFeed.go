@@ -0,0 +1,167 @@
+package device
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type podcastEpisode struct {
+	Guid      string
+	Title     string
+	Url       string
+	Published time.Time
+	// Duration announced by the feed, 0 when unknown
+	Duration time.Duration
+}
+
+// podcastFeedXml matches both RSS feeds (channel items) and Atom feeds (entries)
+type podcastFeedXml struct {
+	Items   []podcastItemXml  `xml:"channel>item"`
+	Entries []podcastEntryXml `xml:"entry"`
+}
+
+type podcastItemXml struct {
+	Title     string `xml:"title"`
+	Guid      string `xml:"guid"`
+	PubDate   string `xml:"pubDate"`
+	Duration  string `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd duration"`
+	Enclosure struct {
+		Url string `xml:"url,attr"`
+	} `xml:"enclosure"`
+}
+
+type podcastEntryXml struct {
+	Title     string `xml:"title"`
+	Id        string `xml:"id"`
+	Published string `xml:"published"`
+	Updated   string `xml:"updated"`
+	Links     []struct {
+		Rel  string `xml:"rel,attr"`
+		Type string `xml:"type,attr"`
+		Href string `xml:"href,attr"`
+	} `xml:"link"`
+}
+
+// Date layouts met in RSS pubDate elements
+var podcastDateLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	time.RFC3339,
+}
+
+// parsePodcastFeed reads the episodes of a RSS or Atom feed, newest first. Items without audio enclosure are skipped.
+func parsePodcastFeed(content []byte) ([]podcastEpisode, error) {
+	var feed podcastFeedXml
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	decoder.Strict = false
+	decoder.CharsetReader = podcastCharsetReader
+	err := decoder.Decode(&feed)
+	if err != nil {
+		return nil, err
+	}
+
+	var episodes []podcastEpisode
+	for _, item := range feed.Items {
+		if item.Enclosure.Url == "" {
+			continue
+		}
+		episodes = append(episodes, podcastEpisode{
+			Guid:      strings.TrimSpace(item.Guid),
+			Title:     strings.TrimSpace(item.Title),
+			Url:       strings.TrimSpace(item.Enclosure.Url),
+			Published: parsePodcastDate(item.PubDate),
+			Duration:  parsePodcastDuration(item.Duration),
+		})
+	}
+	for _, entry := range feed.Entries {
+		episode := podcastEpisode{
+			Guid:      strings.TrimSpace(entry.Id),
+			Title:     strings.TrimSpace(entry.Title),
+			Published: parsePodcastDate(entry.Published),
+		}
+		if episode.Published.IsZero() {
+			episode.Published = parsePodcastDate(entry.Updated)
+		}
+		for _, link := range entry.Links {
+			if link.Rel == "enclosure" || (episode.Url == "" && strings.HasPrefix(link.Type, "audio/")) {
+				episode.Url = strings.TrimSpace(link.Href)
+			}
+		}
+		if episode.Url == "" {
+			continue
+		}
+		episodes = append(episodes, episode)
+	}
+	if len(feed.Items) == 0 && len(feed.Entries) == 0 {
+		return nil, fmt.Errorf("Neither RSS item nor Atom entry found")
+	}
+
+	for i := range episodes {
+		if episodes[i].Guid == "" {
+			episodes[i].Guid = episodes[i].Url
+		}
+		if episodes[i].Title == "" {
+			episodes[i].Title = episodes[i].Published.Format("2006-01-02")
+		}
+	}
+
+	// Episodes without date keep their place in the feed, after the dated ones
+	sort.SliceStable(episodes, func(i, j int) bool {
+		if episodes[j].Published.IsZero() {
+			return !episodes[i].Published.IsZero()
+		}
+		return episodes[i].Published.After(episodes[j].Published)
+	})
+
+	return episodes, nil
+}
+
+func parsePodcastDate(date string) time.Time {
+	date = strings.TrimSpace(date)
+	for _, layout := range podcastDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// parsePodcastDuration reads an itunes:duration: seconds, MM:SS or HH:MM:SS
+func parsePodcastDuration(duration string) time.Duration {
+	var seconds int64
+	for _, part := range strings.Split(strings.TrimSpace(duration), ":") {
+		value, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + value
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// podcastCharsetReader decodes the Latin-1 feeds, encoding/xml only reading UTF-8
+func podcastCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "iso-8859-15", "latin1", "windows-1252":
+		content, err := ioutil.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		return strings.NewReader(decodeLatin1(string(content))), nil
+	default:
+		return nil, fmt.Errorf("Unsupported charset %s", charset)
+	}
+}
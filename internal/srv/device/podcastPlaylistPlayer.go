@@ -0,0 +1,699 @@
+package device
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Podcast playlist ids are prefixed to never match a local playlist name
+const podcastPlaylistIdPrefix = "podcast:"
+
+const (
+	podcastRefreshPeriod        = time.Hour
+	podcastRetryDelay           = 5 * time.Minute
+	podcastFeedTimeout          = 30 * time.Second
+	podcastDefaultDownloadCount = 3
+	podcastFeedFilename         = "feed.xml"
+)
+
+// PodcastPlaylistPlayer plays the episodes of podcast feeds, each feed being a playlist. Unplayed episodes are played
+// newest first, and the newest of them are downloaded ahead of time to be played even when the feed is unreachable.
+type PodcastPlaylistPlayer struct {
+	lock          sync.Mutex
+	eventChannel  chan event.PlaylistEvent
+	audio         *Audio
+	serverState   *config.ServerState
+	volumeOffsets map[apimodel.PlaylistId]int64
+	podcasts      []*config.Podcast
+	folder        string
+
+	// Episodes of each podcast by podcast name, newest first, as read at the last refresh
+	episodes      map[string][]podcastEpisode
+	connectionErr error
+
+	currentPodcast   *config.Podcast
+	currentEpisodes  []podcastEpisode
+	currentPosition  int64
+	currentSongStart time.Duration
+	currentPlayback  Playback
+
+	sendEvent bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wakeUp chan bool
+	done   chan bool
+}
+
+func NewPodcastPlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio) PlaylistPlayer {
+	ctx, cancel := context.WithCancel(context.Background())
+	playlistPlayer := PodcastPlaylistPlayer{
+		audio:         audio,
+		serverState:   serverConfig.ServerState,
+		volumeOffsets: serverConfig.PlaylistVolumeOffsets,
+		podcasts:      serverConfig.Podcasts,
+		folder:        serverConfig.GetCompletePodcastFolder(),
+		episodes:      make(map[string][]podcastEpisode),
+		connectionErr: fmt.Errorf("Not refreshed yet"),
+		eventChannel:  make(chan event.PlaylistEvent),
+		sendEvent:     true,
+		ctx:           ctx,
+		cancel:        cancel,
+		wakeUp:        make(chan bool, 1),
+		done:          make(chan bool),
+	}
+
+	// Feeds read at the last refresh, playable from the downloaded episodes until the feeds are reached
+	for _, podcast := range playlistPlayer.podcasts {
+		content, err := ioutil.ReadFile(filepath.Join(playlistPlayer.podcastFolder(podcast), podcastFeedFilename))
+		if err != nil {
+			continue
+		}
+		episodes, err := parsePodcastFeed(content)
+		if err != nil {
+			logrus.Warnf("Unable to interpret saved feed of podcast %s: %v", podcast.Name, err)
+			continue
+		}
+		playlistPlayer.episodes[podcast.Name] = episodes
+	}
+
+	return &playlistPlayer
+}
+
+// Start reads the feeds in background and downloads the upcoming episodes, then refreshes them periodically
+func (d *PodcastPlaylistPlayer) Start() {
+	logrus.Infof("Start podcast playlist player device")
+
+	go func() {
+		refresh := true
+		for loop := true; loop; {
+			delay := podcastRefreshPeriod
+			if refresh {
+				err := d.refreshFeeds()
+				if err != nil {
+					logrus.Warnf("Unable to read podcast feeds, next attempt in %v: %v", podcastRetryDelay, err)
+					delay = podcastRetryDelay
+				}
+			}
+			d.download()
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+				refresh = true
+			case <-d.wakeUp:
+				// Only the downloads are updated
+				timer.Stop()
+				refresh = false
+			case <-d.ctx.Done():
+				timer.Stop()
+				loop = false
+			}
+		}
+		d.done <- true
+	}()
+}
+
+// refreshFeeds reads every podcast feed, keeping a copy of them on disk. It fails when no feed can be read.
+func (d *PodcastPlaylistPlayer) refreshFeeds() error {
+	var err error
+	readCount := 0
+	for _, podcast := range d.podcasts {
+		episodes, feedErr := d.readFeed(podcast)
+		if feedErr != nil {
+			logrus.Warnf("Unable to read feed of podcast %s: %v", podcast.Name, feedErr)
+			err = feedErr
+			continue
+		}
+		readCount++
+		logrus.Debugf("%d episodes read for podcast %s", len(episodes), podcast.Name)
+
+		d.lock.Lock()
+		d.episodes[podcast.Name] = episodes
+		d.lock.Unlock()
+	}
+	if readCount > 0 || len(d.podcasts) == 0 {
+		err = nil
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.setConnectionErr(err)
+	return err
+}
+
+// readFeed downloads and parses the feed of a podcast, saving it when it is valid
+func (d *PodcastPlaylistPlayer) readFeed(podcast *config.Podcast) ([]podcastEpisode, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, podcastFeedTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, podcast.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	episodes, err := parsePodcastFeed(content)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(d.podcastFolder(podcast), 0770)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(d.podcastFolder(podcast), podcastFeedFilename), content, 0660)
+	}
+	if err != nil {
+		logrus.Warnf("Unable to save feed of podcast %s: %v", podcast.Name, err)
+	}
+
+	return episodes, nil
+}
+
+// setConnectionErr records the status of the feeds, an event being sent when it changes
+func (d *PodcastPlaylistPlayer) setConnectionErr(err error) {
+	statusChanged := (err == nil) != (d.connectionErr == nil)
+	d.connectionErr = err
+	if statusChanged && d.sendEvent {
+		go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventConnectionData{}} }()
+	}
+}
+
+// wake asks the background loop to update the downloaded episodes
+func (d *PodcastPlaylistPlayer) wake() {
+	select {
+	case d.wakeUp <- true:
+	default:
+	}
+}
+
+// download fetches the newest unplayed episodes of each podcast, and removes the other downloaded episodes
+func (d *PodcastPlaylistPlayer) download() {
+	for _, podcast := range d.podcasts {
+		d.lock.Lock()
+		keptEpisodes := d.upcomingEpisodes(podcast)
+		d.lock.Unlock()
+
+		keptFiles := map[string]bool{podcastFeedFilename: true}
+		for _, episode := range keptEpisodes {
+			filename := d.episodeFilename(podcast, episode)
+			keptFiles[filepath.Base(filename)] = true
+			if fileExists(filename) {
+				continue
+			}
+			if d.ctx.Err() != nil {
+				return
+			}
+			err := d.downloadEpisode(episode, filename)
+			if err != nil {
+				logrus.Warnf("Unable to download episode \"%s\" of podcast %s: %v", episode.Title, podcast.Name, err)
+				continue
+			}
+			logrus.Debugf("Episode \"%s\" of podcast %s downloaded", episode.Title, podcast.Name)
+		}
+
+		files, err := ioutil.ReadDir(d.podcastFolder(podcast))
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			if file.IsDir() || keptFiles[file.Name()] {
+				continue
+			}
+			logrus.Debugf("Remove episode %s of podcast %s", file.Name(), podcast.Name)
+			err = os.Remove(filepath.Join(d.podcastFolder(podcast), file.Name()))
+			if err != nil {
+				logrus.Warnf("Unable to remove episode %s of podcast %s: %v", file.Name(), podcast.Name, err)
+			}
+		}
+	}
+}
+
+// upcomingEpisodes lists the episodes to keep on disk: the newest unplayed ones and the one being played
+func (d *PodcastPlaylistPlayer) upcomingEpisodes(podcast *config.Podcast) []podcastEpisode {
+	downloadCount := int(podcast.DownloadCount)
+	if downloadCount <= 0 {
+		downloadCount = podcastDefaultDownloadCount
+	}
+
+	var episodes []podcastEpisode
+	if d.currentPodcast == podcast && d.currentPosition < int64(len(d.currentEpisodes)) {
+		episodes = append(episodes, d.currentEpisodes[d.currentPosition])
+	}
+	for _, episode := range d.episodes[podcast.Name] {
+		if len(episodes) >= downloadCount {
+			break
+		}
+		if !d.serverState.IsEpisodePlayed(podcast.Name, episode.Guid) {
+			episodes = append(episodes, episode)
+		}
+	}
+	return episodes
+}
+
+// downloadEpisode stores an episode in the given file, through a temporary file to never keep a partial episode
+func (d *PodcastPlaylistPlayer) downloadEpisode(episode podcastEpisode, filename string) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0770)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodGet, episode.Url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), "incoming")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+func (d *PodcastPlaylistPlayer) podcastFolder(podcast *config.Podcast) string {
+	return filepath.Join(d.folder, sanitizeFilename(podcast.Name))
+}
+
+// episodeFilename names the downloaded episodes after their guid, keeping the extension of their url
+func (d *PodcastPlaylistPlayer) episodeFilename(podcast *config.Podcast, episode podcastEpisode) string {
+	hash := sha1.Sum([]byte(episode.Guid))
+	extension := ".mp3"
+	if episodeUrl, err := url.Parse(episode.Url); err == nil && pipeline.IsAudioFile(episodeUrl.Path) {
+		extension = strings.ToLower(path.Ext(episodeUrl.Path))
+	}
+	return filepath.Join(d.podcastFolder(podcast), hex.EncodeToString(hash[:])+extension)
+}
+
+func (d *PodcastPlaylistPlayer) Refresh() error {
+	err := d.refreshFeeds()
+	d.wake()
+	return err
+}
+
+func (d *PodcastPlaylistPlayer) ConnectionError() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.connectionErr
+}
+
+func (d *PodcastPlaylistPlayer) StopSendingEvent() {
+	logrus.Infof("Stop sending events for podcast playlist player device")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendEvent = false
+}
+
+func (d *PodcastPlaylistPlayer) Stop() {
+	logrus.Infof("Stop podcast playlist player device")
+
+	d.cancel()
+	<-d.done
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *PodcastPlaylistPlayer) EventChannel() chan event.PlaylistEvent {
+	return d.eventChannel
+}
+
+func (d *PodcastPlaylistPlayer) PlaylistCount() int64 {
+	return int64(len(d.podcasts))
+}
+
+func (d *PodcastPlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	for i := range d.podcasts {
+		if podcastPlaylistId(d.podcasts[i]) == playlistId {
+			return d.playlist(i)
+		}
+	}
+	return nil
+}
+
+func (d *PodcastPlaylistPlayer) GetPlaylistByIndex(index int64) *Playlist {
+	if index < 1 || index > int64(len(d.podcasts)) {
+		return nil
+	}
+	return d.playlist(int(index - 1))
+}
+
+func (d *PodcastPlaylistPlayer) NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist {
+	playlists := make([]Playlist, len(d.podcasts))
+	for i := range d.podcasts {
+		playlists[i] = *d.playlist(i)
+	}
+	return nextPlaylist(playlists, playlistId)
+}
+
+// playlist describes the podcast at the given position of the podcast list
+func (d *PodcastPlaylistPlayer) playlist(i int) *Playlist {
+	return &Playlist{
+		PlaylistId: podcastPlaylistId(d.podcasts[i]),
+		Name:       d.podcasts[i].Name,
+		Index:      int64(i + 1),
+	}
+}
+
+func podcastPlaylistId(podcast *config.Podcast) apimodel.PlaylistId {
+	return apimodel.PlaylistId(podcastPlaylistIdPrefix + podcast.Name)
+}
+
+func (d *PodcastPlaylistPlayer) getPodcast(playlistId apimodel.PlaylistId) *config.Podcast {
+	for _, podcast := range d.podcasts {
+		if podcastPlaylistId(podcast) == playlistId {
+			return podcast
+		}
+	}
+	return nil
+}
+
+func (d *PodcastPlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	podcast := d.getPodcast(playlistId)
+	if podcast == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+
+	if d.currentPodcast == podcast {
+		logrus.Infof("Already listening podcast %s", podcast.Name)
+		return nil
+	}
+
+	episodes := d.playableEpisodes(podcast)
+	if len(episodes) == 0 {
+		if d.connectionErr != nil {
+			return fmt.Errorf("No episode available for podcast %s: %v", podcast.Name, d.connectionErr)
+		}
+		return fmt.Errorf("No episode available for podcast %s", podcast.Name)
+	}
+
+	// Clear actual playlist
+	d.clear()
+
+	d.currentPodcast = podcast
+	d.currentEpisodes = episodes
+	d.currentPosition = 0
+
+	// The episode left unfinished is resumed if it is still the first one to play
+	var start time.Duration
+	if resume, ok := d.serverState.PlaylistResume(playlistId); ok {
+		if resume.Position >= 0 && resume.Position < int64(len(resume.Songs)) && resume.Songs[resume.Position] == episodes[0].Guid {
+			start = time.Duration(resume.Offset) * time.Second
+		}
+	}
+	if start > 0 {
+		logrus.Infof("Resuming podcast %s at %v", podcast.Name, start)
+	} else {
+		logrus.Infof("Listening podcast %s", podcast.Name)
+	}
+	d.audio.SetVolumeOffset(d.volumeOffsets[playlistId])
+
+	d.playEpisodeFrom(start)
+	d.wake()
+
+	return nil
+}
+
+// playableEpisodes returns the unplayed episodes newest first, or all of them when every episode has been played.
+// Without connection, only the downloaded episodes are kept.
+func (d *PodcastPlaylistPlayer) playableEpisodes(podcast *config.Podcast) []podcastEpisode {
+	var episodes []podcastEpisode
+	for _, episode := range d.episodes[podcast.Name] {
+		if !d.serverState.IsEpisodePlayed(podcast.Name, episode.Guid) {
+			episodes = append(episodes, episode)
+		}
+	}
+	if len(episodes) == 0 {
+		episodes = d.episodes[podcast.Name]
+	}
+
+	if d.connectionErr != nil {
+		var downloadedEpisodes []podcastEpisode
+		for _, episode := range episodes {
+			if fileExists(d.episodeFilename(podcast, episode)) {
+				downloadedEpisodes = append(downloadedEpisodes, episode)
+			}
+		}
+		episodes = downloadedEpisodes
+	}
+
+	return episodes
+}
+
+func (d *PodcastPlaylistPlayer) playEpisode() {
+	d.playEpisodeFrom(0)
+}
+
+// playEpisodeFrom plays the episode at the current position, from its downloaded file if any, starting at the given
+// position in the episode
+func (d *PodcastPlaylistPlayer) playEpisodeFrom(start time.Duration) {
+	if d.currentPlayback != nil {
+		d.currentPlayback.Stop()
+	}
+	d.currentPlayback = nil
+
+	currentPodcast := d.currentPodcast
+	if currentPodcast == nil || d.currentPosition >= int64(len(d.currentEpisodes)) {
+		if currentPodcast != nil {
+			// Every episode has been played
+			d.serverState.ClearPlaylistResume(podcastPlaylistId(currentPodcast))
+		}
+		d.currentPodcast = nil
+		d.currentEpisodes = nil
+		d.currentPosition = 0
+		return
+	}
+
+	episode := d.currentEpisodes[d.currentPosition]
+	source := pipeline.Source{Url: episode.Url, Start: start}
+	if filename := d.episodeFilename(currentPodcast, episode); fileExists(filename) {
+		source = pipeline.Source{Path: filename, Start: start}
+	}
+
+	var err error
+	d.currentPlayback, err = d.audio.Play(source)
+	if err != nil {
+		logrus.Warnf("Unable to listen episode \"%s\" of podcast %s: %v", episode.Title, currentPodcast.Name, err)
+		d.clear()
+		return
+	}
+	d.currentSongStart = start
+	d.saveResume()
+
+	currentPlayback := d.currentPlayback
+	go func() {
+		err := currentPlayback.Wait()
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		if d.currentPlayback == currentPlayback {
+			if err == nil {
+				d.serverState.SetEpisodePlayed(currentPodcast.Name, episode.Guid)
+			}
+			d.currentPlayback = nil
+			d.currentPosition++
+			d.playEpisode()
+			d.wake()
+			if d.sendEvent {
+				go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlayingSongData{}} }()
+			}
+		}
+	}()
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// saveResume records the episode being played and the position in it, to resume it later
+func (d *PodcastPlaylistPlayer) saveResume() {
+	if d.currentPodcast == nil {
+		return
+	}
+	episodeGuids := make([]string, len(d.currentEpisodes))
+	for i, episode := range d.currentEpisodes {
+		episodeGuids[i] = episode.Guid
+	}
+	d.serverState.SetPlaylistResume(
+		podcastPlaylistId(d.currentPodcast),
+		newPlaylistResume(episodeGuids, playOrder(len(episodeGuids), apimodel.SequentialPlayMode), d.currentPosition, d.position(), apimodel.SequentialPlayMode),
+	)
+}
+
+func (d *PodcastPlaylistPlayer) CurrentPlaylist() *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPodcast == nil {
+		return nil
+	}
+	return d.GetPlaylist(podcastPlaylistId(d.currentPodcast))
+}
+
+func (d *PodcastPlaylistPlayer) CurrentSongName() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPodcast == nil || d.currentPosition >= int64(len(d.currentEpisodes)) {
+		return ""
+	}
+	return d.currentEpisodes[d.currentPosition].Title
+}
+
+func (d *PodcastPlaylistPlayer) Clear() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *PodcastPlaylistPlayer) clear() {
+	if d.currentPodcast != nil {
+		if d.currentPlayback != nil {
+			d.saveResume()
+			d.currentPlayback.Stop()
+		}
+		d.currentPlayback = nil
+		d.currentPodcast = nil
+		d.currentEpisodes = nil
+		d.currentPosition = 0
+	}
+}
+
+// NextSong skips the current episode, which is considered as played
+func (d *PodcastPlaylistPlayer) NextSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPodcast != nil {
+		if d.currentPosition < int64(len(d.currentEpisodes)) {
+			d.serverState.SetEpisodePlayed(d.currentPodcast.Name, d.currentEpisodes[d.currentPosition].Guid)
+		}
+		d.currentPosition++
+		d.playEpisode()
+		d.wake()
+	}
+}
+
+func (d *PodcastPlaylistPlayer) PreviousSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPodcast != nil {
+		if d.position() < previousSongThreshold && d.currentPosition > 0 {
+			d.currentPosition--
+		}
+		d.playEpisode()
+	}
+}
+
+func (d *PodcastPlaylistPlayer) Seek(offset time.Duration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlayback == nil {
+		return fmt.Errorf("No song is playing")
+	}
+	start := d.position() + offset
+	if start < 0 {
+		start = 0
+	}
+	logrus.Infof("Seek to %v", start.Round(time.Second))
+	d.playEpisodeFrom(start)
+
+	return nil
+}
+
+func (d *PodcastPlaylistPlayer) Position() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.position()
+}
+
+func (d *PodcastPlaylistPlayer) position() time.Duration {
+	if d.currentPlayback == nil {
+		return 0
+	}
+	return d.currentSongStart + d.currentPlayback.Position()
+}
+
+// Duration returns the duration announced by the feed
+func (d *PodcastPlaylistPlayer) Duration() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPodcast == nil || d.currentPosition >= int64(len(d.currentEpisodes)) {
+		return 0
+	}
+	return d.currentEpisodes[d.currentPosition].Duration
+}
+
+// PlayMode is always sequential, episodes being played newest first
+func (d *PodcastPlaylistPlayer) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	return apimodel.SequentialPlayMode
+}
+
+func (d *PodcastPlaylistPlayer) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error {
+	if d.getPodcast(playlistId) == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	if playMode != apimodel.SequentialPlayMode {
+		return fmt.Errorf("Podcasts are only played in %s mode", apimodel.SequentialPlayMode)
+	}
+	return nil
+}
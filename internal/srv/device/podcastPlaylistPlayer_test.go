@@ -0,0 +1,256 @@
+package device
+
+import (
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRssFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+<channel>
+	<title>News</title>
+	<item>
+		<title>Monday</title>
+		<guid>monday</guid>
+		<pubDate>Mon, 02 Jan 2023 07:00:00 +0000</pubDate>
+		<itunes:duration>01:02:03</itunes:duration>
+		<enclosure url="{{url}}/episodes/monday.wav" type="audio/wav"/>
+	</item>
+	<item>
+		<title>Wednesday</title>
+		<guid>wednesday</guid>
+		<pubDate>Wed, 4 Jan 2023 07:00:00 GMT</pubDate>
+		<itunes:duration>95</itunes:duration>
+		<enclosure url="{{url}}/episodes/wednesday.wav" type="audio/wav"/>
+	</item>
+	<item>
+		<title>Tuesday</title>
+		<pubDate>Tue, 03 Jan 2023 07:00:00 +0000</pubDate>
+		<enclosure url="{{url}}/episodes/tuesday.wav" type="audio/wav"/>
+	</item>
+	<item>
+		<title>Article</title>
+		<pubDate>Thu, 05 Jan 2023 07:00:00 +0000</pubDate>
+	</item>
+</channel>
+</rss>`
+
+const testAtomFeed = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Talks</title>
+	<entry>
+		<title>First</title>
+		<id>urn:first</id>
+		<published>2023-01-02T07:00:00Z</published>
+		<link rel="alternate" type="text/html" href="{{url}}/first.html"/>
+		<link rel="enclosure" type="audio/wav" href="{{url}}/episodes/first.wav"/>
+	</entry>
+	<entry>
+		<title>Second</title>
+		<id>urn:second</id>
+		<updated>2023-01-05T07:00:00Z</updated>
+		<link type="audio/wav" href="{{url}}/episodes/second.wav"/>
+	</entry>
+	<entry>
+		<title>Page</title>
+		<id>urn:page</id>
+		<link href="{{url}}/page.html"/>
+	</entry>
+</feed>`
+
+// fakePodcastServer serves the feeds by path, their {{url}} being replaced by the server url, and any episode
+type fakePodcastServer struct {
+	*httptest.Server
+	lock            sync.Mutex
+	feeds           map[string]string
+	episodeRequests map[string]int
+}
+
+func newFakePodcastServer(t *testing.T, feeds map[string]string) *fakePodcastServer {
+	server := &fakePodcastServer{
+		feeds:           feeds,
+		episodeRequests: make(map[string]int),
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serveHTTP))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *fakePodcastServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if feed, ok := s.feeds[r.URL.Path]; ok {
+		w.Write([]byte(strings.ReplaceAll(feed, "{{url}}", "http://"+r.Host)))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/episodes/") {
+		s.lock.Lock()
+		s.episodeRequests[r.URL.Path]++
+		s.lock.Unlock()
+		w.Write(sineWav(0.2, -20))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func (s *fakePodcastServer) episodeRequestCount(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.episodeRequests[path]
+}
+
+func newTestPodcastPlaylistPlayer(t *testing.T, podcasts ...*config.Podcast) *PodcastPlaylistPlayer {
+	serverConfig := newTestServerConfig(t, t.TempDir())
+	serverConfig.Podcasts = podcasts
+
+	playlistPlayer := NewPodcastPlaylistPlayer(serverConfig, newTestAudio(t, serverConfig)).(*PodcastPlaylistPlayer)
+	t.Cleanup(func() {
+		playlistPlayer.cancel()
+		playlistPlayer.lock.Lock()
+		defer playlistPlayer.lock.Unlock()
+		playlistPlayer.clear()
+	})
+	return playlistPlayer
+}
+
+// episodeGuids lists the guids of the episodes read for a podcast
+func episodeGuids(playlistPlayer *PodcastPlaylistPlayer, podcastName string) []string {
+	playlistPlayer.lock.Lock()
+	defer playlistPlayer.lock.Unlock()
+
+	var guids []string
+	for _, episode := range playlistPlayer.episodes[podcastName] {
+		guids = append(guids, episode.Guid)
+	}
+	return guids
+}
+
+func TestPodcastRssFeed(t *testing.T) {
+	server := newFakePodcastServer(t, map[string]string{"/rss.xml": testRssFeed})
+	playlistPlayer := newTestPodcastPlaylistPlayer(t, &config.Podcast{Name: "News", Url: server.URL + "/rss.xml"})
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest first, the item without enclosure skipped and the url used when the guid is missing
+	expectedGuids := []string{"wednesday", server.URL + "/episodes/tuesday.wav", "monday"}
+	if guids := episodeGuids(playlistPlayer, "News"); strings.Join(guids, " ") != strings.Join(expectedGuids, " ") {
+		t.Errorf("Episodes %v, expected %v", guids, expectedGuids)
+	}
+	episodes := playlistPlayer.episodes["News"]
+	if len(episodes) == 3 && (episodes[0].Duration != 95*time.Second || episodes[2].Duration != time.Hour+2*time.Minute+3*time.Second) {
+		t.Errorf("Durations %v and %v, expected 1m35s and 1h2m3s", episodes[0].Duration, episodes[2].Duration)
+	}
+	if err := playlistPlayer.ConnectionError(); err != nil {
+		t.Errorf("Connection error %v after the feed has been read", err)
+	}
+}
+
+func TestPodcastAtomFeed(t *testing.T) {
+	server := newFakePodcastServer(t, map[string]string{"/atom.xml": testAtomFeed})
+	playlistPlayer := newTestPodcastPlaylistPlayer(t, &config.Podcast{Name: "Talks", Url: server.URL + "/atom.xml"})
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dated by the update when not published, the entry without audio link skipped
+	expectedGuids := []string{"urn:second", "urn:first"}
+	if guids := episodeGuids(playlistPlayer, "Talks"); strings.Join(guids, " ") != strings.Join(expectedGuids, " ") {
+		t.Errorf("Episodes %v, expected %v", guids, expectedGuids)
+	}
+	episodes := playlistPlayer.episodes["Talks"]
+	if len(episodes) == 2 && episodes[1].Url != server.URL+"/episodes/first.wav" {
+		t.Errorf("Episode url %s, expected the enclosure link", episodes[1].Url)
+	}
+}
+
+func TestPodcastPlayedEpisodes(t *testing.T) {
+	server := newFakePodcastServer(t, map[string]string{"/rss.xml": testRssFeed})
+	playlistPlayer := newTestPodcastPlaylistPlayer(t, &config.Podcast{Name: "News", Url: server.URL + "/rss.xml"})
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The newest unplayed episode is played first
+	playlistPlayer.serverState.SetEpisodePlayed("News", "wednesday")
+	err = playlistPlayer.Play("podcast:News")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if songName := playlistPlayer.CurrentSongName(); songName != "Tuesday" {
+		t.Errorf("Playing \"%s\", expected Tuesday", songName)
+	}
+
+	// and recorded as played once over
+	tuesdayGuid := server.URL + "/episodes/tuesday.wav"
+	deadline := time.Now().Add(5 * time.Second)
+	for !playlistPlayer.serverState.IsEpisodePlayed("News", tuesdayGuid) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !playlistPlayer.serverState.IsEpisodePlayed("News", tuesdayGuid) {
+		t.Errorf("Episode not recorded as played")
+	}
+}
+
+func TestPodcastDownloadAhead(t *testing.T) {
+	server := newFakePodcastServer(t, map[string]string{"/rss.xml": testRssFeed})
+	podcast := &config.Podcast{Name: "News", Url: server.URL + "/rss.xml", DownloadCount: 2}
+	playlistPlayer := newTestPodcastPlaylistPlayer(t, podcast)
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The two newest unplayed episodes are downloaded
+	playlistPlayer.download()
+	episodes := playlistPlayer.episodes["News"]
+	for i, downloaded := range []bool{true, true, false} {
+		if fileExists(playlistPlayer.episodeFilename(podcast, episodes[i])) != downloaded {
+			t.Errorf("Episode %s downloaded: %v, expected %v", episodes[i].Title, !downloaded, downloaded)
+		}
+	}
+
+	// The played episode is removed and the next one downloaded, the other one not being downloaded again
+	playlistPlayer.serverState.SetEpisodePlayed("News", "wednesday")
+	playlistPlayer.download()
+	for i, downloaded := range []bool{false, true, true} {
+		if fileExists(playlistPlayer.episodeFilename(podcast, episodes[i])) != downloaded {
+			t.Errorf("Episode %s downloaded: %v, expected %v", episodes[i].Title, !downloaded, downloaded)
+		}
+	}
+	if count := server.episodeRequestCount("/episodes/tuesday.wav"); count != 1 {
+		t.Errorf("Episode downloaded %d times, expected once", count)
+	}
+
+	// Downloaded episodes are played without the feed
+	server.Close()
+	playlistPlayer.Refresh()
+	err = playlistPlayer.Play("podcast:News")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if songName := playlistPlayer.CurrentSongName(); songName != "Tuesday" {
+		t.Errorf("Playing \"%s\" without the feed, expected the downloaded Tuesday", songName)
+	}
+}
+
+func TestPodcastNoEpisode(t *testing.T) {
+	server := newFakePodcastServer(t, map[string]string{"/rss.xml": `<rss><channel><item><title>Article</title></item></channel></rss>`})
+	playlistPlayer := newTestPodcastPlaylistPlayer(t, &config.Podcast{Name: "News", Url: server.URL + "/rss.xml"})
+	err := playlistPlayer.Refresh()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = playlistPlayer.Play("podcast:News")
+	if err == nil || strings.Contains(err.Error(), "<nil>") {
+		t.Errorf("Error \"%v\" for a podcast without episode", err)
+	}
+}
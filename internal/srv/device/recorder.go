@@ -0,0 +1,264 @@
+package device
+
+import (
+	"context"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sub folder of the recording folder containing the recordings in progress
+const incomingRecordingFolder = ".incoming"
+
+// Delay before reconnecting to a webradio, doubled after each failed or empty read up to the maximum delay
+const recordingRetryDelay = time.Second
+const recordingMaxRetryDelay = 30 * time.Second
+
+type Recorder struct {
+	lock sync.RWMutex
+
+	serverConfig    *config.ServerConfig
+	recordingFolder string
+	// Snapshot of the webradio groups, replaced as a whole when stations are imported
+	webradioGroups map[int64][]*config.Webradio
+	checkTicker    *time.Ticker
+
+	runningRecordings map[*config.Recording]context.CancelFunc
+	recordingsDone    sync.WaitGroup
+
+	askDone chan bool
+	done    chan bool
+}
+
+func NewRecorder(serverConfig *config.ServerConfig) *Recorder {
+	recorder := Recorder{
+		serverConfig:      serverConfig,
+		recordingFolder:   serverConfig.GetCompleteRecordingFolder(),
+		webradioGroups:    serverConfig.WebradioGroups,
+		runningRecordings: make(map[*config.Recording]context.CancelFunc),
+		askDone:           make(chan bool),
+		done:              make(chan bool),
+	}
+	return &recorder
+}
+
+func (d *Recorder) Start() {
+	logrus.Infof("Start recorder device")
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := os.MkdirAll(filepath.Join(d.recordingFolder, incomingRecordingFolder), 0770)
+	if err != nil {
+		logrus.Warningf("Unable to create recording folder: %v", err)
+	}
+
+	d.checkTicker = time.NewTicker(time.Second)
+
+	go func() {
+		var oldCheckTime time.Time
+
+		for loop := true; loop; {
+			select {
+			case <-d.checkTicker.C:
+				now := time.Now()
+
+				// Check scheduled recordings once per minute
+				if now.Hour() != oldCheckTime.Hour() || now.Minute() != oldCheckTime.Minute() {
+					for _, recording := range d.serverConfig.Recordings {
+						if recording.IsScheduledOn(now.Weekday()) &&
+							int64(now.Hour()) == recording.Hour &&
+							int64(now.Minute()) == recording.Minute {
+							d.record(recording, now)
+						}
+					}
+				}
+				oldCheckTime = now
+
+			case <-d.askDone:
+				loop = false
+			}
+		}
+		d.done <- true
+	}()
+}
+
+func (d *Recorder) Stop() {
+	logrus.Infof("Stop recorder device")
+	d.checkTicker.Stop()
+	d.askDone <- true
+	<-d.done
+
+	// Interrupted recordings are kept
+	d.lock.Lock()
+	for _, cancel := range d.runningRecordings {
+		cancel()
+	}
+	d.lock.Unlock()
+
+	d.recordingsDone.Wait()
+}
+
+// SetWebradioGroups replaces the webradio groups, which must not be modified afterwards
+func (d *Recorder) SetWebradioGroups(webradioGroups map[int64][]*config.Webradio) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.webradioGroups = webradioGroups
+}
+
+func (d *Recorder) record(recording *config.Recording, startTime time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.runningRecordings[recording]; ok {
+		logrus.Infof("Already recording %s", recording.Name)
+		return
+	}
+
+	webradio := d.webradioGroups[recording.WebradioId.GroupId]
+	if recording.WebradioId.IndexId < 1 || recording.WebradioId.IndexId > int64(len(webradio)) {
+		logrus.Warnf("Unable to record %s: radio %d is undefined", recording.Name, recording.WebradioId)
+		return
+	}
+	if len(webradio[recording.WebradioId.IndexId-1].Urls) == 0 {
+		logrus.Warnf("Unable to record %s: radio %d has no url", recording.Name, recording.WebradioId)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), startTime.Add(time.Duration(recording.Duration)*time.Second))
+	d.runningRecordings[recording] = cancel
+	d.recordingsDone.Add(1)
+
+	go func() {
+		defer d.recordingsDone.Done()
+		defer cancel()
+
+		logrus.Infof("Start recording %s", recording.Name)
+		err := d.recordStream(ctx, recording, webradio[recording.WebradioId.IndexId-1], startTime)
+		if err != nil {
+			logrus.Warnf("Unable to record %s: %v", recording.Name, err)
+		} else {
+			logrus.Infof("Recording %s done", recording.Name)
+		}
+
+		d.lock.Lock()
+		delete(d.runningRecordings, recording)
+		d.lock.Unlock()
+	}()
+}
+
+// recordStream saves the raw stream of the webradio until the end of the recording, switching to mirror urls
+// or reconnecting when the stream is interrupted
+func (d *Recorder) recordStream(ctx context.Context, recording *config.Recording, webradio *config.Webradio, startTime time.Time) error {
+	var file *os.File
+	var incomingFilename string
+	var writtenBytes int64
+	retryDelay := recordingRetryDelay
+
+	// retry waits before the next connection, longer after each failure
+	retry := func() {
+		sleepContext(ctx, retryDelay)
+		retryDelay *= 2
+		if retryDelay > recordingMaxRetryDelay {
+			retryDelay = recordingMaxRetryDelay
+		}
+	}
+
+	for urlIndex := 0; ctx.Err() == nil; urlIndex = (urlIndex + 1) % len(webradio.Urls) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, webradio.Urls[urlIndex], nil)
+		if err != nil {
+			return err
+		}
+		resp, err := pipeline.HttpClient.Do(req)
+		if err != nil {
+			logrus.Debugf("Unable to reach %s: %v", webradio.Urls[urlIndex], err)
+			retry()
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			logrus.Debugf("Unable to reach %s: %s", webradio.Urls[urlIndex], resp.Status)
+			retry()
+			continue
+		}
+
+		if file == nil {
+			baseName := startTime.Format("2006-01-02 15h04") + " " + sanitizeFilename(recording.Name) + recordingExtension(resp)
+			incomingFilename = filepath.Join(d.recordingFolder, incomingRecordingFolder, baseName)
+			file, err = os.Create(incomingFilename)
+			if err != nil {
+				resp.Body.Close()
+				return err
+			}
+		}
+
+		n, _ := io.Copy(file, resp.Body)
+		writtenBytes += n
+		resp.Body.Close()
+		if n == 0 {
+			logrus.Debugf("Empty stream from %s", webradio.Urls[urlIndex])
+			retry()
+		} else {
+			retryDelay = recordingRetryDelay
+		}
+	}
+
+	if file == nil {
+		return fmt.Errorf("no stream available")
+	}
+
+	err := file.Close()
+	if err != nil {
+		return err
+	}
+	if writtenBytes == 0 {
+		return os.Remove(incomingFilename)
+	}
+
+	// Only completed recordings are visible in the recording playlist
+	return os.Rename(incomingFilename, filepath.Join(d.recordingFolder, filepath.Base(incomingFilename)))
+}
+
+func recordingExtension(resp *http.Response) string {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "audio/mpeg", "audio/mp3":
+		return ".mp3"
+	case "audio/aac", "audio/aacp", "audio/x-aac":
+		return ".aac"
+	case "audio/ogg", "application/ogg":
+		return ".ogg"
+	case "audio/flac":
+		return ".flac"
+	}
+	if ext := path.Ext(resp.Request.URL.Path); ext != "" {
+		return ext
+	}
+	return ".mp3"
+}
+
+func sanitizeFilename(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+func sleepContext(ctx context.Context, duration time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(duration):
+	}
+}
@@ -0,0 +1,121 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestRecorder(t *testing.T) *Recorder {
+	recorder := NewRecorder(&config.ServerConfig{ConfigDir: t.TempDir(), ServerParam: &config.ServerParam{}})
+	err := os.MkdirAll(filepath.Join(recorder.recordingFolder, incomingRecordingFolder), 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return recorder
+}
+
+// newIcyServer answers any request with the "ICY 200 OK" status line of Shoutcast servers, sends the content and
+// keeps the connection open until the end of the test
+func newIcyServer(t *testing.T, content []byte) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		listener.Close()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				conn.Write([]byte("ICY 200 OK\r\nicy-name: Station\r\nContent-Type: audio/mpeg\r\n\r\n"))
+				conn.Write(content)
+				<-done
+			}()
+		}
+	}()
+	return "http://" + listener.Addr().String() + "/stream"
+}
+
+func TestRecorderIcyStream(t *testing.T) {
+	content := bytes.Repeat([]byte("mp3 frame "), 100)
+	url := newIcyServer(t, content)
+	recorder := newTestRecorder(t)
+
+	startTime := time.Date(2023, 1, 2, 7, 30, 0, 0, time.Local)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := recorder.recordStream(ctx, &config.Recording{Name: "Morning show"}, &config.Webradio{Urls: []string{url}}, startTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := ioutil.ReadFile(filepath.Join(recorder.recordingFolder, "2023-01-02 07h30 Morning show.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recorded, content) {
+		t.Errorf("%d bytes recorded, expected the %d bytes of the stream", len(recorded), len(content))
+	}
+}
+
+func TestRecorderEarlyClose(t *testing.T) {
+	var lock sync.Mutex
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestCount++
+		lock.Unlock()
+		w.Header().Set("Content-Type", "audio/mpeg")
+	}))
+	defer server.Close()
+	recorder := newTestRecorder(t)
+
+	// Reconnected after one second, then two seconds
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	err := recorder.recordStream(ctx, &config.Recording{Name: "Morning show"}, &config.Webradio{Urls: []string{server.URL}}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if requestCount != 2 {
+		t.Errorf("%d connections, expected 2", requestCount)
+	}
+
+	// Nothing recorded
+	for _, folder := range []string{recorder.recordingFolder, filepath.Join(recorder.recordingFolder, incomingRecordingFolder)} {
+		fileInfos, err := ioutil.ReadDir(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, fileInfo := range fileInfos {
+			if !fileInfo.IsDir() {
+				t.Errorf("Empty recording %s kept", fileInfo.Name())
+			}
+		}
+	}
+}
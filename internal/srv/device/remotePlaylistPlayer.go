@@ -0,0 +1,551 @@
+package device
+
+import (
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Delays between two attempts to reach a remote library, doubled at each failure
+const (
+	remoteMinRetryDelay = 5 * time.Second
+	remoteMaxRetryDelay = 5 * time.Minute
+)
+
+// Default delay between two refreshes of the remote playlists
+const remoteDefaultRefreshPeriod = 15 * time.Minute
+
+// remoteLibrary is a music server whose playlists are streamed
+type remoteLibrary interface {
+	// Name designates the library in logs and errors
+	Name() string
+	// IdPrefix is prepended to the playlist ids to never match the ids of the other playlist players
+	IdPrefix() string
+	// Playlists reads the playlists with their songs
+	Playlists() ([]remotePlaylist, error)
+}
+
+type remotePlaylist struct {
+	Id    string
+	Name  string
+	Songs []remoteSong
+}
+
+type remoteSong struct {
+	Id   string
+	Name string
+	// Url streaming the song
+	Url string
+	// Duration announced by the library, 0 when unknown
+	Duration time.Duration
+}
+
+// RemotePlaylistPlayer plays the playlists of a remote library, songs being streamed from the library
+type RemotePlaylistPlayer struct {
+	lock          sync.Mutex
+	eventChannel  chan event.PlaylistEvent
+	audio         *Audio
+	serverState   *config.ServerState
+	volumeOffsets map[apimodel.PlaylistId]int64
+	library       remoteLibrary
+	refreshPeriod time.Duration
+	connectionErr error
+
+	// Copy of the playlist being played, unaffected by the playlist refreshes
+	currentRemotePlaylist   *remotePlaylist
+	currentPlaylistOrder    []int
+	currentPlayMode         apimodel.PlayMode
+	currentPlaylistPosition int64
+	currentSongStart        time.Duration
+	currentPlaylistPlayback Playback
+
+	sendEvent bool
+
+	remotePlaylistList []remotePlaylist
+
+	wakeUp chan bool
+	quit   chan struct{}
+	done   chan bool
+}
+
+// newRemotePlaylistPlayer builds a player of the given library, refreshing its playlists every refreshPeriod seconds
+func newRemotePlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio, library remoteLibrary, refreshPeriod int64) *RemotePlaylistPlayer {
+	playlistPlayer := RemotePlaylistPlayer{
+		audio:         audio,
+		serverState:   serverConfig.ServerState,
+		volumeOffsets: serverConfig.PlaylistVolumeOffsets,
+		library:       library,
+		refreshPeriod: time.Duration(refreshPeriod) * time.Second,
+		connectionErr: fmt.Errorf("Not connected yet"),
+		eventChannel:  make(chan event.PlaylistEvent),
+		sendEvent:     true,
+		wakeUp:        make(chan bool, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan bool),
+	}
+	if playlistPlayer.refreshPeriod <= 0 {
+		playlistPlayer.refreshPeriod = remoteDefaultRefreshPeriod
+	}
+
+	return &playlistPlayer
+}
+
+// Start reads the playlists in background, retrying until the server answers, then refreshes them periodically
+func (d *RemotePlaylistPlayer) Start() {
+	logrus.Infof("Start %s playlist player device", d.library.Name())
+
+	go func() {
+		retryDelay := remoteMinRetryDelay
+		for loop := true; loop; {
+			delay := d.refreshPeriod
+			err := d.refreshPlaylists()
+			if err != nil {
+				logrus.Warnf("Unable to read %s playlists, next attempt in %v: %v", d.library.Name(), retryDelay, err)
+				delay = retryDelay
+				retryDelay *= 2
+				if retryDelay > remoteMaxRetryDelay {
+					retryDelay = remoteMaxRetryDelay
+				}
+			} else {
+				retryDelay = remoteMinRetryDelay
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-d.wakeUp:
+				timer.Stop()
+			case <-d.quit:
+				timer.Stop()
+				loop = false
+			}
+		}
+		d.done <- true
+	}()
+}
+
+// refreshPlaylists reads the playlists of the user, without holding the lock during the requests
+func (d *RemotePlaylistPlayer) refreshPlaylists() error {
+	remotePlaylistList, err := d.library.Playlists()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.setConnectionErr(err)
+	if err != nil {
+		return err
+	}
+	d.remotePlaylistList = remotePlaylistList
+	if d.sendEvent {
+		go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlaylistsData{}} }()
+	}
+	logrus.Debugf("%d %s playlists read", len(remotePlaylistList), d.library.Name())
+	return nil
+}
+
+// setConnectionErr records the connection status, an event being sent when it changes
+func (d *RemotePlaylistPlayer) setConnectionErr(err error) {
+	statusChanged := (err == nil) != (d.connectionErr == nil)
+	d.connectionErr = err
+	if statusChanged {
+		if err == nil {
+			logrus.Infof("Connected to %s server", d.library.Name())
+		}
+		if d.sendEvent {
+			go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventConnectionData{}} }()
+		}
+	}
+}
+
+// wake asks the background loop for an immediate refresh of the playlists
+func (d *RemotePlaylistPlayer) wake() {
+	select {
+	case d.wakeUp <- true:
+	default:
+	}
+}
+
+func (d *RemotePlaylistPlayer) Refresh() error {
+	return d.refreshPlaylists()
+}
+
+func (d *RemotePlaylistPlayer) ConnectionError() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.connectionErr
+}
+
+func (d *RemotePlaylistPlayer) StopSendingEvent() {
+	logrus.Infof("Stop sending events for %s playlist player device", d.library.Name())
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendEvent = false
+}
+
+func (d *RemotePlaylistPlayer) Stop() {
+	logrus.Infof("Stop %s playlist player device", d.library.Name())
+
+	close(d.quit)
+	<-d.done
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *RemotePlaylistPlayer) EventChannel() chan event.PlaylistEvent {
+	return d.eventChannel
+}
+
+func (d *RemotePlaylistPlayer) PlaylistCount() int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return int64(len(d.remotePlaylistList))
+}
+
+func (d *RemotePlaylistPlayer) GetPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.getPlaylist(playlistId)
+}
+
+func (d *RemotePlaylistPlayer) GetPlaylistByIndex(index int64) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if index < 1 || index > int64(len(d.remotePlaylistList)) {
+		return nil
+	}
+	return d.playlist(int(index - 1))
+}
+
+func (d *RemotePlaylistPlayer) NextPlaylist(playlistId *apimodel.PlaylistId) *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	playlists := make([]Playlist, len(d.remotePlaylistList))
+	for i := range d.remotePlaylistList {
+		playlists[i] = *d.playlist(i)
+	}
+	return nextPlaylist(playlists, playlistId)
+}
+
+func (d *RemotePlaylistPlayer) getPlaylist(playlistId apimodel.PlaylistId) *Playlist {
+	for i := range d.remotePlaylistList {
+		if d.playlistId(&d.remotePlaylistList[i]) == playlistId {
+			return d.playlist(i)
+		}
+	}
+	return nil
+}
+
+// playlist describes the remote playlist at the given position of the playlist list
+func (d *RemotePlaylistPlayer) playlist(i int) *Playlist {
+	return &Playlist{
+		PlaylistId: d.playlistId(&d.remotePlaylistList[i]),
+		Name:       d.remotePlaylistList[i].Name,
+		Index:      int64(i + 1),
+	}
+}
+
+func (d *RemotePlaylistPlayer) playlistId(playlist *remotePlaylist) apimodel.PlaylistId {
+	return apimodel.PlaylistId(d.library.IdPrefix() + playlist.Id)
+}
+
+func (d *RemotePlaylistPlayer) getRemotePlaylist(playlistId apimodel.PlaylistId) *remotePlaylist {
+	for i := range d.remotePlaylistList {
+		if d.playlistId(&d.remotePlaylistList[i]) == playlistId {
+			return &d.remotePlaylistList[i]
+		}
+	}
+	return nil
+}
+
+func (d *RemotePlaylistPlayer) Play(playlistId apimodel.PlaylistId) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	playlist := d.getRemotePlaylist(playlistId)
+	if playlist == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	if d.connectionErr != nil {
+		return fmt.Errorf("%s server unavailable: %v", d.library.Name(), d.connectionErr)
+	}
+
+	if d.currentRemotePlaylist != nil && d.playlistId(d.currentRemotePlaylist) == playlistId {
+		logrus.Infof("Already listening playlist %s", playlistId)
+		return nil
+	}
+
+	playMode := d.serverState.PlayMode(playlistId)
+	playlistOrder := playOrder(len(playlist.Songs), playMode)
+	playlistPosition := int64(0)
+	var start time.Duration
+	if resume, ok := d.serverState.PlaylistResume(playlistId); ok {
+		if resumedOrder, resumedPosition, resumedStart, ok := resumeOrder(remoteSongKeys(playlist), resume, playMode); ok {
+			playlistOrder, playlistPosition, start = resumedOrder, resumedPosition, resumedStart
+		}
+	}
+
+	// Clear actual playlist
+	d.clear()
+
+	currentRemotePlaylist := *playlist
+	d.currentRemotePlaylist = &currentRemotePlaylist
+	d.currentPlaylistOrder = playlistOrder
+	d.currentPlaylistPosition = playlistPosition
+	d.currentPlayMode = playMode
+	if playlistPosition > 0 || start > 0 {
+		logrus.Infof("Resuming Playlist %s: \"%s\" (%s) at song %d", playlistId, playlist.Name, playMode, playlistPosition+1)
+	} else {
+		logrus.Infof("Listening Playlist %s: \"%s\" (%s)", playlistId, playlist.Name, playMode)
+	}
+	d.audio.SetVolumeOffset(d.volumeOffsets[playlistId])
+
+	d.playSongFrom(start)
+
+	return nil
+}
+
+func (d *RemotePlaylistPlayer) playSong() {
+	d.playSongFrom(0)
+}
+
+// playSongFrom streams the song at the current position, starting at the given position in the song
+func (d *RemotePlaylistPlayer) playSongFrom(start time.Duration) {
+	if d.currentPlaylistPlayback != nil {
+		d.currentPlaylistPlayback.Stop()
+	}
+	d.currentPlaylistPlayback = nil
+
+	currentRemotePlaylist := d.currentRemotePlaylist
+	if currentRemotePlaylist == nil || d.currentPlaylistPosition >= int64(len(d.currentPlaylistOrder)) {
+		if currentRemotePlaylist != nil {
+			// The playlist is over: next time it starts from the beginning
+			d.serverState.ClearPlaylistResume(d.playlistId(currentRemotePlaylist))
+		}
+		d.currentRemotePlaylist = nil
+		d.currentPlaylistOrder = nil
+		d.currentPlaylistPosition = 0
+		return
+	}
+
+	song := d.currentSong()
+	var err error
+	d.currentPlaylistPlayback, err = d.audio.Play(pipeline.Source{Url: song.Url, Start: start})
+	if err != nil {
+		logrus.Warnf("Unable to listen song %d on playlist %s", d.currentPlaylistPosition, currentRemotePlaylist.Name)
+		d.clear()
+		return
+	}
+	d.currentSongStart = start
+	d.saveResume()
+
+	currentPlaylistPlayback := d.currentPlaylistPlayback
+	go func() {
+		err := currentPlaylistPlayback.Wait()
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		if d.currentPlaylistPlayback == currentPlaylistPlayback {
+			if err != nil {
+				// The server may have become unreachable
+				d.wake()
+			}
+			d.currentPlaylistPlayback = nil
+			d.currentPlaylistPosition = nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode, false)
+			d.playSong()
+			if d.sendEvent {
+				go func() { d.eventChannel <- event.PlaylistEvent{Data: event.PlaylistEventPlayingSongData{}} }()
+			}
+		}
+	}()
+}
+
+// currentSong returns the song at the current position, nil when the playlist isn't playing
+func (d *RemotePlaylistPlayer) currentSong() *remoteSong {
+	if d.currentRemotePlaylist == nil || d.currentPlaylistPosition >= int64(len(d.currentPlaylistOrder)) {
+		return nil
+	}
+	return &d.currentRemotePlaylist.Songs[d.currentPlaylistOrder[d.currentPlaylistPosition]]
+}
+
+func (d *RemotePlaylistPlayer) CurrentPlaylist() *Playlist {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentRemotePlaylist == nil {
+		return nil
+	}
+	playlistId := d.playlistId(d.currentRemotePlaylist)
+	if playlist := d.getPlaylist(playlistId); playlist != nil {
+		return playlist
+	}
+	// The playlist has been removed since it started
+	return &Playlist{
+		PlaylistId: playlistId,
+		Name:       d.currentRemotePlaylist.Name,
+	}
+}
+
+func (d *RemotePlaylistPlayer) CurrentSongName() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if song := d.currentSong(); song != nil {
+		return song.Name
+	}
+	return ""
+}
+
+func (d *RemotePlaylistPlayer) Clear() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+// saveResume records the current song and the position in it, to resume the playlist later
+func (d *RemotePlaylistPlayer) saveResume() {
+	currentRemotePlaylist := d.currentRemotePlaylist
+	if currentRemotePlaylist == nil {
+		return
+	}
+	d.serverState.SetPlaylistResume(
+		d.playlistId(currentRemotePlaylist),
+		newPlaylistResume(remoteSongKeys(currentRemotePlaylist), d.currentPlaylistOrder, d.currentPlaylistPosition, d.position(), d.currentPlayMode),
+	)
+}
+
+func remoteSongKeys(playlist *remotePlaylist) []string {
+	songKeys := make([]string, len(playlist.Songs))
+	for i, song := range playlist.Songs {
+		songKeys[i] = song.Id
+	}
+	return songKeys
+}
+
+func (d *RemotePlaylistPlayer) clear() {
+	if d.currentRemotePlaylist != nil {
+		if d.currentPlaylistPlayback != nil {
+			d.saveResume()
+			d.currentPlaylistPlayback.Stop()
+		}
+		d.currentPlaylistPlayback = nil
+		d.currentRemotePlaylist = nil
+		d.currentPlaylistOrder = nil
+		d.currentPlaylistPosition = 0
+	}
+}
+
+func (d *RemotePlaylistPlayer) NextSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentRemotePlaylist != nil {
+		d.currentPlaylistPosition = nextPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode, true)
+		d.playSong()
+	}
+}
+
+func (d *RemotePlaylistPlayer) PreviousSong() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentRemotePlaylist != nil {
+		if d.position() < previousSongThreshold {
+			d.currentPlaylistPosition = previousPosition(d.currentPlaylistPosition, len(d.currentPlaylistOrder), d.currentPlayMode)
+		}
+		d.playSong()
+	}
+}
+
+// Seek streams the song again, the part before the new position being decoded and dropped
+func (d *RemotePlaylistPlayer) Seek(offset time.Duration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.currentPlaylistPlayback == nil {
+		return fmt.Errorf("No song is playing")
+	}
+	start := d.position() + offset
+	if start < 0 {
+		start = 0
+	}
+	logrus.Infof("Seek to %v", start.Round(time.Second))
+	d.playSongFrom(start)
+
+	return nil
+}
+
+func (d *RemotePlaylistPlayer) Position() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.position()
+}
+
+func (d *RemotePlaylistPlayer) position() time.Duration {
+	if d.currentPlaylistPlayback == nil {
+		return 0
+	}
+	return d.currentSongStart + d.currentPlaylistPlayback.Position()
+}
+
+// Duration returns the duration given by the library
+func (d *RemotePlaylistPlayer) Duration() time.Duration {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if song := d.currentSong(); song != nil {
+		return song.Duration
+	}
+	return 0
+}
+
+func (d *RemotePlaylistPlayer) PlayMode(playlistId apimodel.PlaylistId) apimodel.PlayMode {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	playlist := d.getRemotePlaylist(playlistId)
+	if playlist == nil {
+		return apimodel.ShufflePlayMode
+	}
+	return d.serverState.PlayMode(playlistId)
+}
+
+func (d *RemotePlaylistPlayer) SetPlayMode(playlistId apimodel.PlaylistId, playMode apimodel.PlayMode) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if !playMode.IsValid() {
+		return fmt.Errorf("Play mode %s is undefined", playMode)
+	}
+	playlist := d.getRemotePlaylist(playlistId)
+	if playlist == nil {
+		return fmt.Errorf("Playlist %s is undefined", playlistId)
+	}
+	logrus.Infof("Set play mode of playlist \"%s\" to %s", playlist.Name, playMode)
+	d.serverState.SetPlayMode(playlistId, playMode)
+
+	// Apply the new play mode to the songs still to be played
+	if d.currentRemotePlaylist != nil && d.playlistId(d.currentRemotePlaylist) == playlistId && d.currentPlayMode != playMode {
+		d.currentPlaylistPosition = reorder(d.currentPlaylistOrder, d.currentPlaylistPosition, playMode)
+		d.currentPlayMode = playMode
+		d.saveResume()
+	}
+
+	return nil
+}
@@ -0,0 +1,728 @@
+package device
+
+import (
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRendererName = "vekigi"
+
+// Transport states of the AVTransport service
+const (
+	rendererNoMediaPresent = "NO_MEDIA_PRESENT"
+	rendererStopped        = "STOPPED"
+	rendererPlaying        = "PLAYING"
+	rendererPaused         = "PAUSED_PLAYBACK"
+)
+
+// Error codes of the UPnP faults
+const (
+	upnpErrorInvalidAction      = 401
+	upnpErrorInvalidArgs        = 402
+	upnpErrorActionFailed       = 501
+	upnpErrorTransition         = 701
+	upnpErrorSeekModeNotAllowed = 710
+	upnpErrorInvalidInstanceId  = 718
+)
+
+// Renderer is a UPnP media renderer: control points (phone apps, media centers...) push the url of a song and
+// control its playback, the volume being the one of the radio
+type Renderer struct {
+	lock          sync.Mutex
+	eventChannel  chan event.RendererEvent
+	audio         *Audio
+	rendererParam *config.RendererParam
+	name          string
+	udn           string
+
+	server        *http.Server
+	ssdp          *rendererSsdp
+	quit          chan struct{}
+	subscriptions map[string]*rendererSubscription
+
+	uri      string
+	metadata string
+	title    string
+	duration time.Duration
+	state    string
+	playback Playback
+	// Position where the playback started, or where it has been paused
+	offset time.Duration
+
+	sendEvent bool
+}
+
+type upnpError struct {
+	code    int
+	message string
+}
+
+func (e *upnpError) Error() string {
+	return e.message
+}
+
+type rendererActionHandler func(d *Renderer, args map[string]string) (map[string]string, error)
+
+var rendererActionHandlers = map[string]rendererActionHandler{
+	"AVTransport#SetAVTransportURI":              (*Renderer).setAvTransportUriAction,
+	"AVTransport#GetMediaInfo":                   (*Renderer).getMediaInfoAction,
+	"AVTransport#GetTransportInfo":               (*Renderer).getTransportInfoAction,
+	"AVTransport#GetPositionInfo":                (*Renderer).getPositionInfoAction,
+	"AVTransport#GetDeviceCapabilities":          (*Renderer).getDeviceCapabilitiesAction,
+	"AVTransport#GetTransportSettings":           (*Renderer).getTransportSettingsAction,
+	"AVTransport#GetCurrentTransportActions":     (*Renderer).getCurrentTransportActionsAction,
+	"AVTransport#Stop":                           (*Renderer).stopAction,
+	"AVTransport#Play":                           (*Renderer).playAction,
+	"AVTransport#Pause":                          (*Renderer).pauseAction,
+	"AVTransport#Seek":                           (*Renderer).seekAction,
+	"AVTransport#Next":                           (*Renderer).transitionNotAvailableAction,
+	"AVTransport#Previous":                       (*Renderer).transitionNotAvailableAction,
+	"RenderingControl#ListPresets":               (*Renderer).listPresetsAction,
+	"RenderingControl#SelectPreset":              (*Renderer).selectPresetAction,
+	"RenderingControl#GetMute":                   (*Renderer).getMuteAction,
+	"RenderingControl#SetMute":                   (*Renderer).setMuteAction,
+	"RenderingControl#GetVolume":                 (*Renderer).getVolumeAction,
+	"RenderingControl#SetVolume":                 (*Renderer).setVolumeAction,
+	"ConnectionManager#GetProtocolInfo":          (*Renderer).getProtocolInfoAction,
+	"ConnectionManager#GetCurrentConnectionIDs":  (*Renderer).getCurrentConnectionIdsAction,
+	"ConnectionManager#GetCurrentConnectionInfo": (*Renderer).getCurrentConnectionInfoAction,
+}
+
+type rendererSoapXml struct {
+	Body struct {
+		Action struct {
+			XMLName   xml.Name
+			Arguments []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:",any"`
+	} `xml:"Body"`
+}
+
+func NewRenderer(config *config.ServerConfig, audio *Audio) *Renderer {
+	renderer := Renderer{
+		eventChannel:  make(chan event.RendererEvent),
+		audio:         audio,
+		rendererParam: config.RendererParam,
+		quit:          make(chan struct{}),
+		subscriptions: make(map[string]*rendererSubscription),
+		state:         rendererNoMediaPresent,
+		sendEvent:     true,
+	}
+	if renderer.rendererParam != nil {
+		renderer.name = renderer.rendererParam.Name
+		if renderer.name == "" {
+			renderer.name = defaultRendererName
+		}
+		renderer.udn = rendererUdn(renderer.name)
+	}
+	return &renderer
+}
+
+// rendererUdn derives the unique device name from the host name and the renderer name, to be the same after a restart
+func rendererUdn(name string) string {
+	hostname, _ := os.Hostname()
+	sum := md5.Sum([]byte(hostname + "/" + name))
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// Start serves the descriptions and the control urls, and advertises the renderer, when it is enabled
+func (d *Renderer) Start() {
+	if d.rendererParam == nil {
+		return
+	}
+	logrus.Infof("Start renderer device")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/description.xml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write(rendererDescription(d.name, d.udn))
+	})
+	mux.HandleFunc("/control/", d.controlHandler)
+	mux.HandleFunc("/event/", d.subscriptionHandler)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		service := rendererServiceByName(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".xml"))
+		if service == nil || !strings.HasSuffix(r.URL.Path, ".xml") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+		w.Write(service.scpd())
+	})
+	d.server = &http.Server{
+		Addr:    ":" + strconv.FormatInt(d.rendererParam.Port, 10),
+		Handler: mux,
+	}
+	go func() {
+		err := d.server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Unable to serve UPnP control points: %v", err)
+		}
+	}()
+
+	d.ssdp = newRendererSsdp(d.udn, d.rendererParam.Port)
+	err := d.ssdp.start()
+	if err != nil {
+		logrus.Errorf("Unable to advertise UPnP renderer: %v", err)
+		d.ssdp = nil
+	}
+}
+
+// StopSendingEvent stops answering the control points
+func (d *Renderer) StopSendingEvent() {
+	if d.rendererParam == nil {
+		return
+	}
+	logrus.Infof("Stop sending events for renderer device")
+
+	close(d.quit)
+	if d.ssdp != nil {
+		d.ssdp.stop()
+	}
+	d.server.Close()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.sendEvent = false
+}
+
+func (d *Renderer) Stop() {
+	logrus.Infof("Stop renderer device")
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.clear()
+}
+
+func (d *Renderer) EventChannel() chan event.RendererEvent {
+	return d.eventChannel
+}
+
+// requestPlay asks the event loop to stop the other sources before playing the pushed url
+func (d *Renderer) requestPlay() error {
+	return d.request(event.RendererEventPlayData{})
+}
+
+// request sends an event to the event loop and waits for its result
+func (d *Renderer) request(data interface{}) error {
+	result := make(chan error, 1)
+	select {
+	case d.eventChannel <- event.RendererEvent{Result: result, Data: data}:
+	case <-d.quit:
+		return &upnpError{code: upnpErrorActionFailed, message: "Server stopping"}
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-d.quit:
+		return &upnpError{code: upnpErrorActionFailed, message: "Server stopping"}
+	}
+}
+
+// notifyStopPlaying tells the event loop that the cast song is not playing anymore
+func (d *Renderer) notifyStopPlaying() {
+	if d.sendEvent {
+		go func() { d.eventChannel <- event.RendererEvent{Data: event.RendererEventStopPlayingData{}} }()
+	}
+}
+
+// Play plays the pushed url, resuming it when paused
+func (d *Renderer) Play() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state == rendererPlaying {
+		return nil
+	}
+	if d.uri == "" {
+		return &upnpError{code: upnpErrorTransition, message: "No media to play"}
+	}
+
+	logrus.Infof("Play cast song \"%s\"", d.title)
+	err := d.startPlayback()
+	if err != nil {
+		return err
+	}
+	d.notifySubscribers("AVTransport")
+	return nil
+}
+
+// startPlayback plays the pushed url from the current offset
+func (d *Renderer) startPlayback() error {
+	if d.playback != nil {
+		d.playback.Stop()
+		d.playback = nil
+	}
+	d.audio.SetVolumeOffset(0)
+	playback, err := d.audio.Play(pipeline.Source{Url: d.uri, Start: d.offset})
+	if err != nil {
+		return &upnpError{code: upnpErrorActionFailed, message: err.Error()}
+	}
+	d.playback = playback
+	d.state = rendererPlaying
+	go d.listen(playback)
+	return nil
+}
+
+// listen waits for the end of the playback
+func (d *Renderer) listen(playback Playback) {
+	err := playback.Wait()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.playback != playback {
+		return
+	}
+	if err != nil {
+		logrus.Warnf("Cast song \"%s\" stopped: %v", d.title, err)
+	}
+	d.playback = nil
+	d.offset = 0
+	d.state = rendererStopped
+	d.notifySubscribers("AVTransport")
+	d.notifyStopPlaying()
+}
+
+// CurrentTitle returns the title of the cast song being played or paused, an empty string otherwise
+func (d *Renderer) CurrentTitle() string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state != rendererPlaying && d.state != rendererPaused {
+		return ""
+	}
+	return d.title
+}
+
+// Clear stops the cast song, to let another source play
+func (d *Renderer) Clear() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state == rendererPlaying || d.state == rendererPaused {
+		d.clear()
+		d.notifySubscribers("AVTransport")
+	}
+}
+
+func (d *Renderer) clear() {
+	if d.playback != nil {
+		d.playback.Stop()
+		d.playback = nil
+	}
+	d.offset = 0
+	if d.uri != "" {
+		d.state = rendererStopped
+	} else {
+		d.state = rendererNoMediaPresent
+	}
+}
+
+// position returns the duration of the cast song already played
+func (d *Renderer) position() time.Duration {
+	if d.playback == nil {
+		return d.offset
+	}
+	return d.offset + d.playback.Position()
+}
+
+// currentTransportActions lists the transport actions available in the current state
+func (d *Renderer) currentTransportActions() string {
+	switch d.state {
+	case rendererPlaying:
+		return "Stop,Pause,Seek"
+	case rendererPaused:
+		return "Play,Stop,Seek"
+	case rendererStopped:
+		return "Play,Seek"
+	default:
+		return ""
+	}
+}
+
+func (d *Renderer) controlHandler(w http.ResponseWriter, r *http.Request) {
+	service := rendererServiceByName(strings.TrimPrefix(r.URL.Path, "/control/"))
+	if service == nil || r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	var soap rendererSoapXml
+	err = xml.Unmarshal(body, &soap)
+	if err != nil {
+		writeUpnpFault(w, &upnpError{code: upnpErrorInvalidAction, message: "Invalid Action"})
+		return
+	}
+	actionName := soap.Body.Action.XMLName.Local
+	args := make(map[string]string)
+	for _, argument := range soap.Body.Action.Arguments {
+		args[argument.XMLName.Local] = argument.Value
+	}
+	logrus.Debugf("Receive UPnP action %s#%s from %s", service.Name, actionName, r.RemoteAddr)
+
+	var action *rendererAction
+	for i := range service.Actions {
+		if service.Actions[i].Name == actionName {
+			action = &service.Actions[i]
+		}
+	}
+	handler, ok := rendererActionHandlers[service.Name+"#"+actionName]
+	if action == nil || !ok {
+		writeUpnpFault(w, &upnpError{code: upnpErrorInvalidAction, message: "Invalid Action"})
+		return
+	}
+	if instanceId, ok := args["InstanceID"]; ok && instanceId != "0" {
+		writeUpnpFault(w, &upnpError{code: upnpErrorInvalidInstanceId, message: "Invalid InstanceID"})
+		return
+	}
+
+	outArgs, err := handler(d, args)
+	if err != nil {
+		logrus.Warnf("UPnP action %s failed: %v", actionName, err)
+		writeUpnpFault(w, err)
+		return
+	}
+
+	// Output arguments are written in the order of the SCPD
+	var response strings.Builder
+	response.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:` + actionName + `Response xmlns:u="` + service.Type + `">`)
+	for _, argument := range action.Out {
+		name := strings.SplitN(argument, ":", 2)[0]
+		response.WriteString(`<` + name + `>` + xmlEscape(outArgs[name]) + `</` + name + `>`)
+	}
+	response.WriteString(`</u:` + actionName + `Response></s:Body></s:Envelope>`)
+
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Header().Set("Ext", "")
+	w.Write([]byte(response.String()))
+}
+
+func writeUpnpFault(w http.ResponseWriter, err error) {
+	actionError, ok := err.(*upnpError)
+	if !ok {
+		actionError = &upnpError{code: upnpErrorActionFailed, message: err.Error()}
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail>` +
+		`<UPnPError xmlns="urn:schemas-upnp-org:control-1-0">` +
+		`<errorCode>` + strconv.Itoa(actionError.code) + `</errorCode>` +
+		`<errorDescription>` + xmlEscape(actionError.message) + `</errorDescription>` +
+		`</UPnPError></detail></s:Fault></s:Body></s:Envelope>`))
+}
+
+// formatUpnpDuration writes a duration as H:MM:SS
+func formatUpnpDuration(duration time.Duration) string {
+	seconds := int64(duration / time.Second)
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// castTitle names the cast song after the title and the artist of its metadata, or after its url
+func castTitle(uri string, metadata string) (string, time.Duration) {
+	var didl upnpDidlXml
+	if xml.Unmarshal([]byte(metadata), &didl) == nil && len(didl.Items) > 0 {
+		item := didl.Items[0]
+		var duration time.Duration
+		if len(item.Res) > 0 {
+			duration = parseUpnpDuration(item.Res[0].Duration)
+		}
+		title := strings.TrimSpace(item.Title)
+		artist := strings.TrimSpace(item.Artist)
+		if artist == "" {
+			artist = strings.TrimSpace(item.Creator)
+		}
+		if title != "" && artist != "" {
+			return artist + " - " + title, duration
+		}
+		if title != "" {
+			return title, duration
+		}
+	}
+	if parsedUri, err := url.Parse(uri); err == nil && path.Base(parsedUri.Path) != "/" && path.Base(parsedUri.Path) != "." {
+		return path.Base(parsedUri.Path), 0
+	}
+	return uri, 0
+}
+
+// validCastUri tells whether an url pushed by a control point can be played: only http and https urls are accepted,
+// anything else (local files, player options, other protocols) being read by the decoder or cvlc on the radio itself
+func validCastUri(uri string) bool {
+	if uri == "" {
+		// No media
+		return true
+	}
+	parsedUri, err := url.Parse(uri)
+	if err != nil {
+		return false
+	}
+	return (parsedUri.Scheme == "http" || parsedUri.Scheme == "https") && parsedUri.Host != ""
+}
+
+func (d *Renderer) setAvTransportUriAction(args map[string]string) (map[string]string, error) {
+	uri := strings.TrimSpace(args["CurrentURI"])
+	if !validCastUri(uri) {
+		return nil, &upnpError{code: upnpErrorInvalidArgs, message: "Invalid Args"}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	wasPlaying := d.state == rendererPlaying || d.state == rendererPaused
+	d.uri = uri
+	d.metadata = args["CurrentURIMetaData"]
+	d.title, d.duration = castTitle(d.uri, d.metadata)
+	logrus.Infof("Cast song \"%s\" pushed", d.title)
+
+	// The control point asks to play the new song once set
+	d.clear()
+	d.notifySubscribers("AVTransport")
+	if wasPlaying {
+		d.notifyStopPlaying()
+	}
+	return nil, nil
+}
+
+func (d *Renderer) getMediaInfoAction(args map[string]string) (map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	outArgs := map[string]string{
+		"NrTracks":           "0",
+		"MediaDuration":      formatUpnpDuration(d.duration),
+		"CurrentURI":         d.uri,
+		"CurrentURIMetaData": d.metadata,
+		"PlayMedium":         "NONE",
+		"RecordMedium":       "NOT_IMPLEMENTED",
+		"WriteStatus":        "NOT_IMPLEMENTED",
+	}
+	if d.uri != "" {
+		outArgs["NrTracks"] = "1"
+		outArgs["PlayMedium"] = "NETWORK"
+	}
+	return outArgs, nil
+}
+
+func (d *Renderer) getTransportInfoAction(args map[string]string) (map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return map[string]string{
+		"CurrentTransportState":  d.state,
+		"CurrentTransportStatus": "OK",
+		"CurrentSpeed":           "1",
+	}, nil
+}
+
+func (d *Renderer) getPositionInfoAction(args map[string]string) (map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	outArgs := map[string]string{
+		"Track":         "0",
+		"TrackDuration": formatUpnpDuration(d.duration),
+		"TrackMetaData": d.metadata,
+		"TrackURI":      d.uri,
+		"RelTime":       formatUpnpDuration(d.position()),
+		"AbsTime":       formatUpnpDuration(d.position()),
+		"RelCount":      "2147483647",
+		"AbsCount":      "2147483647",
+	}
+	if d.uri != "" {
+		outArgs["Track"] = "1"
+	}
+	return outArgs, nil
+}
+
+func (d *Renderer) getDeviceCapabilitiesAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{
+		"PlayMedia":       "NETWORK",
+		"RecMedia":        "NOT_IMPLEMENTED",
+		"RecQualityModes": "NOT_IMPLEMENTED",
+	}, nil
+}
+
+func (d *Renderer) getTransportSettingsAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{
+		"PlayMode":       "NORMAL",
+		"RecQualityMode": "NOT_IMPLEMENTED",
+	}, nil
+}
+
+func (d *Renderer) getCurrentTransportActionsAction(args map[string]string) (map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return map[string]string{"Actions": d.currentTransportActions()}, nil
+}
+
+func (d *Renderer) stopAction(args map[string]string) (map[string]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state == rendererPlaying || d.state == rendererPaused {
+		logrus.Infof("Stop cast song")
+		d.clear()
+		d.notifySubscribers("AVTransport")
+		d.notifyStopPlaying()
+	}
+	return nil, nil
+}
+
+func (d *Renderer) playAction(args map[string]string) (map[string]string, error) {
+	return nil, d.requestPlay()
+}
+
+func (d *Renderer) pauseAction(args map[string]string) (map[string]string, error) {
+	return nil, d.Pause()
+}
+
+// Pause pauses the cast song being played, Play resuming it
+func (d *Renderer) Pause() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.state != rendererPlaying {
+		return &upnpError{code: upnpErrorTransition, message: "Transition not available"}
+	}
+	logrus.Infof("Pause cast song")
+	d.offset = d.position()
+	if d.playback != nil {
+		d.playback.Stop()
+		d.playback = nil
+	}
+	d.state = rendererPaused
+	d.notifySubscribers("AVTransport")
+	return nil
+}
+
+func (d *Renderer) seekAction(args map[string]string) (map[string]string, error) {
+	if args["Unit"] != "REL_TIME" && args["Unit"] != "ABS_TIME" {
+		return nil, &upnpError{code: upnpErrorSeekModeNotAllowed, message: "Seek mode not supported"}
+	}
+	target := strings.TrimSpace(args["Target"])
+	if strings.Count(target, ":") != 2 {
+		return nil, &upnpError{code: upnpErrorInvalidArgs, message: "Invalid Args"}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.uri == "" {
+		return nil, &upnpError{code: upnpErrorTransition, message: "No media to seek"}
+	}
+	d.offset = parseUpnpDuration(target)
+	if d.state == rendererPlaying {
+		err := d.startPlayback()
+		if err != nil {
+			d.state = rendererStopped
+			d.notifyStopPlaying()
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (d *Renderer) transitionNotAvailableAction(args map[string]string) (map[string]string, error) {
+	return nil, &upnpError{code: upnpErrorTransition, message: "Transition not available"}
+}
+
+func (d *Renderer) listPresetsAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{"CurrentPresetNameList": "FactoryDefaults"}, nil
+}
+
+func (d *Renderer) selectPresetAction(args map[string]string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (d *Renderer) getMuteAction(args map[string]string) (map[string]string, error) {
+	if d.audio.Muted() {
+		return map[string]string{"CurrentMute": "1"}, nil
+	}
+	return map[string]string{"CurrentMute": "0"}, nil
+}
+
+func (d *Renderer) setMuteAction(args map[string]string) (map[string]string, error) {
+	desiredMute := args["DesiredMute"] == "1" || strings.EqualFold(args["DesiredMute"], "true")
+	err := d.request(event.RendererEventMuteData{Mute: desiredMute})
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.notifySubscribers("RenderingControl")
+	return nil, nil
+}
+
+func (d *Renderer) getVolumeAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{"CurrentVolume": strconv.FormatInt(d.audio.Volume(), 10)}, nil
+}
+
+func (d *Renderer) setVolumeAction(args map[string]string) (map[string]string, error) {
+	volume, err := strconv.ParseInt(strings.TrimSpace(args["DesiredVolume"]), 10, 64)
+	if err != nil || volume < 0 || volume > 100 {
+		return nil, &upnpError{code: upnpErrorInvalidArgs, message: "Invalid Args"}
+	}
+	err = d.request(event.RendererEventVolumeData{Volume: volume})
+	if err != nil {
+		return nil, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.notifySubscribers("RenderingControl")
+	return nil, nil
+}
+
+func (d *Renderer) getProtocolInfoAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{
+		"Source": "",
+		"Sink":   rendererSinkProtocolInfo,
+	}, nil
+}
+
+func (d *Renderer) getCurrentConnectionIdsAction(args map[string]string) (map[string]string, error) {
+	return map[string]string{"ConnectionIDs": "0"}, nil
+}
+
+func (d *Renderer) getCurrentConnectionInfoAction(args map[string]string) (map[string]string, error) {
+	if args["ConnectionID"] != "0" {
+		return nil, &upnpError{code: upnpErrorInvalidArgs, message: "Invalid connection reference"}
+	}
+	return map[string]string{
+		"RcsID":                 "0",
+		"AVTransportID":         "0",
+		"ProtocolInfo":          "",
+		"PeerConnectionManager": "",
+		"PeerConnectionID":      "-1",
+		"Direction":             "Input",
+		"Status":                "OK",
+	}, nil
+}
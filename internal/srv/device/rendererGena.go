@@ -0,0 +1,191 @@
+package device
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rendererSubscriptionTimeout = 1800 * time.Second
+	rendererNotifyTimeout       = 5 * time.Second
+)
+
+var rendererNotifyClient = &http.Client{Timeout: rendererNotifyTimeout}
+
+// rendererSubscription is a control point notified of the state changes of a service
+type rendererSubscription struct {
+	sid         string
+	serviceName string
+	callbacks   []string
+	expiry      time.Time
+	seq         int64
+}
+
+// subscriptionHandler answers the SUBSCRIBE and UNSUBSCRIBE requests of the control points
+func (d *Renderer) subscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	service := rendererServiceByName(strings.TrimPrefix(r.URL.Path, "/event/"))
+	if service == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("Sid")
+		if sid != "" {
+			// Renewal
+			subscription, ok := d.subscriptions[sid]
+			if !ok {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			subscription.expiry = time.Now().Add(rendererSubscriptionTimeout)
+			writeSubscriptionHeaders(w, sid)
+			return
+		}
+
+		// Callback header is a list of urls between angle brackets
+		var callbacks []string
+		for _, callback := range strings.Split(r.Header.Get("Callback"), ">") {
+			callback = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(callback), "<"))
+			if strings.HasPrefix(callback, "http://") {
+				callbacks = append(callbacks, callback)
+			}
+		}
+		if len(callbacks) == 0 || r.Header.Get("Nt") != "upnp:event" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+
+		subscription := &rendererSubscription{
+			sid:         newSid(),
+			serviceName: service.Name,
+			callbacks:   callbacks,
+			expiry:      time.Now().Add(rendererSubscriptionTimeout),
+		}
+		d.subscriptions[subscription.sid] = subscription
+		logrus.Debugf("UPnP control point %s subscribed to %s", r.RemoteAddr, service.Name)
+		writeSubscriptionHeaders(w, subscription.sid)
+
+		// The initial event is sent once the subscription has been acknowledged
+		go d.sendNotification(subscription, 0, d.eventProperties(service.Name))
+		subscription.seq++
+	case "UNSUBSCRIBE":
+		sid := r.Header.Get("Sid")
+		if _, ok := d.subscriptions[sid]; !ok {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		delete(d.subscriptions, sid)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSubscriptionHeaders(w http.ResponseWriter, sid string) {
+	w.Header().Set("Sid", sid)
+	w.Header().Set("Timeout", "Second-"+strconv.Itoa(int(rendererSubscriptionTimeout/time.Second)))
+	w.Header().Set("Server", rendererSsdpServer)
+}
+
+func newSid() string {
+	sidBytes := make([]byte, 16)
+	rand.Read(sidBytes)
+	return fmt.Sprintf("uuid:%x-%x-%x-%x-%x", sidBytes[0:4], sidBytes[4:6], sidBytes[6:8], sidBytes[8:10], sidBytes[10:16])
+}
+
+// eventProperties returns the evented state variables of a service, the transport and rendering states being
+// gathered into a LastChange variable
+func (d *Renderer) eventProperties(serviceName string) map[string]string {
+	switch serviceName {
+	case "AVTransport":
+		var lastChange strings.Builder
+		lastChange.WriteString(`<Event xmlns="urn:schemas-upnp-org:metadata-1-0/AVT/"><InstanceID val="0">`)
+		for _, variable := range [][2]string{
+			{"TransportState", d.state},
+			{"TransportStatus", "OK"},
+			{"CurrentTransportActions", d.currentTransportActions()},
+			{"AVTransportURI", d.uri},
+			{"AVTransportURIMetaData", d.metadata},
+			{"CurrentTrackURI", d.uri},
+			{"CurrentTrackMetaData", d.metadata},
+			{"CurrentTrackDuration", formatUpnpDuration(d.duration)},
+			{"CurrentMediaDuration", formatUpnpDuration(d.duration)},
+		} {
+			lastChange.WriteString(`<` + variable[0] + ` val="` + xmlEscape(variable[1]) + `"/>`)
+		}
+		lastChange.WriteString(`</InstanceID></Event>`)
+		return map[string]string{"LastChange": lastChange.String()}
+	case "RenderingControl":
+		mute := "0"
+		if d.audio.Muted() {
+			mute = "1"
+		}
+		return map[string]string{"LastChange": `<Event xmlns="urn:schemas-upnp-org:metadata-1-0/RCS/"><InstanceID val="0">` +
+			`<Volume channel="Master" val="` + strconv.FormatInt(d.audio.Volume(), 10) + `"/>` +
+			`<Mute channel="Master" val="` + mute + `"/>` +
+			`</InstanceID></Event>`}
+	default:
+		return map[string]string{
+			"SourceProtocolInfo":   "",
+			"SinkProtocolInfo":     rendererSinkProtocolInfo,
+			"CurrentConnectionIDs": "0",
+		}
+	}
+}
+
+// notifySubscribers sends the state of a service to the control points having subscribed to it
+func (d *Renderer) notifySubscribers(serviceName string) {
+	var properties map[string]string
+	for sid, subscription := range d.subscriptions {
+		if time.Now().After(subscription.expiry) {
+			delete(d.subscriptions, sid)
+			continue
+		}
+		if subscription.serviceName != serviceName {
+			continue
+		}
+		if properties == nil {
+			properties = d.eventProperties(serviceName)
+		}
+		go d.sendNotification(subscription, subscription.seq, properties)
+		subscription.seq++
+	}
+}
+
+func (d *Renderer) sendNotification(subscription *rendererSubscription, seq int64, properties map[string]string) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="utf-8"?><e:propertyset xmlns:e="urn:schemas-upnp-org:event-1-0">`)
+	for name, value := range properties {
+		body.WriteString(`<e:property><` + name + `>` + xmlEscape(value) + `</` + name + `></e:property>`)
+	}
+	body.WriteString(`</e:propertyset>`)
+
+	// The first reachable callback url is used
+	for _, callback := range subscription.callbacks {
+		req, err := http.NewRequest("NOTIFY", callback, strings.NewReader(body.String()))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+		req.Header.Set("Nt", "upnp:event")
+		req.Header.Set("Nts", "upnp:propchange")
+		req.Header.Set("Sid", subscription.sid)
+		req.Header.Set("Seq", strconv.FormatInt(seq, 10))
+		resp, err := rendererNotifyClient.Do(req)
+		if err != nil {
+			logrus.Debugf("Unable to notify UPnP control point %s: %v", callback, err)
+			continue
+		}
+		resp.Body.Close()
+		return
+	}
+}
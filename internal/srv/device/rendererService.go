@@ -0,0 +1,241 @@
+package device
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strings"
+)
+
+const (
+	upnpMediaRendererType     = "urn:schemas-upnp-org:device:MediaRenderer:1"
+	upnpAvTransportType       = "urn:schemas-upnp-org:service:AVTransport:1"
+	upnpRenderingControlType  = "urn:schemas-upnp-org:service:RenderingControl:1"
+	upnpConnectionManagerType = "urn:schemas-upnp-org:service:ConnectionManager:1"
+)
+
+// Audio formats accepted from the control points
+var rendererSinkProtocolInfo = strings.Join([]string{
+	"http-get:*:audio/mpeg:*",
+	"http-get:*:audio/mp3:*",
+	"http-get:*:audio/mp4:*",
+	"http-get:*:audio/aac:*",
+	"http-get:*:audio/x-aac:*",
+	"http-get:*:audio/flac:*",
+	"http-get:*:audio/x-flac:*",
+	"http-get:*:audio/ogg:*",
+	"http-get:*:audio/x-ogg:*",
+	"http-get:*:audio/wav:*",
+	"http-get:*:audio/x-wav:*",
+	"http-get:*:audio/L16:*",
+	"http-get:*:audio/x-ms-wma:*",
+}, ",")
+
+// rendererService is a service of the media renderer, described by its SCPD
+type rendererService struct {
+	Id             string
+	Type           string
+	Name           string
+	Actions        []rendererAction
+	StateVariables []rendererStateVariable
+}
+
+type rendererAction struct {
+	Name string
+	// Arguments as name:state variable pairs
+	In  []string
+	Out []string
+}
+
+type rendererStateVariable struct {
+	Name          string
+	DataType      string
+	SendEvents    bool
+	AllowedValues []string
+}
+
+var rendererServices = []rendererService{
+	{
+		Id:   "urn:upnp-org:serviceId:AVTransport",
+		Type: upnpAvTransportType,
+		Name: "AVTransport",
+		Actions: []rendererAction{
+			{Name: "SetAVTransportURI", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "CurrentURI:AVTransportURI", "CurrentURIMetaData:AVTransportURIMetaData"}},
+			{Name: "GetMediaInfo", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"NrTracks:NumberOfTracks", "MediaDuration:CurrentMediaDuration", "CurrentURI:AVTransportURI", "CurrentURIMetaData:AVTransportURIMetaData", "NextURI:NextAVTransportURI", "NextURIMetaData:NextAVTransportURIMetaData", "PlayMedium:PlaybackStorageMedium", "RecordMedium:RecordStorageMedium", "WriteStatus:RecordMediumWriteStatus"}},
+			{Name: "GetTransportInfo", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"CurrentTransportState:TransportState", "CurrentTransportStatus:TransportStatus", "CurrentSpeed:TransportPlaySpeed"}},
+			{Name: "GetPositionInfo", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"Track:CurrentTrack", "TrackDuration:CurrentTrackDuration", "TrackMetaData:CurrentTrackMetaData", "TrackURI:CurrentTrackURI", "RelTime:RelativeTimePosition", "AbsTime:AbsoluteTimePosition", "RelCount:RelativeCounterPosition", "AbsCount:AbsoluteCounterPosition"}},
+			{Name: "GetDeviceCapabilities", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"PlayMedia:PossiblePlaybackStorageMedia", "RecMedia:PossibleRecordStorageMedia", "RecQualityModes:PossibleRecordQualityModes"}},
+			{Name: "GetTransportSettings", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"PlayMode:CurrentPlayMode", "RecQualityMode:CurrentRecordQualityMode"}},
+			{Name: "GetCurrentTransportActions", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"Actions:CurrentTransportActions"}},
+			{Name: "Stop", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}},
+			{Name: "Play", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Speed:TransportPlaySpeed"}},
+			{Name: "Pause", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}},
+			{Name: "Seek", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Unit:A_ARG_TYPE_SeekMode", "Target:A_ARG_TYPE_SeekTarget"}},
+			{Name: "Next", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}},
+			{Name: "Previous", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}},
+		},
+		StateVariables: []rendererStateVariable{
+			{Name: "TransportState", DataType: "string", AllowedValues: []string{"STOPPED", "PLAYING", "PAUSED_PLAYBACK", "TRANSITIONING", "NO_MEDIA_PRESENT"}},
+			{Name: "TransportStatus", DataType: "string", AllowedValues: []string{"OK", "ERROR_OCCURRED"}},
+			{Name: "PlaybackStorageMedium", DataType: "string", AllowedValues: []string{"NONE", "NETWORK"}},
+			{Name: "RecordStorageMedium", DataType: "string", AllowedValues: []string{"NOT_IMPLEMENTED"}},
+			{Name: "PossiblePlaybackStorageMedia", DataType: "string"},
+			{Name: "PossibleRecordStorageMedia", DataType: "string"},
+			{Name: "CurrentPlayMode", DataType: "string", AllowedValues: []string{"NORMAL"}},
+			{Name: "TransportPlaySpeed", DataType: "string", AllowedValues: []string{"1"}},
+			{Name: "RecordMediumWriteStatus", DataType: "string", AllowedValues: []string{"NOT_IMPLEMENTED"}},
+			{Name: "CurrentRecordQualityMode", DataType: "string", AllowedValues: []string{"NOT_IMPLEMENTED"}},
+			{Name: "PossibleRecordQualityModes", DataType: "string"},
+			{Name: "NumberOfTracks", DataType: "ui4"},
+			{Name: "CurrentTrack", DataType: "ui4"},
+			{Name: "CurrentTrackDuration", DataType: "string"},
+			{Name: "CurrentMediaDuration", DataType: "string"},
+			{Name: "CurrentTrackMetaData", DataType: "string"},
+			{Name: "CurrentTrackURI", DataType: "string"},
+			{Name: "AVTransportURI", DataType: "string"},
+			{Name: "AVTransportURIMetaData", DataType: "string"},
+			{Name: "NextAVTransportURI", DataType: "string"},
+			{Name: "NextAVTransportURIMetaData", DataType: "string"},
+			{Name: "RelativeTimePosition", DataType: "string"},
+			{Name: "AbsoluteTimePosition", DataType: "string"},
+			{Name: "RelativeCounterPosition", DataType: "i4"},
+			{Name: "AbsoluteCounterPosition", DataType: "i4"},
+			{Name: "CurrentTransportActions", DataType: "string"},
+			{Name: "LastChange", DataType: "string", SendEvents: true},
+			{Name: "A_ARG_TYPE_SeekMode", DataType: "string", AllowedValues: []string{"REL_TIME", "ABS_TIME"}},
+			{Name: "A_ARG_TYPE_SeekTarget", DataType: "string"},
+			{Name: "A_ARG_TYPE_InstanceID", DataType: "ui4"},
+		},
+	},
+	{
+		Id:   "urn:upnp-org:serviceId:RenderingControl",
+		Type: upnpRenderingControlType,
+		Name: "RenderingControl",
+		Actions: []rendererAction{
+			{Name: "ListPresets", In: []string{"InstanceID:A_ARG_TYPE_InstanceID"}, Out: []string{"CurrentPresetNameList:PresetNameList"}},
+			{Name: "SelectPreset", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "PresetName:A_ARG_TYPE_PresetName"}},
+			{Name: "GetMute", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Channel:A_ARG_TYPE_Channel"}, Out: []string{"CurrentMute:Mute"}},
+			{Name: "SetMute", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Channel:A_ARG_TYPE_Channel", "DesiredMute:Mute"}},
+			{Name: "GetVolume", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Channel:A_ARG_TYPE_Channel"}, Out: []string{"CurrentVolume:Volume"}},
+			{Name: "SetVolume", In: []string{"InstanceID:A_ARG_TYPE_InstanceID", "Channel:A_ARG_TYPE_Channel", "DesiredVolume:Volume"}},
+		},
+		StateVariables: []rendererStateVariable{
+			{Name: "PresetNameList", DataType: "string"},
+			{Name: "Mute", DataType: "boolean"},
+			{Name: "Volume", DataType: "ui2"},
+			{Name: "LastChange", DataType: "string", SendEvents: true},
+			{Name: "A_ARG_TYPE_Channel", DataType: "string", AllowedValues: []string{"Master"}},
+			{Name: "A_ARG_TYPE_PresetName", DataType: "string", AllowedValues: []string{"FactoryDefaults"}},
+			{Name: "A_ARG_TYPE_InstanceID", DataType: "ui4"},
+		},
+	},
+	{
+		Id:   "urn:upnp-org:serviceId:ConnectionManager",
+		Type: upnpConnectionManagerType,
+		Name: "ConnectionManager",
+		Actions: []rendererAction{
+			{Name: "GetProtocolInfo", Out: []string{"Source:SourceProtocolInfo", "Sink:SinkProtocolInfo"}},
+			{Name: "GetCurrentConnectionIDs", Out: []string{"ConnectionIDs:CurrentConnectionIDs"}},
+			{Name: "GetCurrentConnectionInfo", In: []string{"ConnectionID:A_ARG_TYPE_ConnectionID"}, Out: []string{"RcsID:A_ARG_TYPE_RcsID", "AVTransportID:A_ARG_TYPE_AVTransportID", "ProtocolInfo:A_ARG_TYPE_ProtocolInfo", "PeerConnectionManager:A_ARG_TYPE_ConnectionManager", "PeerConnectionID:A_ARG_TYPE_ConnectionID", "Direction:A_ARG_TYPE_Direction", "Status:A_ARG_TYPE_ConnectionStatus"}},
+		},
+		StateVariables: []rendererStateVariable{
+			{Name: "SourceProtocolInfo", DataType: "string", SendEvents: true},
+			{Name: "SinkProtocolInfo", DataType: "string", SendEvents: true},
+			{Name: "CurrentConnectionIDs", DataType: "string", SendEvents: true},
+			{Name: "A_ARG_TYPE_ConnectionStatus", DataType: "string", AllowedValues: []string{"OK", "ContentFormatMismatch", "InsufficientBandwidth", "UnreliableChannel", "Unknown"}},
+			{Name: "A_ARG_TYPE_ConnectionManager", DataType: "string"},
+			{Name: "A_ARG_TYPE_Direction", DataType: "string", AllowedValues: []string{"Input", "Output"}},
+			{Name: "A_ARG_TYPE_ProtocolInfo", DataType: "string"},
+			{Name: "A_ARG_TYPE_ConnectionID", DataType: "i4"},
+			{Name: "A_ARG_TYPE_AVTransportID", DataType: "i4"},
+			{Name: "A_ARG_TYPE_RcsID", DataType: "i4"},
+		},
+	},
+}
+
+// rendererServiceByName returns the service controlled by the given url path element
+func rendererServiceByName(name string) *rendererService {
+	for i := range rendererServices {
+		if rendererServices[i].Name == name {
+			return &rendererServices[i]
+		}
+	}
+	return nil
+}
+
+// rendererDescription is the device description read by the control points
+func rendererDescription(name string, udn string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<root xmlns="urn:schemas-upnp-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion>` +
+		`<device>` +
+		`<deviceType>` + upnpMediaRendererType + `</deviceType>` +
+		`<friendlyName>` + xmlEscape(name) + `</friendlyName>` +
+		`<manufacturer>vekigi</manufacturer>` +
+		`<modelName>vekigi</modelName>` +
+		`<UDN>` + udn + `</UDN>` +
+		`<serviceList>`)
+	for _, service := range rendererServices {
+		buffer.WriteString(`<service>` +
+			`<serviceType>` + service.Type + `</serviceType>` +
+			`<serviceId>` + service.Id + `</serviceId>` +
+			`<SCPDURL>/` + service.Name + `.xml</SCPDURL>` +
+			`<controlURL>/control/` + service.Name + `</controlURL>` +
+			`<eventSubURL>/event/` + service.Name + `</eventSubURL>` +
+			`</service>`)
+	}
+	buffer.WriteString(`</serviceList></device></root>`)
+	return buffer.Bytes()
+}
+
+// scpd describes the actions and the state variables of the service
+func (s *rendererService) scpd() []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString(`<?xml version="1.0" encoding="utf-8"?>` +
+		`<scpd xmlns="urn:schemas-upnp-org:service-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion>` +
+		`<actionList>`)
+	for _, action := range s.Actions {
+		buffer.WriteString(`<action><name>` + action.Name + `</name><argumentList>`)
+		for _, direction := range []struct {
+			name      string
+			arguments []string
+		}{{"in", action.In}, {"out", action.Out}} {
+			for _, argument := range direction.arguments {
+				parts := strings.SplitN(argument, ":", 2)
+				buffer.WriteString(`<argument>` +
+					`<name>` + parts[0] + `</name>` +
+					`<direction>` + direction.name + `</direction>` +
+					`<relatedStateVariable>` + parts[1] + `</relatedStateVariable>` +
+					`</argument>`)
+			}
+		}
+		buffer.WriteString(`</argumentList></action>`)
+	}
+	buffer.WriteString(`</actionList><serviceStateTable>`)
+	for _, stateVariable := range s.StateVariables {
+		sendEvents := "no"
+		if stateVariable.SendEvents {
+			sendEvents = "yes"
+		}
+		buffer.WriteString(`<stateVariable sendEvents="` + sendEvents + `">` +
+			`<name>` + stateVariable.Name + `</name>` +
+			`<dataType>` + stateVariable.DataType + `</dataType>`)
+		if len(stateVariable.AllowedValues) > 0 {
+			buffer.WriteString(`<allowedValueList>`)
+			for _, allowedValue := range stateVariable.AllowedValues {
+				buffer.WriteString(`<allowedValue>` + allowedValue + `</allowedValue>`)
+			}
+			buffer.WriteString(`</allowedValueList>`)
+		}
+		buffer.WriteString(`</stateVariable>`)
+	}
+	buffer.WriteString(`</serviceStateTable></scpd>`)
+	return buffer.Bytes()
+}
+
+func xmlEscape(text string) string {
+	var buffer bytes.Buffer
+	xml.EscapeText(&buffer, []byte(text))
+	return buffer.String()
+}
@@ -0,0 +1,178 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Validity of the advertisements, renewed before expiry
+	rendererSsdpMaxAge       = 1800
+	rendererSsdpNotifyPeriod = 10 * time.Minute
+	rendererSsdpServer       = "Linux UPnP/1.0 vekigi/1.0"
+)
+
+// rendererSsdp advertises the media renderer on the local network and answers the M-SEARCH requests of the
+// control points
+type rendererSsdp struct {
+	udn  string
+	port int64
+
+	conn *net.UDPConn
+	quit chan struct{}
+}
+
+func newRendererSsdp(udn string, port int64) *rendererSsdp {
+	return &rendererSsdp{
+		udn:  udn,
+		port: port,
+		quit: make(chan struct{}),
+	}
+}
+
+func (s *rendererSsdp) start() error {
+	ssdpAddr, err := net.ResolveUDPAddr("udp4", upnpSsdpAddress)
+	if err != nil {
+		return err
+	}
+	s.conn, err = net.ListenMulticastUDP("udp4", nil, ssdpAddr)
+	if err != nil {
+		return err
+	}
+
+	go s.listen()
+	go func() {
+		ticker := time.NewTicker(rendererSsdpNotifyPeriod)
+		defer ticker.Stop()
+		for {
+			s.notify("ssdp:alive")
+			select {
+			case <-ticker.C:
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *rendererSsdp) stop() {
+	close(s.quit)
+	s.notify("ssdp:byebye")
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// targets returns the notification types with their unique service names
+func (s *rendererSsdp) targets() map[string]string {
+	targets := map[string]string{
+		"upnp:rootdevice":     s.udn + "::upnp:rootdevice",
+		s.udn:                 s.udn,
+		upnpMediaRendererType: s.udn + "::" + upnpMediaRendererType,
+	}
+	for _, service := range rendererServices {
+		targets[service.Type] = s.udn + "::" + service.Type
+	}
+	return targets
+}
+
+func (s *rendererSsdp) location(localIp net.IP) string {
+	return "http://" + net.JoinHostPort(localIp.String(), strconv.FormatInt(s.port, 10)) + "/description.xml"
+}
+
+// notify multicasts an alive or a byebye notification for each target
+func (s *rendererSsdp) notify(nts string) {
+	ssdpAddr, err := net.ResolveUDPAddr("udp4", upnpSsdpAddress)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp4", nil, ssdpAddr)
+	if err != nil {
+		logrus.Warnf("Unable to advertise UPnP renderer: %v", err)
+		return
+	}
+	defer conn.Close()
+	localIp := conn.LocalAddr().(*net.UDPAddr).IP
+
+	for nt, usn := range s.targets() {
+		message := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: " + upnpSsdpAddress + "\r\n" +
+			"NT: " + nt + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + usn + "\r\n"
+		if nts == "ssdp:alive" {
+			message += "CACHE-CONTROL: max-age=" + strconv.Itoa(rendererSsdpMaxAge) + "\r\n" +
+				"LOCATION: " + s.location(localIp) + "\r\n" +
+				"SERVER: " + rendererSsdpServer + "\r\n"
+		}
+		_, err = conn.Write([]byte(message + "\r\n"))
+		if err != nil {
+			logrus.Warnf("Unable to advertise UPnP renderer: %v", err)
+			return
+		}
+	}
+}
+
+// listen answers the M-SEARCH requests matching the renderer
+func (s *rendererSsdp) listen() {
+	buffer := make([]byte, 4096)
+	for {
+		n, remoteAddr, err := s.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				logrus.Errorf("Unable to read SSDP request: %v", err)
+			}
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffer[:n])))
+		if err != nil || req.Method != "M-SEARCH" || strings.Trim(req.Header.Get("Man"), `"`) != "ssdp:discover" {
+			continue
+		}
+
+		searchTarget := req.Header.Get("St")
+		targets := s.targets()
+		if searchTarget != "ssdp:all" {
+			usn, ok := targets[searchTarget]
+			if !ok {
+				continue
+			}
+			targets = map[string]string{searchTarget: usn}
+		}
+		go s.answer(remoteAddr, targets)
+	}
+}
+
+func (s *rendererSsdp) answer(remoteAddr *net.UDPAddr, targets map[string]string) {
+	conn, err := net.DialUDP("udp4", nil, remoteAddr)
+	if err != nil {
+		logrus.Warnf("Unable to answer SSDP request of %s: %v", remoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	localIp := conn.LocalAddr().(*net.UDPAddr).IP
+
+	for st, usn := range targets {
+		response := "HTTP/1.1 200 OK\r\n" +
+			"CACHE-CONTROL: max-age=" + strconv.Itoa(rendererSsdpMaxAge) + "\r\n" +
+			"DATE: " + time.Now().UTC().Format(http.TimeFormat) + "\r\n" +
+			"EXT:\r\n" +
+			"LOCATION: " + s.location(localIp) + "\r\n" +
+			"SERVER: " + rendererSsdpServer + "\r\n" +
+			"ST: " + st + "\r\n" +
+			"USN: " + usn + "\r\n\r\n"
+		_, err = conn.Write([]byte(response))
+		if err != nil {
+			logrus.Warnf("Unable to answer SSDP request of %s: %v", remoteAddr, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package device
+
+import (
+	"encoding/xml"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/event"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type rendererFaultXml struct {
+	ErrorCode int `xml:"Body>Fault>detail>UPnPError>errorCode"`
+}
+
+// newTestRenderer serves the control urls of a renderer, without advertising it
+func newTestRenderer(t *testing.T) (*Renderer, *httptest.Server) {
+	renderer := NewRenderer(&config.ServerConfig{ServerParam: &config.ServerParam{RendererParam: &config.RendererParam{}}}, nil)
+	server := httptest.NewServer(http.HandlerFunc(renderer.controlHandler))
+	t.Cleanup(func() {
+		// Actions waiting for the event loop give up first
+		close(renderer.quit)
+		server.Close()
+	})
+	return renderer, server
+}
+
+// callRendererAction sends a SOAP action and returns the response body and the UPnP error code, 0 on success
+func callRendererAction(t *testing.T, server *httptest.Server, serviceName string, actionName string, args map[string]string) (string, int) {
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`)
+	body.WriteString(`<u:` + actionName + ` xmlns:u="urn:schemas-upnp-org:service:` + serviceName + `:1"><InstanceID>0</InstanceID>`)
+	for name, value := range args {
+		body.WriteString(`<` + name + `>` + xmlEscape(value) + `</` + name + `>`)
+	}
+	body.WriteString(`</u:` + actionName + `></s:Body></s:Envelope>`)
+
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/control/"+serviceName, strings.NewReader(body.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("SOAPAction", `"urn:schemas-upnp-org:service:`+serviceName+`:1#`+actionName+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return string(response), 0
+	}
+	var fault rendererFaultXml
+	err = xml.Unmarshal(response, &fault)
+	if err != nil {
+		t.Fatalf("Invalid fault %s", response)
+	}
+	return string(response), fault.ErrorCode
+}
+
+func TestRendererCastUri(t *testing.T) {
+	renderer, server := newTestRenderer(t)
+
+	for _, uri := range []string{"http://nas:8200/song.mp3", " https://nas/song.flac ", ""} {
+		_, errorCode := callRendererAction(t, server, "AVTransport", "SetAVTransportURI", map[string]string{"CurrentURI": uri, "CurrentURIMetaData": ""})
+		if errorCode != 0 {
+			t.Errorf("Url \"%s\" rejected with error %d", uri, errorCode)
+		}
+	}
+
+	_, errorCode := callRendererAction(t, server, "AVTransport", "SetAVTransportURI", map[string]string{"CurrentURI": "http://nas:8200/song.mp3"})
+	if errorCode != 0 {
+		t.Fatalf("Url rejected with error %d", errorCode)
+	}
+	// Local files, player options and other protocols are not read
+	for _, uri := range []string{
+		"file:///etc/passwd",
+		"/etc/passwd",
+		"--sout=#file{dst=/tmp/out}",
+		"rtsp://nas/stream",
+		"concat:/etc/passwd|/etc/hosts",
+		"http://",
+		"http:/etc/passwd",
+	} {
+		_, errorCode := callRendererAction(t, server, "AVTransport", "SetAVTransportURI", map[string]string{"CurrentURI": uri})
+		if errorCode != upnpErrorInvalidArgs {
+			t.Errorf("Url \"%s\" answered with error %d, expected %d", uri, errorCode, upnpErrorInvalidArgs)
+		}
+	}
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+	if renderer.uri != "http://nas:8200/song.mp3" {
+		t.Errorf("Url %s kept, expected the last valid one", renderer.uri)
+	}
+}
+
+func TestRendererActionErrors(t *testing.T) {
+	_, server := newTestRenderer(t)
+
+	for _, test := range []struct {
+		serviceName       string
+		actionName        string
+		args              map[string]string
+		expectedErrorCode int
+	}{
+		{serviceName: "AVTransport", actionName: "Unknown", expectedErrorCode: upnpErrorInvalidAction},
+		{serviceName: "AVTransport", actionName: "Pause", expectedErrorCode: upnpErrorTransition},
+		{serviceName: "AVTransport", actionName: "Next", expectedErrorCode: upnpErrorTransition},
+		{serviceName: "RenderingControl", actionName: "SetVolume", args: map[string]string{"Channel": "Master", "DesiredVolume": "101"}, expectedErrorCode: upnpErrorInvalidArgs},
+		{serviceName: "AVTransport", actionName: "GetTransportInfo", expectedErrorCode: 0},
+	} {
+		response, errorCode := callRendererAction(t, server, test.serviceName, test.actionName, test.args)
+		if errorCode != test.expectedErrorCode {
+			t.Errorf("%s#%s answered with error %d, expected %d: %s", test.serviceName, test.actionName, errorCode, test.expectedErrorCode, response)
+		}
+	}
+}
+
+func TestRendererVolumeThroughEventLoop(t *testing.T) {
+	renderer, server := newTestRenderer(t)
+
+	// The event loop sets the volume and the mute
+	received := make(chan interface{}, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			select {
+			case ev := <-renderer.EventChannel():
+				received <- ev.Data
+				ev.Result <- nil
+			case <-renderer.quit:
+				return
+			}
+		}
+	}()
+
+	_, errorCode := callRendererAction(t, server, "RenderingControl", "SetVolume", map[string]string{"Channel": "Master", "DesiredVolume": "35"})
+	if errorCode != 0 {
+		t.Fatalf("SetVolume failed with error %d", errorCode)
+	}
+	if data, ok := (<-received).(event.RendererEventVolumeData); !ok || data.Volume != 35 {
+		t.Errorf("Event %v, expected a volume of 35", data)
+	}
+
+	_, errorCode = callRendererAction(t, server, "RenderingControl", "SetMute", map[string]string{"Channel": "Master", "DesiredMute": "true"})
+	if errorCode != 0 {
+		t.Fatalf("SetMute failed with error %d", errorCode)
+	}
+	if data, ok := (<-received).(event.RendererEventMuteData); !ok || !data.Mute {
+		t.Errorf("Event %v, expected a mute", data)
+	}
+}
@@ -0,0 +1,165 @@
+package device
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/version"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultStationDirectoryUrl = "https://all.api.radio-browser.info"
+	defaultStationSearchLimit  = 20
+	maxStationSearchLimit      = 200
+	stationDirectoryTimeout    = 30 * time.Second
+)
+
+// StationQuery filters the stations of the directory, every criterion being optional
+type StationQuery struct {
+	Name string
+	// ISO 3166-1 alpha-2 code
+	CountryCode string
+	Tag         string
+	Limit       int64
+}
+
+type radioBrowserStation struct {
+	StationUuid string `json:"stationuuid"`
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	UrlResolved string `json:"url_resolved"`
+	Homepage    string `json:"homepage"`
+	Tags        string `json:"tags"`
+	CountryCode string `json:"countrycode"`
+	Codec       string `json:"codec"`
+	Bitrate     int64  `json:"bitrate"`
+}
+
+// StationDirectory searches webradios in a radio-browser compatible directory
+type StationDirectory struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+func NewStationDirectory(serverConfig *config.ServerConfig) *StationDirectory {
+	stationDirectory := StationDirectory{
+		baseUrl:    strings.TrimSuffix(serverConfig.StationDirectoryUrl, "/"),
+		httpClient: &http.Client{Timeout: stationDirectoryTimeout},
+	}
+	if stationDirectory.baseUrl == "" {
+		stationDirectory.baseUrl = defaultStationDirectoryUrl
+	}
+	return &stationDirectory
+}
+
+// Search returns the working stations matching the query, most popular first
+func (d *StationDirectory) Search(query StationQuery) ([]apimodel.Station, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultStationSearchLimit
+	}
+	if limit > maxStationSearchLimit {
+		limit = maxStationSearchLimit
+	}
+	params := url.Values{
+		"hidebroken": {"true"},
+		"order":      {"clickcount"},
+		"reverse":    {"true"},
+		"limit":      {strconv.FormatInt(limit, 10)},
+	}
+	if query.Name != "" {
+		params.Set("name", query.Name)
+	}
+	if query.CountryCode != "" {
+		params.Set("countrycode", strings.ToUpper(query.CountryCode))
+	}
+	if query.Tag != "" {
+		params.Set("tag", strings.ToLower(query.Tag))
+	}
+	return d.get("/json/stations/search", params)
+}
+
+// Stations returns the stations with the given uuids, in the same order. Unknown uuids are an error.
+func (d *StationDirectory) Stations(stationUuids []string) ([]apimodel.Station, error) {
+	if len(stationUuids) == 0 {
+		return nil, nil
+	}
+	found, err := d.get("/json/stations/byuuid", url.Values{"uuids": {strings.Join(stationUuids, ",")}})
+	if err != nil {
+		return nil, err
+	}
+
+	stationsByUuid := make(map[string]apimodel.Station)
+	for _, station := range found {
+		stationsByUuid[station.StationUuid] = station
+	}
+	var stations []apimodel.Station
+	for _, stationUuid := range stationUuids {
+		station, ok := stationsByUuid[stationUuid]
+		if !ok {
+			return nil, fmt.Errorf("Station %s not found", stationUuid)
+		}
+		stations = append(stations, station)
+	}
+	return stations, nil
+}
+
+func (d *StationDirectory) get(path string, params url.Values) ([]apimodel.Station, error) {
+	req, err := http.NewRequest(http.MethodGet, d.baseUrl+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// The directory asks for a user agent naming the application
+	req.Header.Set("User-Agent", "vekigi/"+version.AppVersion.String())
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s from station directory", resp.Status)
+	}
+
+	var radioBrowserStations []radioBrowserStation
+	err = json.NewDecoder(resp.Body).Decode(&radioBrowserStations)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to interpret station directory response: %v", err)
+	}
+
+	stations := make([]apimodel.Station, 0, len(radioBrowserStations))
+	for _, radioBrowserStation := range radioBrowserStations {
+		stations = append(stations, radioBrowserStation.station())
+	}
+	return stations, nil
+}
+
+// station converts a station of the directory, its resolved stream url being tried before the original one, which
+// may be a playlist file
+func (s radioBrowserStation) station() apimodel.Station {
+	station := apimodel.Station{
+		StationUuid: s.StationUuid,
+		Name:        strings.TrimSpace(s.Name),
+		Homepage:    s.Homepage,
+		CountryCode: s.CountryCode,
+		Codec:       s.Codec,
+		Bitrate:     s.Bitrate,
+	}
+	for _, streamUrl := range []string{s.UrlResolved, s.Url} {
+		streamUrl = strings.TrimSpace(streamUrl)
+		if streamUrl != "" && (len(station.Urls) == 0 || station.Urls[0] != streamUrl) {
+			station.Urls = append(station.Urls, streamUrl)
+		}
+	}
+	for _, tag := range strings.Split(s.Tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			station.Tags = append(station.Tags, tag)
+		}
+	}
+	return station
+}
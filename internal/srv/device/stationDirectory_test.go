@@ -0,0 +1,134 @@
+package device
+
+import (
+	"encoding/json"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testRadioBrowserStations = []radioBrowserStation{
+	{StationUuid: "a1", Name: " Jazz FM ", Url: "http://jazz/listen.pls", UrlResolved: "http://jazz/stream", Tags: "jazz, smooth jazz,", CountryCode: "FR", Codec: "MP3", Bitrate: 128},
+	{StationUuid: "b2", Name: "News", Url: "http://news/stream", UrlResolved: "http://news/stream", CountryCode: "GB", Codec: "AAC", Bitrate: 64},
+}
+
+// stubStationDirectory answers the station searches and the station lookups by uuid of a radio-browser directory
+type stubStationDirectory struct {
+	*httptest.Server
+	lock        sync.Mutex
+	searchQuery url.Values
+}
+
+func newStubStationDirectory(t *testing.T) *stubStationDirectory {
+	directory := &stubStationDirectory{}
+	directory.Server = httptest.NewServer(http.HandlerFunc(directory.serveHTTP))
+	t.Cleanup(directory.Close)
+	return directory
+}
+
+func (s *stubStationDirectory) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.UserAgent(), "vekigi/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/json/stations/search":
+		s.lock.Lock()
+		s.searchQuery = r.URL.Query()
+		s.lock.Unlock()
+		json.NewEncoder(w).Encode(testRadioBrowserStations)
+	case "/json/stations/byuuid":
+		// Found stations are returned in the order of the directory
+		var stations []radioBrowserStation
+		uuids := "," + r.URL.Query().Get("uuids") + ","
+		for _, station := range testRadioBrowserStations {
+			if strings.Contains(uuids, ","+station.StationUuid+",") {
+				stations = append(stations, station)
+			}
+		}
+		json.NewEncoder(w).Encode(stations)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newTestStationDirectory(directoryUrl string) *StationDirectory {
+	return NewStationDirectory(&config.ServerConfig{ServerParam: &config.ServerParam{StationDirectoryUrl: directoryUrl + "/"}})
+}
+
+func TestStationDirectorySearch(t *testing.T) {
+	directory := newStubStationDirectory(t)
+	stationDirectory := newTestStationDirectory(directory.URL)
+
+	stations, err := stationDirectory.Search(StationQuery{Name: "jazz", CountryCode: "fr", Tag: "Smooth", Limit: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory.lock.Lock()
+	query := directory.searchQuery
+	directory.lock.Unlock()
+	for name, expectedValue := range map[string]string{
+		"name":        "jazz",
+		"countrycode": "FR",
+		"tag":         "smooth",
+		"limit":       "200",
+		"hidebroken":  "true",
+		"order":       "clickcount",
+		"reverse":     "true",
+	} {
+		if query.Get(name) != expectedValue {
+			t.Errorf("Search parameter %s: \"%s\", expected \"%s\"", name, query.Get(name), expectedValue)
+		}
+	}
+
+	if len(stations) != 2 {
+		t.Fatalf("%d stations found, expected 2", len(stations))
+	}
+	// The resolved url is tried first, the same url not being listed twice
+	if stations[0].Name != "Jazz FM" || strings.Join(stations[0].Urls, " ") != "http://jazz/stream http://jazz/listen.pls" ||
+		strings.Join(stations[0].Tags, "|") != "jazz|smooth jazz" || stations[0].Bitrate != 128 {
+		t.Errorf("Station %+v", stations[0])
+	}
+	if strings.Join(stations[1].Urls, " ") != "http://news/stream" {
+		t.Errorf("Station urls %v, expected a single one", stations[1].Urls)
+	}
+
+	// Default limit
+	_, err = stationDirectory.Search(StationQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	directory.lock.Lock()
+	defer directory.lock.Unlock()
+	if directory.searchQuery.Get("limit") != "20" || directory.searchQuery.Get("name") != "" {
+		t.Errorf("Search parameters %v, expected the default limit only", directory.searchQuery)
+	}
+}
+
+func TestStationDirectoryStations(t *testing.T) {
+	directory := newStubStationDirectory(t)
+	stationDirectory := newTestStationDirectory(directory.URL)
+
+	// In the order of the uuids
+	stations, err := stationDirectory.Stations([]string{"b2", "a1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stations) != 2 || stations[0].StationUuid != "b2" || stations[1].StationUuid != "a1" {
+		t.Errorf("Stations %v, expected b2 then a1", stations)
+	}
+
+	_, err = stationDirectory.Stations([]string{"a1", "unknown"})
+	if err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Error \"%v\", expected the unknown station", err)
+	}
+
+	_, err = newTestStationDirectory(directory.URL + "/missing").Stations([]string{"a1"})
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Error \"%v\", expected the http status", err)
+	}
+}
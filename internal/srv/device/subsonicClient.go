@@ -0,0 +1,180 @@
+package device
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	subsonicApiVersion = "1.16.1"
+	subsonicClientName = "vekigi"
+	subsonicTimeout    = 30 * time.Second
+	// Prefix of the subsonic playlist ids
+	subsonicPlaylistIdPrefix = "subsonic:"
+)
+
+// subsonicId accepts the ids given as strings by recent servers and as numbers by the older ones
+type subsonicId string
+
+func (id *subsonicId) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&value)
+	if err != nil {
+		return err
+	}
+	*id = subsonicId(fmt.Sprint(value))
+	return nil
+}
+
+type subsonicSong struct {
+	Id     subsonicId `json:"id"`
+	Title  string     `json:"title"`
+	Artist string     `json:"artist"`
+	// Duration in seconds
+	Duration int64 `json:"duration"`
+}
+
+type subsonicPlaylist struct {
+	Id    subsonicId     `json:"id"`
+	Name  string         `json:"name"`
+	Songs []subsonicSong `json:"entry"`
+}
+
+type subsonicResponse struct {
+	Response struct {
+		Status string `json:"status"`
+		Error  *struct {
+			Code    int64  `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Playlists *struct {
+			Playlist []subsonicPlaylist `json:"playlist"`
+		} `json:"playlists"`
+		Playlist *subsonicPlaylist `json:"playlist"`
+	} `json:"subsonic-response"`
+}
+
+// subsonicClient calls the Subsonic REST API, authenticating each request with a salted token. It is the remote
+// library of the subsonic playlist player.
+type subsonicClient struct {
+	subsonicParam *config.SubsonicParam
+	httpClient    *http.Client
+}
+
+func NewSubsonicPlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio) PlaylistPlayer {
+	return newRemotePlaylistPlayer(serverConfig, audio, newSubsonicClient(serverConfig.SubsonicParam), serverConfig.SubsonicParam.RefreshPeriod)
+}
+
+func newSubsonicClient(subsonicParam *config.SubsonicParam) *subsonicClient {
+	return &subsonicClient{
+		subsonicParam: subsonicParam,
+		httpClient:    &http.Client{Timeout: subsonicTimeout},
+	}
+}
+
+// methodUrl builds the url of an api method, with the authentication parameters
+func (c *subsonicClient) methodUrl(method string, params url.Values) string {
+	saltBytes := make([]byte, 8)
+	rand.Read(saltBytes)
+	salt := hex.EncodeToString(saltBytes)
+	token := md5.Sum([]byte(c.subsonicParam.Password + salt))
+
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("u", c.subsonicParam.Username)
+	params.Set("t", hex.EncodeToString(token[:]))
+	params.Set("s", salt)
+	params.Set("v", subsonicApiVersion)
+	params.Set("c", subsonicClientName)
+	params.Set("f", "json")
+
+	return strings.TrimSuffix(c.subsonicParam.Url, "/") + "/rest/" + method + "?" + params.Encode()
+}
+
+func (c *subsonicClient) call(method string, params url.Values) (*subsonicResponse, error) {
+	resp, err := c.httpClient.Get(c.methodUrl(method, params))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s for %s", resp.Status, method)
+	}
+
+	var response subsonicResponse
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to interpret %s response: %v", method, err)
+	}
+	if response.Response.Status != "ok" {
+		if response.Response.Error != nil {
+			return nil, fmt.Errorf("%s failed: %s (error %d)", method, response.Response.Error.Message, response.Response.Error.Code)
+		}
+		return nil, fmt.Errorf("%s failed with status %s", method, response.Response.Status)
+	}
+	return &response, nil
+}
+
+func (c *subsonicClient) Name() string {
+	return "subsonic"
+}
+
+func (c *subsonicClient) IdPrefix() string {
+	return subsonicPlaylistIdPrefix
+}
+
+// Playlists reads the playlists of the user, with their songs
+func (c *subsonicClient) Playlists() ([]remotePlaylist, error) {
+	response, err := c.call("getPlaylists", nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.Response.Playlists == nil {
+		return nil, nil
+	}
+
+	var playlists []remotePlaylist
+	for _, subsonicPlaylist := range response.Response.Playlists.Playlist {
+		response, err = c.call("getPlaylist", url.Values{"id": {string(subsonicPlaylist.Id)}})
+		if err != nil {
+			return nil, err
+		}
+		playlist := remotePlaylist{
+			Id:   string(subsonicPlaylist.Id),
+			Name: subsonicPlaylist.Name,
+		}
+		if response.Response.Playlist != nil {
+			for _, song := range response.Response.Playlist.Songs {
+				playlist.Songs = append(playlist.Songs, c.remoteSong(song))
+			}
+		}
+		playlists = append(playlists, playlist)
+	}
+	return playlists, nil
+}
+
+// remoteSong describes a song streamed from the server, named after its title preceded by its artist when known
+func (c *subsonicClient) remoteSong(song subsonicSong) remoteSong {
+	name := song.Title
+	if song.Artist != "" {
+		name = song.Artist + " - " + song.Title
+	}
+	return remoteSong{
+		Id:       string(song.Id),
+		Name:     name,
+		Url:      c.methodUrl("stream", url.Values{"id": {string(song.Id)}}),
+		Duration: time.Duration(song.Duration) * time.Second,
+	}
+}
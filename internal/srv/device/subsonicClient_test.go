@@ -0,0 +1,146 @@
+package device
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// subsonicAuthenticated checks the salted token of a request, as a Subsonic server does
+func subsonicAuthenticated(query url.Values, username string, password string) bool {
+	token := md5.Sum([]byte(password + query.Get("s")))
+	return query.Get("u") == username && query.Get("s") != "" && query.Get("t") == hex.EncodeToString(token[:]) &&
+		query.Get("v") == subsonicApiVersion && query.Get("c") == subsonicClientName && query.Get("f") == "json"
+}
+
+// newStubSubsonicServer answers getPlaylists and getPlaylist, with numeric ids for the first playlist and string ids
+// for the second one as older and recent servers do
+func newStubSubsonicServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if !subsonicAuthenticated(query, "user", "secret") {
+			// Errors are reported in the envelope, with an OK status
+			w.Write([]byte(`{"subsonic-response":{"status":"failed","version":"1.16.1","error":{"code":40,"message":"Wrong username or password"}}}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/music/rest/getPlaylists":
+			w.Write([]byte(`{"subsonic-response":{"status":"ok","version":"1.16.1","playlists":{"playlist":[
+				{"id":1,"name":"Morning"},
+				{"id":"b9a8e7","name":"Evening"}]}}}`))
+		case "/music/rest/getPlaylist":
+			switch query.Get("id") {
+			case "1":
+				w.Write([]byte(`{"subsonic-response":{"status":"ok","version":"1.16.1","playlist":{"id":1,"name":"Morning","entry":[
+					{"id":12,"title":"Sunrise","artist":"Band","duration":185},
+					{"id":13,"title":"Coffee"}]}}}`))
+			case "b9a8e7":
+				w.Write([]byte(`{"subsonic-response":{"status":"ok","version":"1.16.1","playlist":{"id":"b9a8e7","name":"Evening"}}}`))
+			default:
+				w.Write([]byte(`{"subsonic-response":{"status":"failed","version":"1.16.1","error":{"code":70,"message":"Playlist not found"}}}`))
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestSubsonicPlaylists(t *testing.T) {
+	server := newStubSubsonicServer(t)
+	client := newSubsonicClient(&config.SubsonicParam{Url: server.URL + "/music/", Username: "user", Password: "secret"})
+
+	playlists, err := client.Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 2 {
+		t.Fatalf("%d playlists read, expected 2", len(playlists))
+	}
+	if playlists[0].Id != "1" || playlists[0].Name != "Morning" || playlists[1].Id != "b9a8e7" || playlists[1].Name != "Evening" {
+		t.Errorf("Playlists %s/%s and %s/%s read", playlists[0].Id, playlists[0].Name, playlists[1].Id, playlists[1].Name)
+	}
+	if len(playlists[1].Songs) != 0 {
+		t.Errorf("%d songs in the empty playlist", len(playlists[1].Songs))
+	}
+
+	songs := playlists[0].Songs
+	if len(songs) != 2 {
+		t.Fatalf("%d songs read, expected 2", len(songs))
+	}
+	if songs[0].Id != "12" || songs[0].Name != "Band - Sunrise" || songs[0].Duration != 185*time.Second {
+		t.Errorf("Song %s \"%s\" of %v read", songs[0].Id, songs[0].Name, songs[0].Duration)
+	}
+	if songs[1].Name != "Coffee" || songs[1].Duration != 0 {
+		t.Errorf("Song \"%s\" of %v read, expected Coffee of unknown duration", songs[1].Name, songs[1].Duration)
+	}
+
+	// Songs are streamed with their own authentication
+	streamUrl, err := url.Parse(songs[0].Url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamUrl.Path != "/music/rest/stream" || streamUrl.Query().Get("id") != "12" || !subsonicAuthenticated(streamUrl.Query(), "user", "secret") {
+		t.Errorf("Stream url %s", songs[0].Url)
+	}
+}
+
+func TestSubsonicSalt(t *testing.T) {
+	client := newSubsonicClient(&config.SubsonicParam{Url: "http://localhost", Username: "user", Password: "secret"})
+
+	// A new salt for every request, the password never being sent
+	firstUrl, _ := url.Parse(client.methodUrl("ping", nil))
+	secondUrl, _ := url.Parse(client.methodUrl("ping", nil))
+	if firstUrl.Query().Get("s") == secondUrl.Query().Get("s") {
+		t.Errorf("Salt reused")
+	}
+	if strings.Contains(firstUrl.RawQuery, "secret") || firstUrl.Query().Get("p") != "" {
+		t.Errorf("Password sent in %s", firstUrl)
+	}
+	if !subsonicAuthenticated(firstUrl.Query(), "user", "secret") {
+		t.Errorf("Invalid token in %s", firstUrl)
+	}
+}
+
+func TestSubsonicError(t *testing.T) {
+	server := newStubSubsonicServer(t)
+	client := newSubsonicClient(&config.SubsonicParam{Url: server.URL + "/music", Username: "user", Password: "wrong"})
+
+	_, err := client.Playlists()
+	if err == nil || !strings.Contains(err.Error(), "Wrong username or password (error 40)") {
+		t.Errorf("Error \"%v\", expected the message of the error envelope", err)
+	}
+
+	client = newSubsonicClient(&config.SubsonicParam{Url: server.URL + "/unknown", Username: "user", Password: "secret"})
+	_, err = client.Playlists()
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Error \"%v\", expected the http status", err)
+	}
+}
+
+func TestSubsonicId(t *testing.T) {
+	for data, expectedId := range map[string]subsonicId{
+		`12`:                   "12",
+		`"12"`:                 "12",
+		`"al-3f2c"`:            "al-3f2c",
+		`12345678901234567890`: "12345678901234567890",
+	} {
+		var id subsonicId
+		err := json.Unmarshal([]byte(data), &id)
+		if err != nil {
+			t.Errorf("Unable to read id %s: %v", data, err)
+			continue
+		}
+		if id != expectedId {
+			t.Errorf("Id %s read as %s, expected %s", data, id, expectedId)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"os/exec"
+	"strings"
+)
+
+// Commands of the supported text-to-speech engines, with their default language
+var ttsEngines = map[string]struct {
+	command  []string
+	language string
+}{
+	"espeak": {command: []string{"espeak", "-v", "{language}", "-w", "{output}", "{text}"}, language: "en"},
+	"pico":   {command: []string{"pico2wave", "-l", "{language}", "-w", "{output}", "{text}"}, language: "en-US"},
+}
+
+// ttsCommand writes the text spoken by a local text-to-speech engine into a wav file
+type ttsCommand struct {
+	command  []string
+	language string
+}
+
+func newTtsCommand(announcementParam *config.AnnouncementParam) (*ttsCommand, error) {
+	if announcementParam.Engine == "command" {
+		if len(announcementParam.Command) == 0 {
+			return nil, fmt.Errorf("Missing text-to-speech command")
+		}
+		return &ttsCommand{command: announcementParam.Command, language: announcementParam.Language}, nil
+	}
+
+	engineName := announcementParam.Engine
+	if engineName == "" {
+		engineName = "espeak"
+	}
+	engine, ok := ttsEngines[engineName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown text-to-speech engine %s", engineName)
+	}
+	tts := ttsCommand{command: engine.command, language: announcementParam.Language}
+	if tts.language == "" {
+		tts.language = engine.language
+	}
+	return &tts, nil
+}
+
+// synthesize writes the spoken text into the wav file
+func (t *ttsCommand) synthesize(ctx context.Context, text string, wavFilename string) error {
+	args := make([]string, len(t.command))
+	for i, arg := range t.command {
+		args[i] = strings.NewReplacer("{text}", text, "{output}", wavFilename, "{language}", t.language).Replace(arg)
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
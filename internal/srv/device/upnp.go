@@ -0,0 +1,431 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	upnpSsdpAddress       = "239.255.255.250:1900"
+	upnpMediaServerType   = "urn:schemas-upnp-org:device:MediaServer:1"
+	upnpContentDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:"
+	upnpDiscoveryTimeout  = 3 * time.Second
+	upnpRequestTimeout    = 30 * time.Second
+	upnpBrowsePageSize    = 200
+	upnpMaxContainerDepth = 4
+	upnpMaxPlaylistSongs  = 5000
+	// Prefix of the UPnP playlist ids
+	upnpPlaylistIdPrefix = "upnp:"
+)
+
+var upnpHttpClient = &http.Client{Timeout: upnpRequestTimeout}
+
+// upnpMediaServer is a media server found on the network, browsed through its ContentDirectory service
+type upnpMediaServer struct {
+	Name        string
+	Udn         string
+	ServiceType string
+	ControlUrl  string
+}
+
+type upnpDescriptionXml struct {
+	UrlBase string        `xml:"URLBase"`
+	Device  upnpDeviceXml `xml:"device"`
+}
+
+type upnpDeviceXml struct {
+	FriendlyName string `xml:"friendlyName"`
+	Udn          string `xml:"UDN"`
+	Services     []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlUrl  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDeviceXml `xml:"deviceList>device"`
+}
+
+type upnpBrowseResponseXml struct {
+	Result         string `xml:"Body>BrowseResponse>Result"`
+	NumberReturned int    `xml:"Body>BrowseResponse>NumberReturned"`
+	TotalMatches   int    `xml:"Body>BrowseResponse>TotalMatches"`
+}
+
+type upnpDidlXml struct {
+	Containers []struct {
+		Id    string `xml:"id,attr"`
+		Title string `xml:"title"`
+	} `xml:"container"`
+	Items []struct {
+		Id      string `xml:"id,attr"`
+		Title   string `xml:"title"`
+		Creator string `xml:"creator"`
+		Artist  string `xml:"artist"`
+		Class   string `xml:"class"`
+		Res     []struct {
+			Url          string `xml:",chardata"`
+			ProtocolInfo string `xml:"protocolInfo,attr"`
+			Duration     string `xml:"duration,attr"`
+		} `xml:"res"`
+	} `xml:"item"`
+}
+
+// upnpObject is a container, or an audio item with the url streaming it
+type upnpObject struct {
+	Id        string
+	Title     string
+	Container bool
+	Artist    string
+	Url       string
+	Duration  time.Duration
+}
+
+// discoverUpnpMediaServers searches the media servers answering SSDP requests, and those of the given description urls
+func discoverUpnpMediaServers(locations []string) []upnpMediaServer {
+	discoveredLocations, err := searchSsdp(upnpMediaServerType, upnpDiscoveryTimeout)
+	if err != nil {
+		logrus.Warnf("Unable to discover UPnP media servers: %v", err)
+	}
+
+	var mediaServers []upnpMediaServer
+	knownLocations := make(map[string]bool)
+	for _, location := range append(append([]string{}, locations...), discoveredLocations...) {
+		if knownLocations[location] {
+			continue
+		}
+		knownLocations[location] = true
+
+		mediaServer, err := readUpnpMediaServer(location)
+		if err != nil {
+			logrus.Warnf("Unable to read UPnP media server description %s: %v", location, err)
+			continue
+		}
+		mediaServers = append(mediaServers, *mediaServer)
+	}
+	return mediaServers
+}
+
+// findUpnpMediaServer returns the media server with the given friendly name or UDN
+func findUpnpMediaServer(mediaServers []upnpMediaServer, server string) *upnpMediaServer {
+	for i := range mediaServers {
+		if mediaServers[i].Name == server || mediaServers[i].Udn == server {
+			return &mediaServers[i]
+		}
+	}
+	return nil
+}
+
+// searchSsdp sends a SSDP M-SEARCH request and returns the description urls of the devices answering it
+func searchSsdp(searchTarget string, timeout time.Duration) ([]string, error) {
+	ssdpAddr, err := net.ResolveUDPAddr("udp4", upnpSsdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	request := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + upnpSsdpAddress + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: " + strconv.Itoa(int(timeout/time.Second)) + "\r\n" +
+		"ST: " + searchTarget + "\r\n\r\n"
+	_, err = conn.WriteTo([]byte(request), ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var locations []string
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 4096)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			// Deadline reached
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buffer[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
+
+// readUpnpMediaServer reads the description of a device to find its ContentDirectory service
+func readUpnpMediaServer(location string) (*upnpMediaServer, error) {
+	resp, err := upnpHttpClient.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s", resp.Status)
+	}
+
+	var description upnpDescriptionXml
+	err = xml.NewDecoder(resp.Body).Decode(&description)
+	if err != nil {
+		return nil, err
+	}
+
+	baseUrl, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if description.UrlBase != "" {
+		if urlBase, err := url.Parse(description.UrlBase); err == nil {
+			baseUrl = urlBase
+		}
+	}
+
+	// The service may belong to an embedded device
+	devices := []upnpDeviceXml{description.Device}
+	for len(devices) > 0 {
+		device := devices[0]
+		devices = append(devices[1:], device.Devices...)
+		for _, service := range device.Services {
+			if !strings.HasPrefix(service.ServiceType, upnpContentDirectory) {
+				continue
+			}
+			controlUrl, err := baseUrl.Parse(strings.TrimSpace(service.ControlUrl))
+			if err != nil {
+				return nil, err
+			}
+			return &upnpMediaServer{
+				Name:        strings.TrimSpace(description.Device.FriendlyName),
+				Udn:         strings.TrimSpace(description.Device.Udn),
+				ServiceType: service.ServiceType,
+				ControlUrl:  controlUrl.String(),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("No ContentDirectory service")
+}
+
+// browse lists the children of a container, audio items only being kept
+func (s *upnpMediaServer) browse(containerId string) ([]upnpObject, error) {
+	var objects []upnpObject
+	for startingIndex := 0; ; {
+		response, err := s.browsePage(containerId, startingIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		var didl upnpDidlXml
+		err = xml.Unmarshal([]byte(response.Result), &didl)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to interpret content of container %s: %v", containerId, err)
+		}
+		for _, item := range didl.Items {
+			object := upnpObject{Id: item.Id, Title: strings.TrimSpace(item.Title), Artist: strings.TrimSpace(item.Artist)}
+			if object.Artist == "" {
+				object.Artist = strings.TrimSpace(item.Creator)
+			}
+			for _, res := range item.Res {
+				if strings.Contains(res.ProtocolInfo, ":audio/") || strings.HasPrefix(item.Class, "object.item.audioItem") {
+					object.Url = strings.TrimSpace(res.Url)
+					object.Duration = parseUpnpDuration(res.Duration)
+					break
+				}
+			}
+			if object.Url != "" {
+				objects = append(objects, object)
+			}
+		}
+		// Sub containers come after the items, to play the songs of a folder before those of its sub folders
+		for _, container := range didl.Containers {
+			objects = append(objects, upnpObject{Id: container.Id, Title: strings.TrimSpace(container.Title), Container: true})
+		}
+
+		startingIndex += response.NumberReturned
+		if response.NumberReturned == 0 || startingIndex >= response.TotalMatches {
+			break
+		}
+	}
+	return objects, nil
+}
+
+// browsePage calls the Browse action of the ContentDirectory service
+func (s *upnpMediaServer) browsePage(containerId string, startingIndex int) (*upnpBrowseResponseXml, error) {
+	var escapedId bytes.Buffer
+	xml.EscapeText(&escapedId, []byte(containerId))
+	body := `<?xml version="1.0" encoding="utf-8"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:Browse xmlns:u="` + s.ServiceType + `">` +
+		`<ObjectID>` + escapedId.String() + `</ObjectID>` +
+		`<BrowseFlag>BrowseDirectChildren</BrowseFlag>` +
+		`<Filter>*</Filter>` +
+		`<StartingIndex>` + strconv.Itoa(startingIndex) + `</StartingIndex>` +
+		`<RequestedCount>` + strconv.Itoa(upnpBrowsePageSize) + `</RequestedCount>` +
+		`<SortCriteria></SortCriteria>` +
+		`</u:Browse></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest(http.MethodPost, s.ControlUrl, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.ServiceType+`#Browse"`)
+	resp, err := upnpHttpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %s when browsing container %s", resp.Status, containerId)
+	}
+
+	var response upnpBrowseResponseXml
+	err = xml.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// parseUpnpDuration reads a res duration: H:MM:SS with optional fraction of second
+func parseUpnpDuration(duration string) time.Duration {
+	parts := strings.Split(strings.TrimSpace(duration), ":")
+	if len(parts) != 3 {
+		return 0
+	}
+	hours, err1 := strconv.ParseInt(parts[0], 10, 64)
+	minutes, err2 := strconv.ParseInt(parts[1], 10, 64)
+	seconds, err3 := strconv.ParseFloat(parts[2], 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0
+	}
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second))
+}
+
+// upnpLibrary is the remote library of the UPnP playlist player: each configured container is a playlist
+type upnpLibrary struct {
+	upnpParam *config.UpnpParam
+}
+
+func NewUpnpPlaylistPlayer(serverConfig *config.ServerConfig, audio *Audio) PlaylistPlayer {
+	return newRemotePlaylistPlayer(serverConfig, audio, &upnpLibrary{upnpParam: serverConfig.UpnpParam}, serverConfig.UpnpParam.RefreshPeriod)
+}
+
+func (l *upnpLibrary) Name() string {
+	return "UPnP"
+}
+
+func (l *upnpLibrary) IdPrefix() string {
+	return upnpPlaylistIdPrefix
+}
+
+// Playlists browses the configured containers. The containers of unreachable servers are skipped, an error being
+// returned when none of them can be read.
+func (l *upnpLibrary) Playlists() ([]remotePlaylist, error) {
+	mediaServers := discoverUpnpMediaServers(l.upnpParam.Locations)
+
+	var err error
+	var playlists []remotePlaylist
+	for _, upnpPlaylist := range l.upnpParam.Playlists {
+		mediaServer := findUpnpMediaServer(mediaServers, upnpPlaylist.Server)
+		if mediaServer == nil {
+			err = fmt.Errorf("Media server %s not found", upnpPlaylist.Server)
+			logrus.Warnf("Unable to read UPnP playlist %s: %v", upnpPlaylist.Name, err)
+			continue
+		}
+		playlist := remotePlaylist{
+			Id:   upnpPlaylist.Name,
+			Name: upnpPlaylist.Name,
+		}
+		playlist.Songs, err = l.songs(mediaServer, upnpPlaylist.ContainerId, 0, nil)
+		if err != nil {
+			logrus.Warnf("Unable to read UPnP playlist %s: %v", upnpPlaylist.Name, err)
+			continue
+		}
+		playlists = append(playlists, playlist)
+	}
+	if len(playlists) > 0 || len(l.upnpParam.Playlists) == 0 {
+		err = nil
+	}
+	return playlists, err
+}
+
+// songs collects the audio items of a container and of its sub containers
+func (l *upnpLibrary) songs(mediaServer *upnpMediaServer, containerId string, depth int, songs []remoteSong) ([]remoteSong, error) {
+	objects, err := mediaServer.browse(containerId)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if len(songs) >= upnpMaxPlaylistSongs {
+			break
+		}
+		if object.Container {
+			if depth < upnpMaxContainerDepth {
+				songs, err = l.songs(mediaServer, object.Id, depth+1, songs)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		name := object.Title
+		if object.Artist != "" {
+			name = object.Artist + " - " + object.Title
+		}
+		songs = append(songs, remoteSong{
+			Id:       object.Id,
+			Name:     name,
+			Url:      object.Url,
+			Duration: object.Duration,
+		})
+	}
+	return songs, nil
+}
+
+// BrowseUpnp lists the media servers found on the network when server is empty, otherwise the children of a
+// container of the given server, its root container when containerId is empty
+func BrowseUpnp(upnpParam *config.UpnpParam, server string, containerId string) (interface{}, error) {
+	var locations []string
+	if upnpParam != nil {
+		locations = upnpParam.Locations
+	}
+	mediaServers := discoverUpnpMediaServers(locations)
+
+	if server == "" {
+		upnpServers := make([]apimodel.UpnpServer, 0, len(mediaServers))
+		for _, mediaServer := range mediaServers {
+			upnpServers = append(upnpServers, apimodel.UpnpServer{Name: mediaServer.Name, Udn: mediaServer.Udn})
+		}
+		return upnpServers, nil
+	}
+
+	mediaServer := findUpnpMediaServer(mediaServers, server)
+	if mediaServer == nil {
+		return nil, fmt.Errorf("Media server %s not found", server)
+	}
+	if containerId == "" {
+		containerId = "0"
+	}
+	objects, err := mediaServer.browse(containerId)
+	if err != nil {
+		return nil, err
+	}
+	upnpObjects := make([]apimodel.UpnpObject, 0, len(objects))
+	for _, object := range objects {
+		upnpObjects = append(upnpObjects, apimodel.UpnpObject{Id: object.Id, Title: object.Title, Container: object.Container})
+	}
+	return upnpObjects, nil
+}
@@ -0,0 +1,223 @@
+package device
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The ContentDirectory service belongs to a device embedded in the root device, its control url being relative
+const testUpnpDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+	<device>
+		<deviceType>urn:schemas-upnp-org:device:MediaServer:1</deviceType>
+		<friendlyName>Stub NAS</friendlyName>
+		<UDN>uuid:stub-nas</UDN>
+		<deviceList>
+			<device>
+				<friendlyName>Stub NAS library</friendlyName>
+				<serviceList>
+					<service>
+						<serviceType>urn:schemas-upnp-org:service:ContentDirectory:1</serviceType>
+						<controlURL>ctl/ContentDir</controlURL>
+					</service>
+				</serviceList>
+			</device>
+		</deviceList>
+	</device>
+</root>`
+
+type upnpBrowseRequestXml struct {
+	ObjectId       string `xml:"Body>Browse>ObjectID"`
+	BrowseFlag     string `xml:"Body>Browse>BrowseFlag"`
+	StartingIndex  int    `xml:"Body>Browse>StartingIndex"`
+	RequestedCount int    `xml:"Body>Browse>RequestedCount"`
+}
+
+// stubContentDirectory serves a device description and answers the Browse actions, page by page, from DIDL-Lite
+// children by container id
+type stubContentDirectory struct {
+	*httptest.Server
+	children map[string][]string
+
+	lock           sync.Mutex
+	browseRequests []upnpBrowseRequestXml
+}
+
+func newStubContentDirectory(t *testing.T, children map[string][]string) *stubContentDirectory {
+	contentDirectory := &stubContentDirectory{children: children}
+	contentDirectory.Server = httptest.NewServer(http.HandlerFunc(contentDirectory.serveHTTP))
+	t.Cleanup(contentDirectory.Close)
+	return contentDirectory
+}
+
+func (s *stubContentDirectory) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/upnp/rootDesc.xml":
+		w.Write([]byte(testUpnpDescription))
+	case r.URL.Path == "/upnp/ctl/ContentDir" && r.Method == http.MethodPost:
+		if r.Header.Get("SOAPAction") != `"urn:schemas-upnp-org:service:ContentDirectory:1#Browse"` {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var request upnpBrowseRequestXml
+		err := xml.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.lock.Lock()
+		s.browseRequests = append(s.browseRequests, request)
+		s.lock.Unlock()
+
+		children, ok := s.children[request.ObjectId]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		end := request.StartingIndex + request.RequestedCount
+		if end > len(children) {
+			end = len(children)
+		}
+		var page []string
+		if request.StartingIndex < end {
+			page = children[request.StartingIndex:end]
+		}
+		var result bytes.Buffer
+		result.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+		for _, child := range page {
+			result.WriteString(child)
+		}
+		result.WriteString(`</DIDL-Lite>`)
+		var escapedResult bytes.Buffer
+		xml.EscapeText(&escapedResult, result.Bytes())
+		fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:BrowseResponse xmlns:u="urn:schemas-upnp-org:service:ContentDirectory:1">`+
+			`<Result>%s</Result><NumberReturned>%d</NumberReturned><TotalMatches>%d</TotalMatches><UpdateID>1</UpdateID>`+
+			`</u:BrowseResponse></s:Body></s:Envelope>`, escapedResult.String(), len(page), len(children))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func upnpContainer(id string, title string) string {
+	return `<container id="` + id + `" restricted="1"><dc:title>` + title + `</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`
+}
+
+func upnpAudioItem(id string, title string, artist string, duration string) string {
+	return `<item id="` + id + `" restricted="1"><dc:title>` + title + `</dc:title><upnp:artist>` + artist + `</upnp:artist>` +
+		`<upnp:class>object.item.audioItem.musicTrack</upnp:class>` +
+		`<res protocolInfo="http-get:*:audio/mpeg:*" duration="` + duration + `">http://nas/` + id + `.mp3</res></item>`
+}
+
+func upnpImageItem(id string) string {
+	return `<item id="` + id + `" restricted="1"><dc:title>Cover</dc:title><upnp:class>object.item.imageItem.photo</upnp:class>` +
+		`<res protocolInfo="http-get:*:image/jpeg:*">http://nas/` + id + `.jpg</res></item>`
+}
+
+func TestUpnpRecursiveBrowsing(t *testing.T) {
+	contentDirectory := newStubContentDirectory(t, map[string][]string{
+		"music": {
+			upnpContainer("albums", "Albums"),
+			upnpAudioItem("song1", "Intro", "Band", "0:01:05"),
+			upnpImageItem("cover"),
+		},
+		"albums": {
+			upnpContainer("live", "Live"),
+			upnpAudioItem("song2", "Ballad", "", "0:04:00"),
+		},
+		"live": {
+			upnpAudioItem("song3", "Encore", "Band", "0:03:25.500"),
+		},
+	})
+	library := &upnpLibrary{upnpParam: &config.UpnpParam{
+		Locations: []string{contentDirectory.URL + "/upnp/rootDesc.xml"},
+		Playlists: []*config.UpnpPlaylist{
+			{Name: "Music", Server: "Stub NAS", ContainerId: "music"},
+			{Name: "Missing", Server: "uuid:other-nas", ContainerId: "music"},
+		},
+	}}
+
+	playlists, err := library.Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(playlists) != 1 || playlists[0].Id != "Music" {
+		t.Fatalf("Playlists %v, expected Music only", playlists)
+	}
+
+	// The songs of a container come before those of its sub containers, images being skipped
+	expectedSongs := []remoteSong{
+		{Id: "song1", Name: "Band - Intro", Url: "http://nas/song1.mp3", Duration: 65 * time.Second},
+		{Id: "song2", Name: "Ballad", Url: "http://nas/song2.mp3", Duration: 4 * time.Minute},
+		{Id: "song3", Name: "Band - Encore", Url: "http://nas/song3.mp3", Duration: 3*time.Minute + 25*time.Second + 500*time.Millisecond},
+	}
+	songs := playlists[0].Songs
+	if len(songs) != len(expectedSongs) {
+		t.Fatalf("%d songs read, expected %d", len(songs), len(expectedSongs))
+	}
+	for i := range expectedSongs {
+		if songs[i] != expectedSongs[i] {
+			t.Errorf("Song %d %+v, expected %+v", i+1, songs[i], expectedSongs[i])
+		}
+	}
+}
+
+func TestUpnpBrowsePaging(t *testing.T) {
+	var children []string
+	for i := 0; i < 2*upnpBrowsePageSize+50; i++ {
+		children = append(children, upnpAudioItem("song"+strconv.Itoa(i), "Song "+strconv.Itoa(i), "", "0:03:00"))
+	}
+	contentDirectory := newStubContentDirectory(t, map[string][]string{"big": children})
+	mediaServer, err := readUpnpMediaServer(contentDirectory.URL + "/upnp/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediaServer.Name != "Stub NAS" || mediaServer.Udn != "uuid:stub-nas" || mediaServer.ControlUrl != contentDirectory.URL+"/upnp/ctl/ContentDir" {
+		t.Errorf("Media server %+v", mediaServer)
+	}
+
+	objects, err := mediaServer.browse("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != len(children) {
+		t.Fatalf("%d objects read, expected %d", len(objects), len(children))
+	}
+	for i, object := range objects {
+		if object.Id != "song"+strconv.Itoa(i) {
+			t.Fatalf("Object %d is %s", i, object.Id)
+		}
+	}
+
+	// Three pages requested one after the other
+	contentDirectory.lock.Lock()
+	defer contentDirectory.lock.Unlock()
+	if len(contentDirectory.browseRequests) != 3 {
+		t.Fatalf("%d browse requests, expected 3", len(contentDirectory.browseRequests))
+	}
+	for i, request := range contentDirectory.browseRequests {
+		if request.StartingIndex != i*upnpBrowsePageSize || request.RequestedCount != upnpBrowsePageSize || request.BrowseFlag != "BrowseDirectChildren" {
+			t.Errorf("Browse request %d %+v", i+1, request)
+		}
+	}
+}
+
+func TestUpnpBrowseError(t *testing.T) {
+	contentDirectory := newStubContentDirectory(t, map[string][]string{})
+	mediaServer, err := readUpnpMediaServer(contentDirectory.URL + "/upnp/rootDesc.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mediaServer.browse("unknown")
+	if err == nil {
+		t.Errorf("Unknown container browsed")
+	}
+}
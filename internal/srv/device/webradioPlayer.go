@@ -5,29 +5,40 @@ import (
 	"github.com/jypelle/vekigi/apimodel"
 	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/event"
+	"github.com/jypelle/vekigi/internal/srv/pipeline"
 	"github.com/sirupsen/logrus"
-	"os/exec"
 	"sync"
+	"time"
 )
 
+const defaultWebradioStartTimeout = 8 * time.Second
+
 type WebradioPlayer struct {
 	lock         sync.RWMutex
 	eventChannel chan event.WebradioEvent
+	audio        *Audio
 
+	// Snapshot of the webradio groups, replaced as a whole when stations are imported
 	webradioGroups map[int64][]*config.Webradio
+	startTimeout   time.Duration
 
-	currentRadioId  *apimodel.WebradioId
-	currentRadioCmd *exec.Cmd
+	currentRadioId       *apimodel.WebradioId
+	currentRadioPlayback Playback
 
 	sendEvent bool
 }
 
-func NewWebradioPlayer(config *config.ServerConfig) *WebradioPlayer {
+func NewWebradioPlayer(config *config.ServerConfig, audio *Audio) *WebradioPlayer {
 	webradioPlayer := WebradioPlayer{
+		audio:          audio,
 		webradioGroups: config.WebradioGroups,
+		startTimeout:   time.Duration(config.WebradioStartTimeout) * time.Second,
 		eventChannel:   make(chan event.WebradioEvent),
 		sendEvent:      true,
 	}
+	if webradioPlayer.startTimeout <= 0 {
+		webradioPlayer.startTimeout = defaultWebradioStartTimeout
+	}
 	return &webradioPlayer
 }
 
@@ -58,12 +69,25 @@ func (d *WebradioPlayer) EventChannel() chan event.WebradioEvent {
 	return d.eventChannel
 }
 
-func (d *WebradioPlayer) Play(radioId apimodel.WebradioId) error {
+// SetWebradioGroups replaces the webradio groups, which must not be modified afterwards
+func (d *WebradioPlayer) SetWebradioGroups(webradioGroups map[int64][]*config.Webradio) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.webradioGroups = webradioGroups
+}
+
+// Play listens the webradio in background. When started is not nil and Play succeeds, started receives nil once a
+// mirror of the webradio plays, or an error when none of them plays.
+func (d *WebradioPlayer) Play(radioId apimodel.WebradioId, started chan<- error) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
 	if d.currentRadioId != nil && radioId == *d.currentRadioId {
 		logrus.Infof("Already listening radio %d", radioId)
+		if started != nil {
+			started <- nil
+		}
 		return nil
 	}
 
@@ -76,34 +100,115 @@ func (d *WebradioPlayer) Play(radioId apimodel.WebradioId) error {
 		return fmt.Errorf("Radio %d for group %d is undefined", radioId.IndexId, radioId.GroupId)
 	}
 	webradio := radioGroup[radioId.IndexId-1]
-	if webradio.Url == "" {
+	if len(webradio.Urls) == 0 {
 		return fmt.Errorf("Radio %d is undefined", radioId)
 	}
 	d.clear()
 
 	logrus.Infof("Listening Radio %d: \"%s\" ", radioId, webradio.Name)
-	d.currentRadioCmd = exec.Command("cvlc", "--aout=alsa", "--play-and-exit", webradio.Url)
-	err := d.currentRadioCmd.Start()
-	if err != nil {
-		return fmt.Errorf("Unable to listen Radio %d", radioId)
-	}
 	d.currentRadioId = &radioId
+	d.audio.SetVolumeOffset(webradio.VolumeOffset)
+
+	go d.listen(d.currentRadioId, webradio.Urls, started)
 
-	currentRadioCmd := d.currentRadioCmd
-	go func() {
-		_ = currentRadioCmd.Wait()
+	return nil
+}
+
+// listen tries each url of the webradio until one of them plays, and notifies the end of the stream
+func (d *WebradioPlayer) listen(radioId *apimodel.WebradioId, urls []string, started chan<- error) {
+	// started receives a single value
+	notifyStarted := func(err error) {
+		if started != nil {
+			started <- err
+			started = nil
+		}
+	}
+	defer notifyStarted(fmt.Errorf("No url of radio %d plays", *radioId))
+
+	for _, url := range urls {
 		d.lock.Lock()
-		defer d.lock.Unlock()
-		if d.currentRadioCmd == currentRadioCmd {
-			d.currentRadioCmd = nil
-			d.currentRadioId = nil
-			if d.sendEvent {
-				go func() { d.eventChannel <- event.WebradioEvent{Data: event.WebradioEventStopPlayingData{}} }()
-			}
+		if d.currentRadioId != radioId {
+			d.lock.Unlock()
+			notifyStarted(fmt.Errorf("Radio %d has been stopped", *radioId))
+			return
+		}
+		currentRadioPlayback, err := d.audio.Play(pipeline.Source{Url: url})
+		if err != nil {
+			d.lock.Unlock()
+			logrus.Warnf("Unable to listen url %s of radio %d: %v", url, *radioId, err)
+			continue
 		}
-	}()
+		d.currentRadioPlayback = currentRadioPlayback
+		d.lock.Unlock()
+
+		var endErr error
+		ended := make(chan struct{})
+		go func() {
+			endErr = currentRadioPlayback.Wait()
+			close(ended)
+		}()
+
+		startTime := time.Now()
+		playing := d.waitPlaying(currentRadioPlayback, ended)
+		if playing {
+			notifyStarted(nil)
+		}
+		<-ended
 
-	return nil
+		d.lock.Lock()
+		if d.currentRadioPlayback != currentRadioPlayback {
+			d.lock.Unlock()
+			notifyStarted(fmt.Errorf("Radio %d has been stopped", *radioId))
+			return
+		}
+		d.currentRadioPlayback = nil
+		d.lock.Unlock()
+
+		if playing && time.Since(startTime) >= d.startTimeout {
+			// The stream was playing: its end is not a failure
+			break
+		}
+		if endErr != nil {
+			logrus.Warnf("Url %s of radio %d is unavailable: %v", url, *radioId, endErr)
+		} else {
+			logrus.Warnf("Url %s of radio %d stopped prematurely", url, *radioId)
+		}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.currentRadioId == radioId {
+		d.currentRadioId = nil
+		if d.sendEvent {
+			go func() { d.eventChannel <- event.WebradioEvent{Data: event.WebradioEventStopPlayingData{}} }()
+		}
+	}
+}
+
+// waitPlaying waits for the playback to deliver its first samples. Without the pipeline, a playback still running
+// after the start timeout is considered as playing. A pipeline stream silent until the timeout is stopped.
+func (d *WebradioPlayer) waitPlaying(playback Playback, ended <-chan struct{}) bool {
+	var playing <-chan struct{}
+	stream, isStream := playback.(*pipeline.Stream)
+	if isStream {
+		playing = stream.Playing()
+	}
+
+	timer := time.NewTimer(d.startTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-playing:
+		return true
+	case <-ended:
+		return false
+	case <-timer.C:
+		if isStream {
+			playback.Stop()
+			return false
+		}
+		return true
+	}
 }
 
 func (d *WebradioPlayer) CurrentWebRadio() *config.Webradio {
@@ -134,7 +239,7 @@ func (d *WebradioPlayer) webradio(webradioId apimodel.WebradioId) *config.Webrad
 		return nil
 	}
 	webradio := radioGroup[webradioId.IndexId-1]
-	if webradio.Url == "" {
+	if len(webradio.Urls) == 0 {
 		return nil
 	}
 
@@ -149,11 +254,11 @@ func (d *WebradioPlayer) Clear() {
 }
 
 func (d *WebradioPlayer) clear() {
-	if d.currentRadioCmd != nil {
-		if err := d.currentRadioCmd.Process.Kill(); err != nil {
-			logrus.Errorf("Failed to kill process: %v", err)
+	if d.currentRadioId != nil {
+		if d.currentRadioPlayback != nil {
+			d.currentRadioPlayback.Stop()
 		}
-		d.currentRadioCmd = nil
+		d.currentRadioPlayback = nil
 		d.currentRadioId = nil
 	}
 }
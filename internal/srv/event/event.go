@@ -3,6 +3,7 @@ package event
 import (
 	"github.com/jypelle/vekigi/apimodel"
 	"net/http"
+	"time"
 )
 
 // PopUp
@@ -18,7 +19,12 @@ type TickerEvent struct {
 	Data interface{}
 }
 
-type TickerEventTickData struct{}
+// TickerEventTickData is sent at the beginning of every minute, and when the clock starts
+type TickerEventTickData struct {
+	Time time.Time
+	// Set for the tick sent when the clock starts, in the middle of a minute
+	Startup bool
+}
 type TickerEventAlarmData struct{}
 
 // Webradio
@@ -36,6 +42,38 @@ type PlaylistEvent struct {
 }
 
 type PlaylistEventPlayingSongData struct{}
+type PlaylistEventConnectionData struct{}
+
+// PlaylistEventPlaylistsData is sent when the playlists of a player have been read again
+type PlaylistEventPlaylistsData struct{}
+
+// Renderer
+type RendererEvent struct {
+	// Nil for notifications
+	Result chan error
+	Data   interface{}
+}
+
+type RendererEventPlayData struct{}
+type RendererEventStopPlayingData struct{}
+type RendererEventVolumeData struct {
+	Volume int64
+}
+type RendererEventMuteData struct {
+	Mute bool
+}
+
+// Announcer
+type AnnouncerEvent struct {
+	Data interface{}
+}
+
+// AnnouncerEventAlarmEndData tells that the alarm announcement is over, or has failed
+type AnnouncerEventAlarmEndData struct{}
+
+// AnnouncerEventMessageEndData tells that an announcement other than the alarm one (message, chime or time) is over,
+// or has failed
+type AnnouncerEventMessageEndData struct{}
 
 // Buttons
 type ButtonId int
@@ -84,6 +122,53 @@ type ApiEventPlaylistPlayData struct {
 	PlaylistId apimodel.PlaylistId
 }
 
+type ApiEventPlaylistPlayModeData struct {
+	PlaylistId apimodel.PlaylistId
+	PlayMode   apimodel.PlayMode
+}
+
+type ApiEventPlaylistSeekData struct {
+	Offset time.Duration
+}
+
 type ApiEventAudioVolumeData struct {
 	Volume int64
 }
+
+type ApiEventPlaylistRefreshData struct{}
+
+// ApiEventStopData stops the webradio or the playlist being played
+type ApiEventStopData struct{}
+
+// ApiEventResumeData plays again what was played last, when nothing is playing
+type ApiEventResumeData struct{}
+
+type ApiEventPlaylistNextData struct{}
+
+type ApiEventPlaylistPreviousData struct{}
+
+// ApiEventAnnounceData plays an audio file, an url or speaks a text over the current sound, Message being shown
+// meanwhile. The audio file is removed once played.
+type ApiEventAnnounceData struct {
+	Text    string
+	Url     string
+	Path    string
+	Message string
+}
+
+// ApiEventPlaylistListData asks for the playlists, filled before the result is sent
+type ApiEventPlaylistListData struct {
+	Playlists *[]apimodel.Playlist
+}
+
+// ApiEventWebradioImportData appends stations to a webradio group, their ids being filled before the result is sent
+type ApiEventWebradioImportData struct {
+	GroupId     int64
+	Stations    []apimodel.Station
+	WebradioIds *[]apimodel.WebradioId
+}
+
+// ApiEventStateData asks for the server state, filled before the result is sent
+type ApiEventStateData struct {
+	State *apimodel.State
+}
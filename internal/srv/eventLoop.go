@@ -1,6 +1,8 @@
 package srv
 
 import (
+	"fmt"
+	"github.com/jypelle/vekigi/apimodel"
 	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/device"
 	"github.com/jypelle/vekigi/internal/srv/event"
@@ -9,6 +11,9 @@ import (
 	"time"
 )
 
+// Maximum delay between the two presses of a double press
+const doublePressDelay = 600 * time.Millisecond
+
 func (s *ServerApp) eventLoop() {
 	for loop := true; loop; {
 		select {
@@ -25,47 +30,69 @@ func (s *ServerApp) eventLoop() {
 				}
 			}
 		case ev := <-s.clockDevice.EventChannel():
-			switch ev.Data.(type) {
+			switch data := ev.Data.(type) {
 			case event.TickerEventTickData:
 				logrus.Debugf("Receive Ticker tick event")
+				if !data.Startup {
+					s.chime(data.Time)
+				}
 				if s.currentMode == CLOCK_MODE && s.currentPopUp == NO_POPUP {
 					s.refreshDisplay(false)
 				}
 			case event.TickerEventAlarmData:
 				logrus.Infof("Receive Ticker alarm event")
-				alarmTime := s.Alarm()
-				if alarmTime.WebradioId != nil {
-					s.playlistPlayerDevice.Clear()
-					err := s.webradioPlayerDevice.Play(*alarmTime.WebradioId)
-					if err != nil {
-						logrus.Warn(err)
-					}
-				} else if alarmTime.PlaylistId != nil {
-					s.webradioPlayerDevice.Clear()
-					err := s.playlistPlayerDevice.Play(*alarmTime.PlaylistId)
-					if err != nil {
-						logrus.Warn(err)
-					}
+				if s.announcerDevice.IsAlarmAnnouncementEnabled() {
+					// The alarm rings once the announcement is over
+					s.announcerDevice.AnnounceAlarm()
+				} else {
+					s.playAlarm()
 				}
 				s.refreshDisplay(true)
 			}
+		case ev := <-s.announcerDevice.EventChannel():
+			switch ev.Data.(type) {
+			case event.AnnouncerEventAlarmEndData:
+				logrus.Debugf("Receive announcerAlarmEnd event")
+				// Unless the alarm has been stopped meanwhile
+				if s.clockDevice.IsAlarmRunning() {
+					s.playAlarm()
+					s.refreshDisplay(true)
+				}
+			case event.AnnouncerEventMessageEndData:
+				logrus.Debugf("Receive announcerMessageEnd event")
+				s.resumeInterruptedSound()
+				if s.currentPopUp == MESSAGE_POPUP {
+					// Let the message be read a little longer
+					s.popUpHideTimer = time.AfterFunc(2*time.Second, func() {
+						s.internalEventChannel <- event.InternalEvent{Data: event.InternalEventPopupHideData{}}
+					})
+				}
+			}
 		case ev := <-s.apiDevice.EventChannel():
+			s.handleApiEvent(ev)
+		case ev := <-s.mpdDevice.EventChannel():
+			s.handleApiEvent(ev)
+		case ev := <-s.rendererDevice.EventChannel():
 			switch data := ev.Data.(type) {
-			case event.ApiEventWebradioPlayData:
+			case event.RendererEventPlayData:
+				logrus.Infof("Receive rendererPlay event")
 				s.clockDevice.ClearAlarm()
+				s.webradioPlayerDevice.Clear()
 				s.playlistPlayerDevice.Clear()
-				err := s.webradioPlayerDevice.Play(data.WebradioId)
+				err := s.rendererDevice.Play()
 				ev.Result <- err
 				s.refreshDisplay(true)
-			case event.ApiEventPlaylistPlayData:
-				s.clockDevice.ClearAlarm()
-				s.webradioPlayerDevice.Clear()
-				err := s.playlistPlayerDevice.Play(data.PlaylistId)
-				ev.Result <- err
+			case event.RendererEventStopPlayingData:
+				logrus.Debugf("Receive rendererStopPlaying event")
 				s.refreshDisplay(true)
-			case event.ApiEventAudioVolumeData:
+			case event.RendererEventVolumeData:
+				logrus.Infof("Receive rendererVolume event")
 				err := s.audioDevice.SetVolume(data.Volume)
 				ev.Result <- err
+			case event.RendererEventMuteData:
+				logrus.Infof("Receive rendererMute event")
+				s.audioDevice.SetMute(data.Mute)
+				ev.Result <- nil
 			}
 		case ev := <-s.webradioPlayerDevice.EventChannel():
 			switch ev.Data.(type) {
@@ -78,6 +105,13 @@ func (s *ServerApp) eventLoop() {
 			case event.PlaylistEventPlayingSongData:
 				logrus.Infof("Receive playlistPlayingSong event")
 				s.refreshDisplay(true)
+			case event.PlaylistEventConnectionData:
+				logrus.Debugf("Receive playlistConnection event")
+				s.migratePlaylistIds()
+				s.refreshDisplay(false)
+			case event.PlaylistEventPlaylistsData:
+				logrus.Debugf("Receive playlistPlaylists event")
+				s.refreshDisplay(false)
 			}
 		case ev := <-s.buttonsDevice.EventChannel():
 			logrus.Debugf("Receive button event: %d, %d, %d", ev.ButtonId, ev.ButtonEventType, ev.PressStepCount)
@@ -109,7 +143,8 @@ func (s *ServerApp) eventLoop() {
 								}
 								s.clockDevice.ClearAlarm()
 								s.playlistPlayerDevice.Clear()
-								err := s.webradioPlayerDevice.Play(nextWebradio.WebradioId)
+								s.rendererDevice.Clear()
+								err := s.webradioPlayerDevice.Play(nextWebradio.WebradioId, nil)
 								if err != nil {
 									logrus.Warn(err)
 								}
@@ -130,43 +165,51 @@ func (s *ServerApp) eventLoop() {
 					}
 				}
 			case event.PLAYLIST_BUTTON:
-				if ev.ButtonEventType == event.PRESS_EVENT_TYPE {
-					logrus.Debugf("Receive button playlist press event")
-					if (ev.PressStepCount-1)%3 == 0 {
-						if s.currentMode == CLOCK_MODE {
-							currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist()
-							var nextPlaylist *device.Playlist
-							if currentPlaylist != nil {
-								nextPlaylist = s.playlistPlayerDevice.GetPlaylist(currentPlaylist.PlaylistId + 1)
-							}
-							if nextPlaylist == nil {
-								nextPlaylist = s.playlistPlayerDevice.GetPlaylist(1)
-							}
-							if nextPlaylist != nil {
-								s.clockDevice.ClearAlarm()
-								s.webradioPlayerDevice.Clear()
-								err := s.playlistPlayerDevice.Play(nextPlaylist.PlaylistId)
-								if err != nil {
-									logrus.Warn(err)
-								}
-							}
-						} else if s.currentMode == ALARM_SETTING_MODE {
-							alarmTime := s.Alarm()
-							var nextPlaylist *device.Playlist
-							if alarmTime.PlaylistId != nil {
-								nextPlaylist = s.playlistPlayerDevice.GetPlaylist(*alarmTime.PlaylistId + 1)
-							}
-							if nextPlaylist == nil {
-								nextPlaylist = s.playlistPlayerDevice.GetPlaylist(1)
+				if s.currentMode == CLOCK_MODE {
+					// A short press plays the next playlist, a long press switches the play mode of the current one
+					if ev.ButtonEventType == event.RELEASE_EVENT_TYPE && ev.PressStepCount < 6 {
+						logrus.Debugf("Receive button playlist press event")
+						currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist()
+						var nextPlaylist *device.Playlist
+						if currentPlaylist != nil {
+							nextPlaylist = s.playlistPlayerDevice.NextPlaylist(&currentPlaylist.PlaylistId)
+						} else {
+							nextPlaylist = s.playlistPlayerDevice.NextPlaylist(nil)
+						}
+						if nextPlaylist != nil {
+							s.clockDevice.ClearAlarm()
+							s.webradioPlayerDevice.Clear()
+							s.rendererDevice.Clear()
+							err := s.playlistPlayerDevice.Play(nextPlaylist.PlaylistId)
+							if err != nil {
+								logrus.Warn(err)
 							}
-							if nextPlaylist != nil {
-								alarmTime.WebradioId = nil
-								alarmTime.PlaylistId = &nextPlaylist.PlaylistId
-								s.SetAlarm(alarmTime)
+						}
+						s.refreshDisplay(true)
+					} else if ev.ButtonEventType == event.PRESS_EVENT_TYPE && ev.PressStepCount == 6 {
+						currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist()
+						if currentPlaylist != nil {
+							logrus.Debugf("Switch playlist play mode")
+							playMode := s.playlistPlayerDevice.PlayMode(currentPlaylist.PlaylistId)
+							err := s.playlistPlayerDevice.SetPlayMode(currentPlaylist.PlaylistId, playMode.Next())
+							if err != nil {
+								logrus.Warn(err)
 							}
+							s.refreshDisplay(true)
+						}
+					}
+				} else if s.currentMode == ALARM_SETTING_MODE {
+					// The alarm playlists go by while the button is held
+					if ev.ButtonEventType == event.PRESS_EVENT_TYPE && (ev.PressStepCount-1)%3 == 0 {
+						logrus.Debugf("Receive button playlist press event")
+						alarmTime := s.Alarm()
+						nextPlaylist := s.playlistPlayerDevice.NextPlaylist(alarmTime.PlaylistId)
+						if nextPlaylist != nil {
+							alarmTime.WebradioId = nil
+							alarmTime.PlaylistId = &nextPlaylist.PlaylistId
+							s.SetAlarm(alarmTime)
 						}
 						s.refreshDisplay(true)
-
 					}
 				}
 			case event.ALARM_SETTING_BUTTON:
@@ -243,12 +286,22 @@ func (s *ServerApp) eventLoop() {
 				if ev.ButtonEventType == event.RELEASE_EVENT_TYPE && ev.PressStepCount < 5 {
 					logrus.Debugf("Switch display on/off")
 					s.displayDevice.Switch()
+					// A double press says the time, the display being switched back by the second press
+					if time.Since(s.lastSnoozeRelease) < doublePressDelay {
+						logrus.Debugf("Say the time")
+						s.lastSnoozeRelease = time.Time{}
+						s.sayTime()
+					} else {
+						s.lastSnoozeRelease = time.Now()
+					}
 				} else if ev.ButtonEventType == event.PRESS_EVENT_TYPE {
 					if ev.PressStepCount == 5 {
 						logrus.Debugf("Stop playing sound")
 						s.clockDevice.Snooze()
+						s.announcerDevice.Clear()
 						s.webradioPlayerDevice.Clear()
 						s.playlistPlayerDevice.Clear()
+						s.rendererDevice.Clear()
 						s.refreshDisplay(true)
 					} else if ev.PressStepCount == 15 {
 						if s.clockDevice.IsAlarmRunning() {
@@ -263,12 +316,18 @@ func (s *ServerApp) eventLoop() {
 					}
 				}
 			case event.NEXT_POWEROFF_BUTTON:
-				if ev.ButtonEventType == event.RELEASE_EVENT_TYPE && ev.PressStepCount < 20 {
+				if ev.ButtonEventType == event.RELEASE_EVENT_TYPE && ev.PressStepCount < 5 {
 					if s.playlistPlayerDevice.CurrentPlaylist() != nil {
 						logrus.Debugf("Next song in playlist")
 						s.playlistPlayerDevice.NextSong()
 						s.refreshDisplay(true)
 					}
+				} else if ev.ButtonEventType == event.RELEASE_EVENT_TYPE && ev.PressStepCount < 20 {
+					if s.playlistPlayerDevice.CurrentPlaylist() != nil {
+						logrus.Debugf("Previous song in playlist")
+						s.playlistPlayerDevice.PreviousSong()
+						s.refreshDisplay(true)
+					}
 				} else if ev.ButtonEventType == event.PRESS_EVENT_TYPE && ev.PressStepCount == 20 {
 					logrus.Debugf("See you!")
 					s.clockDevice.ClearAlarm()
@@ -282,3 +341,125 @@ func (s *ServerApp) eventLoop() {
 	}
 	s.eventLoopDone <- true
 }
+
+// playAlarm plays the webradio or the playlist of the alarm
+func (s *ServerApp) playAlarm() {
+	alarmTime := s.Alarm()
+	if alarmTime.WebradioId != nil {
+		s.playlistPlayerDevice.Clear()
+		s.rendererDevice.Clear()
+		err := s.webradioPlayerDevice.Play(*alarmTime.WebradioId, nil)
+		if err != nil {
+			logrus.Warn(err)
+		}
+	} else if alarmTime.PlaylistId != nil {
+		s.webradioPlayerDevice.Clear()
+		s.rendererDevice.Clear()
+		err := s.playlistPlayerDevice.Play(*alarmTime.PlaylistId)
+		if err != nil {
+			logrus.Warn(err)
+		}
+	}
+}
+
+// handleApiEvent executes the requests of the api and of the MPD clients
+func (s *ServerApp) handleApiEvent(ev event.ApiEvent) {
+	switch data := ev.Data.(type) {
+	case event.ApiEventWebradioPlayData:
+		s.clockDevice.ClearAlarm()
+		s.playlistPlayerDevice.Clear()
+		s.rendererDevice.Clear()
+		// The result waits for a mirror of the webradio to play, without blocking the event loop
+		started := make(chan error, 1)
+		err := s.webradioPlayerDevice.Play(data.WebradioId, started)
+		if err != nil {
+			ev.Result <- err
+		} else {
+			go func() {
+				ev.Result <- <-started
+			}()
+		}
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistPlayData:
+		s.clockDevice.ClearAlarm()
+		s.webradioPlayerDevice.Clear()
+		s.rendererDevice.Clear()
+		err := s.playlistPlayerDevice.Play(data.PlaylistId)
+		ev.Result <- err
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistPlayModeData:
+		err := s.playlistPlayerDevice.SetPlayMode(data.PlaylistId, data.PlayMode)
+		ev.Result <- err
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistSeekData:
+		err := s.playlistPlayerDevice.Seek(data.Offset)
+		ev.Result <- err
+		s.refreshDisplay(false)
+	case event.ApiEventAudioVolumeData:
+		err := s.audioDevice.SetVolume(data.Volume)
+		ev.Result <- err
+	case event.ApiEventPlaylistRefreshData:
+		// Don't block the event loop while reaching a remote server
+		go func() {
+			ev.Result <- s.playlistPlayerDevice.Refresh()
+		}()
+	case event.ApiEventStopData:
+		s.clockDevice.ClearAlarm()
+		// Remember what was playing, to resume it later
+		s.saveLastPlayed()
+		s.announcerDevice.Clear()
+		s.webradioPlayerDevice.Clear()
+		s.playlistPlayerDevice.Clear()
+		s.rendererDevice.Clear()
+		ev.Result <- nil
+		s.refreshDisplay(true)
+	case event.ApiEventResumeData:
+		if s.webradioPlayerDevice.CurrentWebRadio() != nil || s.playlistPlayerDevice.CurrentPlaylist() != nil || s.rendererDevice.CurrentTitle() != "" {
+			ev.Result <- nil
+			break
+		}
+		s.clockDevice.ClearAlarm()
+		ev.Result <- s.resumeLastPlayed()
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistNextData:
+		if s.playlistPlayerDevice.CurrentPlaylist() == nil {
+			ev.Result <- fmt.Errorf("No playlist is playing")
+			break
+		}
+		s.playlistPlayerDevice.NextSong()
+		ev.Result <- nil
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistPreviousData:
+		if s.playlistPlayerDevice.CurrentPlaylist() == nil {
+			ev.Result <- fmt.Errorf("No playlist is playing")
+			break
+		}
+		s.playlistPlayerDevice.PreviousSong()
+		ev.Result <- nil
+		s.refreshDisplay(true)
+	case event.ApiEventPlaylistListData:
+		for index := int64(1); ; index++ {
+			playlist := s.playlistPlayerDevice.GetPlaylistByIndex(index)
+			if playlist == nil {
+				break
+			}
+			*data.Playlists = append(*data.Playlists, apimodel.Playlist{
+				PlaylistId: playlist.PlaylistId,
+				Name:       playlist.Name,
+				Index:      playlist.Index,
+			})
+		}
+		ev.Result <- nil
+	case event.ApiEventWebradioImportData:
+		webradioIds, err := s.importWebradios(data.GroupId, data.Stations)
+		*data.WebradioIds = webradioIds
+		ev.Result <- err
+	case event.ApiEventAnnounceData:
+		err := s.announceMessage(data)
+		ev.Result <- err
+		s.refreshDisplay(false)
+	case event.ApiEventStateData:
+		s.fillState(data.State)
+		ev.Result <- nil
+	}
+}
@@ -0,0 +1,222 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Kernel PCM interface, from include/uapi/sound/asound.h
+const (
+	alsaParamAccess    = 0
+	alsaParamFormat    = 1
+	alsaParamSubformat = 2
+
+	alsaParamFirstInterval = 8
+	alsaParamChannels      = 10
+	alsaParamRate          = 11
+	alsaParamPeriodTime    = 12
+	alsaParamBufferTime    = 16
+
+	alsaAccessRwInterleaved = 3
+	alsaFormatS16Le         = 2
+	alsaSubformatStd        = 0
+
+	alsaIntervalInteger = 1 << 2
+)
+
+// Latency bounds of the device buffer: volume and ducking changes are heard once the buffer is played
+const (
+	alsaMinPeriodTime = 20000  // µs
+	alsaMaxBufferTime = 250000 // µs
+)
+
+type alsaMask struct {
+	bits [8]uint32
+}
+
+type alsaInterval struct {
+	min   uint32
+	max   uint32
+	flags uint32
+}
+
+type alsaHwParams struct {
+	flags     uint32
+	masks     [3]alsaMask
+	mres      [5]alsaMask
+	intervals [12]alsaInterval
+	ires      [9]alsaInterval
+	rmask     uint32
+	cmask     uint32
+	info      uint32
+	msbits    uint32
+	rateNum   uint32
+	rateDen   uint32
+	fifoSize  uintptr
+	reserved  [64]byte
+}
+
+type alsaXferi struct {
+	result int
+	buf    uintptr
+	frames uintptr
+}
+
+func alsaIoctlNumber(direction uintptr, number uintptr, size uintptr) uintptr {
+	return direction<<30 | size<<16 | 'A'<<8 | number
+}
+
+var (
+	alsaIoctlHwParams    = alsaIoctlNumber(3, 0x11, unsafe.Sizeof(alsaHwParams{}))
+	alsaIoctlPrepare     = alsaIoctlNumber(0, 0x40, 0)
+	alsaIoctlDrain       = alsaIoctlNumber(0, 0x44, 0)
+	alsaIoctlWriteFrames = alsaIoctlNumber(1, 0x50, unsafe.Sizeof(alsaXferi{}))
+)
+
+// AlsaSink writes the PCM straight to the playback device of a sound card, without going through alsa-lib: the
+// device has to accept signed 16 bits stereo at SampleRate, and is not shared with other programs
+type AlsaSink struct {
+	file *os.File
+}
+
+func NewAlsaSink(device string) (*AlsaSink, error) {
+	filename, err := alsaDeviceFilename(device)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open alsa device %s: %v", device, err)
+	}
+	sink := AlsaSink{file: file}
+
+	// Retry without latency bounds for the devices unable to respect them
+	err = sink.configure(true)
+	if err != nil {
+		err = sink.configure(false)
+	}
+	if err == nil {
+		err = sink.ioctl(alsaIoctlPrepare, nil)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to configure alsa device %s: %v", device, err)
+	}
+	return &sink, nil
+}
+
+// alsaDeviceFilename finds the playback device file of an alsa device name: default, hw:<card>,<device>,
+// plughw:<card>,<device> or hw:CARD=<name>,DEV=<device>
+func alsaDeviceFilename(device string) (string, error) {
+	card := "0"
+	deviceIndex := "0"
+	if device != "" && device != "default" {
+		colon := strings.Index(device, ":")
+		if colon < 0 {
+			return "", fmt.Errorf("unsupported alsa device %s", device)
+		}
+		for i, value := range strings.Split(device[colon+1:], ",") {
+			value = strings.TrimPrefix(strings.TrimPrefix(value, "CARD="), "DEV=")
+			if i == 0 {
+				card = value
+			} else {
+				deviceIndex = value
+			}
+		}
+	}
+
+	// Card names are links to the card directories in /proc/asound
+	if _, err := strconv.Atoi(card); err != nil {
+		cardDir, err := os.Readlink(filepath.Join("/proc/asound", card))
+		if err != nil {
+			return "", fmt.Errorf("unknown alsa card %s", card)
+		}
+		card = strings.TrimPrefix(filepath.Base(cardDir), "card")
+	}
+
+	return fmt.Sprintf("/dev/snd/pcmC%sD%sp", card, deviceIndex), nil
+}
+
+func (s *AlsaSink) configure(boundLatency bool) error {
+	var params alsaHwParams
+	for i := range params.masks {
+		for j := range params.masks[i].bits {
+			params.masks[i].bits[j] = ^uint32(0)
+		}
+	}
+	for i := range params.intervals {
+		params.intervals[i].max = ^uint32(0)
+	}
+	params.rmask = ^uint32(0)
+	params.info = ^uint32(0)
+
+	setMask := func(param int, value uint32) {
+		params.masks[param].bits = [8]uint32{}
+		params.masks[param].bits[value/32] = 1 << (value % 32)
+	}
+	setInterval := func(param int, min uint32, max uint32) {
+		interval := &params.intervals[param-alsaParamFirstInterval]
+		interval.min = min
+		interval.max = max
+		interval.flags = alsaIntervalInteger
+	}
+	setMask(alsaParamAccess, alsaAccessRwInterleaved)
+	setMask(alsaParamFormat, alsaFormatS16Le)
+	setMask(alsaParamSubformat, alsaSubformatStd)
+	setInterval(alsaParamChannels, Channels, Channels)
+	setInterval(alsaParamRate, SampleRate, SampleRate)
+	if boundLatency {
+		setInterval(alsaParamPeriodTime, alsaMinPeriodTime, ^uint32(0))
+		setInterval(alsaParamBufferTime, 0, alsaMaxBufferTime)
+	}
+
+	// The kernel chooses the remaining parameters
+	return s.ioctl(alsaIoctlHwParams, unsafe.Pointer(&params))
+}
+
+func (s *AlsaSink) ioctl(request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, s.file.Fd(), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Write blocks until the device has room for the PCM
+func (s *AlsaSink) Write(pcm []byte) (int, error) {
+	frameSize := Channels * 2
+	written := 0
+	for written+frameSize <= len(pcm) {
+		xfer := alsaXferi{
+			buf:    uintptr(unsafe.Pointer(&pcm[written])),
+			frames: uintptr((len(pcm) - written) / frameSize),
+		}
+		err := s.ioctl(alsaIoctlWriteFrames, unsafe.Pointer(&xfer))
+		runtime.KeepAlive(pcm)
+		switch err {
+		case nil:
+			written += xfer.result * frameSize
+		case syscall.EINTR, syscall.EAGAIN:
+		case syscall.EPIPE, syscall.ESTRPIPE:
+			// Underrun or suspend: the device has to be prepared again before the next write
+			err = s.ioctl(alsaIoctlPrepare, nil)
+			if err != nil {
+				return written, err
+			}
+		default:
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (s *AlsaSink) Close() error {
+	_ = s.ioctl(alsaIoctlDrain, nil)
+	return s.file.Close()
+}
@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Decoder delivers decoded audio as interleaved stereo float samples (-1..1) at SampleRate
+type Decoder interface {
+	// Read fills samples and returns the number of samples read, always a multiple of Channels
+	Read(samples []float32) (int, error)
+	Close() error
+}
+
+// ReadSamples reads until samples is full, the returned error is io.EOF only if nothing has been read
+func ReadSamples(decoder Decoder, samples []float32) (int, error) {
+	read := 0
+	for read < len(samples) {
+		n, err := decoder.Read(samples[read:])
+		read += n
+		if err != nil {
+			if err == io.EOF && read > 0 {
+				return read, nil
+			}
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Placeholder of the decoder command replaced by the file path, the url or "-" when the source is piped on stdin
+const DecoderCommandInput = "{input}"
+
+var DefaultDecoderCommand = []string{"ffmpeg", "-loglevel", "quiet", "-i", DecoderCommandInput, "-f", "s16le", "-ac", "2", "-ar", "44100", "-"}
+
+// commandDecoder delegates the decoding of the formats without native decoder (aac, flac, opus...) to an external
+// command writing signed 16 bits little endian stereo PCM at SampleRate on its standard output
+type commandDecoder struct {
+	cmd    *exec.Cmd
+	output io.ReadCloser
+	reader *bufio.Reader
+	input  io.Closer
+	raw    []byte
+}
+
+func newCommandDecoder(command []string, input string, stdin io.ReadCloser) (*commandDecoder, error) {
+	if len(command) == 0 {
+		command = DefaultDecoderCommand
+	}
+	args := make([]string, len(command)-1)
+	for i, arg := range command[1:] {
+		args[i] = strings.ReplaceAll(arg, DecoderCommandInput, input)
+	}
+
+	decoder := commandDecoder{
+		cmd: exec.Command(command[0], args...),
+	}
+	if stdin != nil {
+		decoder.cmd.Stdin = stdin
+		decoder.input = stdin
+	}
+
+	var err error
+	decoder.output, err = decoder.cmd.StdoutPipe()
+	if err == nil {
+		err = decoder.cmd.Start()
+	}
+	if err != nil {
+		if stdin != nil {
+			stdin.Close()
+		}
+		return nil, fmt.Errorf("unable to start decoder %s: %v", command[0], err)
+	}
+	decoder.reader = bufio.NewReaderSize(decoder.output, chunkFrames*Channels*2)
+
+	return &decoder, nil
+}
+
+func (d *commandDecoder) Read(samples []float32) (int, error) {
+	frames := len(samples) / Channels
+	if frames == 0 {
+		return 0, nil
+	}
+	if cap(d.raw) < frames*Channels*2 {
+		d.raw = make([]byte, frames*Channels*2)
+	}
+	raw := d.raw[:frames*Channels*2]
+
+	n, err := io.ReadFull(d.reader, raw)
+	// A truncated frame at the end of the stream is dropped
+	n -= n % (Channels * 2)
+	for i := 0; i < n/2; i++ {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(raw[2*i:]))) / 32768
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n / 2, err
+}
+
+func (d *commandDecoder) Close() error {
+	if d.cmd.Process != nil {
+		_ = d.cmd.Process.Kill()
+	}
+	if d.input != nil {
+		d.input.Close()
+	}
+	_ = d.cmd.Wait()
+	return nil
+}
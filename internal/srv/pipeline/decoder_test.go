@@ -0,0 +1,148 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"testing"
+)
+
+// sineWav builds a 16 bits PCM wav file of a 440Hz sine at half scale
+func sineWav(sampleRate int, channels int, frames int) []byte {
+	data := make([]byte, frames*channels*2)
+	for i := 0; i < frames; i++ {
+		value := int16(16384 * math.Sin(2*math.Pi*440*float64(i)/float64(sampleRate)))
+		for c := 0; c < channels; c++ {
+			binary.LittleEndian.PutUint16(data[(i*channels+c)*2:], uint16(value))
+		}
+	}
+
+	var wav bytes.Buffer
+	wav.WriteString("RIFF")
+	binary.Write(&wav, binary.LittleEndian, uint32(36+len(data)))
+	wav.WriteString("WAVEfmt ")
+	for _, value := range []interface{}{
+		uint32(16), uint16(wavFormatPcm), uint16(channels), uint32(sampleRate),
+		uint32(sampleRate * channels * 2), uint16(channels * 2), uint16(16),
+	} {
+		binary.Write(&wav, binary.LittleEndian, value)
+	}
+	wav.WriteString("data")
+	binary.Write(&wav, binary.LittleEndian, uint32(len(data)))
+	wav.Write(data)
+	return wav.Bytes()
+}
+
+// silentMp3 builds MPEG-1 layer III mono frames at 44100Hz and 128kbps whose side information is all zeros, which
+// decode to silence
+func silentMp3(frameCount int) []byte {
+	const frameLength = 144 * 128000 / 44100
+	var mp3 bytes.Buffer
+	for i := 0; i < frameCount; i++ {
+		frame := make([]byte, frameLength)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0xC0})
+		mp3.Write(frame)
+	}
+	return mp3.Bytes()
+}
+
+func decodeAll(t *testing.T, source Source) []float32 {
+	decoder, err := Open(source, []string{"false"})
+	if err != nil {
+		t.Fatalf("Unable to open %s: %v", source, err)
+	}
+	defer decoder.Close()
+
+	var samples []float32
+	chunk := make([]float32, chunkFrames*Channels)
+	for {
+		n, err := ReadSamples(decoder, chunk)
+		samples = append(samples, chunk[:n]...)
+		if err == io.EOF {
+			return samples
+		}
+		if err != nil {
+			t.Fatalf("Unable to decode %s: %v", source, err)
+		}
+	}
+}
+
+func TestFormatDetection(t *testing.T) {
+	oggHeader := append([]byte("OggS\x00\x02"), make([]byte, 20)...)
+	oggHeader = append(oggHeader, 1, 30)
+	tests := []struct {
+		name   string
+		header []byte
+		wav    bool
+		mp3    bool
+		ogg    bool
+	}{
+		{"wav", sineWav(SampleRate, 2, 1)[:12], true, false, false},
+		{"mp3 with id3", []byte("ID3\x04\x00"), false, true, false},
+		{"mp3 frame", silentMp3(1)[:4], false, true, false},
+		{"adts aac", []byte{0xFF, 0xF1, 0x50, 0x80}, false, false, false},
+		{"ogg vorbis", append(oggHeader, []byte("\x01vorbis")...), false, false, true},
+		{"ogg opus", append(oggHeader, []byte("OpusHead")...), false, false, false},
+		{"flac", []byte("fLaC\x00\x00\x00\x22"), false, false, false},
+	}
+	for _, test := range tests {
+		if IsWav(test.header) != test.wav || IsMp3(test.header) != test.mp3 || IsOggVorbis(test.header) != test.ogg {
+			t.Errorf("%s: detected as wav %v, mp3 %v, ogg vorbis %v", test.name, IsWav(test.header), IsMp3(test.header), IsOggVorbis(test.header))
+		}
+	}
+}
+
+func TestWavResampling(t *testing.T) {
+	tests := []struct {
+		sampleRate int
+		channels   int
+	}{
+		{SampleRate, 2},
+		{22050, 1},
+		{48000, 2},
+	}
+	for _, test := range tests {
+		wav := sineWav(test.sampleRate, test.channels, test.sampleRate/2)
+		samples := decodeAll(t, Source{Reader: ioutil.NopCloser(bytes.NewReader(wav))})
+
+		// Half a second whatever the source rate, within one source frame
+		frames := len(samples) / Channels
+		if math.Abs(float64(frames-SampleRate/2)) > float64(SampleRate)/float64(test.sampleRate)+1 {
+			t.Errorf("%dHz %d channels: %d frames decoded, expected %d", test.sampleRate, test.channels, frames, SampleRate/2)
+		}
+		peak := 0.0
+		for i := 0; i < len(samples); i += Channels {
+			if samples[i] != samples[i+1] {
+				t.Fatalf("%dHz %d channels: channels differ at frame %d", test.sampleRate, test.channels, i/Channels)
+			}
+			peak = math.Max(peak, math.Abs(float64(samples[i])))
+		}
+		if math.Abs(peak-0.5) > 0.01 {
+			t.Errorf("%dHz %d channels: peak %f, expected 0.5", test.sampleRate, test.channels, peak)
+		}
+	}
+}
+
+func TestMp3Decoding(t *testing.T) {
+	samples := decodeAll(t, Source{Reader: ioutil.NopCloser(bytes.NewReader(silentMp3(10)))})
+
+	// 1152 frames per mp3 frame
+	if len(samples) != 10*1152*Channels {
+		t.Errorf("%d frames decoded, expected %d", len(samples)/Channels, 10*1152)
+	}
+	for i, sample := range samples {
+		if sample != 0 {
+			t.Fatalf("Sample %d is %f instead of silence", i, sample)
+		}
+	}
+}
+
+func TestUnknownFormatUsesDecoderCommand(t *testing.T) {
+	// The decoder command "false" exits at once without output
+	samples := decodeAll(t, Source{Reader: ioutil.NopCloser(bytes.NewReader([]byte("fLaC\x00\x00\x00\x22")))})
+	if len(samples) != 0 {
+		t.Errorf("%d samples decoded by a failing command", len(samples))
+	}
+}
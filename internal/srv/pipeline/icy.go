@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+var icyDialer = &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+
+// HttpClient opens http streams, accepting the "ICY 200 OK" status line of Shoutcast servers which net/http rejects
+// as malformed
+var HttpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := icyDialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &icyConn{Conn: conn}, nil
+		},
+		// The status line is rewritten under the tls layer, which requires to dial tls connections ourselves
+		DialTLSContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			dialer := tls.Dialer{NetDialer: icyDialer}
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &icyConn{Conn: conn}, nil
+		},
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// icyConn replaces the ICY protocol of a response status line by HTTP/1.0
+type icyConn struct {
+	net.Conn
+	checked bool
+	pending []byte
+}
+
+func (c *icyConn) Read(b []byte) (int, error) {
+	if !c.checked {
+		c.checked = true
+		head := make([]byte, 4)
+		n, err := io.ReadFull(c.Conn, head)
+		if n == 0 {
+			return 0, err
+		}
+		c.pending = head[:n]
+		if string(c.pending) == "ICY " {
+			c.pending = []byte("HTTP/1.0 ")
+		}
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
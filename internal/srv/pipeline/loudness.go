@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ReferenceLoudness is the ReplayGain 2.0 reference level, in LUFS
+const ReferenceLoudness = -18.0
+
+// Loudness of a decoded stream, measured according to ITU-R BS.1770 / EBU R128
+type Loudness struct {
+	// Integrated loudness in LUFS
+	Integrated float64
+	// Sample peak (1: full scale)
+	Peak float64
+}
+
+// Gain returns the gain in dB reaching the reference loudness without clipping
+func (l Loudness) Gain() float64 {
+	gain := ReferenceLoudness - l.Integrated
+	if l.Peak > 0 {
+		if maxGain := -20 * math.Log10(l.Peak); gain > maxGain {
+			gain = maxGain
+		}
+	}
+	return gain
+}
+
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	z1, z2             float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+	return y
+}
+
+// kWeightingFilters returns the two stages (high shelf + high pass) of the BS.1770 K-weighting filter
+func kWeightingFilters(sampleRate float64) (biquad, biquad) {
+	f0 := 1681.974450955533
+	g := 3.999843853973347
+	q := 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / sampleRate)
+	vh := math.Pow(10, g/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / sampleRate)
+	a0 = 1 + k/q + k*k
+	highPass := biquad{
+		b0: 1,
+		b1: -2,
+		b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	return shelf, highPass
+}
+
+// MeasureLoudness decodes the whole stream and computes its gated integrated loudness
+func MeasureLoudness(decoder Decoder) (Loudness, error) {
+	var filters [Channels][2]biquad
+	for c := 0; c < Channels; c++ {
+		filters[c][0], filters[c][1] = kWeightingFilters(SampleRate)
+	}
+
+	// Mean square of each 100ms sub block, gating blocks being made of 4 sub blocks (75% overlap)
+	subBlockFrames := SampleRate / 10
+	var subBlockPowers []float64
+	subBlockSum := 0.0
+	subBlockFrameCount := 0
+	peak := 0.0
+
+	samples := make([]float32, chunkFrames*Channels)
+	for {
+		n, err := decoder.Read(samples)
+		for i := 0; i+Channels <= n; i += Channels {
+			for c := 0; c < Channels; c++ {
+				x := float64(samples[i+c])
+				if math.Abs(x) > peak {
+					peak = math.Abs(x)
+				}
+				y := filters[c][1].process(filters[c][0].process(x))
+				subBlockSum += y * y
+			}
+			subBlockFrameCount++
+			if subBlockFrameCount == subBlockFrames {
+				subBlockPowers = append(subBlockPowers, subBlockSum/float64(subBlockFrames))
+				subBlockSum = 0
+				subBlockFrameCount = 0
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Loudness{}, err
+		}
+	}
+
+	var blockPowers []float64
+	for i := 0; i+4 <= len(subBlockPowers); i++ {
+		blockPowers = append(blockPowers, (subBlockPowers[i]+subBlockPowers[i+1]+subBlockPowers[i+2]+subBlockPowers[i+3])/4)
+	}
+
+	// Absolute gate at -70 LUFS, then relative gate 10 LU below the absolute gated loudness
+	absoluteGatedPower, absoluteGatedCount := gatedPower(blockPowers, loudnessToPower(-70))
+	if absoluteGatedCount == 0 {
+		return Loudness{}, fmt.Errorf("stream too short or silent")
+	}
+	relativeGate := powerToLoudness(absoluteGatedPower) - 10
+	relativeGatedPower, _ := gatedPower(blockPowers, loudnessToPower(relativeGate))
+
+	return Loudness{
+		Integrated: powerToLoudness(relativeGatedPower),
+		Peak:       peak,
+	}, nil
+}
+
+func gatedPower(blockPowers []float64, gate float64) (float64, int) {
+	sum := 0.0
+	count := 0
+	for _, power := range blockPowers {
+		if power > gate {
+			sum += power
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, 0
+	}
+	return sum / float64(count), count
+}
+
+func powerToLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+func loudnessToPower(loudness float64) float64 {
+	return math.Pow(10, (loudness+0.691)/10)
+}
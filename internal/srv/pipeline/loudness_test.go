@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"io"
+	"math"
+	"testing"
+)
+
+// sliceDecoder delivers samples from memory
+type sliceDecoder struct {
+	samples []float32
+}
+
+func (d *sliceDecoder) Read(samples []float32) (int, error) {
+	if len(d.samples) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(samples, d.samples)
+	n -= n % Channels
+	d.samples = d.samples[n:]
+	return n, nil
+}
+
+func (d *sliceDecoder) Close() error {
+	return nil
+}
+
+// sine appends a 1kHz stereo sine of the given amplitude in dBFS
+func sine(samples []float32, seconds float64, amplitudeDb float64) []float32 {
+	amplitude := DbToGain(amplitudeDb)
+	frames := int(seconds * SampleRate)
+	for i := 0; i < frames; i++ {
+		value := float32(amplitude * math.Sin(2*math.Pi*1000*float64(i)/SampleRate))
+		samples = append(samples, value, value)
+	}
+	return samples
+}
+
+func TestMeasureLoudness(t *testing.T) {
+	tests := []struct {
+		name       string
+		samples    []float32
+		integrated float64
+		tolerance  float64
+		peak       float64
+	}{
+		// A full scale 1kHz sine in both channels is at 0 LUFS
+		{"full scale", sine(nil, 3, 0), 0, 0.1, 1},
+		{"-20 dBFS", sine(nil, 3, -20), -20, 0.1, 0.1},
+		// Blocks under -70 LUFS are gated out, the overlapping blocks around the transition remain (-23 LUFS without
+		// gate)
+		{"absolute gate", sine(sine(nil, 2, -20), 2, -80), -20, 0.5, 0.1},
+		// Blocks 10 LU under the loudness of the other blocks are gated out too
+		{"relative gate", sine(sine(nil, 2, -20), 2, -35), -20, 0.5, 0.1},
+	}
+	for _, test := range tests {
+		loudness, err := MeasureLoudness(&sliceDecoder{samples: test.samples})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if math.Abs(loudness.Integrated-test.integrated) > test.tolerance {
+			t.Errorf("%s: integrated loudness %.2f LUFS, expected %.2f", test.name, loudness.Integrated, test.integrated)
+		}
+		if math.Abs(loudness.Peak-test.peak) > 0.001 {
+			t.Errorf("%s: peak %.4f, expected %.4f", test.name, loudness.Peak, test.peak)
+		}
+	}
+}
+
+func TestMeasureLoudnessSilence(t *testing.T) {
+	for name, samples := range map[string][]float32{
+		"silence":   make([]float32, 3*SampleRate*Channels),
+		"too short": sine(nil, 0.3, -20),
+	} {
+		_, err := MeasureLoudness(&sliceDecoder{samples: samples})
+		if err == nil {
+			t.Errorf("%s: loudness measured", name)
+		}
+	}
+}
+
+func TestLoudnessGain(t *testing.T) {
+	tests := []struct {
+		loudness Loudness
+		gain     float64
+	}{
+		{Loudness{Integrated: -10, Peak: 0.5}, -8},
+		{Loudness{Integrated: -30, Peak: 0.1}, 12},
+		// Limited to avoid clipping: a 0.5 peak reaches full scale at +6.02 dB
+		{Loudness{Integrated: -30, Peak: 0.5}, 20 * math.Log10(2)},
+		{Loudness{Integrated: -30}, 12},
+	}
+	for _, test := range tests {
+		if gain := test.loudness.Gain(); math.Abs(gain-test.gain) > 1e-9 {
+			t.Errorf("%+v: gain %.2f dB, expected %.2f", test.loudness, gain, test.gain)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/hajimehoshi/go-mp3"
+	"io"
+)
+
+// IsMp3 checks the ID3v2 tag or the MPEG layer III frame sync of a file header
+func IsMp3(header []byte) bool {
+	if len(header) >= 3 && string(header[0:3]) == "ID3" {
+		return true
+	}
+	// Sync word, then layer bits set to 01 (layer III): ADTS AAC streams share the sync word with layer bits 00
+	return len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && (header[1]>>1)&0x03 == 0x01
+}
+
+// mp3Decoder decodes mp3 files and streams natively, converting them to SampleRate
+type mp3Decoder struct {
+	resampler
+	reader *bufio.Reader
+	closer io.Closer
+
+	frame []byte
+}
+
+func newMp3Decoder(reader io.Reader, closer io.Closer) (*mp3Decoder, error) {
+	// The mp3 decoder always delivers signed 16 bits little endian stereo
+	mp3Reader, err := mp3.NewDecoder(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := mp3Decoder{
+		reader: bufio.NewReaderSize(mp3Reader, chunkFrames*Channels*2),
+		closer: closer,
+		frame:  make([]byte, Channels*2),
+	}
+	decoder.resampler = newResampler(mp3Reader.SampleRate(), decoder.readFrame)
+	return &decoder, nil
+}
+
+func (d *mp3Decoder) Read(samples []float32) (int, error) {
+	return d.read(samples)
+}
+
+func (d *mp3Decoder) readFrame() ([Channels]float32, error) {
+	var frame [Channels]float32
+
+	_, err := io.ReadFull(d.reader, d.frame)
+	if err != nil {
+		return frame, io.EOF
+	}
+	for c := 0; c < Channels; c++ {
+		frame[c] = float32(int16(binary.LittleEndian.Uint16(d.frame[2*c:]))) / 32768
+	}
+	return frame, nil
+}
+
+func (d *mp3Decoder) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
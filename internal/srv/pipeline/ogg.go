@@ -0,0 +1,77 @@
+package pipeline
+
+import (
+	"github.com/jfreymuth/oggvorbis"
+	"io"
+)
+
+// IsOggVorbis checks the Ogg page signature and the vorbis identification packet of a file header
+func IsOggVorbis(header []byte) bool {
+	if len(header) < 27 || string(header[0:4]) != "OggS" {
+		return false
+	}
+	// The first packet follows the segment table of the first page
+	packetStart := 27 + int(header[26])
+	return len(header) >= packetStart+7 && string(header[packetStart:packetStart+7]) == "\x01vorbis"
+}
+
+// oggDecoder decodes ogg vorbis files and streams natively, converting them to stereo at SampleRate
+type oggDecoder struct {
+	resampler
+	reader *oggvorbis.Reader
+	closer io.Closer
+
+	channels int
+	buffer   []float32
+	pending  []float32
+}
+
+func newOggDecoder(reader io.Reader, closer io.Closer) (*oggDecoder, error) {
+	oggReader, err := oggvorbis.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := oggDecoder{
+		reader:   oggReader,
+		closer:   closer,
+		channels: oggReader.Channels(),
+		buffer:   make([]float32, chunkFrames*oggReader.Channels()),
+	}
+	decoder.resampler = newResampler(oggReader.SampleRate(), decoder.readFrame)
+	return &decoder, nil
+}
+
+func (d *oggDecoder) Read(samples []float32) (int, error) {
+	return d.read(samples)
+}
+
+func (d *oggDecoder) readFrame() ([Channels]float32, error) {
+	var frame [Channels]float32
+
+	for len(d.pending) < d.channels {
+		n, err := d.reader.Read(d.buffer)
+		d.pending = d.buffer[:n]
+		if n == 0 && err != nil {
+			return frame, io.EOF
+		}
+	}
+
+	for c := 0; c < Channels; c++ {
+		// Mono is duplicated, extra channels are dropped
+		sourceChannel := c
+		if sourceChannel >= d.channels {
+			sourceChannel = d.channels - 1
+		}
+		frame[c] = d.pending[sourceChannel]
+	}
+	d.pending = d.pending[d.channels:]
+	return frame, nil
+}
+
+func (d *oggDecoder) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package pipeline
+
+import (
+	"github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// PCM format produced by the decoders and written to the sinks: interleaved signed 16 bits little endian stereo
+const (
+	SampleRate = 44100
+	Channels   = 2
+)
+
+// Number of frames mixed at each pipeline iteration (~23ms)
+const chunkFrames = 1024
+
+// Duration of the transition between the normal and the ducked gain
+const duckingTransition = 300 * time.Millisecond
+
+// Pipeline mixes the playing streams, applies the software volume and writes the result to the sink.
+// Silence is written when nothing is playing, which keeps the sound card awake and avoids popping/clicking noises.
+type Pipeline struct {
+	lock           sync.Mutex
+	sink           Sink
+	decoderCommand []string
+	gain           float64
+	crossfade      int
+	streams        []*Stream
+	mixing         []mixEntry
+
+	// Gain applied to the streams played under an overlay, and gain currently applied, moving towards 1 or towards
+	// the ducking gain
+	duckingGain float64
+	duckGain    float64
+
+	askDone chan bool
+	done    chan bool
+}
+
+func New(sink Sink, decoderCommand []string) *Pipeline {
+	pipeline := Pipeline{
+		sink:           sink,
+		decoderCommand: decoderCommand,
+		gain:           1,
+		duckingGain:    1,
+		duckGain:       1,
+		askDone:        make(chan bool),
+		done:           make(chan bool),
+	}
+	return &pipeline
+}
+
+func (p *Pipeline) Start() {
+	go p.run()
+}
+
+func (p *Pipeline) Stop() {
+	p.askDone <- true
+	<-p.done
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, stream := range p.streams {
+		stream.lock.Lock()
+		next := stream.next
+		stream.lock.Unlock()
+		if next != nil {
+			next.Stop()
+		}
+		stream.Stop()
+		stream.finish()
+	}
+	p.streams = nil
+
+	err := p.sink.Close()
+	if err != nil {
+		logrus.Warnf("Unable to close audio sink: %v", err)
+	}
+}
+
+// SetGain sets the master software gain (0: mute, 1: full scale)
+func (p *Pipeline) SetGain(gain float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gain = gain
+}
+
+// SetCrossfade sets the duration of the transition between a stream and the one chained to it, 0 for gapless
+// transitions
+func (p *Pipeline) SetCrossfade(crossfade time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.crossfade = int(crossfade * SampleRate / time.Second)
+}
+
+// SetDucking sets the gain applied to the other streams while an overlay stream is playing (1: no ducking)
+func (p *Pipeline) SetDucking(gain float64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.duckingGain = gain
+}
+
+// Play starts decoding the source in background and mixes it into the output as soon as data is available
+func (p *Pipeline) Play(source Source) *Stream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stream := p.newStream(source)
+	p.streams = append(p.streams, stream)
+	stream.markStarted()
+
+	return stream
+}
+
+// PlayOver plays the source like Play, the other streams being ducked until its end
+func (p *Pipeline) PlayOver(source Source) *Stream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stream := p.newStream(source)
+	stream.overlay = true
+	p.streams = append(p.streams, stream)
+	stream.markStarted()
+
+	return stream
+}
+
+// PlayNext chains the source to the current stream: it is decoded in advance and mixed right after the end of the
+// current stream, or during its last seconds when crossfade is enabled
+func (p *Pipeline) PlayNext(current *Stream, source Source) *Stream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stream := p.newStream(source)
+	if current.finished() {
+		p.streams = append(p.streams, stream)
+		stream.markStarted()
+		return stream
+	}
+
+	current.lock.Lock()
+	defer current.lock.Unlock()
+	if current.next != nil && !current.nextStarted {
+		current.next.Stop()
+	}
+	current.next = stream
+	current.nextStarted = false
+	current.crossfadeFrames = p.crossfade
+
+	return stream
+}
+
+func (p *Pipeline) newStream(source Source) *Stream {
+	// The buffer must hold the whole crossfade to detect its beginning
+	bufferedChunks := streamBufferedChunks + p.crossfade/chunkFrames
+	stream := newStream(func() (Decoder, error) { return Open(source, p.decoderCommand) }, bufferedChunks)
+	stream.SetGain(DbToGain(source.Gain))
+	return stream
+}
+
+// mixEntry is a stream mixed at the current iteration, from the offset where it has been started
+type mixEntry struct {
+	stream *Stream
+	offset int
+}
+
+func (p *Pipeline) run() {
+	mix := make([]float32, chunkFrames*Channels)
+	pcm := make([]byte, chunkFrames*Channels*2)
+
+	for loop := true; loop; {
+		select {
+		case <-p.askDone:
+			loop = false
+		default:
+			for i := range mix {
+				mix[i] = 0
+			}
+
+			p.lock.Lock()
+			gain := p.gain
+			p.mixing = p.mixing[:0]
+			duckGainTarget := 1.0
+			for _, stream := range p.streams {
+				p.mixing = append(p.mixing, mixEntry{stream: stream})
+				if stream.overlay {
+					duckGainTarget = p.duckingGain
+				}
+			}
+			p.updateDuckGain(duckGainTarget)
+			duckGain := float32(p.duckGain)
+			activeStreams := p.streams[:0]
+			// Chained streams are appended while mixing, to be mixed from the point where they start
+			for i := 0; i < len(p.mixing); i++ {
+				entry := p.mixing[i]
+				if next := entry.stream.startCrossfade(); next != nil {
+					next.markStarted()
+					p.mixing = append(p.mixing, mixEntry{stream: next, offset: entry.offset})
+				}
+				mixed, active := entry.stream.mixInto(mix[entry.offset:], duckGain)
+				if active {
+					activeStreams = append(activeStreams, entry.stream)
+					continue
+				}
+				if next := entry.stream.takeNext(); next != nil {
+					next.markStarted()
+					p.mixing = append(p.mixing, mixEntry{stream: next, offset: entry.offset + mixed})
+				}
+				entry.stream.finish()
+			}
+			for i := len(activeStreams); i < len(p.streams); i++ {
+				p.streams[i] = nil
+			}
+			p.streams = activeStreams
+			p.lock.Unlock()
+
+			encodePcm(pcm, mix, gain)
+			_, err := p.sink.Write(pcm)
+			if err != nil {
+				logrus.Warnf("Unable to write to audio sink: %v", err)
+				time.Sleep(time.Duration(chunkFrames) * time.Second / SampleRate)
+			}
+		}
+	}
+	p.done <- true
+}
+
+// updateDuckGain moves the ducking gain currently applied one iteration closer to the target
+func (p *Pipeline) updateDuckGain(target float64) {
+	step := float64(chunkFrames) / (duckingTransition.Seconds() * SampleRate)
+	if p.duckGain < target {
+		p.duckGain = math.Min(p.duckGain+step, target)
+	} else if p.duckGain > target {
+		p.duckGain = math.Max(p.duckGain-step, target)
+	}
+}
+
+// DbToGain converts a gain in dB to a linear factor
+func DbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// encodePcm converts float samples to signed 16 bits little endian, with clipping
+func encodePcm(pcm []byte, samples []float32, gain float64) {
+	for i, sample := range samples {
+		value := math.Round(float64(sample) * gain * 32767)
+		if value > 32767 {
+			value = 32767
+		} else if value < -32768 {
+			value = -32768
+		}
+		v := int16(value)
+		pcm[2*i] = byte(v)
+		pcm[2*i+1] = byte(v >> 8)
+	}
+}
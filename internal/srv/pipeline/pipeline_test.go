@@ -0,0 +1,199 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// playToFile plays the sources one after the other through a real time file sink and returns the written PCM
+func playToFile(t *testing.T, gain float64, sources ...Source) []int16 {
+	filename := filepath.Join(t.TempDir(), "output.pcm")
+	sink, err := NewFileSink(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := New(sink, []string{"false"})
+	pipeline.SetGain(gain)
+	pipeline.Start()
+
+	for _, source := range sources {
+		stream := pipeline.Play(source)
+		select {
+		case <-waitChannel(stream):
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s still playing", source)
+		}
+	}
+	pipeline.Stop()
+
+	pcm, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[2*i:]))
+	}
+	return samples
+}
+
+func waitChannel(stream *Stream) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- stream.Wait()
+	}()
+	return result
+}
+
+// soundFrames counts the frames between the first and the last non silent samples, and returns the peak
+func soundFrames(samples []int16) (int, int16) {
+	first, last := -1, -1
+	var peak int16
+	for i, sample := range samples {
+		if sample != 0 {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+		if sample > peak {
+			peak = sample
+		}
+	}
+	if first < 0 {
+		return 0, 0
+	}
+	return (last-first)/Channels + 1, peak
+}
+
+func TestPipelineFileSink(t *testing.T) {
+	wav := sineWav(22050, 1, 22050/4)
+	samples := playToFile(t, 1, Source{Reader: ioutil.NopCloser(bytes.NewReader(wav))})
+
+	frames, peak := soundFrames(samples)
+	// A quarter of a second, the zero crossings at the edges of the sine excepted
+	if math.Abs(float64(frames-SampleRate/4)) > 4 {
+		t.Errorf("%d frames played, expected %d", frames, SampleRate/4)
+	}
+	if math.Abs(float64(peak)-16384) > 200 {
+		t.Errorf("Peak %d, expected 16384", peak)
+	}
+	if len(samples)%Channels != 0 {
+		t.Errorf("Truncated frame written to the sink")
+	}
+}
+
+func TestPipelineGains(t *testing.T) {
+	wav := sineWav(SampleRate, 2, SampleRate/10)
+	samples := playToFile(t, 0.5, Source{Reader: ioutil.NopCloser(bytes.NewReader(wav)), Gain: -6.0206})
+
+	_, peak := soundFrames(samples)
+	// Master gain 0.5 and source gain -6dB
+	if math.Abs(float64(peak)-4096) > 50 {
+		t.Errorf("Peak %d, expected 4096", peak)
+	}
+}
+
+func TestPipelineMp3Source(t *testing.T) {
+	pipeline := New(NewNullSink(true), nil)
+	pipeline.Start()
+	defer pipeline.Stop()
+
+	playback := pipeline.Play(Source{Reader: ioutil.NopCloser(bytes.NewReader(silentMp3(20)))})
+	select {
+	case <-playback.Playing():
+	case <-time.After(5 * time.Second):
+		t.Fatal("mp3 stream not playing")
+	}
+	select {
+	case err := <-waitChannel(playback):
+		if err != nil {
+			t.Errorf("mp3 stream failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("mp3 stream still playing")
+	}
+	if position := playback.Position(); position < 500*time.Millisecond || position > 600*time.Millisecond {
+		t.Errorf("Position %v at the end of 20 mp3 frames", position)
+	}
+}
+
+func TestPipelineReplacedNext(t *testing.T) {
+	pipeline := New(NewNullSink(true), nil)
+	pipeline.Start()
+	defer pipeline.Stop()
+
+	current := pipeline.Play(Source{Reader: ioutil.NopCloser(bytes.NewReader(sineWav(SampleRate, 2, SampleRate)))})
+	replaced := pipeline.PlayNext(current, Source{Reader: ioutil.NopCloser(bytes.NewReader(sineWav(SampleRate, 2, SampleRate)))})
+	next := pipeline.PlayNext(current, Source{Reader: ioutil.NopCloser(bytes.NewReader(sineWav(SampleRate, 2, SampleRate/10)))})
+
+	// The replaced stream never plays, its end is not delayed until the end of the current one
+	select {
+	case <-waitChannel(replaced):
+	case <-time.After(200 * time.Millisecond):
+		t.Fatal("Replaced chained stream still waited for")
+	}
+	if replaced.Position() != 0 {
+		t.Errorf("Replaced chained stream played")
+	}
+
+	current.Skip()
+	select {
+	case <-waitChannel(next):
+	case <-time.After(2 * time.Second):
+		t.Fatal("Chained stream still playing")
+	}
+	if next.Position() == 0 {
+		t.Errorf("Chained stream not played")
+	}
+}
+
+// blockingDecoder blocks in Read until released, and records a Close received during a Read
+type blockingDecoder struct {
+	reading chan struct{}
+	release chan struct{}
+	closed  chan bool
+	inRead  int32
+}
+
+func (d *blockingDecoder) Read(samples []float32) (int, error) {
+	atomic.StoreInt32(&d.inRead, 1)
+	defer atomic.StoreInt32(&d.inRead, 0)
+	d.reading <- struct{}{}
+	<-d.release
+	return len(samples), nil
+}
+
+func (d *blockingDecoder) Close() error {
+	d.closed <- atomic.LoadInt32(&d.inRead) == 1
+	return nil
+}
+
+func TestStreamStopDuringRead(t *testing.T) {
+	decoder := &blockingDecoder{reading: make(chan struct{}), release: make(chan struct{}), closed: make(chan bool, 1)}
+	stream := newStream(func() (Decoder, error) { return decoder, nil }, streamBufferedChunks)
+	<-decoder.reading
+
+	// The decoder is closed by the decode goroutine, once the read is over
+	stream.Stop()
+	select {
+	case <-decoder.closed:
+		t.Fatal("Decoder closed during a read")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(decoder.release)
+	select {
+	case closedDuringRead := <-decoder.closed:
+		if closedDuringRead {
+			t.Errorf("Decoder closed during a read")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Decoder not closed")
+	}
+}
@@ -0,0 +1,67 @@
+package pipeline
+
+import (
+	"io"
+)
+
+// resampler converts the frames of a decoder to SampleRate by linear interpolation
+type resampler struct {
+	// readFrame returns the next frame of the source, io.EOF at its end
+	readFrame func() ([Channels]float32, error)
+
+	step      float64
+	position  float64
+	prevFrame [Channels]float32
+	nextFrame [Channels]float32
+	started   bool
+	ended     bool
+}
+
+func newResampler(sampleRate int, readFrame func() ([Channels]float32, error)) resampler {
+	return resampler{
+		readFrame: readFrame,
+		step:      float64(sampleRate) / SampleRate,
+	}
+}
+
+func (r *resampler) read(samples []float32) (int, error) {
+	if !r.started {
+		r.started = true
+		var err error
+		r.prevFrame, err = r.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		r.nextFrame, err = r.readFrame()
+		if err != nil {
+			r.nextFrame = r.prevFrame
+			r.ended = true
+		}
+	}
+
+	read := 0
+	for ; read+Channels <= len(samples); read += Channels {
+		for r.position >= 1 {
+			if r.ended {
+				if read == 0 {
+					return 0, io.EOF
+				}
+				return read, nil
+			}
+			r.prevFrame = r.nextFrame
+			r.position--
+			var err error
+			r.nextFrame, err = r.readFrame()
+			if err != nil {
+				r.nextFrame = r.prevFrame
+				r.ended = true
+			}
+		}
+		for c := 0; c < Channels; c++ {
+			samples[read+c] = r.prevFrame[c] + (r.nextFrame[c]-r.prevFrame[c])*float32(r.position)
+		}
+		r.position += r.step
+	}
+
+	return read, nil
+}
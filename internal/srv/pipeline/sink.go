@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// Sink receives the mixed PCM; Write blocks as long as the output needs to play the data in real time
+type Sink interface {
+	io.WriteCloser
+}
+
+// pacer slows down writes to real time for outputs which don't do it by themselves
+type pacer struct {
+	realtime      bool
+	startTime     time.Time
+	writtenFrames int64
+}
+
+func (p *pacer) wait(byteCount int) {
+	if !p.realtime {
+		return
+	}
+	if p.startTime.IsZero() {
+		p.startTime = time.Now()
+	}
+	p.writtenFrames += int64(byteCount / (Channels * 2))
+	delay := time.Until(p.startTime.Add(time.Duration(p.writtenFrames) * time.Second / SampleRate))
+	if delay > 0 {
+		time.Sleep(delay)
+	} else if delay < -time.Second {
+		// Too late to catch up: restart the clock
+		p.startTime = time.Now()
+		p.writtenFrames = 0
+	}
+}
+
+// NullSink discards the PCM
+type NullSink struct {
+	pacer pacer
+}
+
+func NewNullSink(realtime bool) *NullSink {
+	return &NullSink{pacer: pacer{realtime: realtime}}
+}
+
+func (s *NullSink) Write(pcm []byte) (int, error) {
+	s.pacer.wait(len(pcm))
+	return len(pcm), nil
+}
+
+func (s *NullSink) Close() error {
+	return nil
+}
+
+// FileSink appends the raw PCM to a file
+type FileSink struct {
+	file  *os.File
+	pacer pacer
+}
+
+func NewFileSink(filename string, realtime bool) (*FileSink, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, pacer: pacer{realtime: realtime}}, nil
+}
+
+func (s *FileSink) Write(pcm []byte) (int, error) {
+	n, err := s.file.Write(pcm)
+	s.pacer.wait(n)
+	return n, err
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
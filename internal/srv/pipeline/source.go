@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jypelle/vekigi/internal/srv/tag"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Source designates what to play: a local file, an url or an already opened stream
+type Source struct {
+	Path   string
+	Url    string
+	Reader io.ReadCloser
+	// Gain in dB applied to this source only (loudness normalization)
+	Gain float64
+	// Position where the playback starts
+	Start time.Duration
+}
+
+func (s Source) String() string {
+	switch {
+	case s.Reader != nil:
+		return "stream"
+	case s.Path != "":
+		return s.Path
+	default:
+		return s.Url
+	}
+}
+
+// Open selects the native decoder of wav, mp3 and ogg vorbis sources, and the decoder command for other formats
+func Open(source Source, decoderCommand []string) (Decoder, error) {
+	decoder, err := openDecoder(source, decoderCommand)
+	if err != nil || source.Start <= 0 {
+		return decoder, err
+	}
+
+	// Decode and drop everything before the start position
+	err = skip(decoder, int64(source.Start*SampleRate/time.Second)*Channels)
+	if err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	return decoder, nil
+}
+
+func openDecoder(source Source, decoderCommand []string) (Decoder, error) {
+	switch {
+	case source.Reader != nil:
+		return openStream(source.Reader, decoderCommand)
+	case source.Path != "":
+		file, err := os.Open(source.Path)
+		if err != nil {
+			return nil, err
+		}
+		reader := bufio.NewReader(file)
+		decoder, err := openNative(reader, file)
+		if decoder != nil || err != nil {
+			if err != nil {
+				file.Close()
+			}
+			return decoder, err
+		}
+		file.Close()
+		return newCommandDecoder(decoderCommand, source.Path, nil)
+	case strings.HasPrefix(source.Url, "http://") || strings.HasPrefix(source.Url, "https://"):
+		resp, err := HttpClient.Get(source.Url)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, source.Url)
+		}
+		return openStream(resp.Body, decoderCommand)
+	case source.Url != "":
+		return newCommandDecoder(decoderCommand, source.Url, nil)
+	default:
+		return nil, fmt.Errorf("empty source")
+	}
+}
+
+func openStream(stream io.ReadCloser, decoderCommand []string) (Decoder, error) {
+	reader := bufio.NewReader(stream)
+	decoder, err := openNative(reader, stream)
+	if decoder != nil || err != nil {
+		if err != nil {
+			stream.Close()
+		}
+		return decoder, err
+	}
+	return newCommandDecoder(decoderCommand, "-", readCloser{reader, stream})
+}
+
+// openNative returns the native decoder of the format recognized from the header, or nil for other formats
+func openNative(reader *bufio.Reader, closer io.Closer) (Decoder, error) {
+	header, _ := reader.Peek(64)
+	switch {
+	case IsWav(header):
+		decoder, err := newWavDecoder(reader, closer)
+		if err != nil {
+			return nil, err
+		}
+		return decoder, nil
+	case IsMp3(header):
+		decoder, err := newMp3Decoder(reader, closer)
+		if err != nil {
+			return nil, err
+		}
+		return decoder, nil
+	case IsOggVorbis(header):
+		decoder, err := newOggDecoder(reader, closer)
+		if err != nil {
+			return nil, err
+		}
+		return decoder, nil
+	default:
+		return nil, nil
+	}
+}
+
+func skip(decoder Decoder, sampleCount int64) error {
+	samples := make([]float32, chunkFrames*Channels)
+	for sampleCount > 0 {
+		if sampleCount < int64(len(samples)) {
+			samples = samples[:sampleCount]
+		}
+		n, err := decoder.Read(samples)
+		sampleCount -= int64(n)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Duration returns the duration of a local file, read from the header of wav files and from the tags or the
+// container headers of other formats
+func Duration(path string) (time.Duration, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	header, _ := reader.Peek(12)
+	if IsWav(header) {
+		decoder, err := newWavDecoder(reader, file)
+		if err != nil {
+			return 0, err
+		}
+		return decoder.duration, nil
+	}
+	return tag.Duration(path)
+}
+
+// readCloser keeps the buffered bytes already peeked from a stream
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// audioExtensions are the file extensions of the formats handled by the native wav decoder and the decoder command
+var audioExtensions = map[string]bool{
+	".mp3":  true,
+	".flac": true,
+	".ogg":  true,
+	".oga":  true,
+	".opus": true,
+	".m4a":  true,
+	".mp4":  true,
+	".aac":  true,
+	".wav":  true,
+	".wma":  true,
+	".aif":  true,
+	".aiff": true,
+}
+
+// IsAudioFile reports whether the file extension is the one of a playable audio format
+func IsAudioFile(filename string) bool {
+	return audioExtensions[strings.ToLower(filepath.Ext(filename))]
+}
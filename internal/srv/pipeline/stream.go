@@ -0,0 +1,321 @@
+package pipeline
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Number of decoded chunks buffered ahead for each stream (~1.5s)
+const streamBufferedChunks = 64
+
+// Stream is a source being decoded and mixed by the pipeline
+type Stream struct {
+	lock     sync.Mutex
+	err      error
+	decoded  bool
+	buffered int
+	played   int64
+
+	chunks  chan []float32
+	pending []float32
+	gain    float64
+	// Played over the other streams, which are ducked meanwhile
+	overlay bool
+
+	// Fade applied on top of the gain, fadeStep being added to fadeGain at each frame
+	fadeGain float32
+	fadeStep float32
+
+	// Stream chained to this one, started at its end or at the beginning of the crossfade
+	next            *Stream
+	nextStarted     bool
+	crossfadeFrames int
+	skipped         bool
+
+	startOnce   sync.Once
+	playingOnce sync.Once
+	stopOnce    sync.Once
+	finishOnce  sync.Once
+	started     chan struct{}
+	playing     chan struct{}
+	quit        chan struct{}
+	done        chan struct{}
+}
+
+func newStream(open func() (Decoder, error), bufferedChunks int) *Stream {
+	stream := Stream{
+		chunks:   make(chan []float32, bufferedChunks),
+		gain:     1,
+		fadeGain: 1,
+		started:  make(chan struct{}),
+		playing:  make(chan struct{}),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go stream.decode(open)
+
+	return &stream
+}
+
+// decode feeds the chunk buffer until the end of the source or until the stream is stopped. The decoder is only used
+// by this goroutine, which closes it: native decoders are not safe for concurrent use.
+func (s *Stream) decode(open func() (Decoder, error)) {
+	defer close(s.chunks)
+
+	decoder, err := open()
+	if err != nil {
+		s.setErr(err)
+		return
+	}
+	defer decoder.Close()
+
+	for {
+		// Stop may have been called while opening or reading
+		select {
+		case <-s.quit:
+			return
+		default:
+		}
+
+		chunk := make([]float32, chunkFrames*Channels)
+		n, err := ReadSamples(decoder, chunk)
+		if n > 0 {
+			s.lock.Lock()
+			s.buffered += n
+			s.lock.Unlock()
+			select {
+			case s.chunks <- chunk[:n]:
+			case <-s.quit:
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.setErr(err)
+			}
+			s.lock.Lock()
+			s.decoded = true
+			s.lock.Unlock()
+			return
+		}
+	}
+}
+
+// mixInto adds the next available samples of the stream to the mix, with the ducking gain unless the stream is an
+// overlay. It returns the number of samples mixed and false once the stream is over.
+func (s *Stream) mixInto(mix []float32, duckGain float32) (int, bool) {
+	select {
+	case <-s.quit:
+		return 0, false
+	default:
+	}
+
+	s.lock.Lock()
+	gain := float32(s.gain)
+	s.lock.Unlock()
+	if !s.overlay {
+		gain *= duckGain
+	}
+
+	mixed := 0
+	defer func() {
+		s.lock.Lock()
+		s.buffered -= mixed
+		s.played += int64(mixed / Channels)
+		s.lock.Unlock()
+	}()
+
+	for mixed < len(mix) {
+		if len(s.pending) == 0 {
+			select {
+			case chunk, ok := <-s.chunks:
+				if !ok {
+					return mixed, false
+				}
+				s.pending = chunk
+				s.playingOnce.Do(func() {
+					close(s.playing)
+				})
+			default:
+				// Buffer underrun: the rest of the chunk stays silent
+				return mixed, true
+			}
+		}
+		n := len(mix) - mixed
+		if n > len(s.pending) {
+			n = len(s.pending)
+		}
+		for i := 0; i < n; i += Channels {
+			frameGain := gain * s.fadeGain
+			for c := 0; c < Channels; c++ {
+				mix[mixed+i+c] += s.pending[i+c] * frameGain
+			}
+			if s.fadeStep != 0 {
+				s.fadeGain += s.fadeStep
+				if s.fadeGain >= 1 {
+					s.fadeGain = 1
+					s.fadeStep = 0
+				} else if s.fadeGain <= 0 {
+					// Faded out before its end: the stream is over
+					mixed += i + Channels
+					s.pending = nil
+					s.fadeGain = 0
+					s.fadeStep = 0
+					go s.Stop()
+					return mixed, false
+				}
+			}
+		}
+		s.pending = s.pending[n:]
+		mixed += n
+	}
+
+	return mixed, true
+}
+
+// fade ramps the fade gain to 1 (fade in) or 0 (fade out) in the given number of frames
+func (s *Stream) fade(in bool, frames int) {
+	if frames <= 0 {
+		frames = 1
+	}
+	if in {
+		s.fadeGain = 0
+		s.fadeStep = 1 / float32(frames)
+	} else {
+		s.fadeStep = -s.fadeGain / float32(frames)
+	}
+}
+
+// startCrossfade returns the chained stream when it must start before the end of this one: when the remaining
+// decoded samples fit in the crossfade duration, or when the stream has been skipped
+func (s *Stream) startCrossfade() *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.next == nil || s.nextStarted || s.crossfadeFrames == 0 {
+		return nil
+	}
+	remainingFrames := s.buffered / Channels
+	if !s.skipped && !(s.decoded && remainingFrames <= s.crossfadeFrames) {
+		return nil
+	}
+	if remainingFrames > s.crossfadeFrames || s.skipped {
+		remainingFrames = s.crossfadeFrames
+	}
+
+	s.nextStarted = true
+	s.next.fade(true, s.crossfadeFrames)
+	s.fade(false, remainingFrames)
+	return s.next
+}
+
+// takeNext returns the chained stream when it must start right after the end of this one
+func (s *Stream) takeNext() *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.next == nil || s.nextStarted {
+		return nil
+	}
+	// A stopped stream doesn't start the next one, unless it has been skipped
+	select {
+	case <-s.quit:
+		if !s.skipped {
+			return nil
+		}
+	default:
+	}
+	s.nextStarted = true
+	return s.next
+}
+
+// Skip ends the stream and immediately starts the chained one, with a crossfade when configured.
+// Without chained stream, Skip is the same as Stop.
+func (s *Stream) Skip() {
+	s.lock.Lock()
+	s.skipped = true
+	fading := s.next != nil && s.crossfadeFrames > 0
+	s.lock.Unlock()
+
+	if !fading {
+		s.Stop()
+	}
+}
+
+// Position returns the duration of the stream already played
+func (s *Stream) Position() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Duration(s.played) * time.Second / SampleRate
+}
+
+// SetGain sets the gain applied to this stream only
+func (s *Stream) SetGain(gain float64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.gain = gain
+}
+
+// Stop interrupts the stream, Wait returns as soon as the pipeline dropped it, or at once when the pipeline never
+// mixed it (replaced chained stream)
+func (s *Stream) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.quit)
+		select {
+		case <-s.started:
+		default:
+			// Once quit is closed, a stream taken by the pipeline afterwards is dropped without being mixed
+			defer s.finish()
+		}
+		// The decode goroutine closes the decoder once it sees quit
+		s.markStarted()
+	})
+}
+
+// Started is closed when the pipeline begins to mix the stream, or when the stream is stopped before
+func (s *Stream) Started() <-chan struct{} {
+	return s.started
+}
+
+// Playing is closed once the first decoded samples of the stream are mixed
+func (s *Stream) Playing() <-chan struct{} {
+	return s.playing
+}
+
+func (s *Stream) markStarted() {
+	s.startOnce.Do(func() {
+		close(s.started)
+	})
+}
+
+// Wait blocks until the end of the stream and returns the decoding error, if any
+func (s *Stream) Wait() error {
+	<-s.done
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+func (s *Stream) finish() {
+	s.finishOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *Stream) finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Stream) setErr(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.err = err
+}
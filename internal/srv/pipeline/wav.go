@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+const (
+	wavFormatPcm        = 1
+	wavFormatFloat      = 3
+	wavFormatExtensible = 0xFFFE
+)
+
+// IsWav checks the RIFF/WAVE signature of a file header
+func IsWav(header []byte) bool {
+	return len(header) >= 12 && string(header[0:4]) == "RIFF" && string(header[8:12]) == "WAVE"
+}
+
+// wavDecoder decodes PCM and float wav files natively, converting them to stereo at SampleRate
+type wavDecoder struct {
+	resampler
+	reader io.Reader
+	closer io.Closer
+
+	format         int
+	channels       int
+	sampleRate     int
+	bytesPerSample int
+	duration       time.Duration
+
+	frame []byte
+}
+
+func newWavDecoder(reader *bufio.Reader, closer io.Closer) (*wavDecoder, error) {
+	decoder := wavDecoder{
+		closer: closer,
+	}
+
+	header := make([]byte, 12)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+	if !IsWav(header) {
+		return nil, fmt.Errorf("not a wav file")
+	}
+
+	// Look for fmt and data chunks
+	chunkHeader := make([]byte, 8)
+	for {
+		_, err = io.ReadFull(reader, chunkHeader)
+		if err != nil {
+			return nil, fmt.Errorf("no data chunk in wav file: %v", err)
+		}
+		chunkId := string(chunkHeader[0:4])
+		chunkSize := int64(binary.LittleEndian.Uint32(chunkHeader[4:8]))
+
+		switch chunkId {
+		case "fmt ":
+			if chunkSize < 16 {
+				return nil, fmt.Errorf("invalid wav fmt chunk")
+			}
+			fmtChunk := make([]byte, chunkSize)
+			_, err = io.ReadFull(reader, fmtChunk)
+			if err != nil {
+				return nil, err
+			}
+			decoder.format = int(binary.LittleEndian.Uint16(fmtChunk[0:2]))
+			decoder.channels = int(binary.LittleEndian.Uint16(fmtChunk[2:4]))
+			decoder.sampleRate = int(binary.LittleEndian.Uint32(fmtChunk[4:8]))
+			decoder.bytesPerSample = int(binary.LittleEndian.Uint16(fmtChunk[14:16])+7) / 8
+			if decoder.format == wavFormatExtensible && chunkSize >= 26 {
+				decoder.format = int(binary.LittleEndian.Uint16(fmtChunk[24:26]))
+			}
+			if chunkSize%2 == 1 {
+				_, _ = reader.Discard(1)
+			}
+		case "data":
+			if decoder.channels == 0 {
+				return nil, fmt.Errorf("missing wav fmt chunk")
+			}
+			if decoder.format != wavFormatPcm && decoder.format != wavFormatFloat {
+				return nil, fmt.Errorf("unsupported wav format %d", decoder.format)
+			}
+			if decoder.format == wavFormatFloat && decoder.bytesPerSample != 4 && decoder.bytesPerSample != 8 {
+				return nil, fmt.Errorf("unsupported wav float sample size %d", decoder.bytesPerSample)
+			}
+			if decoder.format == wavFormatPcm && (decoder.bytesPerSample < 1 || decoder.bytesPerSample > 4) {
+				return nil, fmt.Errorf("unsupported wav sample size %d", decoder.bytesPerSample)
+			}
+			if decoder.sampleRate <= 0 {
+				return nil, fmt.Errorf("invalid wav sample rate %d", decoder.sampleRate)
+			}
+			decoder.reader = io.LimitReader(reader, chunkSize)
+			decoder.frame = make([]byte, decoder.channels*decoder.bytesPerSample)
+			decoder.resampler = newResampler(decoder.sampleRate, decoder.readFrame)
+			decoder.duration = time.Duration(chunkSize) * time.Second / time.Duration(decoder.sampleRate*len(decoder.frame))
+			return &decoder, nil
+		default:
+			_, err = reader.Discard(int(chunkSize + chunkSize%2))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (d *wavDecoder) Read(samples []float32) (int, error) {
+	return d.read(samples)
+}
+
+func (d *wavDecoder) readFrame() ([Channels]float32, error) {
+	var frame [Channels]float32
+
+	_, err := io.ReadFull(d.reader, d.frame)
+	if err != nil {
+		return frame, io.EOF
+	}
+
+	for c := 0; c < Channels; c++ {
+		// Mono is duplicated, extra channels are dropped
+		sourceChannel := c
+		if sourceChannel >= d.channels {
+			sourceChannel = d.channels - 1
+		}
+		frame[c] = d.decodeSample(d.frame[sourceChannel*d.bytesPerSample : (sourceChannel+1)*d.bytesPerSample])
+	}
+	return frame, nil
+}
+
+func (d *wavDecoder) decodeSample(raw []byte) float32 {
+	if d.format == wavFormatFloat {
+		if len(raw) == 8 {
+			return float32(math.Float64frombits(binary.LittleEndian.Uint64(raw)))
+		}
+		return math.Float32frombits(binary.LittleEndian.Uint32(raw))
+	}
+
+	switch len(raw) {
+	case 1:
+		// 8 bits samples are unsigned
+		return (float32(raw[0]) - 128) / 128
+	case 2:
+		return float32(int16(binary.LittleEndian.Uint16(raw))) / 32768
+	case 3:
+		return float32(int32(uint32(raw[0])<<8|uint32(raw[1])<<16|uint32(raw[2])<<24)>>8) / 8388608
+	default:
+		return float32(int32(binary.LittleEndian.Uint32(raw))) / 2147483648
+	}
+}
+
+func (d *wavDecoder) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
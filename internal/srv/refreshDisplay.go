@@ -1,6 +1,7 @@
 package srv
 
 import (
+	"github.com/jypelle/vekigi/apimodel"
 	"github.com/jypelle/vekigi/internal/images"
 	"github.com/jypelle/vekigi/internal/srv/event"
 	"github.com/sirupsen/logrus"
@@ -44,6 +45,21 @@ func (s *ServerApp) refreshDisplay(resetMode bool) {
 			img := image.NewRGBA(image.Rect(0, 0, 128, 64))
 			AddCenteredLabel(img, 40, "Snooze off")
 			imgToDisplay = img
+		case MESSAGE_POPUP:
+			img := image.NewRGBA(image.Rect(0, 0, 128, 64))
+			AddCenteredLabel(img, 20, "Message")
+			message := s.currentMessage
+			if len(message)*6-128 > 0 {
+				deltaX := s.animationTickCount % (len(message)*6 + 20)
+				AddLabel(img, 10-deltaX, 44, message)
+				AddLabel(img, len(message)*6+20+10-deltaX, 44, message)
+				s.animationTickTimer = time.AfterFunc(100*time.Millisecond, func() {
+					s.internalEventChannel <- event.InternalEvent{Data: event.InternalEventAnimationTickData{}}
+				})
+			} else {
+				AddCenteredLabel(img, 44, message)
+			}
+			imgToDisplay = img
 		}
 	} else {
 		switch s.currentMode {
@@ -82,6 +98,10 @@ func (s *ServerApp) refreshClockDisplay() image.Image {
 		name = currentWebradio.Name
 	} else if currentPlaylist != nil {
 		name = currentPlaylist.Name + ":" + s.playlistPlayerDevice.CurrentSongName()
+	} else if castTitle := s.rendererDevice.CurrentTitle(); castTitle != "" {
+		name = "Cast:" + castTitle
+	} else if s.playlistPlayerDevice.ConnectionError() != nil {
+		name = "Playlists offline"
 	}
 	if len(name)*6-128 > 0 {
 		deltaX := s.animationTickCount % (len(name)*6 + 20)
@@ -91,6 +111,30 @@ func (s *ServerApp) refreshClockDisplay() image.Image {
 		AddLabel(img, 0, 62, name)
 	}
 
+	// Progress bar of the current song, under its name
+	showProgress := false
+	if currentPlaylist != nil {
+		duration := s.playlistPlayerDevice.Duration()
+		if duration > 0 {
+			showProgress = true
+			progress := int(int64(img.Bounds().Dx()) * int64(s.playlistPlayerDevice.Position()) / int64(duration))
+			if progress > img.Bounds().Dx() {
+				progress = img.Bounds().Dx()
+			}
+			draw.Draw(img, image.Rect(0, 63, progress, 64), &image.Uniform{color.RGBA{255, 255, 255, 255}}, image.ZP, draw.Src)
+		}
+	}
+
+	if currentPlaylist != nil {
+		// Next to the alarm and snooze icons
+		playModeImage := playModeImage(s.playlistPlayerDevice.PlayMode(currentPlaylist.PlaylistId))
+		draw.Draw(
+			img,
+			playModeImage.Bounds().Add(image.Pt(img.Bounds().Dx()-images.AlarmImage.Bounds().Dx()-images.SnoozeImage.Bounds().Dx()-playModeImage.Bounds().Dx()-1, 0)),
+			playModeImage,
+			playModeImage.Bounds().Min,
+			draw.Src)
+	}
 	if s.Alarm().Enabled {
 		draw.Draw(
 			img,
@@ -112,10 +156,27 @@ func (s *ServerApp) refreshClockDisplay() image.Image {
 		s.animationTickTimer = time.AfterFunc(100*time.Millisecond, func() {
 			s.internalEventChannel <- event.InternalEvent{Data: event.InternalEventAnimationTickData{}}
 		})
+	} else if showProgress {
+		s.animationTickTimer = time.AfterFunc(time.Second, func() {
+			s.internalEventChannel <- event.InternalEvent{Data: event.InternalEventAnimationTickData{}}
+		})
 	}
 	return img
 }
 
+func playModeImage(playMode apimodel.PlayMode) image.Image {
+	switch playMode {
+	case apimodel.SequentialPlayMode:
+		return images.SequentialImage
+	case apimodel.RepeatAllPlayMode:
+		return images.RepeatAllImage
+	case apimodel.RepeatOnePlayMode:
+		return images.RepeatOneImage
+	default:
+		return images.ShuffleImage
+	}
+}
+
 func (s *ServerApp) refreshAlarmSettingsDisplay() image.Image {
 	logrus.Debugf("Display alarm settings")
 
@@ -1,15 +1,28 @@
 package srv
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/jypelle/vekigi/apimodel"
 	"github.com/jypelle/vekigi/internal/srv/config"
 	"github.com/jypelle/vekigi/internal/srv/device"
 	"github.com/jypelle/vekigi/internal/srv/event"
 	"github.com/jypelle/vekigi/internal/version"
 	"github.com/sirupsen/logrus"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
@@ -22,11 +35,28 @@ type ServerApp struct {
 	clockDevice          *device.Clock
 	buttonsDevice        *device.Buttons
 	apiDevice            *device.Api
+	mpdDevice            *device.Mpd
+	rendererDevice       *device.Renderer
+	announcerDevice      *device.Announcer
+	recorderDevice       *device.Recorder
+
+	stationDirectory *device.StationDirectory
+
+	// Player of the playlists numbered by the indexes saved by previous versions, nil once they are migrated
+	legacyPlaylistIndexer device.LegacyPlaylistIndexer
 
 	currentMode Mode
 
 	currentPopUp   PopUp
 	popUpHideTimer *time.Timer
+	// Text of the message popup
+	currentMessage string
+
+	// Sound paused during an announcement, to be played again once it is over
+	interruptedSound *interruptedSound
+
+	// Last short press of the snooze button, a second one shortly after saying the time
+	lastSnoozeRelease time.Time
 
 	animationTickCount int
 	animationTickTimer *time.Timer
@@ -54,8 +84,16 @@ const (
 	NO_POPUP PopUp = iota
 	VOLUME_POPUP
 	SNOOZE_OFF_POPUP
+	MESSAGE_POPUP
 )
 
+// interruptedSound is the webradio, the playlist or the cast song paused by an announcement
+type interruptedSound struct {
+	webradioId *apimodel.WebradioId
+	playlistId *apimodel.PlaylistId
+	cast       bool
+}
+
 func NewServerApp(configDir string, debugMode bool, simulationMode bool) *ServerApp {
 
 	logrus.Debugf("Creation of vekigi server %s ...", version.AppVersion.String())
@@ -69,16 +107,40 @@ func NewServerApp(configDir string, debugMode bool, simulationMode bool) *Server
 	}
 
 	app.displayDevice = device.NewDisplay(app.SimulationMode)
-	app.audioDevice = device.NewAudio(app.ServerState)
-	app.webradioPlayerDevice = device.NewWebradioPlayer(app.ServerConfig)
-	if app.ServerConfig.MifasolParam == nil {
-		app.playlistPlayerDevice = device.NewLocalPlaylistPlayer(app.ServerConfig.GetCompletePlaylistFolder())
+	app.audioDevice = device.NewAudio(app.ServerConfig)
+	app.webradioPlayerDevice = device.NewWebradioPlayer(app.ServerConfig, app.audioDevice)
+	app.announcerDevice = device.NewAnnouncer(app.ServerConfig, app.audioDevice)
+	// Local playlists come first, followed by the mifasol favorite playlists, the subsonic playlists, the UPnP
+	// containers and the podcasts
+	playlistPlayers := []device.PlaylistPlayer{device.NewLocalPlaylistPlayer(app.ServerConfig, app.audioDevice)}
+	// Previous versions played either the mifasol playlists or the local ones
+	app.legacyPlaylistIndexer = playlistPlayers[0].(device.LegacyPlaylistIndexer)
+	if app.ServerConfig.MifasolParam != nil {
+		mifasolPlaylistPlayer := device.NewMifasolPlaylistPlayer(app.ServerConfig, app.audioDevice)
+		app.legacyPlaylistIndexer = mifasolPlaylistPlayer.(device.LegacyPlaylistIndexer)
+		playlistPlayers = append(playlistPlayers, mifasolPlaylistPlayer)
+	}
+	if app.ServerConfig.SubsonicParam != nil {
+		playlistPlayers = append(playlistPlayers, device.NewSubsonicPlaylistPlayer(app.ServerConfig, app.audioDevice))
+	}
+	if app.ServerConfig.UpnpParam != nil {
+		playlistPlayers = append(playlistPlayers, device.NewUpnpPlaylistPlayer(app.ServerConfig, app.audioDevice))
+	}
+	if len(app.ServerConfig.Podcasts) > 0 {
+		playlistPlayers = append(playlistPlayers, device.NewPodcastPlaylistPlayer(app.ServerConfig, app.audioDevice))
+	}
+	if len(playlistPlayers) == 1 {
+		app.playlistPlayerDevice = playlistPlayers[0]
 	} else {
-		app.playlistPlayerDevice = device.NewMifasolPlaylistPlayer(app.ServerConfig.MifasolParam)
+		app.playlistPlayerDevice = device.NewCompositePlaylistPlayer(playlistPlayers...)
 	}
 	app.clockDevice = device.NewClock(app.ServerConfig)
 	app.buttonsDevice = device.NewButtons(app.SimulationMode)
 	app.apiDevice = device.NewApi(app.ServerConfig)
+	app.mpdDevice = device.NewMpd(app.ServerConfig)
+	app.rendererDevice = device.NewRenderer(app.ServerConfig, app.audioDevice)
+	app.recorderDevice = device.NewRecorder(app.ServerConfig)
+	app.stationDirectory = device.NewStationDirectory(app.ServerConfig)
 
 	logrus.Debugln("Server created")
 
@@ -106,8 +168,13 @@ func (s *ServerApp) Start() {
 	// Start webradio player device
 	s.webradioPlayerDevice.Start()
 
+	// Start announcer device
+	s.announcerDevice.Start()
+
 	// Start playlist player device
+	s.prefixPlaylistIds()
 	s.playlistPlayerDevice.Start()
+	s.migratePlaylistIds()
 
 	// Start event loop
 	go s.eventLoop()
@@ -121,6 +188,22 @@ func (s *ServerApp) Start() {
 	// Start api device
 	s.apiDevice.Start()
 
+	// Start MPD device
+	s.mpdDevice.Start()
+
+	// Start renderer device
+	s.rendererDevice.Start()
+
+	// Start recorder device
+	s.recorderDevice.Start()
+
+	if s.ResumeOnStartup {
+		err := s.resumeLastPlayed()
+		if err != nil {
+			logrus.Warn(err)
+		}
+	}
+
 	// Set clock mode
 	s.currentMode = CLOCK_MODE
 	s.refreshDisplay(true)
@@ -133,6 +216,12 @@ func (s *ServerApp) Stop(halt bool) {
 	// Stop api
 	s.apiDevice.StopSendingEvent()
 
+	// Stop MPD device
+	s.mpdDevice.StopSendingEvent()
+
+	// Stop renderer event
+	s.rendererDevice.StopSendingEvent()
+
 	// Stop buttons device
 	s.buttonsDevice.StopSendingEvent()
 
@@ -145,21 +234,36 @@ func (s *ServerApp) Stop(halt bool) {
 	// Stop webradio player event
 	s.webradioPlayerDevice.StopSendingEvent()
 
+	// Stop announcer event
+	s.announcerDevice.StopSendingEvent()
+
 	// Stop event loop
 	logrus.Infof("Stop event loop")
 	s.eventLoopAskDone <- true
 	<-s.eventLoopDone
 
+	// Remember what is playing, to resume it on next startup
+	s.saveLastPlayed()
+
 	// Display end mode image
 	s.currentMode = END_MODE
 	s.refreshDisplay(true)
 
+	// Stop recorder device
+	s.recorderDevice.Stop()
+
 	// Stop playlist player
 	s.playlistPlayerDevice.Stop()
 
 	// Stop webradio player
 	s.webradioPlayerDevice.Stop()
 
+	// Stop renderer
+	s.rendererDevice.Stop()
+
+	// Stop announcer
+	s.announcerDevice.Stop()
+
 	// Stop volume device
 	s.audioDevice.Stop()
 
@@ -181,3 +285,401 @@ func (s *ServerApp) Stop(halt bool) {
 	}
 	os.Exit(0)
 }
+
+func (s *ServerApp) saveLastPlayed() {
+	var lastPlayed config.LastPlayed
+	if currentWebradio := s.webradioPlayerDevice.CurrentWebRadio(); currentWebradio != nil {
+		webradioId := currentWebradio.WebradioId
+		lastPlayed.WebradioId = &webradioId
+	} else if currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist(); currentPlaylist != nil {
+		playlistId := currentPlaylist.PlaylistId
+		lastPlayed.PlaylistId = &playlistId
+	}
+	s.SetLastPlayed(lastPlayed)
+}
+
+// fillState describes what is playing, for the api
+func (s *ServerApp) fillState(state *apimodel.State) {
+	alarm := s.Alarm()
+	state.Volume = s.Volume()
+	state.Alarm = apimodel.AlarmState{
+		Enabled: alarm.Enabled,
+		Running: s.clockDevice.IsAlarmRunning(),
+		Hour:    alarm.Hour,
+		Minute:  alarm.Minute,
+	}
+
+	if currentWebradio := s.webradioPlayerDevice.CurrentWebRadio(); currentWebradio != nil {
+		state.Webradio = &apimodel.WebradioState{
+			WebradioId: currentWebradio.WebradioId,
+			Name:       currentWebradio.Name,
+		}
+	} else if currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist(); currentPlaylist != nil {
+		state.Playlist = &apimodel.PlaylistState{
+			PlaylistId: currentPlaylist.PlaylistId,
+			Name:       currentPlaylist.Name,
+			PlayMode:   s.playlistPlayerDevice.PlayMode(currentPlaylist.PlaylistId),
+			Song:       s.playlistPlayerDevice.CurrentSongName(),
+			Position:   s.playlistPlayerDevice.Position().Seconds(),
+			Duration:   s.playlistPlayerDevice.Duration().Seconds(),
+		}
+	}
+
+	if err := s.playlistPlayerDevice.ConnectionError(); err != nil {
+		state.PlaylistPlayer.Error = err.Error()
+	} else {
+		state.PlaylistPlayer.Connected = true
+	}
+}
+
+func (s *ServerApp) resumeLastPlayed() error {
+	lastPlayed := s.LastPlayed()
+	if lastPlayed.WebradioId != nil {
+		logrus.Infof("Resume last played webradio")
+		return s.webradioPlayerDevice.Play(*lastPlayed.WebradioId, nil)
+	} else if lastPlayed.PlaylistId != nil {
+		logrus.Infof("Resume last played playlist")
+		return s.playlistPlayerDevice.Play(*lastPlayed.PlaylistId)
+	}
+	return fmt.Errorf("Nothing has been played yet")
+}
+
+// announceMessage plays an announcement over the current sound and shows its message
+func (s *ServerApp) announceMessage(data event.ApiEventAnnounceData) error {
+	err := s.announceOver(func(over bool) error {
+		return s.announcerDevice.AnnounceMessage(data.Text, data.Url, data.Path, over)
+	})
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Show message \"%s\"", data.Message)
+	if s.popUpHideTimer != nil {
+		s.popUpHideTimer.Stop()
+		s.popUpHideTimer = nil
+	}
+	s.currentPopUp = MESSAGE_POPUP
+	s.currentMessage = data.Message
+	s.animationTickCount = 0
+	return nil
+}
+
+// chime rings at the beginning of the hours, and of their quarters when enabled, out of the quiet hours
+func (s *ServerApp) chime(now time.Time) {
+	if s.ChimeParam == nil || now.Minute()%15 != 0 || (now.Minute() != 0 && !s.ChimeParam.Quarters) || s.ChimeParam.IsQuiet(int64(now.Hour())) {
+		return
+	}
+	// Announcements aren't interrupted by the chime
+	if s.announcerDevice.IsAnnouncing() {
+		return
+	}
+	err := s.announceOver(func(over bool) error {
+		return s.announcerDevice.AnnounceChime(now.Minute() == 0, s.ChimeParam.SpeakTime, over)
+	})
+	if err != nil {
+		logrus.Warnf("Unable to chime: %v", err)
+	}
+}
+
+// sayTime speaks the time over the current sound (talking clock)
+func (s *ServerApp) sayTime() {
+	err := s.announceOver(func(over bool) error {
+		return s.announcerDevice.AnnounceTime(over)
+	})
+	if err != nil {
+		logrus.Warnf("Unable to say the time: %v", err)
+	}
+}
+
+// announceOver starts an announcement over the current sound, or pauses the current sound during the announcement
+// when sounds can't be mixed
+func (s *ServerApp) announceOver(announce func(over bool) error) error {
+	over := s.audioDevice.CanPlayOver()
+	if !over {
+		// An announcement replacing another one resumes what the first one interrupted
+		if !s.announcerDevice.IsAnnouncingMessage() {
+			s.interruptedSound = nil
+		}
+		if currentWebradio := s.webradioPlayerDevice.CurrentWebRadio(); currentWebradio != nil {
+			webradioId := currentWebradio.WebradioId
+			s.interruptedSound = &interruptedSound{webradioId: &webradioId}
+			s.webradioPlayerDevice.Clear()
+		} else if currentPlaylist := s.playlistPlayerDevice.CurrentPlaylist(); currentPlaylist != nil {
+			playlistId := currentPlaylist.PlaylistId
+			s.interruptedSound = &interruptedSound{playlistId: &playlistId}
+			// The position in the playlist is saved to resume it
+			s.playlistPlayerDevice.Clear()
+		} else if s.rendererDevice.Pause() == nil {
+			s.interruptedSound = &interruptedSound{cast: true}
+		}
+	}
+
+	err := announce(over)
+	if err != nil {
+		s.resumeInterruptedSound()
+		return err
+	}
+	return nil
+}
+
+// resumeInterruptedSound plays again the sound paused by an announcement, unless another one has been started
+func (s *ServerApp) resumeInterruptedSound() {
+	interrupted := s.interruptedSound
+	s.interruptedSound = nil
+	if interrupted == nil {
+		return
+	}
+	if s.webradioPlayerDevice.CurrentWebRadio() != nil || s.playlistPlayerDevice.CurrentPlaylist() != nil || (!interrupted.cast && s.rendererDevice.CurrentTitle() != "") {
+		return
+	}
+
+	var err error
+	if interrupted.webradioId != nil {
+		err = s.webradioPlayerDevice.Play(*interrupted.webradioId, nil)
+	} else if interrupted.playlistId != nil {
+		err = s.playlistPlayerDevice.Play(*interrupted.playlistId)
+	} else if s.rendererDevice.CurrentTitle() != "" {
+		// Still paused
+		err = s.rendererDevice.Play()
+	}
+	if err != nil {
+		logrus.Warnf("Unable to resume the sound interrupted by the announcement: %v", err)
+	}
+}
+
+// SearchStations searches webradios in the station directory
+func (s *ServerApp) SearchStations(query device.StationQuery) ([]apimodel.Station, error) {
+	return s.stationDirectory.Search(query)
+}
+
+// ImportStations reads stations of the station directory and appends them to a webradio group. When the API is
+// enabled and the server is running, the stations are imported by the server, the returned bool being true. Otherwise
+// they are written to the param file, which would be overwritten by a running server.
+func (s *ServerApp) ImportStations(groupId int64, stationUuids []string) ([]apimodel.WebradioId, bool, error) {
+	if s.ApiParam.Enabled {
+		webradioIds, reached, err := s.importStationsThroughServer(groupId, stationUuids)
+		if reached || err != nil {
+			return webradioIds, reached, err
+		}
+	}
+
+	stations, err := s.stationDirectory.Stations(stationUuids)
+	if err != nil {
+		return nil, false, err
+	}
+	webradioIds, err := s.importWebradios(groupId, stations)
+	return webradioIds, false, err
+}
+
+// importStationsThroughServer posts the stations to the API of the running server, reached being false when no server
+// is listening
+func (s *ServerApp) importStationsThroughServer(groupId int64, stationUuids []string) ([]apimodel.WebradioId, bool, error) {
+	// The self-signed certificate of the server has no host name: only the one of the config folder is trusted
+	certFilename := filepath.Join(s.ConfigDir, "cert.pem")
+	rawCert, err := ioutil.ReadFile(certFilename)
+	if os.IsNotExist(err) {
+		// The server has never been started with the API
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	certBlock, _ := pem.Decode(rawCert)
+	if certBlock == nil {
+		return nil, false, fmt.Errorf("Invalid certificate %s", certFilename)
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: true,
+				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], certBlock.Bytes) {
+						return fmt.Errorf("Certificate of the server differs from %s", certFilename)
+					}
+					return nil
+				},
+			},
+		},
+	}
+
+	body, err := json.Marshal(apimodel.StationImport{GroupId: groupId, StationUuids: stationUuids})
+	if err != nil {
+		return nil, false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://localhost:"+strconv.FormatInt(s.ApiParam.SslPort, 10)+"/api/station/import", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", s.ApiParam.ApiKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		errorMessage := apimodel.ErrorMessage{ErrStatusCode: resp.StatusCode}
+		json.NewDecoder(resp.Body).Decode(&errorMessage)
+		return nil, true, &errorMessage
+	}
+	var webradioIds []apimodel.WebradioId
+	err = json.NewDecoder(resp.Body).Decode(&webradioIds)
+	return webradioIds, true, err
+}
+
+// importWebradios appends stations to a webradio group and saves the param file. Stations already in the group are
+// not added twice, the ids of all the stations being returned.
+func (s *ServerApp) importWebradios(groupId int64, stations []apimodel.Station) ([]apimodel.WebradioId, error) {
+	if groupId < 1 {
+		return nil, fmt.Errorf("Invalid webradio group %d", groupId)
+	}
+	for _, station := range stations {
+		if len(station.Urls) == 0 {
+			return nil, fmt.Errorf("Station %s has no stream url", station.Name)
+		}
+	}
+
+	// The groups are copied then swapped in: the recorder and the webradio player read them from other goroutines
+	webradioGroups := make(map[int64][]*config.Webradio, len(s.WebradioGroups)+1)
+	for webradioGroupId, webradioList := range s.WebradioGroups {
+		webradioGroups[webradioGroupId] = webradioList
+	}
+
+	var webradioIds []apimodel.WebradioId
+	for _, station := range stations {
+		webradioList := webradioGroups[groupId]
+		var webradio *config.Webradio
+		for _, groupWebradio := range webradioList {
+			if len(groupWebradio.Urls) > 0 && groupWebradio.Urls[0] == station.Urls[0] {
+				webradio = groupWebradio
+				break
+			}
+		}
+		if webradio != nil {
+			logrus.Infof("Station %s already imported as webradio %d", station.Name, webradio.WebradioId)
+		} else {
+			webradio = &config.Webradio{
+				Name: station.Name,
+				Urls: station.Urls,
+				WebradioId: apimodel.WebradioId{
+					GroupId: groupId,
+					IndexId: int64(len(webradioList)) + 1,
+				},
+			}
+			// Appended to a copy of the list, the previous one being still read
+			webradioGroups[groupId] = append(webradioList[:len(webradioList):len(webradioList)], webradio)
+			logrus.Infof("Station %s imported as webradio %d", station.Name, webradio.WebradioId)
+		}
+		webradioIds = append(webradioIds, webradio.WebradioId)
+	}
+
+	s.WebradioGroups = webradioGroups
+	s.webradioPlayerDevice.SetWebradioGroups(webradioGroups)
+	s.recorderDevice.SetWebradioGroups(webradioGroups)
+	s.SaveParam()
+
+	return webradioIds, nil
+}
+
+// migratePlaylistIds replaces the playlist indexes saved by previous versions with the matching playlist ids. The
+// indexes are resolved by the player numbering the playlists as previous versions did, once its playlists are loaded.
+func (s *ServerApp) migratePlaylistIds() {
+	if s.legacyPlaylistIndexer == nil {
+		return
+	}
+
+	alarm := s.Alarm()
+	alarmPlaylistId, alarmReady := s.migratePlaylistId(alarm.PlaylistId)
+	if alarmPlaylistId != nil {
+		alarm.PlaylistId = alarmPlaylistId
+		s.SetAlarm(alarm)
+	}
+
+	lastPlayed := s.LastPlayed()
+	lastPlayedPlaylistId, lastPlayedReady := s.migratePlaylistId(lastPlayed.PlaylistId)
+	if lastPlayedPlaylistId != nil {
+		lastPlayed.PlaylistId = lastPlayedPlaylistId
+		s.SetLastPlayed(lastPlayed)
+	}
+
+	if alarmReady && lastPlayedReady {
+		s.legacyPlaylistIndexer = nil
+	}
+}
+
+// migratePlaylistId returns the id of the playlist saved as an index, nil when there is nothing to migrate. ready is
+// false when the playlists the index refers to aren't loaded yet.
+func (s *ServerApp) migratePlaylistId(playlistId *apimodel.PlaylistId) (*apimodel.PlaylistId, bool) {
+	if playlistId == nil || s.playlistPlayerDevice.GetPlaylist(*playlistId) != nil {
+		return nil, true
+	}
+	index, err := strconv.ParseInt(string(*playlistId), 10, 64)
+	if err != nil {
+		return nil, true
+	}
+	migratedPlaylistId, ready := s.legacyPlaylistIndexer.LegacyPlaylistId(index)
+	if migratedPlaylistId == nil {
+		return nil, ready
+	}
+	logrus.Infof("Playlist %d saved by a previous version is now identified as %s", index, *migratedPlaylistId)
+	return migratedPlaylistId, true
+}
+
+// prefixPlaylistIds adds the prefix of their player to the ids of the local and mifasol playlists saved by previous
+// versions, in the state and in the playlist volume offsets. The indexes saved by older versions are left to
+// migratePlaylistIds.
+func (s *ServerApp) prefixPlaylistIds() {
+	alarm := s.Alarm()
+	if playlistId, ok := s.prefixPlaylistId(alarm.PlaylistId); ok {
+		alarm.PlaylistId = playlistId
+		s.SetAlarm(alarm)
+	}
+
+	lastPlayed := s.LastPlayed()
+	if playlistId, ok := s.prefixPlaylistId(lastPlayed.PlaylistId); ok {
+		lastPlayed.PlaylistId = playlistId
+		s.SetLastPlayed(lastPlayed)
+	}
+
+	for _, playlistId := range s.ServerState.PlaylistIds() {
+		if prefixedPlaylistId, ok := device.PrefixedPlaylistId(playlistId, s.playlistPlayerDevice, s.MifasolParam != nil); ok {
+			s.ServerState.RenamePlaylistId(playlistId, prefixedPlaylistId)
+		}
+	}
+
+	paramChanged := false
+	for playlistId, volumeOffset := range s.PlaylistVolumeOffsets {
+		if prefixedPlaylistId, ok := device.PrefixedPlaylistId(playlistId, s.playlistPlayerDevice, s.MifasolParam != nil); ok {
+			delete(s.PlaylistVolumeOffsets, playlistId)
+			if _, ok := s.PlaylistVolumeOffsets[prefixedPlaylistId]; !ok {
+				s.PlaylistVolumeOffsets[prefixedPlaylistId] = volumeOffset
+			}
+			paramChanged = true
+		}
+	}
+	if paramChanged {
+		s.SaveParam()
+	}
+}
+
+// prefixPlaylistId returns the prefixed id of a playlist saved without prefix, false when there is nothing to change
+func (s *ServerApp) prefixPlaylistId(playlistId *apimodel.PlaylistId) (*apimodel.PlaylistId, bool) {
+	if playlistId == nil {
+		return nil, false
+	}
+	if _, err := strconv.ParseInt(string(*playlistId), 10, 64); err == nil && s.legacyPlaylistIndexer != nil {
+		return nil, false
+	}
+	prefixedPlaylistId, ok := device.PrefixedPlaylistId(*playlistId, s.playlistPlayerDevice, s.MifasolParam != nil)
+	if !ok {
+		return nil, false
+	}
+	logrus.Infof("Playlist %s saved by a previous version is now identified as %s", *playlistId, prefixedPlaylistId)
+	return &prefixedPlaylistId, true
+}
@@ -0,0 +1,238 @@
+package srv
+
+import (
+	"github.com/jypelle/vekigi/apimodel"
+	"github.com/jypelle/vekigi/internal/srv/config"
+	"github.com/jypelle/vekigi/internal/srv/device"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// legacyIndexerStub numbers playlists which are only loaded once ready is set
+type legacyIndexerStub struct {
+	playlistIds []apimodel.PlaylistId
+	ready       bool
+}
+
+func (s *legacyIndexerStub) LegacyPlaylistId(index int64) (*apimodel.PlaylistId, bool) {
+	if !s.ready {
+		return nil, false
+	}
+	if index < 1 || index > int64(len(s.playlistIds)) {
+		return nil, true
+	}
+	return &s.playlistIds[index-1], true
+}
+
+func newTestServerApp(t *testing.T) *ServerApp {
+	configDir := t.TempDir()
+	serverConfig := &config.ServerConfig{
+		ConfigDir:   configDir,
+		ServerParam: &config.ServerParam{},
+		ServerState: config.NewsServerState(filepath.Join(configDir, "state.yaml")),
+	}
+	t.Cleanup(serverConfig.FlushSave)
+
+	// Hidden folders were numbered by previous versions, M3U files didn't exist
+	for _, folder := range []string{".hidden", "Jazz", "Rock"} {
+		err := os.MkdirAll(filepath.Join(serverConfig.GetCompletePlaylistFolder(), folder), 0770)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(serverConfig.GetCompletePlaylistFolder(), "Zouk.m3u"), nil, 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	localPlaylistPlayer := device.NewLocalPlaylistPlayer(serverConfig, nil)
+	return &ServerApp{
+		ServerConfig:          serverConfig,
+		playlistPlayerDevice:  localPlaylistPlayer,
+		legacyPlaylistIndexer: localPlaylistPlayer.(device.LegacyPlaylistIndexer),
+	}
+}
+
+func playlistIdPointer(playlistId apimodel.PlaylistId) *apimodel.PlaylistId {
+	return &playlistId
+}
+
+func TestMigrateLocalPlaylistIds(t *testing.T) {
+	s := newTestServerApp(t)
+	s.SetAlarm(config.Alarm{Hour: 7, PlaylistId: playlistIdPointer("3")})
+	s.SetLastPlayed(config.LastPlayed{PlaylistId: playlistIdPointer("2")})
+
+	s.migratePlaylistIds()
+
+	// Numbered among the folders, hidden ones included, and not in the current catalogue: Jazz, Rock, Zouk.m3u
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "local:Rock" {
+		t.Errorf("Alarm playlist %v, expected local:Rock", playlistId)
+	}
+	if playlistId := s.LastPlayed().PlaylistId; playlistId == nil || *playlistId != "local:Jazz" {
+		t.Errorf("Last played playlist %v, expected local:Jazz", playlistId)
+	}
+	if s.legacyPlaylistIndexer != nil {
+		t.Errorf("Migration still pending")
+	}
+}
+
+func TestMigratePlaylistIdsUnchanged(t *testing.T) {
+	s := newTestServerApp(t)
+	// Already an id, and a hidden folder which isn't a playlist anymore
+	s.SetAlarm(config.Alarm{PlaylistId: playlistIdPointer("local:Jazz")})
+	s.SetLastPlayed(config.LastPlayed{PlaylistId: playlistIdPointer("1")})
+
+	s.migratePlaylistIds()
+
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "local:Jazz" {
+		t.Errorf("Alarm playlist %v, expected local:Jazz", playlistId)
+	}
+	if playlistId := s.LastPlayed().PlaylistId; playlistId == nil || *playlistId != "1" {
+		t.Errorf("Last played playlist %v, expected 1", playlistId)
+	}
+}
+
+func TestMigratePlaylistIdsOnceLoaded(t *testing.T) {
+	s := newTestServerApp(t)
+	indexer := &legacyIndexerStub{playlistIds: []apimodel.PlaylistId{"mifasol:a", "mifasol:b"}}
+	s.legacyPlaylistIndexer = indexer
+	s.SetAlarm(config.Alarm{PlaylistId: playlistIdPointer("2")})
+
+	// Not resolved against the local playlists while the remote ones aren't loaded
+	s.migratePlaylistIds()
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "2" {
+		t.Errorf("Alarm playlist %v migrated before the playlists are loaded", playlistId)
+	}
+	if s.legacyPlaylistIndexer == nil {
+		t.Fatalf("Migration given up before the playlists are loaded")
+	}
+
+	indexer.ready = true
+	s.migratePlaylistIds()
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "mifasol:b" {
+		t.Errorf("Alarm playlist %v, expected mifasol:b", playlistId)
+	}
+	if s.legacyPlaylistIndexer != nil {
+		t.Errorf("Migration still pending")
+	}
+}
+
+func TestPrefixPlaylistIds(t *testing.T) {
+	s := newTestServerApp(t)
+	s.MifasolParam = &config.MifasolParam{}
+	s.SetAlarm(config.Alarm{PlaylistId: playlistIdPointer("Jazz")})
+	s.SetLastPlayed(config.LastPlayed{PlaylistId: playlistIdPointer("01FMIFASOL")})
+	s.SetPlayMode("Zouk.m3u", apimodel.SequentialPlayMode)
+	s.SetPlayMode("subsonic:42", apimodel.RepeatAllPlayMode)
+	s.SetPlaylistResume("01FMIFASOL", config.PlaylistResume{})
+	s.PlaylistVolumeOffsets = map[apimodel.PlaylistId]int64{"Rock": -10}
+
+	s.prefixPlaylistIds()
+
+	// Local playlists are found by name, the other ones being mifasol playlists
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "local:Jazz" {
+		t.Errorf("Alarm playlist %v, expected local:Jazz", playlistId)
+	}
+	if playlistId := s.LastPlayed().PlaylistId; playlistId == nil || *playlistId != "mifasol:01FMIFASOL" {
+		t.Errorf("Last played playlist %v, expected mifasol:01FMIFASOL", playlistId)
+	}
+	if playMode := s.PlayMode("local:Zouk.m3u"); playMode != apimodel.SequentialPlayMode {
+		t.Errorf("Play mode %s, expected %s", playMode, apimodel.SequentialPlayMode)
+	}
+	if playMode := s.PlayMode("subsonic:42"); playMode != apimodel.RepeatAllPlayMode {
+		t.Errorf("Play mode of a prefixed id %s, expected %s", playMode, apimodel.RepeatAllPlayMode)
+	}
+	if _, ok := s.PlaylistResume("mifasol:01FMIFASOL"); !ok {
+		t.Errorf("Resume point not moved to the prefixed id")
+	}
+	if volumeOffset, ok := s.PlaylistVolumeOffsets["local:Rock"]; !ok || volumeOffset != -10 || len(s.PlaylistVolumeOffsets) != 1 {
+		t.Errorf("Volume offsets %v, expected local:Rock only", s.PlaylistVolumeOffsets)
+	}
+}
+
+func TestPrefixPlaylistIdsLegacyIndex(t *testing.T) {
+	s := newTestServerApp(t)
+	s.SetAlarm(config.Alarm{PlaylistId: playlistIdPointer("3")})
+
+	// Left to the migration of the indexes
+	s.prefixPlaylistIds()
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "3" {
+		t.Errorf("Alarm playlist %v, expected index 3", playlistId)
+	}
+	s.migratePlaylistIds()
+	if playlistId := s.Alarm().PlaylistId; playlistId == nil || *playlistId != "local:Rock" {
+		t.Errorf("Alarm playlist %v, expected local:Rock", playlistId)
+	}
+}
+
+func TestImportStations(t *testing.T) {
+	// Radio-browser directory knowing two stations
+	directory := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var stations []string
+		for _, stationUuid := range strings.Split(r.URL.Query().Get("uuids"), ",") {
+			switch stationUuid {
+			case "jazz":
+				stations = append(stations, `{"stationuuid":"jazz","name":"Jazz FM","url":"http://jazz/stream"}`)
+			case "news":
+				stations = append(stations, `{"stationuuid":"news","name":"News","url":"http://news/stream"}`)
+			}
+		}
+		w.Write([]byte("[" + strings.Join(stations, ",") + "]"))
+	}))
+	defer directory.Close()
+
+	s := newTestServerApp(t)
+	s.StationDirectoryUrl = directory.URL
+	previousWebradioGroups := map[int64][]*config.Webradio{
+		1: {{Name: "News", Urls: []string{"http://news/stream"}, WebradioId: apimodel.WebradioId{GroupId: 1, IndexId: 1}}},
+	}
+	s.WebradioGroups = previousWebradioGroups
+	s.webradioPlayerDevice = device.NewWebradioPlayer(s.ServerConfig, nil)
+	s.recorderDevice = device.NewRecorder(s.ServerConfig)
+	s.stationDirectory = device.NewStationDirectory(s.ServerConfig)
+
+	// The known station isn't imported twice
+	webradioIds, reached, err := s.ImportStations(1, []string{"jazz", "news"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reached {
+		t.Errorf("Stations imported by a server, expected a local import")
+	}
+	expectedWebradioIds := []apimodel.WebradioId{{GroupId: 1, IndexId: 2}, {GroupId: 1, IndexId: 1}}
+	if len(webradioIds) != len(expectedWebradioIds) || webradioIds[0] != expectedWebradioIds[0] || webradioIds[1] != expectedWebradioIds[1] {
+		t.Errorf("Webradios %v, expected %v", webradioIds, expectedWebradioIds)
+	}
+
+	// New groups swapped in, the previous ones being left as they were for their readers
+	if len(previousWebradioGroups[1]) != 1 {
+		t.Errorf("%d webradios in the previous group, expected it unchanged", len(previousWebradioGroups[1]))
+	}
+	if len(s.WebradioGroups[1]) != 2 || s.WebradioGroups[1][1].Name != "Jazz FM" {
+		t.Errorf("Webradio group %v, expected Jazz FM added", s.WebradioGroups[1])
+	}
+	if webradio := s.webradioPlayerDevice.Webradio(apimodel.WebradioId{GroupId: 1, IndexId: 2}); webradio == nil || webradio.Name != "Jazz FM" {
+		t.Errorf("Webradio %v for the player, expected Jazz FM", webradio)
+	}
+	rawParam, err := ioutil.ReadFile(s.GetCompleteParamFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rawParam), "Jazz FM") {
+		t.Errorf("Imported station not saved")
+	}
+
+	// Nothing imported when a station is unknown
+	_, _, err = s.ImportStations(2, []string{"jazz", "unknown"})
+	if err == nil {
+		t.Errorf("Unknown station imported")
+	}
+	if _, ok := s.WebradioGroups[2]; ok {
+		t.Errorf("Webradio group 2 created")
+	}
+}
@@ -0,0 +1,336 @@
+package tag
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bitrates in kbps of the MPEG audio frames, by layer bits (layer III, II, I) and bitrate index
+var (
+	mpeg1Bitrates = [4][15]int{
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+	}
+	mpeg2Bitrates = [4][15]int{
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+	}
+	mpeg1SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// Frame headers are looked for in the first bytes following the ID3v2 tag, the tag padding being skipped
+const mp3SearchSize = 64 * 1024
+
+// Size of the end of an ogg file searched for the last page
+const oggLastPageSearchSize = 64 * 1024
+
+// mp3Frame is the decoded header of a MPEG audio frame
+type mp3Frame struct {
+	bitrate    int
+	sampleRate int
+	samples    int
+	// Offset of the Xing/Info header of layer III frames, after the side information
+	xingOffset int
+}
+
+// Duration reads the duration of an audio file from its headers, without decoding it: flac stream info, ogg
+// granule position, mp4 movie header, ID3v2 TLEN frame, Xing/Info or VBRI header of VBR mp3, or bitrate of CBR mp3
+func Duration(filename string) (time.Duration, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, _ := reader.Peek(8)
+
+	switch {
+	case len(header) >= 4 && string(header[0:4]) == "fLaC":
+		return flacDuration(reader)
+	case len(header) >= 4 && string(header[0:4]) == "OggS":
+		return oggDuration(file)
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return mp4Duration(file)
+	default:
+		return mp3Duration(file)
+	}
+}
+
+// flacDuration reads the sample rate and the total number of samples of the stream info block, always the first one
+func flacDuration(reader io.Reader) (time.Duration, error) {
+	data := make([]byte, 8+34)
+	_, err := io.ReadFull(reader, data)
+	if err != nil {
+		return 0, err
+	}
+	streamInfo := data[8:]
+	if data[4]&0x7F != 0 {
+		return 0, fmt.Errorf("no flac stream info")
+	}
+	sampleRate := int64(streamInfo[10])<<12 | int64(streamInfo[11])<<4 | int64(streamInfo[12])>>4
+	totalSamples := int64(streamInfo[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(streamInfo[14:18]))
+	if sampleRate == 0 || totalSamples == 0 {
+		return 0, fmt.Errorf("unknown flac duration")
+	}
+	return time.Duration(totalSamples) * time.Second / time.Duration(sampleRate), nil
+}
+
+// oggDuration reads the granule position of the last page, in samples of the rate given by the identification
+// header of the first page
+func oggDuration(file io.ReadSeeker) (time.Duration, error) {
+	_, err := file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	firstPage := make([]byte, 27+255+19)
+	n, err := io.ReadFull(file, firstPage)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	firstPage = firstPage[:n]
+	if len(firstPage) < 27 || len(firstPage) < 27+int(firstPage[26]) {
+		return 0, fmt.Errorf("invalid ogg page")
+	}
+	packet := firstPage[27+int(firstPage[26]):]
+
+	var sampleRate, preSkip int64
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x01vorbis")) && len(packet) >= 16:
+		sampleRate = int64(binary.LittleEndian.Uint32(packet[12:16]))
+	case bytes.HasPrefix(packet, []byte("OpusHead")) && len(packet) >= 12:
+		// Opus granule positions always count 48kHz samples
+		sampleRate = 48000
+		preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+	default:
+		return 0, fmt.Errorf("unsupported ogg stream")
+	}
+	if sampleRate == 0 {
+		return 0, fmt.Errorf("invalid ogg sample rate")
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	start := size - oggLastPageSearchSize
+	if start < 0 {
+		start = 0
+	}
+	_, err = file.Seek(start, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	end, err := io.ReadAll(file)
+	if err != nil {
+		return 0, err
+	}
+	lastPage := bytes.LastIndex(end, []byte("OggS"))
+	if lastPage < 0 || lastPage+14 > len(end) {
+		return 0, fmt.Errorf("no last ogg page")
+	}
+	granulePosition := int64(binary.LittleEndian.Uint64(end[lastPage+6 : lastPage+14]))
+	if granulePosition <= preSkip {
+		return 0, fmt.Errorf("unknown ogg duration")
+	}
+	return time.Duration(granulePosition-preSkip) * time.Second / time.Duration(sampleRate), nil
+}
+
+// mp4Duration reads the time scale and the duration of the movie header, moov/mvhd
+func mp4Duration(file io.ReadSeeker) (time.Duration, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	atom, err := findMp4Atom(file, mp4Atom{start: 0, end: size}, "moov")
+	if err != nil {
+		return 0, err
+	}
+	atom, err = findMp4Atom(file, atom, "mvhd")
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, 32)
+	if atom.end-atom.start < int64(len(data)) {
+		data = data[:atom.end-atom.start]
+	}
+	_, err = file.Seek(atom.start, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return 0, err
+	}
+
+	// Version 1 headers have 64 bits dates and duration
+	var timeScale, duration uint64
+	switch {
+	case len(data) >= 20 && data[0] == 0:
+		timeScale = uint64(binary.BigEndian.Uint32(data[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(data[16:20]))
+	case len(data) >= 32 && data[0] == 1:
+		timeScale = uint64(binary.BigEndian.Uint32(data[20:24]))
+		duration = binary.BigEndian.Uint64(data[24:32])
+	default:
+		return 0, fmt.Errorf("invalid mp4 movie header")
+	}
+	if timeScale == 0 || duration == 0 || duration == 0xFFFFFFFF || duration >= 1<<62 {
+		return 0, fmt.Errorf("unknown mp4 duration")
+	}
+	return time.Duration(float64(duration) / float64(timeScale) * float64(time.Second)), nil
+}
+
+// mp3Duration uses the TLEN frame of the ID3v2 tag, the frame count of a Xing/Info or VBRI header, or the bitrate
+// of the first frame for CBR files
+func mp3Duration(file io.ReadSeeker) (time.Duration, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	var audioStart int64
+	header := make([]byte, 10)
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.ReadFull(file, header)
+	if err != nil {
+		return 0, err
+	}
+	if string(header[0:3]) == "ID3" {
+		audioStart = 10 + int64(syncsafeInt(header[6:10]))
+		if header[5]&0x10 != 0 {
+			// Footer
+			audioStart += 10
+		}
+
+		// TLEN holds the duration in milliseconds
+		_, err = file.Seek(0, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+		tags, err := readId3v2(file)
+		if err == nil {
+			milliseconds, err := strconv.ParseInt(strings.TrimSpace(tags["TLEN"]), 10, 64)
+			if err == nil && milliseconds > 0 {
+				return time.Duration(milliseconds) * time.Millisecond, nil
+			}
+		}
+	}
+
+	// ID3v1 tag at the end of the file
+	if size-audioStart >= 128 {
+		_, err = file.Seek(-128, io.SeekEnd)
+		if err != nil {
+			return 0, err
+		}
+		_, err = io.ReadFull(file, header[:3])
+		if err != nil {
+			return 0, err
+		}
+		if string(header[:3]) == "TAG" {
+			size -= 128
+		}
+	}
+
+	_, err = file.Seek(audioStart, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	data := make([]byte, mp3SearchSize)
+	n, err := io.ReadFull(file, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+	data = data[:n]
+
+	for i := 0; i+4 <= len(data); i++ {
+		frame, ok := parseMp3FrameHeader(data[i:])
+		if !ok {
+			continue
+		}
+
+		var frameCount int64
+		if frame.xingOffset > 0 && i+frame.xingOffset+12 <= len(data) {
+			xing := data[i+frame.xingOffset:]
+			if (string(xing[0:4]) == "Xing" || string(xing[0:4]) == "Info") && xing[7]&0x01 != 0 {
+				frameCount = int64(binary.BigEndian.Uint32(xing[8:12]))
+			}
+		}
+		if i+4+32+18 <= len(data) && string(data[i+4+32:i+4+32+4]) == "VBRI" {
+			frameCount = int64(binary.BigEndian.Uint32(data[i+4+32+14 : i+4+32+18]))
+		}
+		if frameCount > 0 {
+			return time.Duration(frameCount*int64(frame.samples)) * time.Second / time.Duration(frame.sampleRate), nil
+		}
+
+		audioSize := size - audioStart - int64(i)
+		return time.Duration(audioSize*8) * time.Second / time.Duration(frame.bitrate), nil
+	}
+	return 0, fmt.Errorf("no mp3 frame")
+}
+
+// parseMp3FrameHeader decodes the 4 bytes header of a MPEG audio frame, free format bitrate excepted
+func parseMp3FrameHeader(data []byte) (mp3Frame, bool) {
+	if data[0] != 0xFF || data[1]&0xE0 != 0xE0 {
+		return mp3Frame{}, false
+	}
+	// Version bits: 3 for MPEG-1, 2 for MPEG-2, 0 for MPEG-2.5; layer bits: 1 for layer III, 2 for II, 3 for I
+	version := data[1] >> 3 & 0x03
+	layer := data[1] >> 1 & 0x03
+	bitrateIndex := data[2] >> 4
+	sampleRateIndex := data[2] >> 2 & 0x03
+	if version == 1 || layer == 0 || bitrateIndex == 0 || bitrateIndex == 15 || sampleRateIndex == 3 {
+		return mp3Frame{}, false
+	}
+	mono := data[3]>>6 == 3
+
+	var frame mp3Frame
+	switch version {
+	case 3:
+		frame.bitrate = mpeg1Bitrates[layer][bitrateIndex] * 1000
+		frame.sampleRate = mpeg1SampleRates[sampleRateIndex]
+	case 2:
+		frame.bitrate = mpeg2Bitrates[layer][bitrateIndex] * 1000
+		frame.sampleRate = mpeg1SampleRates[sampleRateIndex] / 2
+	default:
+		frame.bitrate = mpeg2Bitrates[layer][bitrateIndex] * 1000
+		frame.sampleRate = mpeg1SampleRates[sampleRateIndex] / 4
+	}
+
+	switch layer {
+	case 3:
+		frame.samples = 384
+	case 2:
+		frame.samples = 1152
+	default:
+		// Layer III: the side information size depends on the version and the channels
+		if version == 3 {
+			frame.samples = 1152
+			frame.xingOffset = 4 + 32
+			if mono {
+				frame.xingOffset = 4 + 17
+			}
+		} else {
+			frame.samples = 576
+			frame.xingOffset = 4 + 17
+			if mono {
+				frame.xingOffset = 4 + 9
+			}
+		}
+	}
+	return frame, true
+}
@@ -0,0 +1,218 @@
+package tag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+)
+
+// Normalized names of the ID3v2 text frames (2.3/2.4 and 2.2 identifiers)
+var id3FrameNames = map[string]string{
+	"TIT2": Title,
+	"TT2":  Title,
+	"TPE1": Artist,
+	"TP1":  Artist,
+	"TALB": Album,
+	"TAL":  Album,
+}
+
+func readId3v2(reader io.Reader) (Tags, error) {
+	header := make([]byte, 10)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
+	}
+
+	version := header[3]
+	flags := header[5]
+	size := syncsafeInt(header[6:10])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("unsupported ID3v2.%d tag", version)
+	}
+
+	data := make([]byte, size)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tag level unsynchronisation (ID3v2.4 uses frame level unsynchronisation)
+	if flags&0x80 != 0 && version < 4 {
+		data = removeUnsynchronisation(data)
+	}
+
+	// Skip extended header
+	if flags&0x40 != 0 && version >= 3 && len(data) >= 4 {
+		var extendedHeaderSize int
+		if version == 3 {
+			extendedHeaderSize = int(binary.BigEndian.Uint32(data[0:4])) + 4
+		} else {
+			extendedHeaderSize = syncsafeInt(data[0:4])
+		}
+		if extendedHeaderSize > len(data) {
+			return nil, fmt.Errorf("invalid ID3v2 extended header")
+		}
+		data = data[extendedHeaderSize:]
+	}
+
+	idSize := 4
+	frameHeaderSize := 10
+	if version == 2 {
+		idSize = 3
+		frameHeaderSize = 6
+	}
+
+	tags := make(Tags)
+	for len(data) >= frameHeaderSize && data[0] != 0 {
+		frameId := string(data[0:idSize])
+		var frameSize int
+		var frameFlags uint16
+		switch version {
+		case 2:
+			frameSize = int(data[3])<<16 | int(data[4])<<8 | int(data[5])
+		case 3:
+			frameSize = int(binary.BigEndian.Uint32(data[4:8]))
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		default:
+			frameSize = syncsafeInt(data[4:8])
+			frameFlags = binary.BigEndian.Uint16(data[8:10])
+		}
+		// Compared to the remaining length, as the header size added to a 32 bits frame size could overflow
+		if frameSize < 0 || frameSize > len(data)-frameHeaderSize {
+			break
+		}
+		frameData := data[frameHeaderSize : frameHeaderSize+frameSize]
+		data = data[frameHeaderSize+frameSize:]
+
+		if version == 4 {
+			// Compressed and encrypted frames are ignored
+			if frameFlags&0x000C != 0 {
+				continue
+			}
+			if frameFlags&0x0002 != 0 {
+				frameData = removeUnsynchronisation(frameData)
+			}
+			if frameFlags&0x0001 != 0 {
+				if len(frameData) < 4 {
+					continue
+				}
+				frameData = frameData[4:]
+			}
+		} else if version == 3 && frameFlags&0x00C0 != 0 {
+			continue
+		}
+
+		switch {
+		case frameId == "TXXX" || frameId == "TXX":
+			if len(frameData) < 1 {
+				continue
+			}
+			values := strings.SplitN(decodeId3Text(frameData[0], frameData[1:]), "\x00", 2)
+			if len(values) == 2 {
+				tags[strings.ToUpper(values[0])] = strings.ReplaceAll(strings.TrimRight(values[1], "\x00"), "\x00", " / ")
+			}
+		case frameId[0] == 'T':
+			if len(frameData) < 1 {
+				continue
+			}
+			name, ok := id3FrameNames[frameId]
+			if !ok {
+				name = frameId
+			}
+			tags[name] = strings.ReplaceAll(strings.TrimRight(decodeId3Text(frameData[0], frameData[1:]), "\x00"), "\x00", " / ")
+		}
+	}
+
+	return tags, nil
+}
+
+// readId3v1 reads the fixed size ID3v1 tag found in the last 128 bytes of old mp3 files
+func readId3v1(file io.ReadSeeker) (Tags, error) {
+	_, err := file.Seek(-128, io.SeekEnd)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported tag format")
+	}
+	data := make([]byte, 128)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, err
+	}
+	if string(data[0:3]) != "TAG" {
+		return nil, fmt.Errorf("unsupported tag format")
+	}
+
+	tags := make(Tags)
+	for key, field := range map[string][]byte{Title: data[3:33], Artist: data[33:63], Album: data[63:93]} {
+		value := strings.TrimSpace(strings.TrimRight(decodeId3Text(0, field), "\x00"))
+		if value != "" {
+			tags[key] = value
+		}
+	}
+	return tags, nil
+}
+
+// decodeId3Text converts an ID3v2 text to UTF-8, string separators being kept as \x00
+func decodeId3Text(encoding byte, data []byte) string {
+	switch encoding {
+	case 0:
+		// ISO-8859-1
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes)
+	case 1, 2:
+		// UTF-16 with BOM, UTF-16BE
+		var values []string
+		for _, part := range splitUtf16(data) {
+			bigEndian := encoding == 2
+			if len(part) >= 2 && part[0] == 0xFF && part[1] == 0xFE {
+				bigEndian = false
+				part = part[2:]
+			} else if len(part) >= 2 && part[0] == 0xFE && part[1] == 0xFF {
+				bigEndian = true
+				part = part[2:]
+			}
+			units := make([]uint16, len(part)/2)
+			for i := range units {
+				if bigEndian {
+					units[i] = binary.BigEndian.Uint16(part[2*i:])
+				} else {
+					units[i] = binary.LittleEndian.Uint16(part[2*i:])
+				}
+			}
+			values = append(values, string(utf16.Decode(units)))
+		}
+		return strings.Join(values, "\x00")
+	default:
+		// UTF-8
+		return string(data)
+	}
+}
+
+// splitUtf16 splits UTF-16 strings on their 2 bytes null terminators
+func splitUtf16(data []byte) [][]byte {
+	var parts [][]byte
+	start := 0
+	for i := 0; i+1 < len(data); i += 2 {
+		if data[i] == 0 && data[i+1] == 0 {
+			parts = append(parts, data[start:i])
+			start = i + 2
+		}
+	}
+	if start < len(data) {
+		parts = append(parts, data[start:])
+	}
+	return parts
+}
+
+func syncsafeInt(data []byte) int {
+	return int(data[0]&0x7F)<<21 | int(data[1]&0x7F)<<14 | int(data[2]&0x7F)<<7 | int(data[3]&0x7F)
+}
+
+func removeUnsynchronisation(data []byte) []byte {
+	return bytes.ReplaceAll(data, []byte{0xFF, 0x00}, []byte{0xFF})
+}
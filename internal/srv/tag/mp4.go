@@ -0,0 +1,132 @@
+package tag
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Normalized names of the iTunes metadata items
+var mp4ItemNames = map[string]string{
+	"\xa9nam": Title,
+	"\xa9ART": Artist,
+	"\xa9alb": Album,
+}
+
+type mp4Atom struct {
+	start int64
+	end   int64
+}
+
+// readMp4 extracts the iTunes metadata of a mp4/m4a file, found in moov/udta/meta/ilst
+func readMp4(file io.ReadSeeker) (Tags, error) {
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	atom := mp4Atom{start: 0, end: size}
+	for _, name := range []string{"moov", "udta", "meta", "ilst"} {
+		atom, err = findMp4Atom(file, atom, name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "meta" {
+			// meta is a full atom: version and flags precede its children
+			atom.start += 4
+		}
+	}
+
+	if atom.end-atom.start > maxCommentSize {
+		return nil, fmt.Errorf("mp4 metadata too large")
+	}
+	data := make([]byte, atom.end-atom.start)
+	_, err = file.Seek(atom.start, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseMp4Items(data), nil
+}
+
+func findMp4Atom(file io.ReadSeeker, parent mp4Atom, name string) (mp4Atom, error) {
+	header := make([]byte, 16)
+	for position := parent.start; position+8 <= parent.end; {
+		_, err := file.Seek(position, io.SeekStart)
+		if err != nil {
+			return mp4Atom{}, err
+		}
+		_, err = io.ReadFull(file, header[:8])
+		if err != nil {
+			return mp4Atom{}, err
+		}
+		atomSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		headerSize := int64(8)
+		switch atomSize {
+		case 0:
+			// Atom extending to the end of its parent
+			atomSize = parent.end - position
+		case 1:
+			// 64 bits atom size
+			_, err = io.ReadFull(file, header[8:16])
+			if err != nil {
+				return mp4Atom{}, err
+			}
+			atomSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if atomSize < headerSize || atomSize > parent.end-position {
+			return mp4Atom{}, fmt.Errorf("invalid mp4 atom")
+		}
+		if string(header[4:8]) == name {
+			return mp4Atom{start: position + headerSize, end: position + atomSize}, nil
+		}
+		position += atomSize
+	}
+	return mp4Atom{}, fmt.Errorf("no %s atom", name)
+}
+
+// parseMp4Items reads the ilst items, each one holding a data atom, and the freeform "----" items a name atom too
+func parseMp4Items(data []byte) Tags {
+	tags := make(Tags)
+	for len(data) >= 8 {
+		itemSize := int(binary.BigEndian.Uint32(data[0:4]))
+		if itemSize < 8 || itemSize > len(data) {
+			break
+		}
+		itemName := string(data[4:8])
+		item := data[8:itemSize]
+		data = data[itemSize:]
+
+		key := mp4ItemNames[itemName]
+		var value string
+		for len(item) >= 8 {
+			childSize := int(binary.BigEndian.Uint32(item[0:4]))
+			if childSize < 8 || childSize > len(item) {
+				break
+			}
+			childName := string(item[4:8])
+			child := item[8:childSize]
+			item = item[childSize:]
+
+			switch {
+			case childName == "name" && itemName == "----" && len(child) >= 4:
+				key = strings.ToUpper(string(child[4:]))
+			case childName == "data" && len(child) >= 8:
+				// Type and locale precede the value, type 1 being UTF-8 text
+				if binary.BigEndian.Uint32(child[0:4]) == 1 {
+					value = string(child[8:])
+				}
+			}
+		}
+		if key != "" && value != "" {
+			tags[key] = value
+		}
+	}
+	return tags
+}
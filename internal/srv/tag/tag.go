@@ -0,0 +1,136 @@
+package tag
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Normalized tag field names
+const (
+	Title               = "TITLE"
+	Artist              = "ARTIST"
+	Album               = "ALBUM"
+	ReplayGainTrackGain = "REPLAYGAIN_TRACK_GAIN"
+	ReplayGainTrackPeak = "REPLAYGAIN_TRACK_PEAK"
+)
+
+// Tags are the text fields of an audio file, indexed by upper case field name
+type Tags map[string]string
+
+// Read extracts the text tags of an audio file: ID3v2 and ID3v1 (mp3), Vorbis comments (flac, ogg vorbis, opus),
+// iTunes metadata (mp4, m4a)
+func Read(filename string) (Tags, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header, _ := reader.Peek(8)
+
+	switch {
+	case len(header) >= 3 && string(header[0:3]) == "ID3":
+		return readId3v2(reader)
+	case len(header) >= 4 && string(header[0:4]) == "fLaC":
+		return readFlac(reader)
+	case len(header) >= 4 && string(header[0:4]) == "OggS":
+		return readOgg(reader)
+	case len(header) >= 8 && string(header[4:8]) == "ftyp":
+		return readMp4(file)
+	default:
+		return readId3v1(file)
+	}
+}
+
+// Name returns "Artist - Title", the title alone when the artist is unknown, or an empty string without title
+func (t Tags) Name() string {
+	title := strings.TrimSpace(t[Title])
+	artist := strings.TrimSpace(t[Artist])
+	switch {
+	case title == "":
+		return ""
+	case artist == "":
+		return title
+	default:
+		return artist + " - " + title
+	}
+}
+
+// ReplayGain returns the track gain in dB, limited to avoid clipping when the track peak is known
+func (t Tags) ReplayGain() (float64, bool) {
+	gain, ok := parseReplayGainValue(t[ReplayGainTrackGain])
+	if !ok {
+		return 0, false
+	}
+	if peak, ok := parseReplayGainValue(t[ReplayGainTrackPeak]); ok && peak > 0 {
+		if maxGain := -20 * math.Log10(peak); gain > maxGain {
+			gain = maxGain
+		}
+	}
+	return gain, true
+}
+
+func parseReplayGainValue(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(value, "dB"), "db"))
+	if value == "" {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, false
+	}
+	return number, true
+}
+
+// parseVorbisComment reads a vorbis comment structure: vendor string followed by KEY=value fields
+func parseVorbisComment(data []byte) (Tags, error) {
+	tags := make(Tags)
+
+	readUint32 := func() (uint32, error) {
+		if len(data) < 4 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		value := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		data = data[4:]
+		return value, nil
+	}
+
+	vendorLength, err := readUint32()
+	if err != nil || uint64(vendorLength) > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid vorbis comment")
+	}
+	data = data[vendorLength:]
+
+	count, err := readUint32()
+	if err != nil {
+		return nil, fmt.Errorf("invalid vorbis comment")
+	}
+	for i := uint32(0); i < count; i++ {
+		length, err := readUint32()
+		if err != nil || uint64(length) > uint64(len(data)) {
+			return tags, nil
+		}
+		field := string(data[:length])
+		data = data[length:]
+
+		separator := strings.IndexByte(field, '=')
+		if separator <= 0 {
+			continue
+		}
+		key := strings.ToUpper(field[:separator])
+		if previous, ok := tags[key]; ok {
+			tags[key] = previous + " / " + field[separator+1:]
+		} else {
+			tags[key] = field[separator+1:]
+		}
+	}
+
+	return tags, nil
+}
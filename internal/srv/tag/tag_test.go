@@ -0,0 +1,403 @@
+package tag
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func syncsafe(size int) []byte {
+	return []byte{byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+}
+
+// id3v2 builds an ID3v2 tag followed by a few bytes of audio
+func id3v2(version byte, flags byte, frames ...[]byte) []byte {
+	body := bytes.Join(frames, nil)
+	tag := append([]byte{'I', 'D', '3', version, 0, flags}, syncsafe(len(body))...)
+	return append(append(tag, body...), 0xFF, 0xFB, 0x90, 0xC0)
+}
+
+func id3Frame(version byte, id string, flags uint16, payload []byte) []byte {
+	var frame []byte
+	switch version {
+	case 2:
+		frame = append([]byte(id), byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload)))
+	case 3:
+		frame = append([]byte(id), 0, 0, 0, 0, byte(flags>>8), byte(flags))
+		binary.BigEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	default:
+		frame = append(append([]byte(id), syncsafe(len(payload))...), byte(flags>>8), byte(flags))
+	}
+	return append(frame, payload...)
+}
+
+func text(encoding byte, value string) []byte {
+	return append([]byte{encoding}, value...)
+}
+
+func utf16Text(value string) []byte {
+	data := []byte{1, 0xFF, 0xFE}
+	for _, r := range value {
+		data = append(data, byte(r), byte(r>>8))
+	}
+	return data
+}
+
+func id3v1(title string, artist string, album string) []byte {
+	data := make([]byte, 128)
+	copy(data, "TAG")
+	copy(data[3:33], title)
+	copy(data[33:63], artist)
+	copy(data[63:93], album)
+	return append([]byte{0xFF, 0xFB, 0x90, 0xC0, 0, 0, 0, 0}, data...)
+}
+
+func vorbisComment(fields ...string) []byte {
+	var comment bytes.Buffer
+	binary.Write(&comment, binary.LittleEndian, uint32(len("vekigi")))
+	comment.WriteString("vekigi")
+	binary.Write(&comment, binary.LittleEndian, uint32(len(fields)))
+	for _, field := range fields {
+		binary.Write(&comment, binary.LittleEndian, uint32(len(field)))
+		comment.WriteString(field)
+	}
+	return comment.Bytes()
+}
+
+func flac(comment []byte) []byte {
+	data := []byte("fLaC")
+	// Stream info block, then the last block holding the vorbis comment
+	data = append(data, 0, 0, 0, 34)
+	data = append(data, make([]byte, 34)...)
+	data = append(data, 0x80|flacVorbisCommentBlockType, byte(len(comment)>>16), byte(len(comment)>>8), byte(len(comment)))
+	return append(data, comment...)
+}
+
+// ogg builds a single page holding the packets
+func ogg(packets ...[]byte) []byte {
+	return oggPage(0, packets...)
+}
+
+func oggPage(granulePosition int64, packets ...[]byte) []byte {
+	var segmentTable, body []byte
+	for _, packet := range packets {
+		size := len(packet)
+		for ; size >= 255; size -= 255 {
+			segmentTable = append(segmentTable, 255)
+		}
+		segmentTable = append(segmentTable, byte(size))
+		body = append(body, packet...)
+	}
+	page := append([]byte("OggS"), make([]byte, 22)...)
+	binary.LittleEndian.PutUint64(page[6:14], uint64(granulePosition))
+	page = append(page, byte(len(segmentTable)))
+	return append(append(page, segmentTable...), body...)
+}
+
+func atom(name string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	data := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(data, uint32(8+len(body)))
+	copy(data[4:], name)
+	return append(data, body...)
+}
+
+func mp4Data(value string) []byte {
+	return atom("data", append([]byte{0, 0, 0, 1, 0, 0, 0, 0}, value...))
+}
+
+func mp4(items ...[]byte) []byte {
+	meta := atom("meta", append([]byte{0, 0, 0, 0}, atom("ilst", items...)...))
+	return append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov", atom("mvhd", make([]byte, 100)), atom("udta", meta))...)
+}
+
+func TestRead(t *testing.T) {
+	longText := string(bytes.Repeat([]byte("a"), 300))
+	overflowingFrame := id3Frame(3, "TALB", 0, text(0, "Album"))
+	binary.BigEndian.PutUint32(overflowingFrame[4:8], 0x7FFFFFFA)
+
+	tests := []struct {
+		name    string
+		content []byte
+		tags    Tags
+	}{
+		{
+			"id3v2.2",
+			id3v2(2, 0, id3Frame(2, "TT2", 0, text(0, "Title")), id3Frame(2, "TP1", 0, text(0, "Artist"))),
+			Tags{Title: "Title", Artist: "Artist"},
+		},
+		{
+			"id3v2.3 latin1 and utf16",
+			id3v2(3, 0, id3Frame(3, "TIT2", 0, text(0, "Caf\xe9")), id3Frame(3, "TPE1", 0, utf16Text("Été")), id3Frame(3, "TALB", 0, text(0, "Album\x00"))),
+			Tags{Title: "Café", Artist: "Été", Album: "Album"},
+		},
+		{
+			"id3v2.3 replaygain",
+			id3v2(3, 0, id3Frame(3, "TXXX", 0, text(0, "replaygain_track_gain\x00-6.50 dB")), id3Frame(3, "TXXX", 0, text(0, "REPLAYGAIN_TRACK_PEAK\x000.988"))),
+			Tags{ReplayGainTrackGain: "-6.50 dB", ReplayGainTrackPeak: "0.988"},
+		},
+		{
+			"id3v2.3 compressed frame skipped",
+			id3v2(3, 0, id3Frame(3, "TIT2", 0x0080, text(0, "Compressed")), id3Frame(3, "TPE1", 0, text(0, "Artist"))),
+			Tags{Artist: "Artist"},
+		},
+		{
+			"id3v2.3 frame larger than the tag",
+			id3v2(3, 0, id3Frame(3, "TIT2", 0, text(0, "Title")), overflowingFrame),
+			Tags{Title: "Title"},
+		},
+		{
+			"id3v2.4 utf8 multiple values",
+			id3v2(4, 0, id3Frame(4, "TPE1", 0, text(3, "One\x00Two")), id3Frame(4, "TIT2", 0, text(3, longText))),
+			Tags{Artist: "One / Two", Title: longText},
+		},
+		{
+			"id3v2.4 data length indicator",
+			id3v2(4, 0, id3Frame(4, "TIT2", 0x0001, append([]byte{0, 0, 0, 6}, text(0, "Title")...))),
+			Tags{Title: "Title"},
+		},
+		{
+			"id3v1",
+			id3v1("Title", "Artist", "Album"),
+			Tags{Title: "Title", Artist: "Artist", Album: "Album"},
+		},
+		{
+			"flac",
+			flac(vorbisComment("title=Title", "ARTIST=One", "Artist=Two", "REPLAYGAIN_TRACK_GAIN=+1.20 dB", "invalid")),
+			Tags{Title: "Title", Artist: "One / Two", ReplayGainTrackGain: "+1.20 dB"},
+		},
+		{
+			"ogg vorbis",
+			ogg(append([]byte("\x01vorbis"), make([]byte, 23)...), append([]byte("\x03vorbis"), vorbisComment("TITLE=Title", "ALBUM="+longText)...)),
+			Tags{Title: "Title", Album: longText},
+		},
+		{
+			"ogg opus",
+			ogg(append([]byte("OpusHead"), make([]byte, 11)...), append([]byte("OpusTags"), vorbisComment("ARTIST=Artist")...)),
+			Tags{Artist: "Artist"},
+		},
+		{
+			"mp4",
+			mp4(
+				atom("\xa9nam", mp4Data("Title")),
+				atom("\xa9ART", mp4Data("Artist")),
+				atom("----", atom("mean", []byte("\x00\x00\x00\x00com.apple.iTunes")), atom("name", []byte("\x00\x00\x00\x00replaygain_track_gain")), mp4Data("-3.00 dB")),
+				atom("covr", atom("data", []byte{0, 0, 0, 13, 0, 0, 0, 0, 0xFF, 0xD8})),
+			),
+			Tags{Title: "Title", Artist: "Artist", ReplayGainTrackGain: "-3.00 dB"},
+		},
+	}
+
+	directory := t.TempDir()
+	for _, test := range tests {
+		filename := filepath.Join(directory, "song")
+		err := ioutil.WriteFile(filename, test.content, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags, err := Read(filename)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(tags) != len(test.tags) {
+			t.Errorf("%s: got %q, expected %q", test.name, tags, test.tags)
+			continue
+		}
+		for key, value := range test.tags {
+			if tags[key] != value {
+				t.Errorf("%s: got %s=%q, expected %q", test.name, key, tags[key], value)
+			}
+		}
+	}
+}
+
+func TestReadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"no tag", []byte{0xFF, 0xFB, 0x90, 0xC0}},
+		{"truncated id3v2", id3v2(3, 0, id3Frame(3, "TIT2", 0, text(0, "Title")))[:15]},
+		{"unsupported id3v2 version", id3v2(5, 0)},
+		{"mp4 without metadata", atom("ftyp", []byte("M4A \x00\x00\x00\x00"))},
+		{"mp4 atom larger than the file", append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), 0x7F, 0xFF, 0xFF, 0xFF, 'm', 'o', 'o', 'v')},
+		{"ogg without comment", ogg(append([]byte("\x01vorbis"), make([]byte, 23)...))},
+	}
+
+	directory := t.TempDir()
+	for _, test := range tests {
+		filename := filepath.Join(directory, "song")
+		err := ioutil.WriteFile(filename, test.content, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags, err := Read(filename)
+		if err == nil {
+			t.Errorf("%s: got %q instead of an error", test.name, tags)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	tests := []struct {
+		tags Tags
+		name string
+	}{
+		{Tags{Title: "Title", Artist: "Artist"}, "Artist - Title"},
+		{Tags{Title: " Title "}, "Title"},
+		{Tags{Artist: "Artist"}, ""},
+	}
+	for _, test := range tests {
+		if name := test.tags.Name(); name != test.name {
+			t.Errorf("%q: got %q, expected %q", test.tags, name, test.name)
+		}
+	}
+}
+
+func TestReplayGain(t *testing.T) {
+	tests := []struct {
+		gain string
+		peak string
+		ok   bool
+		db   float64
+	}{
+		{"-6.50 dB", "", true, -6.5},
+		{"+2.5 dB", "", true, 2.5},
+		{"3", "", true, 3},
+		{" -1.25db ", "0.5", true, -1.25},
+		// Limited by the peak: 0.5 reaches full scale at +6.02 dB
+		{"+8 dB", "0.5", true, 20 * math.Log10(2)},
+		{"+8 dB", "invalid", true, 8},
+		{"+8 dB", "0", true, 8},
+		{"", "0.5", false, 0},
+		{"loud", "", false, 0},
+	}
+	for _, test := range tests {
+		tags := Tags{ReplayGainTrackGain: test.gain, ReplayGainTrackPeak: test.peak}
+		db, ok := tags.ReplayGain()
+		if ok != test.ok || math.Abs(db-test.db) > 1e-9 {
+			t.Errorf("Gain %q and peak %q: got %f %v, expected %f %v", test.gain, test.peak, db, ok, test.db, test.ok)
+		}
+	}
+}
+
+// flacStreamInfo builds a flac file holding only its stream info block
+func flacStreamInfo(sampleRate int, totalSamples int64) []byte {
+	streamInfo := make([]byte, 34)
+	streamInfo[10] = byte(sampleRate >> 12)
+	streamInfo[11] = byte(sampleRate >> 4)
+	streamInfo[12] = byte(sampleRate<<4) | 0x02
+	streamInfo[13] = 0xF0 | byte(totalSamples>>32)
+	binary.BigEndian.PutUint32(streamInfo[14:18], uint32(totalSamples))
+	return append([]byte{'f', 'L', 'a', 'C', 0x80, 0, 0, 34}, streamInfo...)
+}
+
+func mvhd(version byte, timeScale uint32, duration uint64) []byte {
+	data := make([]byte, 100)
+	data[0] = version
+	if version == 0 {
+		binary.BigEndian.PutUint32(data[12:16], timeScale)
+		binary.BigEndian.PutUint32(data[16:20], uint32(duration))
+	} else {
+		binary.BigEndian.PutUint32(data[20:24], timeScale)
+		binary.BigEndian.PutUint64(data[24:32], duration)
+	}
+	return atom("mvhd", data)
+}
+
+// mp3Frames builds MPEG-1 layer III stereo frames at 44100Hz and 128kbps, the first one holding a Xing header when
+// xingFrames is positive
+func mp3Frames(frameCount int, xingFrames uint32) []byte {
+	const frameLength = 144 * 128000 / 44100
+	var data []byte
+	for i := 0; i < frameCount; i++ {
+		frame := make([]byte, frameLength)
+		copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+		if i == 0 && xingFrames > 0 {
+			copy(frame[36:], "Xing\x00\x00\x00\x01")
+			binary.BigEndian.PutUint32(frame[44:48], xingFrames)
+		}
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func TestDuration(t *testing.T) {
+	vorbisHeader := append([]byte("\x01vorbis\x00\x00\x00\x00\x02"), 0x44, 0xAC, 0, 0)
+	vorbisHeader = append(vorbisHeader, make([]byte, 14)...)
+	opusHeader := append([]byte("OpusHead\x01\x02"), 0x38, 0x01, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	// Without the frame header following the tag
+	titleTag := id3v2(4, 0, id3Frame(4, "TIT2", 0, text(3, "Title")))
+
+	tests := []struct {
+		name     string
+		content  []byte
+		duration time.Duration
+	}{
+		{"flac", flacStreamInfo(44100, 44100*90), 90 * time.Second},
+		{
+			"ogg vorbis",
+			append(append(oggPage(0, vorbisHeader), oggPage(0, vorbisComment())...), oggPage(44100*61+22050, []byte("audio"))...),
+			61500 * time.Millisecond,
+		},
+		{
+			"ogg opus",
+			append(oggPage(0, opusHeader), oggPage(48000*30+312, []byte("audio"))...),
+			30 * time.Second,
+		},
+		{"mp4", append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov", mvhd(0, 1000, 215250))...), 215250 * time.Millisecond},
+		{"mp4 version 1", append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov", mvhd(1, 44100, 44100*3))...), 3 * time.Second},
+		{"mp3 tlen", append(id3v2(3, 0, id3Frame(3, "TLEN", 0, text(0, "183456"))), mp3Frames(2, 0)...), 183456 * time.Millisecond},
+		// 38 frames of 1152 samples
+		{"mp3 xing", append(titleTag[:len(titleTag)-4], mp3Frames(2, 38)...), 38 * 1152 * time.Second / 44100},
+		// 10 frames of 417 bytes at 128kbps, the ID3v1 tag excepted
+		{"mp3 cbr", append(mp3Frames(10, 0), id3v1("Title", "Artist", "Album")[8:]...), 4170 * 8 * time.Second / 128000},
+	}
+
+	directory := t.TempDir()
+	for _, test := range tests {
+		filename := filepath.Join(directory, "song")
+		err := ioutil.WriteFile(filename, test.content, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration, err := Duration(filename)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if duration != test.duration {
+			t.Errorf("%s: got %v, expected %v", test.name, duration, test.duration)
+		}
+	}
+}
+
+func TestDurationUnknown(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"no audio", []byte("not an audio file")},
+		{"flac without samples count", flacStreamInfo(44100, 0)},
+		{"mp4 without movie header", append(atom("ftyp", []byte("M4A \x00\x00\x00\x00")), atom("moov")...)},
+		{"ogg flac", oggPage(0, []byte("\x7fFLAC"))},
+	}
+
+	directory := t.TempDir()
+	for _, test := range tests {
+		filename := filepath.Join(directory, "song")
+		err := ioutil.WriteFile(filename, test.content, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		duration, err := Duration(filename)
+		if err == nil {
+			t.Errorf("%s: got %v instead of an error", test.name, duration)
+		}
+	}
+}
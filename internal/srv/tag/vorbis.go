@@ -0,0 +1,102 @@
+package tag
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Upper bound of a comment packet, as it may embed cover art
+const maxCommentSize = 16 * 1024 * 1024
+
+const flacVorbisCommentBlockType = 4
+
+func readFlac(reader io.Reader) (Tags, error) {
+	signature := make([]byte, 4)
+	_, err := io.ReadFull(reader, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	blockHeader := make([]byte, 4)
+	for {
+		_, err = io.ReadFull(reader, blockHeader)
+		if err != nil {
+			return nil, err
+		}
+		lastBlock := blockHeader[0]&0x80 != 0
+		blockType := blockHeader[0] & 0x7F
+		blockSize := int64(blockHeader[1])<<16 | int64(blockHeader[2])<<8 | int64(blockHeader[3])
+
+		if blockType == flacVorbisCommentBlockType {
+			block := make([]byte, blockSize)
+			_, err = io.ReadFull(reader, block)
+			if err != nil {
+				return nil, err
+			}
+			return parseVorbisComment(block)
+		}
+
+		_, err = io.CopyN(io.Discard, reader, blockSize)
+		if err != nil {
+			return nil, err
+		}
+		if lastBlock {
+			return make(Tags), nil
+		}
+	}
+}
+
+// readOgg extracts the comment header, second packet of a vorbis or opus stream
+func readOgg(reader io.Reader) (Tags, error) {
+	var packet []byte
+	packetIndex := 0
+
+	pageHeader := make([]byte, 27)
+	for {
+		_, err := io.ReadFull(reader, pageHeader)
+		if err != nil {
+			return nil, err
+		}
+		if string(pageHeader[0:4]) != "OggS" {
+			return nil, fmt.Errorf("invalid ogg page")
+		}
+		segmentTable := make([]byte, pageHeader[26])
+		_, err = io.ReadFull(reader, segmentTable)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, segmentSize := range segmentTable {
+			segment := make([]byte, segmentSize)
+			_, err = io.ReadFull(reader, segment)
+			if err != nil {
+				return nil, err
+			}
+			if packetIndex == 1 {
+				packet = append(packet, segment...)
+				if len(packet) > maxCommentSize {
+					return nil, fmt.Errorf("ogg comment too large")
+				}
+			}
+			// A segment smaller than 255 bytes ends the packet
+			if segmentSize < 255 {
+				if packetIndex == 1 {
+					return parseOggCommentPacket(packet)
+				}
+				packetIndex++
+			}
+		}
+	}
+}
+
+func parseOggCommentPacket(packet []byte) (Tags, error) {
+	switch {
+	case bytes.HasPrefix(packet, []byte("\x03vorbis")):
+		return parseVorbisComment(packet[7:])
+	case bytes.HasPrefix(packet, []byte("OpusTags")):
+		return parseVorbisComment(packet[8:])
+	default:
+		return nil, fmt.Errorf("unsupported ogg stream")
+	}
+}